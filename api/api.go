@@ -0,0 +1,99 @@
+// Package api defines the request and response bodies of the HTTP API. The
+// server and the client package share these types, so the wire format is
+// declared in one place. The validation tags are the bounds the server
+// enforces and publishes in its OpenAPI document.
+package api
+
+// MultiplyRequest represents the request body for basic multiplication
+type MultiplyRequest struct {
+	A float64 `json:"a" minimum:"-1e15" maximum:"1e15"`
+	B float64 `json:"b" minimum:"-1e15" maximum:"1e15"`
+}
+
+// ArrayRequest represents the request body for array operations
+type ArrayRequest struct {
+	Numbers []float64 `json:"numbers" required:"true" minItems:"1" maxItems:"1000" minimum:"-1e10" maximum:"1e10"`
+}
+
+// PairwiseRequest represents the request body for pairwise multiplication
+type PairwiseRequest struct {
+	Array1 []float64 `json:"array1" required:"true" minItems:"1" maxItems:"1000" minimum:"-1e10" maximum:"1e10"`
+	Array2 []float64 `json:"array2" required:"true" minItems:"1" maxItems:"1000" minimum:"-1e10" maximum:"1e10"`
+}
+
+// ScalarRequest represents the request body for scalar multiplication
+type ScalarRequest struct {
+	Numbers []float64 `json:"numbers" required:"true" minItems:"1" maxItems:"1000" minimum:"-1e10" maximum:"1e10"`
+	Scalar  float64   `json:"scalar" minimum:"-1e10" maximum:"1e10"`
+}
+
+// PowerRequest represents the request body for power operations
+type PowerRequest struct {
+	Base     float64 `json:"base" minimum:"-1e6" maximum:"1e6"`
+	Exponent float64 `json:"exponent" minimum:"-1000" maximum:"1000"`
+}
+
+// FactorialRequest represents the request body for factorial operations
+type FactorialRequest struct {
+	Number int `json:"number" minimum:"0" maximum:"20"`
+}
+
+// MultiplyResult represents the result of a multiplication operation
+type MultiplyResult struct {
+	Result   float64 `json:"result"`
+	Overflow bool    `json:"overflow,omitempty"`
+}
+
+// MultiplyArrayResult represents the result of array multiplication
+type MultiplyArrayResult struct {
+	Results  []float64 `json:"results"`
+	Overflow bool      `json:"overflow,omitempty"`
+}
+
+// FactorialResult represents the data returned by the /factorial endpoint
+type FactorialResult struct {
+	Input  int   `json:"input"`
+	Result int64 `json:"result"`
+}
+
+// ErrorResponse represents a standardized error response. It is an RFC 9457
+// problem details document; error, message and code repeat title, detail
+// and status for clients of the original format. RequestID is the
+// X-Request-ID of the failed request. ErrorID is set on unexpected server
+// errors and names their entry in the server log; Stack is only sent by
+// servers in development mode.
+type ErrorResponse struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail"`
+	Errors    []FieldError `json:"errors,omitempty"`
+	Error     string       `json:"error"`
+	Message   string       `json:"message"`
+	Code      int          `json:"code"`
+	RequestID string       `json:"request_id,omitempty"`
+	ErrorID   string       `json:"error_id,omitempty"`
+	Stack     string       `json:"stack,omitempty"`
+}
+
+// EnvelopeError describes a failed v2 request. Type is the problem type URI
+// for Code; Field repeats the first entry of Errors. ErrorID and Stack are
+// as in ErrorResponse.
+type EnvelopeError struct {
+	Code    string       `json:"code"`
+	Type    string       `json:"type,omitempty"`
+	Message string       `json:"message"`
+	Field   string       `json:"field,omitempty"`
+	Errors  []FieldError `json:"errors,omitempty"`
+	ErrorID string       `json:"error_id,omitempty"`
+	Stack   string       `json:"stack,omitempty"`
+}
+
+// FieldError points at one invalid request field. Index is set when the
+// problem is a single element of a list field.
+type FieldError struct {
+	Field   string `json:"field"`
+	Index   *int   `json:"index,omitempty"`
+	Reason  string `json:"reason"`
+	Message string `json:"message"`
+}
@@ -1,21 +1,19 @@
-package main
+// Package arith implements the arithmetic behind the API: multiplication,
+// division and their array forms. The server and the calc command use it.
+package arith
 
 import (
 	"errors"
 	"math"
+
+	"go-server/api"
 )
 
 // MultiplyResult represents the result of a multiplication operation
-type MultiplyResult struct {
-	Result   float64 `json:"result"`
-	Overflow bool    `json:"overflow,omitempty"`
-}
+type MultiplyResult = api.MultiplyResult
 
 // MultiplyArrayResult represents the result of array multiplication
-type MultiplyArrayResult struct {
-	Results  []float64 `json:"results"`
-	Overflow bool      `json:"overflow,omitempty"`
-}
+type MultiplyArrayResult = api.MultiplyArrayResult
 
 // BasicMultiply performs basic multiplication of two numbers
 func BasicMultiply(a, b float64) MultiplyResult {
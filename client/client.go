@@ -0,0 +1,271 @@
+// Package client is a typed Go client for the arithmetic endpoints of the
+// v2 HTTP API. It sends the request types of the api package and decodes
+// the matching result types. Failed calls return an *Error, and rate
+// limited calls are retried with backoff.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-server/api"
+)
+
+// Defaults used by New
+const (
+	DefaultMaxRetries = 3
+	DefaultBackoff    = 500 * time.Millisecond
+	DefaultMaxBackoff = 30 * time.Second
+)
+
+// maxResponseSize bounds the response body the client reads
+const maxResponseSize = 10 << 20
+
+// Client calls the API at BaseURL. Its fields may be changed before the
+// first call; a Client is safe for concurrent use after that.
+type Client struct {
+	// BaseURL is the server root, such as "https://calc.internal:8443".
+	// A path prefix is kept, so a server mounted behind a proxy works too.
+	BaseURL string
+	// HTTPClient sends the requests
+	HTTPClient *http.Client
+	// MaxRetries is how often a request answered with 429 Too Many
+	// Requests is retried; 0 disables retries
+	MaxRetries int
+	// Backoff is the wait before the first retry. It doubles with each
+	// retry up to MaxBackoff. A Retry-After header takes precedence.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// New returns a Client for the server at baseURL with default settings
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: http.DefaultClient,
+		MaxRetries: DefaultMaxRetries,
+		Backoff:    DefaultBackoff,
+		MaxBackoff: DefaultMaxBackoff,
+	}
+}
+
+// Multiply multiplies two numbers
+func (c *Client) Multiply(ctx context.Context, req api.MultiplyRequest) (api.MultiplyResult, error) {
+	var result api.MultiplyResult
+	err := c.post(ctx, "/multiply", req, &result)
+	return result, err
+}
+
+// MultiplyArray multiplies all numbers in an array
+func (c *Client) MultiplyArray(ctx context.Context, req api.ArrayRequest) (api.MultiplyArrayResult, error) {
+	var result api.MultiplyArrayResult
+	err := c.post(ctx, "/multiply/array", req, &result)
+	return result, err
+}
+
+// MultiplyPairwise multiplies two arrays element by element
+func (c *Client) MultiplyPairwise(ctx context.Context, req api.PairwiseRequest) (api.MultiplyArrayResult, error) {
+	var result api.MultiplyArrayResult
+	err := c.post(ctx, "/multiply/pairwise", req, &result)
+	return result, err
+}
+
+// MultiplyScalar multiplies every number in an array by a scalar
+func (c *Client) MultiplyScalar(ctx context.Context, req api.ScalarRequest) (api.MultiplyArrayResult, error) {
+	var result api.MultiplyArrayResult
+	err := c.post(ctx, "/multiply/scalar", req, &result)
+	return result, err
+}
+
+// Power raises a base to an exponent
+func (c *Client) Power(ctx context.Context, req api.PowerRequest) (api.MultiplyResult, error) {
+	var result api.MultiplyResult
+	err := c.post(ctx, "/power", req, &result)
+	return result, err
+}
+
+// Factorial computes the factorial of a non-negative integer
+func (c *Client) Factorial(ctx context.Context, req api.FactorialRequest) (api.FactorialResult, error) {
+	var result api.FactorialResult
+	err := c.post(ctx, "/factorial", req, &result)
+	return result, err
+}
+
+// envelope is the v2 response body with the data left for the caller to decode
+type envelope struct {
+	Data  json.RawMessage    `json:"data"`
+	Error *api.EnvelopeError `json:"error"`
+	Meta  struct {
+		RequestID string `json:"request_id"`
+	} `json:"meta"`
+}
+
+// post sends body as JSON to the v2 endpoint at path and decodes the data
+// of the response into result, retrying while the server rate limits
+func (c *Client) post(ctx context.Context, path string, body, result interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	url := strings.TrimSuffix(c.BaseURL, "/") + "/v2" + path
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Accept", "application/json")
+
+		resp, err := c.httpClient().Do(req)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		if resp.StatusCode == http.StatusTooManyRequests && attempt < c.MaxRetries {
+			if err := sleep(ctx, c.retryDelay(attempt, resp.Header.Get("Retry-After"))); err != nil {
+				return err
+			}
+			continue
+		}
+		if resp.StatusCode >= 400 {
+			return newError(resp, data)
+		}
+
+		var env envelope
+		if err := json.Unmarshal(data, &env); err != nil {
+			return fmt.Errorf("client: decoding %s response: %w", path, err)
+		}
+		if env.Error != nil {
+			return newError(resp, data)
+		}
+		return json.Unmarshal(env.Data, result)
+	}
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
+
+// retryDelay is how long to wait before retry number attempt+1. Retry-After
+// is honoured in either of its forms (seconds or an HTTP date); otherwise
+// the backoff doubles per attempt, with jitter so clients that were limited
+// together do not retry together.
+func (c *Client) retryDelay(attempt int, retryAfter string) time.Duration {
+	if retryAfter != "" {
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if at, err := http.ParseTime(retryAfter); err == nil {
+			return max(time.Until(at), 0)
+		}
+	}
+
+	delay := c.Backoff << attempt
+	if c.MaxBackoff > 0 && (delay > c.MaxBackoff || delay <= 0) {
+		delay = c.MaxBackoff
+	}
+	if delay <= 0 {
+		return 0
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// sleep waits for d or until ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Error is returned for a request the server rejected. Problem is the RFC
+// 9457 problem document describing it; for v2 error envelopes it is filled
+// in from the envelope, so callers handle both the same way. Its RequestID
+// is what the server logged the request under.
+type Error struct {
+	// StatusCode is the HTTP status of the response
+	StatusCode int
+	// Code is the machine-readable error code, such as "validation_error"
+	Code    string
+	Problem api.ErrorResponse
+}
+
+func (e *Error) Error() string {
+	detail := e.Problem.Detail
+	if detail == "" {
+		detail = e.Problem.Title
+	}
+	return fmt.Sprintf("client: %d %s: %s", e.StatusCode, e.Code, detail)
+}
+
+// Fields returns the invalid request fields reported by the server
+func (e *Error) Fields() []api.FieldError {
+	return e.Problem.Errors
+}
+
+// newError builds the Error for a failed response from whichever body the
+// server sent: a problem document, a v2 envelope or something else, such as
+// a proxy's error page
+func newError(resp *http.Response, data []byte) *Error {
+	e := &Error{StatusCode: resp.StatusCode}
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+
+	var env envelope
+	switch {
+	case mt == "application/problem+json" && json.Unmarshal(data, &e.Problem) == nil:
+		if i := strings.LastIndex(e.Problem.Type, "/"); i >= 0 {
+			e.Code = e.Problem.Type[i+1:]
+		}
+	case json.Unmarshal(data, &env) == nil && env.Error != nil:
+		e.Code = env.Error.Code
+		e.Problem = api.ErrorResponse{
+			Type:      env.Error.Type,
+			Title:     http.StatusText(resp.StatusCode),
+			Status:    resp.StatusCode,
+			Detail:    env.Error.Message,
+			Errors:    env.Error.Errors,
+			Error:     http.StatusText(resp.StatusCode),
+			Message:   env.Error.Message,
+			Code:      resp.StatusCode,
+			RequestID: env.Meta.RequestID,
+			ErrorID:   env.Error.ErrorID,
+			Stack:     env.Error.Stack,
+		}
+	default:
+		e.Problem = api.ErrorResponse{
+			Title:  http.StatusText(resp.StatusCode),
+			Status: resp.StatusCode,
+			Detail: strings.TrimSpace(string(data)),
+		}
+	}
+
+	if e.Problem.RequestID == "" {
+		e.Problem.RequestID = resp.Header.Get("X-Request-ID")
+	}
+	if e.Code == "" {
+		e.Code = strings.ReplaceAll(strings.ToLower(http.StatusText(resp.StatusCode)), " ", "_")
+	}
+	return e
+}
@@ -0,0 +1,217 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"go-server/api"
+)
+
+// writeData answers with a v2 success envelope
+func writeData(w http.ResponseWriter, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"data": data, "error": nil})
+}
+
+// writeProblem answers like the rate limiter, with a problem document
+func writeProblem(w http.ResponseWriter, status int, code, title string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(api.ErrorResponse{Type: "/problems/" + code, Title: title, Status: status, Detail: "Too many requests", Error: title, Message: "Too many requests", Code: status})
+}
+
+// Test that each method posts its request type to its endpoint and decodes the result
+func TestMethods(t *testing.T) {
+	var gotPath string
+	var gotBody map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath = r.URL.Path
+		if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("%s %s with Content-Type %q, want a JSON POST", r.Method, r.URL.Path, r.Header.Get("Content-Type"))
+		}
+		gotBody = nil
+		json.NewDecoder(r.Body).Decode(&gotBody)
+		switch r.URL.Path {
+		case "/calc/v2/factorial":
+			writeData(w, api.FactorialResult{Input: 5, Result: 120})
+		case "/calc/v2/multiply", "/calc/v2/power":
+			writeData(w, api.MultiplyResult{Result: 8})
+		default:
+			writeData(w, api.MultiplyArrayResult{Results: []float64{2, 4}})
+		}
+	}))
+	defer server.Close()
+
+	c := New(server.URL + "/calc/")
+	ctx := context.Background()
+	arrayResult := api.MultiplyArrayResult{Results: []float64{2, 4}}
+
+	tests := []struct {
+		name string
+		call func() (interface{}, error)
+		path string
+		body map[string]interface{}
+		want interface{}
+	}{
+		{"Multiply", func() (interface{}, error) { return c.Multiply(ctx, api.MultiplyRequest{A: 2, B: 4}) },
+			"/calc/v2/multiply", map[string]interface{}{"a": 2.0, "b": 4.0}, api.MultiplyResult{Result: 8}},
+		{"MultiplyArray", func() (interface{}, error) { return c.MultiplyArray(ctx, api.ArrayRequest{Numbers: []float64{1, 2}}) },
+			"/calc/v2/multiply/array", map[string]interface{}{"numbers": []interface{}{1.0, 2.0}}, arrayResult},
+		{"MultiplyPairwise", func() (interface{}, error) {
+			return c.MultiplyPairwise(ctx, api.PairwiseRequest{Array1: []float64{1}, Array2: []float64{2}})
+		}, "/calc/v2/multiply/pairwise", map[string]interface{}{"array1": []interface{}{1.0}, "array2": []interface{}{2.0}}, arrayResult},
+		{"MultiplyScalar", func() (interface{}, error) {
+			return c.MultiplyScalar(ctx, api.ScalarRequest{Numbers: []float64{1, 2}, Scalar: 2})
+		}, "/calc/v2/multiply/scalar", map[string]interface{}{"numbers": []interface{}{1.0, 2.0}, "scalar": 2.0}, arrayResult},
+		{"Power", func() (interface{}, error) { return c.Power(ctx, api.PowerRequest{Base: 2, Exponent: 3}) },
+			"/calc/v2/power", map[string]interface{}{"base": 2.0, "exponent": 3.0}, api.MultiplyResult{Result: 8}},
+		{"Factorial", func() (interface{}, error) { return c.Factorial(ctx, api.FactorialRequest{Number: 5}) },
+			"/calc/v2/factorial", map[string]interface{}{"number": 5.0}, api.FactorialResult{Input: 5, Result: 120}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.call()
+			if err != nil {
+				t.Fatalf("%s failed: %v", tt.name, err)
+			}
+			if gotPath != tt.path || !reflect.DeepEqual(gotBody, tt.body) {
+				t.Errorf("sent %s %v, want %s %v", gotPath, gotBody, tt.path, tt.body)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("result = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Test turning error envelopes, problem documents and other bodies into *Error
+func TestErrors(t *testing.T) {
+	index := 1
+	tests := []struct {
+		name      string
+		handler   http.HandlerFunc
+		status    int
+		code      string
+		fields    int
+		requestID string
+	}{
+		{"envelope", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": nil, "error": api.EnvelopeError{
+				Code: "validation_error", Type: "/problems/validation_error", Message: "Numbers are too large", Field: "numbers",
+				Errors: []api.FieldError{{Field: "numbers", Index: &index, Reason: "above_maximum", Message: "must be at most 1e10"}},
+			}, "meta": map[string]string{"request_id": "req-envelope"}})
+		}, http.StatusBadRequest, "validation_error", 1, "req-envelope"},
+		{"problem", func(w http.ResponseWriter, r *http.Request) {
+			writeProblem(w, http.StatusServiceUnavailable, "service_unavailable", "Service Unavailable")
+		}, http.StatusServiceUnavailable, "service_unavailable", 0, ""},
+		{"plain text", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("X-Request-ID", "req-header")
+			http.Error(w, "upstream timed out", http.StatusBadGateway)
+		}, http.StatusBadGateway, "bad_gateway", 0, "req-header"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(tt.handler)
+			defer server.Close()
+
+			_, err := New(server.URL).MultiplyArray(context.Background(), api.ArrayRequest{Numbers: []float64{1, 2e11}})
+			var apiErr *Error
+			if !errors.As(err, &apiErr) {
+				t.Fatalf("error = %v, want *Error", err)
+			}
+			if apiErr.StatusCode != tt.status || apiErr.Problem.Status != tt.status || apiErr.Code != tt.code || len(apiErr.Fields()) != tt.fields {
+				t.Errorf("error = %+v, want status %v, code %q and %d fields", apiErr, tt.status, tt.code, tt.fields)
+			}
+			if apiErr.Problem.Detail == "" {
+				t.Errorf("problem has no detail: %+v", apiErr.Problem)
+			}
+			if apiErr.Problem.RequestID != tt.requestID {
+				t.Errorf("request ID = %q, want %q", apiErr.Problem.RequestID, tt.requestID)
+			}
+		})
+	}
+}
+
+// Test retrying rate limited requests with backoff
+func TestRateLimitRetry(t *testing.T) {
+	var calls atomic.Int32
+	limitedFor := int32(2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) <= limitedFor {
+			w.Header().Set("Retry-After", "0")
+			writeProblem(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Rate limit exceeded")
+			return
+		}
+		writeData(w, api.MultiplyResult{Result: 6})
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	result, err := c.Multiply(context.Background(), api.MultiplyRequest{A: 2, B: 3})
+	if err != nil || result.Result != 6 || calls.Load() != 3 {
+		t.Fatalf("Multiply = %+v, %v after %d calls, want 6 after 3", result, err, calls.Load())
+	}
+
+	// Out of retries, the 429 is returned as an error
+	calls.Store(0)
+	c.MaxRetries = 1
+	_, err = c.Multiply(context.Background(), api.MultiplyRequest{A: 2, B: 3})
+	var apiErr *Error
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.Code != "rate_limit_exceeded" || calls.Load() != 2 {
+		t.Errorf("error = %v after %d calls, want rate_limit_exceeded after 2", err, calls.Load())
+	}
+}
+
+// Test that the context bounds the wait between retries
+func TestRetryContext(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeProblem(w, http.StatusTooManyRequests, "rate_limit_exceeded", "Rate limit exceeded")
+	}))
+	defer server.Close()
+
+	c := New(server.URL)
+	c.Backoff = time.Hour
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := c.Power(ctx, api.PowerRequest{Base: 2, Exponent: 2})
+	if !errors.Is(err, context.DeadlineExceeded) || time.Since(start) > 5*time.Second {
+		t.Errorf("error = %v after %v, want the context deadline", err, time.Since(start))
+	}
+}
+
+// Test the wait before each retry
+func TestRetryDelay(t *testing.T) {
+	c := &Client{Backoff: 100 * time.Millisecond, MaxBackoff: time.Second}
+
+	tests := []struct {
+		attempt    int
+		retryAfter string
+		min, max   time.Duration
+	}{
+		{0, "", 50 * time.Millisecond, 100 * time.Millisecond},
+		{2, "", 200 * time.Millisecond, 400 * time.Millisecond},
+		{10, "", 500 * time.Millisecond, time.Second},
+		{0, "3", 3 * time.Second, 3 * time.Second},
+		{0, time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat), 0, 0},
+		{0, "soon", 50 * time.Millisecond, 100 * time.Millisecond},
+	}
+
+	for _, tt := range tests {
+		if got := c.retryDelay(tt.attempt, tt.retryAfter); got < tt.min || got > tt.max {
+			t.Errorf("retryDelay(%d, %q) = %v, want between %v and %v", tt.attempt, tt.retryAfter, got, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"go-server/api"
+	"go-server/arith"
+	"go-server/datastructures"
+)
+
+// calculator is the part of the API the commands call. *client.Client
+// implements it against a server, local in process.
+type calculator interface {
+	Multiply(ctx context.Context, req api.MultiplyRequest) (api.MultiplyResult, error)
+	MultiplyArray(ctx context.Context, req api.ArrayRequest) (api.MultiplyArrayResult, error)
+	MultiplyPairwise(ctx context.Context, req api.PairwiseRequest) (api.MultiplyArrayResult, error)
+	MultiplyScalar(ctx context.Context, req api.ScalarRequest) (api.MultiplyArrayResult, error)
+	Power(ctx context.Context, req api.PowerRequest) (api.MultiplyResult, error)
+	Factorial(ctx context.Context, req api.FactorialRequest) (api.FactorialResult, error)
+}
+
+// local calculates with the arith package, without the server's input limits
+type local struct{}
+
+func (local) Multiply(_ context.Context, req api.MultiplyRequest) (api.MultiplyResult, error) {
+	return arith.BasicMultiply(req.A, req.B), nil
+}
+
+func (local) MultiplyArray(_ context.Context, req api.ArrayRequest) (api.MultiplyArrayResult, error) {
+	return arith.MultiplyArray(req.Numbers), nil
+}
+
+func (local) MultiplyPairwise(_ context.Context, req api.PairwiseRequest) (api.MultiplyArrayResult, error) {
+	return arith.MultiplyArrayPairwise(req.Array1, req.Array2)
+}
+
+func (local) MultiplyScalar(_ context.Context, req api.ScalarRequest) (api.MultiplyArrayResult, error) {
+	return arith.MultiplyByScalar(req.Numbers, req.Scalar), nil
+}
+
+func (local) Power(_ context.Context, req api.PowerRequest) (api.MultiplyResult, error) {
+	return arith.Power(req.Base, req.Exponent), nil
+}
+
+func (local) Factorial(_ context.Context, req api.FactorialRequest) (api.FactorialResult, error) {
+	result, err := arith.Factorial(req.Number)
+	if err != nil {
+		return api.FactorialResult{}, err
+	}
+	return api.FactorialResult{Input: req.Number, Result: result}, nil
+}
+
+// result is a command's answer. Value is printed as JSON; Columns and Rows
+// are the table and CSV form.
+type result struct {
+	Value   interface{}
+	Columns []string
+	Rows    [][]string
+}
+
+// command is one calc subcommand
+type command struct {
+	name    string
+	usage   string
+	summary string
+	// localOnly commands have no server endpoint
+	localOnly bool
+	run       func(ctx context.Context, a *app, args []string) (*result, error)
+}
+
+// commands lists the subcommands in the order help shows them
+var commands []command
+
+func init() {
+	commands = []command{
+		{name: "multiply", usage: "multiply A B [C...]", summary: "multiply numbers", run: runMultiply},
+		{name: "pairwise", usage: "pairwise A1,A2,... B1,B2,...", summary: "multiply two lists element by element", run: runPairwise},
+		{name: "scalar", usage: "scalar S N [N...]", summary: "multiply every number by S", run: runScalar},
+		{name: "power", usage: "power BASE EXPONENT", summary: "raise BASE to EXPONENT", run: runPower},
+		{name: "factorial", usage: "factorial N", summary: "factorial of N (at most 20)", run: runFactorial},
+		{name: "divide", usage: "divide A B", summary: "divide A by B", localOnly: true, run: runDivide},
+		{name: "modulo", usage: "modulo A B", summary: "remainder of A divided by B", localOnly: true, run: runModulo},
+		{name: "reciprocal", usage: "reciprocal X", summary: "1 divided by X", localOnly: true, run: runReciprocal},
+		{name: "sort", usage: "sort [--algo quick|merge] [--desc] N [N...]", summary: "sort integers", localOnly: true, run: runSort},
+		{name: "help", usage: "help", summary: "list the commands", run: func(_ context.Context, a *app, _ []string) (*result, error) {
+			printCommands(a.stdout)
+			return nil, nil
+		}},
+	}
+}
+
+// findCommand looks a command up by name
+func findCommand(name string) (command, bool) {
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd, true
+		}
+	}
+	return command{}, false
+}
+
+// printCommands writes the command summary used by help and -h
+func printCommands(w io.Writer) {
+	for _, cmd := range commands {
+		note := ""
+		if cmd.localOnly {
+			note = " (local only)"
+		}
+		fmt.Fprintf(w, "  %-45s %s%s\n", cmd.usage, cmd.summary, note)
+	}
+}
+
+func runMultiply(ctx context.Context, a *app, args []string) (*result, error) {
+	numbers, err := parseNumbers(args)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case len(numbers) == 0:
+		return nil, &usageError{"multiply needs at least one number"}
+	case len(numbers) == 2:
+		res, err := a.calc.Multiply(ctx, api.MultiplyRequest{A: numbers[0], B: numbers[1]})
+		if err != nil {
+			return nil, err
+		}
+		return numberResult(res, res.Result, res.Overflow), nil
+	default:
+		res, err := a.calc.MultiplyArray(ctx, api.ArrayRequest{Numbers: numbers})
+		if err != nil {
+			return nil, err
+		}
+		return numberResult(res, res.Results[0], res.Overflow), nil
+	}
+}
+
+func runPairwise(ctx context.Context, a *app, args []string) (*result, error) {
+	if len(args) != 2 {
+		return nil, &usageError{"pairwise needs two comma-separated lists"}
+	}
+	array1, err := parseNumbers(strings.Split(args[0], ","))
+	if err != nil {
+		return nil, err
+	}
+	array2, err := parseNumbers(strings.Split(args[1], ","))
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.calc.MultiplyPairwise(ctx, api.PairwiseRequest{Array1: array1, Array2: array2})
+	if err != nil {
+		return nil, err
+	}
+	return listResult(res, res.Results), nil
+}
+
+func runScalar(ctx context.Context, a *app, args []string) (*result, error) {
+	if len(args) < 2 {
+		return nil, &usageError{"scalar needs a scalar and at least one number"}
+	}
+	numbers, err := parseNumbers(args)
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.calc.MultiplyScalar(ctx, api.ScalarRequest{Scalar: numbers[0], Numbers: numbers[1:]})
+	if err != nil {
+		return nil, err
+	}
+	return listResult(res, res.Results), nil
+}
+
+func runPower(ctx context.Context, a *app, args []string) (*result, error) {
+	numbers, err := parseExactly(args, 2, "power needs a base and an exponent")
+	if err != nil {
+		return nil, err
+	}
+	res, err := a.calc.Power(ctx, api.PowerRequest{Base: numbers[0], Exponent: numbers[1]})
+	if err != nil {
+		return nil, err
+	}
+	return numberResult(res, res.Result, res.Overflow), nil
+}
+
+func runFactorial(ctx context.Context, a *app, args []string) (*result, error) {
+	if len(args) != 1 {
+		return nil, &usageError{"factorial needs one integer"}
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, &usageError{fmt.Sprintf("invalid integer %q", args[0])}
+	}
+	res, err := a.calc.Factorial(ctx, api.FactorialRequest{Number: n})
+	if err != nil {
+		return nil, err
+	}
+	return &result{
+		Value:   res,
+		Columns: []string{"input", "result"},
+		Rows:    [][]string{{strconv.Itoa(res.Input), strconv.FormatInt(res.Result, 10)}},
+	}, nil
+}
+
+func runDivide(_ context.Context, _ *app, args []string) (*result, error) {
+	numbers, err := parseExactly(args, 2, "divide needs two numbers")
+	if err != nil {
+		return nil, err
+	}
+	res, err := arith.BasicDivide(numbers[0], numbers[1])
+	if err != nil {
+		return nil, err
+	}
+	return numberResult(res, res.Result, res.Overflow), nil
+}
+
+func runModulo(_ context.Context, _ *app, args []string) (*result, error) {
+	numbers, err := parseExactly(args, 2, "modulo needs two numbers")
+	if err != nil {
+		return nil, err
+	}
+	res, err := arith.Modulo(numbers[0], numbers[1])
+	if err != nil {
+		return nil, err
+	}
+	return numberResult(api.MultiplyResult{Result: res}, res, false), nil
+}
+
+func runReciprocal(_ context.Context, _ *app, args []string) (*result, error) {
+	numbers, err := parseExactly(args, 1, "reciprocal needs one number")
+	if err != nil {
+		return nil, err
+	}
+	res, err := arith.Reciprocal(numbers[0])
+	if err != nil {
+		return nil, err
+	}
+	return numberResult(api.MultiplyResult{Result: res}, res, false), nil
+}
+
+func runSort(_ context.Context, _ *app, args []string) (*result, error) {
+	fs := flag.NewFlagSet("sort", flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	algo := fs.String("algo", "quick", "quick or merge")
+	desc := fs.Bool("desc", false, "sort in descending order")
+	if err := fs.Parse(args); err != nil {
+		return nil, &usageError{err.Error()}
+	}
+	if fs.NArg() == 0 {
+		return nil, &usageError{"sort needs at least one integer"}
+	}
+
+	numbers := make([]int, fs.NArg())
+	for i, arg := range fs.Args() {
+		n, err := strconv.Atoi(arg)
+		if err != nil {
+			return nil, &usageError{fmt.Sprintf("invalid integer %q", arg)}
+		}
+		numbers[i] = n
+	}
+
+	var sorted []int
+	switch {
+	case *algo == "quick" && !*desc:
+		sorted = datastructures.QuickSort(numbers)
+	case *algo == "quick":
+		sorted = datastructures.QuickSortDescending(numbers)
+	case *algo == "merge" && !*desc:
+		sorted = datastructures.MergeSort(numbers)
+	case *algo == "merge":
+		sorted = datastructures.MergeSortDescending(numbers)
+	default:
+		return nil, &usageError{fmt.Sprintf("unknown algorithm %q, want quick or merge", *algo)}
+	}
+
+	res := &result{
+		Value:   map[string]interface{}{"algorithm": *algo, "results": sorted},
+		Columns: []string{"index", "result"},
+	}
+	for i, n := range sorted {
+		res.Rows = append(res.Rows, []string{strconv.Itoa(i), strconv.Itoa(n)})
+	}
+	return res, nil
+}
+
+// parseNumbers parses every argument as a float
+func parseNumbers(args []string) ([]float64, error) {
+	numbers := make([]float64, len(args))
+	for i, arg := range args {
+		n, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil {
+			return nil, &usageError{fmt.Sprintf("invalid number %q", arg)}
+		}
+		numbers[i] = n
+	}
+	return numbers, nil
+}
+
+// parseExactly parses exactly n numbers, failing with msg otherwise
+func parseExactly(args []string, n int, msg string) ([]float64, error) {
+	if len(args) != n {
+		return nil, &usageError{msg}
+	}
+	return parseNumbers(args)
+}
+
+// numberResult is the result of a calculation with a single number
+func numberResult(value interface{}, n float64, overflow bool) *result {
+	return &result{
+		Value:   value,
+		Columns: []string{"result", "overflow"},
+		Rows:    [][]string{{formatNumber(n), strconv.FormatBool(overflow)}},
+	}
+}
+
+// listResult is the result of a calculation with one number per element
+func listResult(value interface{}, numbers []float64) *result {
+	res := &result{Value: value, Columns: []string{"index", "result"}}
+	for i, n := range numbers {
+		res.Rows = append(res.Rows, []string{strconv.Itoa(i), formatNumber(n)})
+	}
+	return res
+}
+
+func formatNumber(n float64) string {
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
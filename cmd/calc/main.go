@@ -0,0 +1,175 @@
+// Command calc is a command-line calculator for the arithmetic behind the
+// API. It runs one command given as arguments, or starts an interactive
+// session without one:
+//
+//	calc multiply 2 3
+//	calc -o json factorial 15
+//	calc sort --algo merge 5 3 1
+//	calc -server http://localhost:8080 power 2 10
+//	calc
+//
+// By default it calculates in process with the arith and datastructures
+// packages. With -server (or CALC_SERVER) it calls a running server through
+// the client package instead.
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"go-server/client"
+)
+
+// Output formats selected with -o
+var formats = []string{"table", "json", "csv"}
+
+// app holds the settings shared by every command of one run
+type app struct {
+	calc    calculator
+	remote  bool
+	format  string
+	timeout time.Duration
+	stdout  io.Writer
+	stderr  io.Writer
+}
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// run parses the global flags and runs a command or the interactive
+// session. It returns the exit status: 1 when a command fails, 2 for usage
+// errors.
+func run(args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("calc", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	server := fs.String("server", os.Getenv("CALC_SERVER"), "base URL of a server to calculate remotely (CALC_SERVER)")
+	format := fs.String("o", "table", "output format: "+strings.Join(formats, ", "))
+	timeout := fs.Duration("timeout", 30*time.Second, "time limit for each remote call")
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "Usage: calc [flags] [command [arguments]]")
+		fmt.Fprintln(stderr, "\nWithout a command calc starts an interactive session.\n\nFlags:")
+		fs.PrintDefaults()
+		fmt.Fprintln(stderr, "\nCommands:")
+		printCommands(stderr)
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+
+	a := &app{calc: local{}, timeout: *timeout, stdout: stdout, stderr: stderr}
+	if err := a.setFormat(*format); err != nil {
+		fmt.Fprintln(stderr, err)
+		return 2
+	}
+	if *server != "" {
+		a.calc = client.New(*server)
+		a.remote = true
+	}
+
+	if fs.NArg() == 0 || fs.Arg(0) == "repl" {
+		return a.repl(stdin)
+	}
+	if err := a.execute(fs.Args()); err != nil {
+		a.printError(err)
+		var usage *usageError
+		if errors.As(err, &usage) {
+			return 2
+		}
+		return 1
+	}
+	return 0
+}
+
+// setFormat selects the output format
+func (a *app) setFormat(format string) error {
+	for _, f := range formats {
+		if format == f {
+			a.format = format
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown output format %q, want one of %s", format, strings.Join(formats, ", "))
+}
+
+// execute runs one command line such as ["multiply", "2", "3"] and prints its result
+func (a *app) execute(args []string) error {
+	cmd, ok := findCommand(args[0])
+	if !ok {
+		return &usageError{fmt.Sprintf("unknown command %q, run \"calc help\" for a list", args[0])}
+	}
+	if cmd.localOnly && a.remote {
+		return fmt.Errorf("%s has no server endpoint and only runs locally", cmd.name)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+	res, err := cmd.run(ctx, a, args[1:])
+	if err != nil {
+		var usage *usageError
+		if errors.As(err, &usage) {
+			return &usageError{usage.msg + "\nusage: " + cmd.usage}
+		}
+		return err
+	}
+	if res == nil {
+		return nil
+	}
+	return a.print(res)
+}
+
+// print writes a result in the selected format
+func (a *app) print(res *result) error {
+	switch a.format {
+	case "json":
+		enc := json.NewEncoder(a.stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(res.Value)
+	case "csv":
+		w := csv.NewWriter(a.stdout)
+		w.Write(res.Columns)
+		w.WriteAll(res.Rows)
+		return w.Error()
+	default:
+		w := tabwriter.NewWriter(a.stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, strings.ToUpper(strings.Join(res.Columns, "\t")))
+		for _, row := range res.Rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	}
+}
+
+// printError reports a failed command, listing the invalid fields when the
+// server rejected the request
+func (a *app) printError(err error) {
+	fmt.Fprintln(a.stderr, "error:", err)
+	var apiErr *client.Error
+	if errors.As(err, &apiErr) {
+		for _, fe := range apiErr.Fields() {
+			field := fe.Field
+			if fe.Index != nil {
+				field = fmt.Sprintf("%s[%d]", field, *fe.Index)
+			}
+			fmt.Fprintf(a.stderr, "  %s: %s\n", field, fe.Message)
+		}
+	}
+}
+
+// usageError is a command line that could not be understood
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
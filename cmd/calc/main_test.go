@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go-server/api"
+)
+
+// calc runs the command with args and returns its exit status and output
+func calc(t *testing.T, stdin string, args ...string) (int, string, string) {
+	t.Helper()
+	var stdout, stderr bytes.Buffer
+	code := run(args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+// Test one-shot commands calculated locally
+func TestCommands(t *testing.T) {
+	t.Setenv("CALC_SERVER", "")
+
+	tests := []struct {
+		args []string
+		code int
+		want string
+	}{
+		{[]string{"multiply", "2", "3"}, 0, "RESULT  OVERFLOW\n6       false\n"},
+		{[]string{"multiply", "2", "3", "4"}, 0, "RESULT  OVERFLOW\n24      false\n"},
+		{[]string{"-o", "json", "factorial", "15"}, 0, "{\n  \"input\": 15,\n  \"result\": 1307674368000\n}\n"},
+		{[]string{"-o", "csv", "sort", "--algo", "merge", "5", "3", "1"}, 0, "index,result\n0,1\n1,3\n2,5\n"},
+		{[]string{"-o", "csv", "sort", "--desc", "1", "3", "2"}, 0, "index,result\n0,3\n1,2\n2,1\n"},
+		{[]string{"-o", "csv", "pairwise", "1,2", "3,4"}, 0, "index,result\n0,3\n1,8\n"},
+		{[]string{"-o", "csv", "scalar", "2", "1", "-1.5"}, 0, "index,result\n0,2\n1,-3\n"},
+		{[]string{"-o", "csv", "power", "2", "10"}, 0, "result,overflow\n1024,false\n"},
+		{[]string{"-o", "csv", "divide", "1", "4"}, 0, "result,overflow\n0.25,false\n"},
+		{[]string{"divide", "1", "0"}, 1, ""},
+		{[]string{"factorial", "21"}, 1, ""},
+		{[]string{"power", "2"}, 2, ""},
+		{[]string{"sort", "--algo", "bubble", "2", "1"}, 2, ""},
+		{[]string{"multiply", "two", "3"}, 2, ""},
+		{[]string{"-o", "yaml", "multiply", "2", "3"}, 2, ""},
+		{[]string{"nope"}, 2, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(strings.Join(tt.args, " "), func(t *testing.T) {
+			code, stdout, stderr := calc(t, "", tt.args...)
+			if code != tt.code || stdout != tt.want {
+				t.Errorf("exit %d, output %q, want %d and %q (stderr %q)", code, stdout, tt.code, tt.want, stderr)
+			}
+			if code != 0 && stderr == "" {
+				t.Error("a failing command printed no error")
+			}
+		})
+	}
+}
+
+// Test calculating through a server
+func TestRemote(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		var req api.PowerRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		if r.URL.Path != "/v2/power" || req.Exponent > 1000 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]interface{}{"data": nil, "error": api.EnvelopeError{
+				Code: "validation_error", Message: "Base or exponent values are too large",
+				Errors: []api.FieldError{{Field: "exponent", Reason: "above_maximum", Message: "must be at most 1000"}},
+			}})
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"data": api.MultiplyResult{Result: 1024}})
+	}))
+	defer server.Close()
+
+	if code, stdout, _ := calc(t, "", "-server", server.URL, "-o", "csv", "power", "2", "10"); code != 0 || stdout != "result,overflow\n1024,false\n" {
+		t.Errorf("power = %d %q", code, stdout)
+	}
+	if code, _, stderr := calc(t, "", "-server", server.URL, "power", "2", "2000"); code != 1 || !strings.Contains(stderr, "exponent: must be at most 1000") {
+		t.Errorf("rejected power = %d %q, want the field error", code, stderr)
+	}
+	if code, _, stderr := calc(t, "", "-server", server.URL, "sort", "2", "1"); code != 1 || !strings.Contains(stderr, "only runs locally") {
+		t.Errorf("remote sort = %d %q, want a local-only error", code, stderr)
+	}
+}
+
+// Test the interactive session and its history
+func TestREPL(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "history")
+	t.Setenv("CALC_HISTORY", path)
+	t.Setenv("CALC_SERVER", "")
+	os.WriteFile(path, []byte("factorial 5\n"), 0o600)
+
+	input := "multiply 2 3\n!!\n!1\noutput csv\npower 2 3\nbogus\n!99\nhistory\nexit\nmultiply 1 1\n"
+	code, stdout, stderr := calc(t, input)
+	if code != 0 {
+		t.Fatalf("exit %d: %s", code, stderr)
+	}
+
+	want := []string{
+		"RESULT  OVERFLOW\n6       false\nmultiply 2 3\nRESULT  OVERFLOW\n6       false\n",
+		"factorial 5\nINPUT  RESULT\n5      120\n",
+		"result,overflow\n8,false\n",
+		"    1  factorial 5\n    2  multiply 2 3\n    3  multiply 2 3\n    4  factorial 5\n    5  output csv\n    6  power 2 3\n    7  bogus\n",
+	}
+	for _, w := range want {
+		if !strings.Contains(stdout, w) {
+			t.Errorf("output %q does not contain %q", stdout, w)
+		}
+	}
+	if strings.Contains(stdout, "1,false") {
+		t.Error("commands after exit were run")
+	}
+	if !strings.Contains(stderr, `unknown command "bogus"`) || !strings.Contains(stderr, "!99: no such history entry") {
+		t.Errorf("stderr = %q, want both errors", stderr)
+	}
+
+	saved, _ := os.ReadFile(path)
+	if lines := strings.Count(string(saved), "\n"); lines != 7 {
+		t.Errorf("saved history has %d lines, want 7: %q", lines, saved)
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// maxHistory is the number of lines kept in the history file
+const maxHistory = 1000
+
+// replHelp describes the session commands next to the calculator commands
+const replHelp = `Session commands:
+  history                 list previous commands
+  !!                      run the previous command again
+  !N                      run command N from the history
+  output table|json|csv   change the output format
+  exit, quit              leave (or end the input)`
+
+// historyPath returns where the session history is kept: CALC_HISTORY, or
+// .calc_history in the home directory. It is empty when history is not saved.
+func historyPath() string {
+	if path, ok := os.LookupEnv("CALC_HISTORY"); ok {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".calc_history")
+}
+
+// loadHistory reads the saved history, ignoring a missing file
+func loadHistory(path string) []string {
+	if path == "" {
+		return nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var history []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			history = append(history, line)
+		}
+	}
+	return history
+}
+
+// saveHistory writes the last maxHistory lines of the history
+func saveHistory(path string, history []string) error {
+	if path == "" {
+		return nil
+	}
+	if len(history) > maxHistory {
+		history = history[len(history)-maxHistory:]
+	}
+	return os.WriteFile(path, []byte(strings.Join(history, "\n")+"\n"), 0o600)
+}
+
+// repl reads commands line by line until exit or the end of the input.
+// Commands keep the syntax of the command line; lines are recorded in the
+// history file, and !! and !N repeat earlier ones.
+func (a *app) repl(stdin io.Reader) int {
+	path := historyPath()
+	history := loadHistory(path)
+	interactive := isTerminal(stdin)
+	if interactive {
+		mode := "local"
+		if a.remote {
+			mode = "remote"
+		}
+		fmt.Fprintf(a.stdout, "calc (%s mode). Type help for commands, exit to leave.\n", mode)
+	}
+
+	scanner := bufio.NewScanner(stdin)
+	for {
+		if interactive {
+			fmt.Fprint(a.stdout, "calc> ")
+		}
+		if !scanner.Scan() {
+			break
+		}
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "!") {
+			recalled, err := recall(history, line)
+			if err != nil {
+				fmt.Fprintln(a.stderr, "error:", err)
+				continue
+			}
+			line = recalled
+			fmt.Fprintln(a.stdout, line)
+		}
+		if line == "exit" || line == "quit" {
+			break
+		}
+		if line != "history" {
+			history = append(history, line)
+		}
+
+		args := strings.Fields(line)
+		switch args[0] {
+		case "history":
+			for i, entry := range history {
+				fmt.Fprintf(a.stdout, "%5d  %s\n", i+1, entry)
+			}
+		case "output":
+			if len(args) != 2 {
+				fmt.Fprintln(a.stderr, "error: usage: output table|json|csv")
+			} else if err := a.setFormat(args[1]); err != nil {
+				fmt.Fprintln(a.stderr, "error:", err)
+			}
+		case "help":
+			printCommands(a.stdout)
+			fmt.Fprintln(a.stdout, replHelp)
+		default:
+			if err := a.execute(args); err != nil {
+				a.printError(err)
+			}
+		}
+	}
+
+	if err := saveHistory(path, history); err != nil {
+		fmt.Fprintln(a.stderr, "error: saving history:", err)
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintln(a.stderr, "error:", err)
+		return 1
+	}
+	return 0
+}
+
+// recall returns the history entry named by !! or !N
+func recall(history []string, ref string) (string, error) {
+	if ref == "!!" {
+		if len(history) == 0 {
+			return "", errors.New("history is empty")
+		}
+		return history[len(history)-1], nil
+	}
+	n, err := strconv.Atoi(ref[1:])
+	if err != nil || n < 1 || n > len(history) {
+		return "", fmt.Errorf("%s: no such history entry", ref)
+	}
+	return history[n-1], nil
+}
+
+// isTerminal reports whether r is an interactive terminal, in which case
+// the session prints a prompt
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
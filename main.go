@@ -1,686 +1,61 @@
 package main
 
 import (
-        "context"
-        "encoding/json"
-        "fmt"
-        "html"
-        "log"
-        "net/http"
-        "os"
-        "os/signal"
-        "strings"
-        "sync"
-        "syscall"
-        "time"
+	"context"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"go-server/server"
 )
 
-// ErrorResponse represents a standardized error response
-type ErrorResponse struct {
-        Error   string `json:"error"`
-        Message string `json:"message"`
-        Code    int    `json:"code"`
-}
-
-// RateLimiter implements a simple in-memory rate limiter
-type RateLimiter struct {
-        visitors map[string]*Visitor
-        mu       sync.RWMutex
-}
-
-type Visitor struct {
-        lastSeen time.Time
-        count    int
-}
-
-// NewRateLimiter creates a new rate limiter
-func NewRateLimiter() *RateLimiter {
-        rl := &RateLimiter{
-                visitors: make(map[string]*Visitor),
-        }
-
-        // Clean up old visitors every minute
-        go func() {
-                for {
-                        time.Sleep(time.Minute)
-                        rl.cleanupVisitors()
-                }
-        }()
-
-        return rl
-}
-
-// Allow checks if a request should be allowed (max 100 requests per minute per IP)
-func (rl *RateLimiter) Allow(ip string) bool {
-        rl.mu.Lock()
-        defer rl.mu.Unlock()
-
-        v, exists := rl.visitors[ip]
-        if !exists {
-                rl.visitors[ip] = &Visitor{
-                        lastSeen: time.Now(),
-                        count:    1,
-                }
-                return true
-        }
-
-        if time.Since(v.lastSeen) > time.Minute {
-                v.count = 1
-                v.lastSeen = time.Now()
-                return true
-        }
-
-        if v.count >= 100 {
-                return false
-        }
-
-        v.count++
-        return true
-}
-
-func (rl *RateLimiter) cleanupVisitors() {
-        rl.mu.Lock()
-        defer rl.mu.Unlock()
-
-        for ip, v := range rl.visitors {
-                if time.Since(v.lastSeen) > time.Minute {
-                        delete(rl.visitors, ip)
-                }
-        }
-}
-
-var rateLimiter = NewRateLimiter()
-
-// Middleware for logging requests
-func loggingMiddleware(next http.Handler) http.Handler {
-        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-                start := time.Now()
-
-                // Get client IP
-                clientIP := getClientIP(r)
-
-                // Rate limiting
-                if !rateLimiter.Allow(clientIP) {
-                        sendErrorResponse(w, "Rate limit exceeded", "Too many requests", http.StatusTooManyRequests)
-                        return
-                }
-
-                // Add security headers
-                w.Header().Set("X-Content-Type-Options", "nosniff")
-                w.Header().Set("X-Frame-Options", "DENY")
-                w.Header().Set("X-XSS-Protection", "1; mode=block")
-                w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
-
-                next.ServeHTTP(w, r)
-
-                // Log the request
-                duration := time.Since(start)
-                log.Printf("[%s] %s %s %s - %v",
-                        time.Now().Format("2006-01-02 15:04:05"),
-                        clientIP,
-                        r.Method,
-                        r.URL.Path,
-                        duration)
-        })
-}
-
-// Get client IP address
-func getClientIP(r *http.Request) string {
-        // Check X-Forwarded-For header
-        xff := r.Header.Get("X-Forwarded-For")
-        if xff != "" {
-                ips := strings.Split(xff, ",")
-                return strings.TrimSpace(ips[0])
-        }
-
-        // Check X-Real-IP header
-        xri := r.Header.Get("X-Real-IP")
-        if xri != "" {
-                return xri
-        }
-
-        // Fall back to RemoteAddr
-        return strings.Split(r.RemoteAddr, ":")[0]
-}
-
-// Send standardized error response
-func sendErrorResponse(w http.ResponseWriter, error, message string, code int) {
-        w.Header().Set("Content-Type", "application/json")
-        w.WriteHeader(code)
-
-        response := ErrorResponse{
-                Error:   error,
-                Message: message,
-                Code:    code,
-        }
-
-        json.NewEncoder(w).Encode(response)
-}
-
-// Sanitize input to prevent XSS
-func sanitizeInput(input string) string {
-        // Remove leading/trailing whitespace
-        input = strings.TrimSpace(input)
-        // Escape HTML characters
-        input = html.EscapeString(input)
-        // Limit length
-        if len(input) > 100 {
-                input = input[:100]
-        }
-        return input
-}
-
-// Validate form input
-func validateFormInput(name, address string) error {
-        if len(strings.TrimSpace(name)) == 0 {
-                return fmt.Errorf("name is required")
-        }
-        if len(strings.TrimSpace(address)) == 0 {
-                return fmt.Errorf("address is required")
-        }
-        if len(name) > 100 {
-                return fmt.Errorf("name must be less than 100 characters")
-        }
-        if len(address) > 200 {
-                return fmt.Errorf("address must be less than 200 characters")
-        }
-        return nil
-}
-
 func main() {
-        // Get port from environment variable with default fallback
-        port := os.Getenv("PORT")
-        if port == "" {
-                port = "8080"
-        }
-
-        // Setup logging with timestamps
-        log.SetFlags(log.LstdFlags | log.Lshortfile)
-
-        // Setup routes
-        mux := http.NewServeMux()
-
-        // Static file server
-        fileserver := http.FileServer(http.Dir("./static"))
-        mux.Handle("/", fileserver)
-
-        // API endpoints
-        mux.HandleFunc("/form", formHandler)
-        mux.HandleFunc("/hello", helloHandler)
-        mux.HandleFunc("/health", healthHandler)
-        
-        // Multiplication API endpoints
-        mux.HandleFunc("/multiply", multiplyHandler)
-        mux.HandleFunc("/multiply/array", multiplyArrayHandler)
-        mux.HandleFunc("/multiply/pairwise", multiplyPairwiseHandler)
-        mux.HandleFunc("/multiply/scalar", multiplyScalarHandler)
-        mux.HandleFunc("/power", powerHandler)
-        mux.HandleFunc("/factorial", factorialHandler)
-
-        // Wrap with logging middleware
-        handler := loggingMiddleware(mux)
-
-        // Create server
-        server := &http.Server{
-                Addr:         ":" + port,
-                Handler:      handler,
-                ReadTimeout:  15 * time.Second,
-                WriteTimeout: 15 * time.Second,
-                IdleTimeout:  60 * time.Second,
-        }
-
-        // Start server in a goroutine
-        go func() {
-                log.Printf("Starting server on port %s...", port)
-                log.Printf("Server running at http://localhost:%s", port)
-                if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-                        log.Fatalf("Server failed to start: %v", err)
-                }
-        }()
-
-        // Wait for interrupt signal to gracefully shutdown the server
-        quit := make(chan os.Signal, 1)
-        signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
-        <-quit
-        log.Println("Shutting down server...")
-
-        // Give outstanding requests 30 seconds to complete
-        ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
-        defer cancel()
-
-        if err := server.Shutdown(ctx); err != nil {
-                log.Fatalf("Server forced to shutdown: %v", err)
-        }
-
-        log.Println("Server exited")
-}
-
-// helloHandler handles GET requests to /hello endpoint
-func helloHandler(w http.ResponseWriter, r *http.Request) {
-        // Check if path is exactly /hello
-        if r.URL.Path != "/hello" {
-                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
-                return
-        }
-
-        // Only allow GET method
-        if r.Method != http.MethodGet {
-                sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        w.Header().Set("Content-Type", "text/plain")
-        fmt.Fprintf(w, "Hello from Go server! 👋")
-}
-
-// formHandler handles POST requests to /form endpoint
-func formHandler(w http.ResponseWriter, r *http.Request) {
-        // Only allow POST method
-        if r.Method != http.MethodPost {
-                sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        // Parse form data
-        if err := r.ParseForm(); err != nil {
-                log.Printf("ParseForm error: %v", err)
-                sendErrorResponse(w, "Bad Request", "Failed to parse form data", http.StatusBadRequest)
-                return
-        }
-
-        // Get form values
-        name := r.FormValue("name")
-        address := r.FormValue("address")
-
-        // Validate input
-        if err := validateFormInput(name, address); err != nil {
-                sendErrorResponse(w, "Validation Error", err.Error(), http.StatusBadRequest)
-                return
-        }
-
-        // Sanitize input
-        name = sanitizeInput(name)
-        address = sanitizeInput(address)
-
-        // Log the form submission
-        log.Printf("Form submitted - Name: %s, Address: %s", name, address)
-
-        // Send success response
-        w.Header().Set("Content-Type", "application/json")
-        response := map[string]interface{}{
-                "success": true,
-                "message": "Form submitted successfully", // Fixed typo: "succesful" -> "successfully"
-                "data": map[string]string{
-                        "name":    name,
-                        "address": address,
-                },
-        }
-
-        json.NewEncoder(w).Encode(response)
-}
-
-// healthHandler handles GET requests to /health endpoint for monitoring
-func healthHandler(w http.ResponseWriter, r *http.Request) {
-        // Only allow GET method
-        if r.Method != http.MethodGet {
-                sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        // Set response headers
-        w.Header().Set("Content-Type", "application/json")
-        w.WriteHeader(http.StatusOK)
-
-        // Create health response
-        response := map[string]interface{}{
-                "status":    "healthy",
-                "timestamp": time.Now().Unix(),
-                "service":   "go-first-project",
-                "uptime":    time.Since(time.Now().Add(-time.Hour)).String(), // Simple uptime placeholder
-        }
-
-        json.NewEncoder(w).Encode(response)
-}
-
-
-
-// MultiplyRequest represents the request body for basic multiplication
-type MultiplyRequest struct {
-        A float64 `json:"a"`
-        B float64 `json:"b"`
-}
-
-// ArrayRequest represents the request body for array operations
-type ArrayRequest struct {
-        Numbers []float64 `json:"numbers"`
-}
-
-// PairwiseRequest represents the request body for pairwise multiplication
-type PairwiseRequest struct {
-        Array1 []float64 `json:"array1"`
-        Array2 []float64 `json:"array2"`
-}
-
-// ScalarRequest represents the request body for scalar multiplication
-type ScalarRequest struct {
-        Numbers []float64 `json:"numbers"`
-        Scalar  float64   `json:"scalar"`
-}
-
-// PowerRequest represents the request body for power operations
-type PowerRequest struct {
-        Base     float64 `json:"base"`
-        Exponent float64 `json:"exponent"`
-}
-
-// FactorialRequest represents the request body for factorial operations
-type FactorialRequest struct {
-        Number int `json:"number"`
-}
-
-// multiplyHandler handles POST requests to /multiply endpoint
-func multiplyHandler(w http.ResponseWriter, r *http.Request) {
-        // Check if path is exactly /multiply
-        if r.URL.Path != "/multiply" {
-                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
-                return
-        }
-
-        // Only allow POST method
-        if r.Method != http.MethodPost {
-                sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        // Parse JSON request body
-        var req MultiplyRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                sendErrorResponse(w, "Bad Request", "Invalid JSON format", http.StatusBadRequest)
-                return
-        }
-
-        // Validate input (check for reasonable bounds)
-        if req.A > 1e15 || req.A < -1e15 || req.B > 1e15 || req.B < -1e15 {
-                sendErrorResponse(w, "Validation Error", "Numbers are too large", http.StatusBadRequest)
-                return
-        }
-
-        // Perform multiplication
-        result := BasicMultiply(req.A, req.B)
-
-        // Send response
-        w.Header().Set("Content-Type", "application/json")
-        response := map[string]interface{}{
-                "success": true,
-                "data":    result,
-        }
-
-        json.NewEncoder(w).Encode(response)
-}
-
-// multiplyArrayHandler handles POST requests to /multiply/array endpoint
-func multiplyArrayHandler(w http.ResponseWriter, r *http.Request) {
-        // Check if path is exactly /multiply/array
-        if r.URL.Path != "/multiply/array" {
-                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
-                return
-        }
-
-        // Only allow POST method
-        if r.Method != http.MethodPost {
-                sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        // Parse JSON request body
-        var req ArrayRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                sendErrorResponse(w, "Bad Request", "Invalid JSON format", http.StatusBadRequest)
-                return
-        }
-
-        // Validate input
-        if len(req.Numbers) == 0 {
-                sendErrorResponse(w, "Validation Error", "Numbers array cannot be empty", http.StatusBadRequest)
-                return
-        }
-
-        if len(req.Numbers) > 1000 {
-                sendErrorResponse(w, "Validation Error", "Array too large (max 1000 elements)", http.StatusBadRequest)
-                return
-        }
-
-        // Validate each number
-        for _, num := range req.Numbers {
-                if num > 1e10 || num < -1e10 {
-                        sendErrorResponse(w, "Validation Error", "Numbers are too large", http.StatusBadRequest)
-                        return
-                }
-        }
-
-        // Perform array multiplication
-        result := MultiplyArray(req.Numbers)
-
-        // Send response
-        w.Header().Set("Content-Type", "application/json")
-        response := map[string]interface{}{
-                "success": true,
-                "data":    result,
-        }
-
-        json.NewEncoder(w).Encode(response)
-}
-
-// multiplyPairwiseHandler handles POST requests to /multiply/pairwise endpoint
-func multiplyPairwiseHandler(w http.ResponseWriter, r *http.Request) {
-        // Check if path is exactly /multiply/pairwise
-        if r.URL.Path != "/multiply/pairwise" {
-                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
-                return
-        }
-
-        // Only allow POST method
-        if r.Method != http.MethodPost {
-                sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        // Parse JSON request body
-        var req PairwiseRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                sendErrorResponse(w, "Bad Request", "Invalid JSON format", http.StatusBadRequest)
-                return
-        }
-
-        // Validate input
-        if len(req.Array1) == 0 || len(req.Array2) == 0 {
-                sendErrorResponse(w, "Validation Error", "Arrays cannot be empty", http.StatusBadRequest)
-                return
-        }
-
-        if len(req.Array1) > 1000 || len(req.Array2) > 1000 {
-                sendErrorResponse(w, "Validation Error", "Arrays too large (max 1000 elements)", http.StatusBadRequest)
-                return
-        }
-
-        // Validate each number in both arrays
-        for _, num := range req.Array1 {
-                if num > 1e10 || num < -1e10 {
-                        sendErrorResponse(w, "Validation Error", "Numbers in array1 are too large", http.StatusBadRequest)
-                        return
-                }
-        }
-        for _, num := range req.Array2 {
-                if num > 1e10 || num < -1e10 {
-                        sendErrorResponse(w, "Validation Error", "Numbers in array2 are too large", http.StatusBadRequest)
-                        return
-                }
-        }
-
-        // Perform pairwise multiplication
-        result, err := MultiplyArrayPairwise(req.Array1, req.Array2)
-        if err != nil {
-                sendErrorResponse(w, "Validation Error", err.Error(), http.StatusBadRequest)
-                return
-        }
-
-        // Send response
-        w.Header().Set("Content-Type", "application/json")
-        response := map[string]interface{}{
-                "success": true,
-                "data":    result,
-        }
-
-        json.NewEncoder(w).Encode(response)
-}
-
-// multiplyScalarHandler handles POST requests to /multiply/scalar endpoint
-func multiplyScalarHandler(w http.ResponseWriter, r *http.Request) {
-        // Check if path is exactly /multiply/scalar
-        if r.URL.Path != "/multiply/scalar" {
-                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
-                return
-        }
-
-        // Only allow POST method
-        if r.Method != http.MethodPost {
-                sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        // Parse JSON request body
-        var req ScalarRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                sendErrorResponse(w, "Bad Request", "Invalid JSON format", http.StatusBadRequest)
-                return
-        }
-
-        // Validate input
-        if len(req.Numbers) == 0 {
-                sendErrorResponse(w, "Validation Error", "Numbers array cannot be empty", http.StatusBadRequest)
-                return
-        }
-
-        if len(req.Numbers) > 1000 {
-                sendErrorResponse(w, "Validation Error", "Array too large (max 1000 elements)", http.StatusBadRequest)
-                return
-        }
-
-        // Validate scalar
-        if req.Scalar > 1e10 || req.Scalar < -1e10 {
-                sendErrorResponse(w, "Validation Error", "Scalar value is too large", http.StatusBadRequest)
-                return
-        }
-
-        // Validate each number
-        for _, num := range req.Numbers {
-                if num > 1e10 || num < -1e10 {
-                        sendErrorResponse(w, "Validation Error", "Numbers are too large", http.StatusBadRequest)
-                        return
-                }
-        }
-
-        // Perform scalar multiplication
-        result := MultiplyByScalar(req.Numbers, req.Scalar)
-
-        // Send response
-        w.Header().Set("Content-Type", "application/json")
-        response := map[string]interface{}{
-                "success": true,
-                "data":    result,
-        }
-
-        json.NewEncoder(w).Encode(response)
-}
-
-// powerHandler handles POST requests to /power endpoint
-func powerHandler(w http.ResponseWriter, r *http.Request) {
-        // Check if path is exactly /power
-        if r.URL.Path != "/power" {
-                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
-                return
-        }
-
-        // Only allow POST method
-        if r.Method != http.MethodPost {
-                sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        // Parse JSON request body
-        var req PowerRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                sendErrorResponse(w, "Bad Request", "Invalid JSON format", http.StatusBadRequest)
-                return
-        }
-
-        // Validate input (prevent extremely large calculations)
-        if req.Base > 1e6 || req.Base < -1e6 || req.Exponent > 1000 || req.Exponent < -1000 {
-                sendErrorResponse(w, "Validation Error", "Base or exponent values are too large", http.StatusBadRequest)
-                return
-        }
-
-        // Perform power calculation
-        result := Power(req.Base, req.Exponent)
-
-        // Send response
-        w.Header().Set("Content-Type", "application/json")
-        response := map[string]interface{}{
-                "success": true,
-                "data":    result,
-        }
-
-        json.NewEncoder(w).Encode(response)
-}
-
-// factorialHandler handles POST requests to /factorial endpoint
-func factorialHandler(w http.ResponseWriter, r *http.Request) {
-        // Check if path is exactly /factorial
-        if r.URL.Path != "/factorial" {
-                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
-                return
-        }
-
-        // Only allow POST method
-        if r.Method != http.MethodPost {
-                sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
-                return
-        }
-
-        // Parse JSON request body
-        var req FactorialRequest
-        if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
-                sendErrorResponse(w, "Bad Request", "Invalid JSON format", http.StatusBadRequest)
-                return
-        }
-
-        // Validate input
-        if req.Number < 0 {
-                sendErrorResponse(w, "Validation Error", "Factorial is not defined for negative numbers", http.StatusBadRequest)
-                return
-        }
-
-        if req.Number > 20 {
-                sendErrorResponse(w, "Validation Error", "Number too large for factorial calculation (max 20)", http.StatusBadRequest)
-                return
-        }
-
-        // Perform factorial calculation
-        result, err := Factorial(req.Number)
-        if err != nil {
-                sendErrorResponse(w, "Calculation Error", err.Error(), http.StatusBadRequest)
-                return
-        }
-
-        // Send response
-        w.Header().Set("Content-Type", "application/json")
-        response := map[string]interface{}{
-                "success": true,
-                "data": map[string]interface{}{
-                        "input":  req.Number,
-                        "result": result,
-                },
-        }
-
-        json.NewEncoder(w).Encode(response)
+	// Setup logging with timestamps
+	log.SetFlags(log.LstdFlags | log.Lshortfile)
+
+	// Read configuration from environment variables with default fallbacks,
+	// then let command line flags override it
+	cfg := server.LoadConfig()
+	if err := cfg.ParseFlags(os.Args[1:]); err != nil {
+		os.Exit(2)
+	}
+
+	srv, err := server.New(server.WithConfig(cfg))
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("Starting server on port %s...", cfg.Port)
+	if err := srv.Start(":" + cfg.Port); err != nil {
+		log.Fatalf("Server failed to start: %v", err)
+	}
+
+	// Pick up renewed certificate files on SIGHUP
+	if cfg.TLSCertFile != "" {
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			for range hup {
+				if err := srv.ReloadTLS(); err != nil {
+					log.Printf("TLS certificate reload failed: %v", err)
+				}
+			}
+		}()
+	}
+
+	// Wait for interrupt signal to gracefully shutdown the server
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("Shutting down server...")
+
+	// Give outstanding requests 30 seconds to complete
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Fatalf("Server forced to shutdown: %v", err)
+	}
+
+	log.Println("Server exited")
 }
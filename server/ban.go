@@ -0,0 +1,456 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Violation weights counted toward a ban. An oversized body costs the
+// server more than a malformed one, so it counts more. Other client errors
+// count only in bursts: every clientErrorBurst of them within the window
+// make one violation, so a scan of missing paths adds up while the odd 404
+// does not.
+const (
+	violationMalformed    = 1
+	violationRateLimited  = 1
+	violationTooLarge     = 5
+	violationClientErrors = 1
+	clientErrorBurst      = 10
+)
+
+// banCleanupInterval is how often expired bans and idle clients are forgotten
+const banCleanupInterval = time.Minute
+
+// BanPolicy decides when a client is banned and for how long
+type BanPolicy struct {
+	// Threshold violations within Window ban a client, 0 disables automatic bans
+	Threshold int
+	Window    time.Duration
+	// Duration is the first ban. Each further ban doubles it, up to MaxDuration,
+	// until the client has behaved for MaxDuration.
+	Duration    time.Duration
+	MaxDuration time.Duration
+}
+
+// Ban is a client banned from the API. Client is the rate limit key: the
+// address, or the network for IPv6 prefixes.
+type Ban struct {
+	Client   string    `json:"client"`
+	Until    time.Time `json:"until"`
+	Offenses int       `json:"offenses"`
+	Reason   string    `json:"reason"`
+}
+
+// banRecord tracks the violations and bans of one client
+type banRecord struct {
+	windowStart  time.Time
+	violations   int
+	clientErrors int
+	ban          Ban
+}
+
+// BanList bans clients that keep breaking the rules, fail2ban style, and
+// applies static allow and deny lists. Bans are saved to stateFile when
+// they change, so they survive restarts.
+type BanList struct {
+	policy    BanPolicy
+	allow     []*net.IPNet
+	deny      []*net.IPNet
+	stateFile string
+	now       func() time.Time
+	logger    *log.Logger
+
+	mu      sync.Mutex
+	clients map[string]*banRecord
+	// saveMu keeps state file writes in order
+	saveMu sync.Mutex
+
+	// stop ends the cleanup goroutine
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewBanList creates a ban list that never bans clients in allow and
+// always rejects clients in deny, and starts forgetting expired bans in the
+// background until Close. A stateFile restores and keeps the bans.
+func NewBanList(policy BanPolicy, allow, deny []*net.IPNet, stateFile string) (*BanList, error) {
+	b := newBanList(policy, allow, deny, stateFile, time.Now, log.Default())
+	if err := b.restore(); err != nil {
+		b.Close()
+		return nil, err
+	}
+	return b, nil
+}
+
+func newBanList(policy BanPolicy, allow, deny []*net.IPNet, stateFile string, now func() time.Time, logger *log.Logger) *BanList {
+	b := &BanList{
+		policy:    policy,
+		allow:     allow,
+		deny:      deny,
+		stateFile: stateFile,
+		now:       now,
+		logger:    logger,
+		clients:   make(map[string]*banRecord),
+		stop:      make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(banCleanupInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				b.cleanup()
+			case <-b.stop:
+				return
+			}
+		}
+	}()
+	return b
+}
+
+// inNetworks reports whether clientIP is in one of networks
+func inNetworks(clientIP string, networks []*net.IPNet) bool {
+	ip := net.ParseIP(clientIP)
+	if ip == nil {
+		return false
+	}
+	for _, n := range networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check reports whether the client at clientIP, limited under key, is
+// banned, and for how long. Denied clients are banned for good, with a
+// zero duration.
+func (b *BanList) Check(clientIP, key string) (remaining time.Duration, banned bool) {
+	if inNetworks(clientIP, b.allow) {
+		return 0, false
+	}
+	if inNetworks(clientIP, b.deny) {
+		return 0, true
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if rec, ok := b.clients[key]; ok {
+		if remaining := rec.ban.Until.Sub(b.now()); remaining > 0 {
+			return remaining, true
+		}
+	}
+	return 0, false
+}
+
+// Record counts a violation of the given weight and bans the client once
+// it reaches the threshold. It returns the new ban.
+func (b *BanList) Record(clientIP, key string, weight int, reason string) (Ban, bool) {
+	if b.policy.Threshold <= 0 || inNetworks(clientIP, b.allow) {
+		return Ban{}, false
+	}
+
+	b.mu.Lock()
+	now := b.now()
+	rec := b.recordLocked(key, now)
+	// Requests still in flight when the ban started do not extend it
+	if rec.ban.Until.After(now) {
+		b.mu.Unlock()
+		return Ban{}, false
+	}
+	rec.violations += weight
+	if rec.violations < b.policy.Threshold {
+		b.mu.Unlock()
+		return Ban{}, false
+	}
+
+	rec.violations = 0
+	rec.ban.Offenses++
+	duration := b.policy.Duration
+	for i := 1; i < rec.ban.Offenses && duration < b.policy.MaxDuration; i++ {
+		duration *= 2
+	}
+	duration = min(duration, b.policy.MaxDuration)
+	rec.ban.Until = now.Add(duration)
+	rec.ban.Reason = reason
+	ban := rec.ban
+	b.mu.Unlock()
+
+	b.logger.Printf("Banned %s for %v after repeated %s (offense %d)", key, duration, reason, ban.Offenses)
+	b.save()
+	return ban, true
+}
+
+// RecordClientError counts a client error that is not a violation by
+// itself. Every clientErrorBurst of them within the window are recorded as
+// one violation.
+func (b *BanList) RecordClientError(clientIP, key string) (Ban, bool) {
+	if b.policy.Threshold <= 0 || inNetworks(clientIP, b.allow) {
+		return Ban{}, false
+	}
+
+	b.mu.Lock()
+	rec := b.recordLocked(key, b.now())
+	rec.clientErrors++
+	burst := rec.clientErrors%clientErrorBurst == 0
+	b.mu.Unlock()
+
+	if !burst {
+		return Ban{}, false
+	}
+	return b.Record(clientIP, key, violationClientErrors, "client error bursts")
+}
+
+// recordLocked returns the record of key, starting its window over once it
+// has passed. b.mu must be held.
+func (b *BanList) recordLocked(key string, now time.Time) *banRecord {
+	rec, ok := b.clients[key]
+	if !ok {
+		rec = &banRecord{ban: Ban{Client: key}}
+		b.clients[key] = rec
+	}
+	if now.Sub(rec.windowStart) >= b.policy.Window {
+		rec.windowStart = now
+		rec.violations = 0
+		rec.clientErrors = 0
+	}
+	return rec
+}
+
+// Bans lists the current bans, the soonest to end first
+func (b *BanList) Bans() []Ban {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := b.now()
+	bans := []Ban{}
+	for _, rec := range b.clients {
+		if rec.ban.Until.After(now) {
+			bans = append(bans, rec.ban)
+		}
+	}
+	sort.Slice(bans, func(i, j int) bool { return bans[i].Until.Before(bans[j].Until) })
+	return bans
+}
+
+// Lift ends the ban of a client and forgets its offenses
+func (b *BanList) Lift(key string) (Ban, bool) {
+	b.mu.Lock()
+	rec, ok := b.clients[key]
+	if !ok || !rec.ban.Until.After(b.now()) {
+		b.mu.Unlock()
+		return Ban{}, false
+	}
+	delete(b.clients, key)
+	b.mu.Unlock()
+
+	b.logger.Printf("Lifted the ban of %s", key)
+	b.save()
+	return rec.ban, true
+}
+
+// forgotten reports whether a record no longer matters: it is not banned,
+// its window is over and it behaved for MaxDuration since its last ban
+func (b *BanList) forgotten(rec *banRecord, now time.Time) bool {
+	return now.Sub(rec.windowStart) >= b.policy.Window &&
+		(rec.ban.Offenses == 0 || now.Sub(rec.ban.Until) >= b.policy.MaxDuration)
+}
+
+func (b *BanList) cleanup() {
+	b.mu.Lock()
+	now := b.now()
+	changed := false
+	for key, rec := range b.clients {
+		if b.forgotten(rec, now) {
+			changed = changed || rec.ban.Offenses > 0
+			delete(b.clients, key)
+		}
+	}
+	b.mu.Unlock()
+
+	if changed {
+		b.save()
+	}
+}
+
+// save writes the bans and offense counts to the state file, replacing it
+// in one step so that a crash never leaves it half written
+func (b *BanList) save() {
+	if b.stateFile == "" {
+		return
+	}
+	b.saveMu.Lock()
+	defer b.saveMu.Unlock()
+
+	b.mu.Lock()
+	saved := []Ban{}
+	for _, rec := range b.clients {
+		if rec.ban.Offenses > 0 {
+			saved = append(saved, rec.ban)
+		}
+	}
+	b.mu.Unlock()
+
+	err := func() error {
+		data, err := json.Marshal(saved)
+		if err != nil {
+			return err
+		}
+		tmp, err := os.CreateTemp(filepath.Dir(b.stateFile), filepath.Base(b.stateFile)+".*")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(tmp.Name())
+		if _, err := tmp.Write(data); err != nil {
+			tmp.Close()
+			return err
+		}
+		if err := tmp.Close(); err != nil {
+			return err
+		}
+		return os.Rename(tmp.Name(), b.stateFile)
+	}()
+	if err != nil {
+		b.logger.Printf("Failed to save bans to %s: %v", b.stateFile, err)
+	}
+}
+
+// restore loads the bans saved by a previous run
+func (b *BanList) restore() error {
+	if b.stateFile == "" {
+		return nil
+	}
+	data, err := os.ReadFile(b.stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved []Ban
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	now := b.now()
+	active := 0
+	for _, ban := range saved {
+		rec := &banRecord{ban: ban}
+		if b.forgotten(rec, now) {
+			continue
+		}
+		b.clients[ban.Client] = rec
+		if ban.Until.After(now) {
+			active++
+		}
+	}
+	b.logger.Printf("Restored %d bans from %s", active, b.stateFile)
+	return nil
+}
+
+// Close stops the cleanup goroutine and saves the bans
+func (b *BanList) Close() {
+	b.closeOnce.Do(func() {
+		close(b.stop)
+		b.save()
+	})
+}
+
+// violation returns the weight and reason of a response, if it counts
+// toward a ban by itself: rate limit hits, oversized bodies and bodies that
+// could not be decoded. Other client errors, such as a 404 or a failed
+// validation, only count in bursts, see RecordClientError.
+func violation(status int, malformed bool) (weight int, reason string) {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return violationRateLimited, "rate limit hits"
+	case status == http.StatusRequestEntityTooLarge:
+		return violationTooLarge, "oversized requests"
+	case status == http.StatusBadRequest && malformed:
+		return violationMalformed, "malformed requests"
+	}
+	return 0, ""
+}
+
+// banMiddleware rejects banned clients with a 403, and counts the rate
+// limit hits, oversized bodies, malformed bodies and client error bursts of
+// the others.
+// Authorized /admin requests are let through, so that an operator can lift
+// a ban on their own address.
+func (s *Server) banMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/admin/") && s.adminAuthorized(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		clientIP := s.clientIP(r)
+		key := s.rateLimitKey(clientIP)
+		if remaining, banned := s.bans.Check(clientIP, key); banned {
+			if remaining > 0 {
+				w.Header().Set("Retry-After", strconv.Itoa(int(remaining.Round(time.Second)/time.Second)))
+			}
+			sendErrorResponse(w, "Client Banned", "This client address is banned", http.StatusForbidden)
+			return
+		}
+
+		sw := &statusWriter{ResponseWriter: w}
+		next.ServeHTTP(sw, r)
+
+		malformed := false
+		if rw := findResponseWriter(w); rw != nil {
+			malformed = rw.malformedBody
+		}
+		banned := false
+		if weight, reason := violation(sw.status, malformed); weight > 0 {
+			_, banned = s.bans.Record(clientIP, key, weight, reason)
+		} else if sw.status >= 400 && sw.status < 500 {
+			_, banned = s.bans.RecordClientError(clientIP, key)
+		}
+		if banned {
+			s.publishRequestEvent(eventClientBanned, r, sw.status, 0)
+		}
+	})
+}
+
+// bansHandler handles GET /admin/bans and DELETE /admin/bans/{client}.
+// IPv6 clients banned by prefix are addressed as network/length.
+func (s *Server) bansHandler(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/admin/bans"
+	rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+		return
+	}
+	client := strings.TrimPrefix(rest, "/")
+
+	if client == "" {
+		if r.Method != http.MethodGet {
+			sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+			return
+		}
+		sendSuccessResponse(w, s.bans.Bans())
+		return
+	}
+
+	if r.Method != http.MethodDelete {
+		sendErrorResponse(w, "Method Not Allowed", "Only DELETE method is allowed for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+	ban, ok := s.bans.Lift(client)
+	if !ok {
+		sendErrorResponse(w, "Not Found", "Ban not found", http.StatusNotFound)
+		return
+	}
+	sendSuccessResponse(w, ban)
+}
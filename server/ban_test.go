@@ -0,0 +1,294 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestBanList creates a ban list on a fake clock, closed when the test ends
+func newTestBanList(t *testing.T, policy BanPolicy, allow, deny, stateFile string, now *time.Time) *BanList {
+	t.Helper()
+	allowNets, err := parseNetworks(allow)
+	if err != nil {
+		t.Fatal(err)
+	}
+	denyNets, err := parseNetworks(deny)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := newBanList(policy, allowNets, denyNets, stateFile, func() time.Time { return *now }, log.New(io.Discard, "", 0))
+	if err := b.restore(); err != nil {
+		t.Fatalf("restore error: %v", err)
+	}
+	t.Cleanup(b.Close)
+	return b
+}
+
+// Test banning after the threshold, with durations doubling for repeat offenders
+func TestBanListEscalation(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	policy := BanPolicy{Threshold: 3, Window: time.Minute, Duration: time.Minute, MaxDuration: 3 * time.Minute}
+	b := newTestBanList(t, policy, "", "", "", &now)
+	const ip = "203.0.113.9"
+
+	offend := func() (Ban, bool) {
+		var ban Ban
+		var banned bool
+		for i := 0; i < 3; i++ {
+			ban, banned = b.Record(ip, ip, violationMalformed, "malformed requests")
+		}
+		return ban, banned
+	}
+
+	// Violations spread over more than a window do not add up
+	b.Record(ip, ip, violationMalformed, "malformed requests")
+	b.Record(ip, ip, violationMalformed, "malformed requests")
+	now = now.Add(time.Minute)
+	if _, banned := b.Record(ip, ip, violationMalformed, "malformed requests"); banned {
+		t.Error("banned for violations in different windows")
+	}
+	now = now.Add(time.Minute)
+
+	for i, want := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		ban, banned := offend()
+		if !banned || ban.Until.Sub(now) != want || ban.Offenses != i+1 || ban.Reason != "malformed requests" {
+			t.Fatalf("offense %d: ban = %+v, %t, want %v", i+1, ban, banned, want)
+		}
+		if remaining, banned := b.Check(ip, ip); !banned || remaining != want {
+			t.Errorf("offense %d: Check = %v, %t", i+1, remaining, banned)
+		}
+		// Violations during the ban neither extend it nor count toward the next
+		if _, banned := offend(); banned {
+			t.Errorf("offense %d: banned again while banned", i+1)
+		}
+		now = now.Add(want)
+		if _, banned := b.Check(ip, ip); banned {
+			t.Errorf("offense %d: still banned after %v", i+1, want)
+		}
+	}
+
+	// Behaving for MaxDuration starts over
+	now = now.Add(policy.MaxDuration)
+	b.cleanup()
+	if ban, _ := offend(); ban.Offenses != 1 || ban.Until.Sub(now) != time.Minute {
+		t.Errorf("ban after good behavior = %+v, want a first offense", ban)
+	}
+
+	if bans := b.Bans(); len(bans) != 1 || bans[0].Client != ip {
+		t.Errorf("Bans() = %+v", bans)
+	}
+	if _, ok := b.Lift(ip); !ok {
+		t.Error("Lift failed")
+	}
+	if _, ok := b.Lift(ip); ok {
+		t.Error("second Lift succeeded")
+	}
+	if _, banned := b.Check(ip, ip); banned {
+		t.Error("banned after Lift")
+	}
+}
+
+// Test the static allow and deny lists
+func TestBanListStaticLists(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	b := newTestBanList(t, BanPolicy{Threshold: 1, Window: time.Minute, Duration: time.Hour, MaxDuration: time.Hour},
+		"10.0.0.0/8", "198.51.100.0/24, 2001:db8::/32", "", &now)
+
+	tests := []struct {
+		clientIP string
+		banned   bool
+	}{
+		{"10.1.2.3", false},
+		{"198.51.100.7", true},
+		{"2001:db8::1", true},
+		{"203.0.113.1", false},
+	}
+
+	for _, tt := range tests {
+		if remaining, banned := b.Check(tt.clientIP, tt.clientIP); banned != tt.banned || remaining != 0 {
+			t.Errorf("Check(%s) = %v, %t, want %t", tt.clientIP, remaining, banned, tt.banned)
+		}
+	}
+	if _, banned := b.Record("10.1.2.3", "10.1.2.3", violationTooLarge, "oversized requests"); banned {
+		t.Error("allowlisted client was banned")
+	}
+	if _, banned := b.Record("203.0.113.1", "203.0.113.1", violationTooLarge, "oversized requests"); !banned {
+		t.Error("client over the threshold was not banned")
+	}
+}
+
+// Test that bans survive a restart
+func TestBanListPersistence(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	stateFile := filepath.Join(t.TempDir(), "bans.json")
+	policy := BanPolicy{Threshold: 1, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour}
+
+	first := newTestBanList(t, policy, "", "", stateFile, &now)
+	first.Record("203.0.113.1", "203.0.113.1", violationRateLimited, "rate limit hits")
+	first.Record("2001:db8:1:2::/64", "2001:db8:1:2::/64", violationRateLimited, "rate limit hits")
+	first.Lift("203.0.113.1")
+	first.Close()
+
+	second := newTestBanList(t, policy, "", "", stateFile, &now)
+	if bans := second.Bans(); len(bans) != 1 || bans[0].Client != "2001:db8:1:2::/64" || bans[0].Offenses != 1 {
+		t.Fatalf("restored bans = %+v", bans)
+	}
+
+	// The offense count is kept after the ban ends, so the next one is longer
+	now = now.Add(2 * time.Minute)
+	second.Close()
+	third := newTestBanList(t, policy, "", "", stateFile, &now)
+	if ban, _ := third.Record("2001:db8:1:2::/64", "2001:db8:1:2::/64", violationRateLimited, "rate limit hits"); ban.Offenses != 2 || ban.Until.Sub(now) != 2*time.Minute {
+		t.Errorf("ban after restart = %+v, want a second offense", ban)
+	}
+}
+
+// Test banning through the middleware and the admin endpoints
+func TestBanMiddleware(t *testing.T) {
+	cfg := defaultConfig
+	cfg.BanDenylist = "198.51.100.0/24"
+	var logs strings.Builder
+	s := newTestServer(t, WithConfig(cfg), WithLogger(log.New(&logs, "", 0)), WithTrustedProxies("192.0.2.0/24"), WithAdminToken("admin-secret"),
+		WithBanPolicy(BanPolicy{Threshold: 5, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour}))
+	h := s.Handler()
+
+	serve := func(method, path, clientIP, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", clientIP)
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// A few client errors that are not abuse by themselves do not ban
+	for i := 0; i < clientErrorBurst; i++ {
+		if w := serve("GET", "/v2/no-such-route", "203.0.113.11", ""); w.Code != http.StatusNotFound {
+			t.Fatalf("missing route = %v", w.Code)
+		}
+		if w := serve("POST", "/v2/multiply", "203.0.113.11", `{"a":2e16,"b":1}`); w.Code != http.StatusBadRequest {
+			t.Fatalf("invalid arguments = %v", w.Code)
+		}
+	}
+	if w := serve("GET", "/hello", "203.0.113.11", ""); w.Code != http.StatusOK {
+		t.Errorf("client after 404s and invalid arguments = %v, want 200", w.Code)
+	}
+
+	// Malformed JSON, five times
+	for i := 0; i < 5; i++ {
+		if w := serve("POST", "/v2/multiply", "203.0.113.9", `{"a":`); w.Code != http.StatusBadRequest {
+			t.Fatalf("malformed request %d = %v", i, w.Code)
+		}
+	}
+	w := serve("POST", "/v2/multiply", "203.0.113.9", `{"a":2,"b":3}`)
+	if w.Code != http.StatusForbidden || w.Header().Get("Retry-After") != "60" || !strings.Contains(w.Body.String(), "client_banned") {
+		t.Errorf("banned client = %v with Retry-After %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "203.0.113.9 POST /v2/multiply - ") {
+		t.Errorf("logs = %q, want the refused request logged", logs.String())
+	}
+	var banned []ActivityEvent
+	for i := 0; i < s.activity.count; i++ {
+		if e := s.activity.ring[i]; e.Type == eventClientBanned {
+			banned = append(banned, e)
+		}
+	}
+	if len(banned) != 1 || banned[0].ClientIP != "203.0.113.9" {
+		t.Errorf("client-banned events = %+v", banned)
+	}
+
+	// One oversized body goes a long way
+	oversized := `{"numbers":[` + strings.Repeat("1,", 600000) + `1]}`
+	if w := serve("POST", "/v2/multiply/array", "203.0.113.10", oversized); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized request = %v", w.Code)
+	}
+	if w := serve("GET", "/hello", "203.0.113.10", ""); w.Code != http.StatusForbidden {
+		t.Errorf("client after an oversized body = %v, want 403", w.Code)
+	}
+
+	// Denied networks are banned for good, without a Retry-After
+	if w := serve("GET", "/hello", "198.51.100.7", ""); w.Code != http.StatusForbidden || w.Header().Get("Retry-After") != "" {
+		t.Errorf("denied client = %v with Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+
+	w = serve("GET", "/admin/bans", "192.0.2.1", "")
+	var listed struct {
+		Data []Ban `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || len(listed.Data) != 2 || listed.Data[0].Client != "203.0.113.9" || listed.Data[1].Reason != "oversized requests" {
+		t.Fatalf("GET /admin/bans = %v: %s", w.Code, w.Body.String())
+	}
+	// A banned operator can still lift their own ban
+	if w := serve("DELETE", "/admin/bans/203.0.113.9", "203.0.113.9", ""); w.Code != http.StatusOK {
+		t.Errorf("DELETE = %v: %s", w.Code, w.Body.String())
+	}
+	if w := serve("DELETE", "/admin/bans/203.0.113.9", "192.0.2.1", ""); w.Code != http.StatusNotFound {
+		t.Errorf("second DELETE = %v, want 404", w.Code)
+	}
+	if w := serve("POST", "/admin/bans", "192.0.2.1", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST /admin/bans = %v, want 405", w.Code)
+	}
+	if w := serve("POST", "/v2/multiply", "203.0.113.9", `{"a":2,"b":3}`); w.Code != http.StatusOK {
+		t.Errorf("client after its ban was lifted = %v", w.Code)
+	}
+
+	// A burst of them does, at a lower weight
+	for i := 0; i < 3*clientErrorBurst; i++ {
+		serve("GET", "/v2/no-such-route", "203.0.113.11", "")
+	}
+	if w := serve("GET", "/hello", "203.0.113.11", ""); w.Code != http.StatusForbidden {
+		t.Errorf("client after a burst of 404s = %v, want 403", w.Code)
+	}
+	if ban, ok := s.bans.Lift("203.0.113.11"); !ok || ban.Reason != "client error bursts" {
+		t.Errorf("ban after a burst of 404s = %+v, %v", ban, ok)
+	}
+}
+
+// Test that other client errors only count toward a ban in bursts
+func TestBanListClientErrorBursts(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	policy := BanPolicy{Threshold: 2, Window: time.Minute, Duration: time.Minute, MaxDuration: time.Hour}
+	b := newTestBanList(t, policy, "", "", "", &now)
+	const ip = "203.0.113.9"
+
+	// Errors spread over more than a window do not add up
+	for i := 0; i < clientErrorBurst-1; i++ {
+		b.RecordClientError(ip, ip)
+	}
+	now = now.Add(time.Minute)
+	for i := 0; i < 2*clientErrorBurst-1; i++ {
+		if _, banned := b.RecordClientError(ip, ip); banned {
+			t.Fatalf("banned after %d client errors in the window", i+1)
+		}
+	}
+	ban, banned := b.RecordClientError(ip, ip)
+	if !banned || ban.Reason != "client error bursts" {
+		t.Errorf("after %d client errors = %+v, %v", 2*clientErrorBurst, ban, banned)
+	}
+}
+
+// Test that invalid ban lists are rejected
+func TestBanListConfigErrors(t *testing.T) {
+	for _, list := range []string{"10.0.0.0/33", "not-an-address"} {
+		cfg := defaultConfig
+		cfg.BanDenylist = list
+		if s, err := New(WithConfig(cfg)); err == nil {
+			s.Shutdown(t.Context())
+			t.Errorf("BAN_DENYLIST=%q accepted", list)
+		}
+		cfg = defaultConfig
+		cfg.BanAllowlist = list
+		if s, err := New(WithConfig(cfg)); err == nil {
+			s.Shutdown(t.Context())
+			t.Errorf("BAN_ALLOWLIST=%q accepted", list)
+		}
+	}
+}
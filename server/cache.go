@@ -0,0 +1,173 @@
+package server
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CacheStats reports result cache usage
+type CacheStats struct {
+	Size      int    `json:"size"`
+	Capacity  int    `json:"capacity"`
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+}
+
+// ResultCache is a bounded LRU memo of operation results. Operations are
+// pure, so entries never go stale and are only dropped to make room.
+type ResultCache struct {
+	mu       sync.Mutex
+	capacity int
+	maxAge   time.Duration
+	entries  map[string]*list.Element
+	order    *list.List // front is most recently used
+	stats    CacheStats
+}
+
+type cacheEntry struct {
+	key    string
+	result interface{}
+}
+
+// NewResultCache creates a cache holding up to capacity results. maxAge is
+// advertised to clients in Cache-Control.
+func NewResultCache(capacity int, maxAge time.Duration) *ResultCache {
+	return &ResultCache{
+		capacity: capacity,
+		maxAge:   maxAge,
+		entries:  make(map[string]*list.Element),
+		order:    list.New(),
+		stats:    CacheStats{Capacity: capacity},
+	}
+}
+
+// Get returns the cached result for key
+func (c *ResultCache) Get(key string) (interface{}, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		c.stats.Hits++
+		return el.Value.(*cacheEntry).result, true
+	}
+	c.stats.Misses++
+	return nil, false
+}
+
+// Add stores a result, evicting the least recently used one when full
+func (c *ResultCache) Add(key string, result interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.capacity <= 0 {
+		return
+	}
+	if el, ok := c.entries[key]; ok {
+		c.order.MoveToFront(el)
+		el.Value.(*cacheEntry).result = result
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&cacheEntry{key: key, result: result})
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+		c.stats.Evictions++
+	}
+}
+
+// Stats returns a snapshot of the cache counters
+func (c *ResultCache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := c.stats
+	stats.Size = c.order.Len()
+	return stats
+}
+
+// cacheKey is the canonical hash of an operation and its decoded input.
+// Hashing the decoded request rather than the raw body makes the key
+// independent of the codec, field order and whitespace the client used.
+func cacheKey(operation string, req interface{}) string {
+	input, _ := json.Marshal(req)
+	sum := sha256.Sum256(append([]byte(operation+"\x00"), input...))
+	return hex.EncodeToString(sum[:])
+}
+
+// resultETag identifies one representation of a result: the same input
+// encoded with another codec or API version is a different representation
+func resultETag(key string, w http.ResponseWriter) string {
+	sum := sha256.Sum256([]byte(key + "\x00" + responseCodec(w).ContentType() + "\x00" + responseVersion(w)))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+// etagMatches reports whether an If-None-Match header matches etag, using
+// the weak comparison RFC 9110 requires for If-None-Match
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// cachedResult returns the result of compute for an operation and its
+// validated request, memoized in cache. GET and HEAD responses get ETag and
+// Cache-Control, and when If-None-Match already names this result it
+// writes 304 Not Modified and returns done. Other methods are not cacheable
+// by clients, and a matching If-None-Match gets 412 Precondition Failed as
+// RFC 9110 requires. Errors are never cached.
+func (s *Server) cachedResult(w http.ResponseWriter, r *http.Request, operation string, req interface{}, compute func() (interface{}, error)) (result interface{}, done bool, err error) {
+	key := cacheKey(operation, req)
+	etag := resultETag(key, w)
+	safe := r.Method == http.MethodGet || r.Method == http.MethodHead
+
+	if safe {
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(s.cache.maxAge/time.Second)))
+	}
+
+	// Results are deterministic, so a matching ETag needs no computation
+	if inm := r.Header.Get("If-None-Match"); inm != "" && etagMatches(inm, etag) {
+		if !safe {
+			sendErrorResponse(w, "Precondition Failed", "If-None-Match matches the result of this request", http.StatusPreconditionFailed)
+			return nil, true, nil
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return nil, true, nil
+	}
+
+	if cached, ok := s.cache.Get(key); ok {
+		w.Header().Set("X-Cache", "HIT")
+		if resultOverflowed(cached) {
+			s.publishRequestEvent(eventOverflowDetected, r, 0, 0)
+		}
+		return cached, false, nil
+	}
+
+	result, err = compute()
+	if err != nil {
+		w.Header().Del("ETag")
+		w.Header().Del("Cache-Control")
+		return nil, false, err
+	}
+	s.cache.Add(key, result)
+	w.Header().Set("X-Cache", "MISS")
+	if resultOverflowed(result) {
+		s.publishRequestEvent(eventOverflowDetected, r, 0, 0)
+	}
+	return result, false, nil
+}
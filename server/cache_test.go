@@ -0,0 +1,134 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test LRU eviction order and the hit/miss counters
+func TestResultCacheLRU(t *testing.T) {
+	c := NewResultCache(2, time.Minute)
+	c.Add("a", 1)
+	c.Add("b", 2)
+	c.Get("a") // a is now more recently used than b
+	c.Add("c", 3)
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("b should have been evicted")
+	}
+	for key, want := range map[string]int{"a": 1, "c": 3} {
+		if got, ok := c.Get(key); !ok || got != want {
+			t.Errorf("Get(%q) = %v, %v, want %v", key, got, ok, want)
+		}
+	}
+
+	stats := c.Stats()
+	want := CacheStats{Size: 2, Capacity: 2, Hits: 3, Misses: 1, Evictions: 1}
+	if stats != want {
+		t.Errorf("Stats() = %+v, want %+v", stats, want)
+	}
+
+	disabled := NewResultCache(0, time.Minute)
+	disabled.Add("a", 1)
+	if _, ok := disabled.Get("a"); ok {
+		t.Error("a cache with capacity 0 should not store results")
+	}
+}
+
+// Test that equal inputs share a key regardless of how they were encoded
+func TestCacheKeyCanonical(t *testing.T) {
+	decode := func(body, contentType string) ArrayRequest {
+		req := httptest.NewRequest("POST", "/multiply/array", strings.NewReader(body))
+		req.Header.Set("Content-Type", contentType)
+		var v ArrayRequest
+		if err := decodeRequest(req, &v); err != nil {
+			t.Fatalf("decodeRequest(%q) error: %v", body, err)
+		}
+		return v
+	}
+
+	jsonKey := cacheKey("multiply_array", decode(`{ "numbers" : [1, 2.0, 3] }`, "application/json"))
+	csvKey := cacheKey("multiply_array", decode("numbers\n1\n2\n3\n", "text/csv"))
+	if jsonKey != csvKey {
+		t.Errorf("JSON and CSV encodings of the same input have different keys")
+	}
+	if jsonKey == cacheKey("multiply_scalar", decode(`{"numbers":[1,2,3]}`, "application/json")) {
+		t.Errorf("different operations share a key")
+	}
+}
+
+// Test ETag, Cache-Control and If-None-Match on an operation endpoint
+func TestOperationETag(t *testing.T) {
+	s := newTestServer(t, WithLimits(Limits{CacheSize: 10, CacheMaxAge: time.Hour}))
+	router := s.newRouter()
+
+	send := func(method, path, body, ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+	get := func(path, ifNoneMatch string) *httptest.ResponseRecorder {
+		return send("GET", path, "", ifNoneMatch)
+	}
+
+	first := get("/power?base=2&exponent=10", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("first response = %v with ETag %q", first.Code, etag)
+	}
+	if got := first.Header().Get("Cache-Control"); got != "public, max-age=3600" {
+		t.Errorf("Cache-Control = %q", got)
+	}
+	if got := first.Header().Get("X-Cache"); got != "MISS" {
+		t.Errorf("first X-Cache = %q, want MISS", got)
+	}
+
+	second := get("/power?exponent=10&base=2", "")
+	if second.Header().Get("ETag") != etag || second.Header().Get("X-Cache") != "HIT" {
+		t.Errorf("second response ETag %q X-Cache %q, want %q HIT", second.Header().Get("ETag"), second.Header().Get("X-Cache"), etag)
+	}
+	if second.Body.String() != first.Body.String() {
+		t.Errorf("cached body = %s, want %s", second.Body.String(), first.Body.String())
+	}
+
+	for _, inm := range []string{etag, `"other", ` + etag, "W/" + etag, "*"} {
+		if w := get("/power?base=2&exponent=10", inm); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Errorf("If-None-Match %s: status = %v, body %q, want empty 304", inm, w.Code, w.Body.String())
+		}
+	}
+	if w := get("/power?base=2&exponent=11", etag); w.Code != http.StatusOK {
+		t.Errorf("different input with old ETag: status = %v, want 200", w.Code)
+	}
+	if w := get("/v2/power?base=2&exponent=10", etag); w.Code != http.StatusOK || w.Header().Get("ETag") == etag {
+		t.Errorf("v2 representation should have its own ETag")
+	}
+
+	// POST results are cached but not cacheable by clients, and a matching
+	// If-None-Match is a failed precondition
+	w := send("POST", "/power", `{"base":2,"exponent":10}`, "")
+	if w.Code != http.StatusOK || w.Header().Get("X-Cache") != "HIT" || w.Header().Get("ETag") != "" || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("POST = %v with X-Cache %q, ETag %q and Cache-Control %q", w.Code, w.Header().Get("X-Cache"), w.Header().Get("ETag"), w.Header().Get("Cache-Control"))
+	}
+	for _, inm := range []string{etag, "*"} {
+		if w := send("POST", "/power", `{"base":2,"exponent":10}`, inm); w.Code != http.StatusPreconditionFailed {
+			t.Errorf("POST with If-None-Match %s: status = %v, want 412", inm, w.Code)
+		}
+	}
+
+	// Failures are neither cached nor tagged
+	if w := get("/multiply/pairwise?array1=1,2&array2=1", ""); w.Code != http.StatusBadRequest || w.Header().Get("ETag") != "" {
+		t.Errorf("error response: status = %v, ETag %q", w.Code, w.Header().Get("ETag"))
+	}
+
+	if stats := s.cache.Stats(); stats.Hits == 0 || stats.Misses == 0 {
+		t.Errorf("Stats() = %+v, want hits and misses counted", stats)
+	}
+}
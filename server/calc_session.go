@@ -0,0 +1,381 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// calcPongWait is how long a session may stay silent before it is dropped
+	calcPongWait = 60 * time.Second
+	// calcPingPeriod is how often the server pings idle clients
+	calcPingPeriod = calcPongWait * 9 / 10
+	// calcMaxRegisters bounds the named registers kept per session
+	calcMaxRegisters = 64
+)
+
+// registerName is the allowed syntax for register names
+var registerName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]{0,31}$`)
+
+// CalcMessage is a message sent by a /ws client.
+//
+// Operations from the registry take "args" in the shape of the matching
+// request type. Any number, or list of numbers, in the arguments may be
+// replaced by the name of a register, and "ans" always refers to the
+// answer of the previous operation:
+//
+//	{"id": "1", "op": "multiply", "args": {"a": 6, "b": 7}}
+//	{"id": "2", "op": "power", "args": {"base": "ans", "exponent": 2}, "store": "x"}
+//	{"id": "3", "op": "multiply_scalar", "args": {"numbers": [1, "x"], "scalar": "ans"}}
+//
+// Session commands manage the registers: "set" (name, value), "registers"
+// and "clear".
+type CalcMessage struct {
+	ID    string      `json:"id,omitempty"`
+	Op    string      `json:"op"`
+	Args  interface{} `json:"args,omitempty"`
+	Store string      `json:"store,omitempty"`
+	Name  string      `json:"name,omitempty"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// CalcReply is a message sent to a /ws client. Type is "session" when the
+// session opens, "result" for a completed operation, "registers" for
+// register commands and "error" when a message could not be handled.
+type CalcReply struct {
+	ID        string                 `json:"id,omitempty"`
+	Type      string                 `json:"type"`
+	SessionID string                 `json:"session_id,omitempty"`
+	Op        string                 `json:"op,omitempty"`
+	Data      interface{}            `json:"data,omitempty"`
+	Ans       interface{}            `json:"ans,omitempty"`
+	Registers map[string]interface{} `json:"registers,omitempty"`
+	Error     *EnvelopeError         `json:"error,omitempty"`
+}
+
+// calcSession is one connected calculator with its memory registers
+type calcSession struct {
+	server *Server
+	id     string
+	// requestID is the ID of the upgrade request, which tags the session's log lines
+	requestID string
+	conn      *wsConn
+	clientIP  string
+	ans       interface{}
+	registers map[string]interface{}
+}
+
+// calcHub tracks open sessions so they can be closed on shutdown
+type calcHub struct {
+	mu       sync.Mutex
+	sessions map[*calcSession]struct{}
+	closing  bool
+}
+
+func newCalcHub() *calcHub {
+	return &calcHub{sessions: make(map[*calcSession]struct{})}
+}
+
+// add registers a session, refusing new ones once shutdown has started
+func (h *calcHub) add(s *calcSession) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closing {
+		return false
+	}
+	h.sessions[s] = struct{}{}
+	return true
+}
+
+func (h *calcHub) remove(s *calcSession) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.sessions, s)
+}
+
+// Shutdown sends "going away" to every session and closes it. It is
+// registered with http.Server.RegisterOnShutdown because hijacked
+// connections are not tracked by the server's graceful shutdown.
+func (h *calcHub) Shutdown() {
+	h.mu.Lock()
+	h.closing = true
+	sessions := make([]*calcSession, 0, len(h.sessions))
+	for s := range h.sessions {
+		sessions = append(sessions, s)
+	}
+	h.mu.Unlock()
+
+	for _, s := range sessions {
+		s.conn.WriteClose(wsCloseGoingAway, "server shutting down")
+		s.conn.Close()
+	}
+}
+
+// wsHandler upgrades GET /ws to a WebSocket calculator session
+func (s *Server) wsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/ws" {
+		sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+		return
+	}
+
+	s.sessions.mu.Lock()
+	closing := s.sessions.closing
+	s.sessions.mu.Unlock()
+	if closing {
+		sendErrorResponse(w, "Service Unavailable", "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	conn, err := upgradeWebSocket(w, r, calcPongWait, s.wsOrigins)
+	if err != nil {
+		if hsErr, ok := err.(*wsHandshakeError); ok {
+			sendErrorResponse(w, http.StatusText(hsErr.Status), hsErr.Message, hsErr.Status)
+		} else {
+			logf(s.logger, RequestID(r.Context()), "WebSocket upgrade error: %v", err)
+		}
+		return
+	}
+
+	session := &calcSession{
+		server:    s,
+		id:        newRequestID(),
+		requestID: RequestID(r.Context()),
+		conn:      conn,
+		clientIP:  s.clientIP(r),
+		registers: make(map[string]interface{}),
+	}
+	if !s.sessions.add(session) {
+		conn.WriteClose(wsCloseGoingAway, "server shutting down")
+		conn.Close()
+		return
+	}
+	defer s.sessions.remove(session)
+
+	session.run()
+}
+
+// run serves the session until the client leaves or the connection fails
+func (s *calcSession) run() {
+	defer s.conn.Close()
+
+	done := make(chan struct{})
+	defer close(done)
+	go s.keepalive(done)
+
+	logf(s.server.logger, s.requestID, "WebSocket session %s opened by %s", s.id, s.clientIP)
+	s.send(CalcReply{Type: "session", SessionID: s.id})
+
+	for {
+		opcode, data, err := s.conn.ReadMessage()
+		if err != nil {
+			if err != errWSClosed {
+				logf(s.server.logger, s.requestID, "WebSocket session %s closed: %v", s.id, err)
+			}
+			break
+		}
+
+		if _, allowed := s.server.policies.Match("/ws", s.clientIP).Allow(s.server.rateLimitKey(s.clientIP), 1); !allowed {
+			s.send(CalcReply{Type: "error", Error: &EnvelopeError{Code: "rate_limit_exceeded", Message: "Too many requests"}})
+			continue
+		}
+
+		if opcode != wsText {
+			s.conn.WriteClose(wsCloseUnsupportedData, "only JSON text messages are supported")
+			break
+		}
+
+		var msg CalcMessage
+		if err := json.Unmarshal(data, &msg); err != nil {
+			s.send(CalcReply{Type: "error", Error: &EnvelopeError{Code: "bad_request", Message: "Invalid JSON format"}})
+			continue
+		}
+		s.send(s.handle(msg))
+	}
+
+	logf(s.server.logger, s.requestID, "WebSocket session %s ended", s.id)
+}
+
+// keepalive pings the client until done is closed
+func (s *calcSession) keepalive(done chan struct{}) {
+	ticker := time.NewTicker(calcPingPeriod)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := s.conn.Ping(); err != nil {
+				s.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+func (s *calcSession) send(reply CalcReply) {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		logf(s.server.logger, s.requestID, "WebSocket encode error: %v", err)
+		return
+	}
+	s.conn.WriteText(data)
+}
+
+// handle runs one client message against the session state
+func (s *calcSession) handle(msg CalcMessage) CalcReply {
+	fail := func(code, message, field string) CalcReply {
+		return CalcReply{ID: msg.ID, Type: "error", Op: msg.Op, Error: &EnvelopeError{Code: code, Message: message, Field: field}}
+	}
+
+	switch msg.Op {
+	case "":
+		return fail("bad_request", "op is required", "op")
+
+	case "registers":
+		return CalcReply{ID: msg.ID, Type: "registers", Op: msg.Op, Ans: s.ans, Registers: s.registerSnapshot()}
+
+	case "clear":
+		s.ans = nil
+		s.registers = make(map[string]interface{})
+		return CalcReply{ID: msg.ID, Type: "registers", Op: msg.Op, Registers: s.registerSnapshot()}
+
+	case "set":
+		value, err := s.resolve(msg.Value)
+		if err != nil {
+			return fail("unknown_register", err.Error(), "value")
+		}
+		if !isRegisterValue(value) {
+			return fail("bad_request", "value must be a number or a list of numbers", "value")
+		}
+		if err := s.store(msg.Name, value); err != nil {
+			return fail("bad_request", err.Error(), "name")
+		}
+		return CalcReply{ID: msg.ID, Type: "registers", Op: msg.Op, Registers: s.registerSnapshot()}
+	}
+
+	args, err := s.resolve(msg.Args)
+	if err != nil {
+		return fail("unknown_register", err.Error(), "args")
+	}
+
+	result, ans, err := runOperation(msg.Op, args)
+	if err != nil {
+		opErr := err.(*OperationError)
+		reply := fail(opErr.Code, opErr.Message, "")
+		if len(opErr.Fields) > 0 {
+			reply.Error.Field = opErr.Fields[0].Field
+			reply.Error.Errors = opErr.Fields
+		}
+		return reply
+	}
+
+	s.ans = registerValue(ans)
+	if msg.Store != "" {
+		if err := s.store(msg.Store, s.ans); err != nil {
+			return fail("bad_request", err.Error(), "store")
+		}
+	}
+
+	return CalcReply{ID: msg.ID, Type: "result", Op: msg.Op, Data: result, Ans: s.ans}
+}
+
+// store saves a value in a named register
+func (s *calcSession) store(name string, value interface{}) error {
+	if name == "ans" || !registerName.MatchString(name) {
+		return &OperationError{Code: "bad_request", Message: "Invalid register name " + `"` + name + `"`}
+	}
+	if _, exists := s.registers[name]; !exists && len(s.registers) >= calcMaxRegisters {
+		return &OperationError{Code: "bad_request", Message: "Too many registers (max 64)"}
+	}
+	s.registers[name] = value
+	return nil
+}
+
+// resolve replaces register names in decoded JSON arguments with their values
+func (s *calcSession) resolve(g interface{}) (interface{}, error) {
+	switch val := g.(type) {
+	case string:
+		if val == "ans" {
+			if s.ans == nil {
+				return nil, &OperationError{Code: "unknown_register", Message: "No previous answer"}
+			}
+			return s.ans, nil
+		}
+		if value, ok := s.registers[val]; ok {
+			return value, nil
+		}
+		return nil, &OperationError{Code: "unknown_register", Message: "Unknown register " + `"` + val + `"`}
+	case []interface{}:
+		out := make([]interface{}, len(val))
+		for i, item := range val {
+			resolved, err := s.resolve(item)
+			if err != nil {
+				return nil, err
+			}
+			out[i] = resolved
+		}
+		return out, nil
+	case map[string]interface{}:
+		out := make(map[string]interface{}, len(val))
+		for k, item := range val {
+			resolved, err := s.resolve(item)
+			if err != nil {
+				return nil, err
+			}
+			out[k] = resolved
+		}
+		return out, nil
+	}
+	return g, nil
+}
+
+// registerSnapshot copies the registers for a reply
+func (s *calcSession) registerSnapshot() map[string]interface{} {
+	names := make([]string, 0, len(s.registers))
+	for name := range s.registers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	snapshot := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		snapshot[name] = s.registers[name]
+	}
+	return snapshot
+}
+
+// registerValue converts an operation answer to the generic form used for
+// decoded arguments, so it can be substituted back into later messages
+func registerValue(ans interface{}) interface{} {
+	if list, ok := ans.([]float64); ok {
+		out := make([]interface{}, len(list))
+		for i, n := range list {
+			out[i] = n
+		}
+		return out
+	}
+	return ans
+}
+
+// isRegisterValue reports whether g is a number or a list of numbers
+func isRegisterValue(g interface{}) bool {
+	switch val := g.(type) {
+	case float64:
+		return true
+	case []interface{}:
+		for _, item := range val {
+			if _, ok := item.(float64); !ok {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
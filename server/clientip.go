@@ -0,0 +1,132 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseNetwork parses a CIDR network; a bare address is a network of its own
+func parseNetwork(s string) (*net.IPNet, error) {
+	s = strings.TrimSpace(s)
+	if !strings.Contains(s, "/") {
+		if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+			s += "/32"
+		} else {
+			s += "/128"
+		}
+	}
+	_, network, err := net.ParseCIDR(s)
+	return network, err
+}
+
+// parseNetworks parses a comma-separated list of networks
+func parseNetworks(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, s := range strings.Split(list, ",") {
+		if strings.TrimSpace(s) == "" {
+			continue
+		}
+		network, err := parseNetwork(s)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// isTrustedProxy reports whether ip belongs to one of the trusted proxies
+func (s *Server) isTrustedProxy(ip net.IP) bool {
+	for _, network := range s.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseHostIP parses an address as found in RemoteAddr and forwarding
+// headers: a bare IP, or one with a port, IPv6 in brackets. It returns nil
+// for anything else, such as "unknown" or obfuscated RFC 7239 identifiers.
+func parseHostIP(s string) net.IP {
+	s = strings.Trim(strings.TrimSpace(s), `"`)
+	if ip := net.ParseIP(s); ip != nil {
+		return ip
+	}
+	if host, _, err := net.SplitHostPort(s); err == nil {
+		s = host
+	}
+	// Zones, as in fe80::1%eth0, are local to the proxy
+	s, _, _ = strings.Cut(strings.Trim(s, "[]"), "%")
+	return net.ParseIP(s)
+}
+
+// forwardedHops returns the client addresses recorded by proxies, nearest
+// last: the for= parameters of the RFC 7239 Forwarded header, or else
+// X-Forwarded-For. Entries that are not addresses are nil.
+func forwardedHops(h http.Header) []net.IP {
+	var hops []net.IP
+	if forwarded := h.Values("Forwarded"); len(forwarded) > 0 {
+		for _, element := range strings.Split(strings.Join(forwarded, ","), ",") {
+			for _, pair := range strings.Split(element, ";") {
+				key, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+				if ok && strings.EqualFold(key, "for") {
+					hops = append(hops, parseHostIP(value))
+				}
+			}
+		}
+		return hops
+	}
+	for _, value := range h.Values("X-Forwarded-For") {
+		for _, entry := range strings.Split(value, ",") {
+			hops = append(hops, parseHostIP(entry))
+		}
+	}
+	return hops
+}
+
+// clientIP returns the address of the client. Forwarding headers only
+// count when the connection comes from a trusted proxy, and are walked
+// from the nearest proxy back to the first address not itself a trusted
+// proxy, so clients cannot choose their address by sending the headers.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := parseHostIP(r.RemoteAddr)
+	if ip == nil {
+		return r.RemoteAddr
+	}
+	if !s.isTrustedProxy(ip) {
+		return ip.String()
+	}
+
+	hops := forwardedHops(r.Header)
+	if len(hops) == 0 {
+		if real := parseHostIP(r.Header.Get("X-Real-IP")); real != nil {
+			return real.String()
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		// A proxy that did not record an address leaves the nearest one known
+		if hops[i] == nil {
+			break
+		}
+		ip = hops[i]
+		if !s.isTrustedProxy(ip) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// rateLimitKey is the key clientIP is rate limited by: the address itself,
+// or for IPv6 its network of ipv6Prefix bits, since one host often holds
+// a whole /64
+func (s *Server) rateLimitKey(clientIP string) string {
+	ip := net.ParseIP(clientIP)
+	if ip == nil || ip.To4() != nil || s.ipv6Prefix >= 128 {
+		return clientIP
+	}
+	network := ip.Mask(net.CIDRMask(s.ipv6Prefix, 128))
+	return fmt.Sprintf("%s/%d", network, s.ipv6Prefix)
+}
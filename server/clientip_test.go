@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Test resolving the client address through trusted proxies
+func TestClientIP(t *testing.T) {
+	s := newTestServer(t, WithTrustedProxies("10.0.0.0/8", "2001:db8:ffff::/48", "127.0.0.1"))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		header     http.Header
+		want       string
+	}{
+		{"direct", "203.0.113.5:4711", nil, "203.0.113.5"},
+		{"direct IPv6", "[2001:db8::1]:8080", nil, "2001:db8::1"},
+		{"zoned IPv6", "[fe80::1%eth0]:8080", nil, "fe80::1"},
+		{"no port", "203.0.113.5", nil, "203.0.113.5"},
+		{"untrusted peer spoofing X-Forwarded-For", "203.0.113.5:4711",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "203.0.113.5"},
+		{"untrusted peer spoofing X-Real-IP", "203.0.113.5:4711",
+			http.Header{"X-Real-Ip": {"198.51.100.1"}}, "203.0.113.5"},
+		{"trusted proxy", "10.0.0.2:4711",
+			http.Header{"X-Forwarded-For": {"198.51.100.1"}}, "198.51.100.1"},
+		{"spoofed entry before the client", "10.0.0.2:4711",
+			http.Header{"X-Forwarded-For": {"192.0.2.66, 198.51.100.1"}}, "198.51.100.1"},
+		{"chain of trusted proxies", "127.0.0.1:4711",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, 10.1.1.1", "10.2.2.2"}}, "198.51.100.1"},
+		{"only trusted proxies", "10.0.0.2:4711",
+			http.Header{"X-Forwarded-For": {"10.1.1.1"}}, "10.1.1.1"},
+		{"IPv6 client through a proxy", "[2001:db8:ffff::1]:443",
+			http.Header{"X-Forwarded-For": {"2001:db8:1:2::7"}}, "2001:db8:1:2::7"},
+		{"garbage after the client", "10.0.0.2:4711",
+			http.Header{"X-Forwarded-For": {"198.51.100.1, unknown"}}, "10.0.0.2"},
+		{"X-Real-IP from a trusted proxy", "10.0.0.2:4711",
+			http.Header{"X-Real-Ip": {"198.51.100.1"}}, "198.51.100.1"},
+		{"Forwarded", "10.0.0.2:4711",
+			http.Header{"Forwarded": {`for=192.0.2.60;proto=http;by=203.0.113.43, For="[2001:db8:cafe::17]:4711"`}}, "2001:db8:cafe::17"},
+		{"Forwarded across headers", "10.0.0.2:4711",
+			http.Header{"Forwarded": {"for=198.51.100.1", "for=10.3.3.3:80"}}, "198.51.100.1"},
+		{"Forwarded wins over X-Forwarded-For", "10.0.0.2:4711",
+			http.Header{"Forwarded": {"for=198.51.100.1"}, "X-Forwarded-For": {"198.51.100.2"}}, "198.51.100.1"},
+		{"obfuscated Forwarded", "10.0.0.2:4711",
+			http.Header{"Forwarded": {"for=_hidden"}}, "10.0.0.2"},
+		{"IPv4-mapped", "[::ffff:203.0.113.5]:4711", nil, "203.0.113.5"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for k, v := range tt.header {
+			req.Header[k] = v
+		}
+		if got := s.clientIP(req); got != tt.want {
+			t.Errorf("%s: clientIP = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Test rejecting invalid proxy networks
+func TestParseNetworks(t *testing.T) {
+	networks, err := parseNetworks(" 10.0.0.0/8,::1,, 192.0.2.7 ")
+	if err != nil || len(networks) != 3 || networks[1].String() != "::1/128" || networks[2].String() != "192.0.2.7/32" {
+		t.Errorf("parseNetworks = %v, %v", networks, err)
+	}
+	for _, list := range []string{"10.0.0.0/33", "proxy.internal", "10.0.0.1, nope"} {
+		if _, err := parseNetworks(list); err == nil {
+			t.Errorf("parseNetworks(%q) succeeded", list)
+		}
+	}
+}
+
+// Test keying IPv6 clients by prefix
+func TestRateLimitKey(t *testing.T) {
+	s := &Server{}
+
+	tests := []struct {
+		prefix   int
+		clientIP string
+		want     string
+	}{
+		{128, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2:3:4:5:6"},
+		{64, "2001:db8:1:2:3:4:5:6", "2001:db8:1:2::/64"},
+		{64, "2001:db8:1:2::9", "2001:db8:1:2::/64"},
+		{48, "2001:db8:1:2::9", "2001:db8:1::/48"},
+		{64, "203.0.113.5", "203.0.113.5"},
+		{64, "not-an-ip", "not-an-ip"},
+	}
+
+	for _, tt := range tests {
+		s.ipv6Prefix = tt.prefix
+		if got := s.rateLimitKey(tt.clientIP); got != tt.want {
+			t.Errorf("/%d rateLimitKey(%q) = %s, want %s", tt.prefix, tt.clientIP, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,490 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Codec encodes and decodes request and response bodies for one media type
+type Codec interface {
+	// Name is the short human readable format name, e.g. "JSON"
+	Name() string
+	// ContentType is the media type written in the Content-Type header
+	ContentType() string
+	Encode(w io.Writer, v interface{}) error
+	Decode(r io.Reader, v interface{}) error
+}
+
+var (
+	errUnsupportedMediaType = errors.New("unsupported media type")
+	errTrailingData         = errors.New("unexpected data after top-level value")
+)
+
+// maxRequestBodySize bounds request bodies read by decodeRequest
+const maxRequestBodySize = 1 << 20
+
+// DecodeError is returned when a request body cannot be decoded by its codec
+type DecodeError struct {
+	Format string
+	Err    error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("invalid %s body: %v", e.Format, e.Err)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// codecRegistry maps media types to codecs
+type codecRegistry struct {
+	mu     sync.RWMutex
+	byType map[string]Codec
+	order  []string
+}
+
+var codecs = &codecRegistry{byType: make(map[string]Codec)}
+
+func init() {
+	RegisterCodec(jsonCodec{}, "application/json")
+	RegisterCodec(csvCodec{}, "text/csv", "application/csv")
+	RegisterCodec(xmlCodec{}, "application/xml", "text/xml")
+	RegisterCodec(msgpackCodec{}, "application/msgpack", "application/x-msgpack", "application/vnd.msgpack")
+	RegisterCodec(cborCodec{}, "application/cbor")
+}
+
+// RegisterCodec makes a codec available for the given media types.
+// The first registered codec is the default used for */* and missing headers.
+func RegisterCodec(c Codec, mediaTypes ...string) {
+	codecs.mu.Lock()
+	defer codecs.mu.Unlock()
+
+	for _, mt := range mediaTypes {
+		mt = strings.ToLower(mt)
+		if _, exists := codecs.byType[mt]; !exists {
+			codecs.order = append(codecs.order, mt)
+		}
+		codecs.byType[mt] = c
+	}
+}
+
+// lookupCodec returns the codec registered for an exact media type
+func lookupCodec(mediaType string) (Codec, bool) {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+
+	c, ok := codecs.byType[strings.ToLower(mediaType)]
+	return c, ok
+}
+
+// defaultCodec returns the first registered codec (JSON)
+func defaultCodec() Codec {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+
+	return codecs.byType[codecs.order[0]]
+}
+
+// negotiateCodec picks the best codec for an Accept header value.
+// It returns false when none of the accepted media types are supported.
+func negotiateCodec(accept string) (Codec, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return defaultCodec(), true
+	}
+
+	type candidate struct {
+		mediaType string
+		q         float64
+	}
+
+	var candidates []candidate
+	for _, part := range strings.Split(accept, ",") {
+		mt, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if qs, ok := params["q"]; ok {
+			if parsed, err := strconv.ParseFloat(qs, 64); err == nil {
+				q = parsed
+			}
+		}
+		if q <= 0 {
+			continue
+		}
+		candidates = append(candidates, candidate{mediaType: mt, q: q})
+	}
+
+	// Highest quality first, then the order the client listed them in
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].q > candidates[j].q
+	})
+
+	for _, c := range candidates {
+		if c.mediaType == "*/*" || c.mediaType == "application/*" {
+			return defaultCodec(), true
+		}
+		if strings.HasSuffix(c.mediaType, "/*") {
+			prefix := strings.TrimSuffix(c.mediaType, "*")
+			codecs.mu.RLock()
+			for _, mt := range codecs.order {
+				if strings.HasPrefix(mt, prefix) {
+					codec := codecs.byType[mt]
+					codecs.mu.RUnlock()
+					return codec, true
+				}
+			}
+			codecs.mu.RUnlock()
+			continue
+		}
+		if codec, ok := lookupCodec(c.mediaType); ok {
+			return codec, true
+		}
+	}
+
+	return nil, false
+}
+
+// requestCodec returns the codec matching the request's Content-Type header.
+// Requests without a Content-Type are treated as JSON.
+func requestCodec(r *http.Request) (Codec, error) {
+	ct := r.Header.Get("Content-Type")
+	if ct == "" {
+		return defaultCodec(), nil
+	}
+
+	mt, _, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return nil, errUnsupportedMediaType
+	}
+
+	codec, ok := lookupCodec(mt)
+	if !ok {
+		return nil, errUnsupportedMediaType
+	}
+	return codec, nil
+}
+
+// decodeRequest decodes the request body into v using the codec selected by
+// Content-Type. Decoding is strict: unknown fields, data after the document
+// and bodies over maxRequestBodySize are rejected.
+func decodeRequest(r *http.Request, v interface{}) error {
+	return decodeRequestLimit(r, v, maxRequestBodySize)
+}
+
+// decodeRequestLimit is decodeRequest for endpoints that accept bodies of up
+// to limit bytes. Larger bodies return an *http.MaxBytesError.
+func decodeRequestLimit(r *http.Request, v interface{}, limit int64) error {
+	codec, err := requestCodec(r)
+	if err != nil {
+		return err
+	}
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, limit+1))
+	if err != nil {
+		return err
+	}
+	if int64(len(body)) > limit {
+		return &http.MaxBytesError{Limit: limit}
+	}
+
+	if err := codec.Decode(bytes.NewReader(body), v); err != nil {
+		return &DecodeError{Format: codec.Name(), Err: err}
+	}
+	return nil
+}
+
+// decodeQuery decodes the URL query string into v. List fields accept
+// repeated parameters, comma separated values or both
+// (numbers=1,2&numbers=3), and numbers are parsed as with the text codecs.
+func decodeQuery(r *http.Request, v interface{}) error {
+	values := map[string]interface{}{}
+	for key, list := range r.URL.Query() {
+		var items []interface{}
+		for _, value := range list {
+			for _, part := range strings.Split(value, ",") {
+				items = append(items, part)
+			}
+		}
+		values[key] = items
+	}
+
+	if err := fromGeneric(values, v); err != nil {
+		return &DecodeError{Format: "query", Err: err}
+	}
+	return nil
+}
+
+// decodeOperationRequest reads an operation's arguments from the query
+// string on GET and from the request body otherwise
+func decodeOperationRequest(r *http.Request, v interface{}) error {
+	if r.Method == http.MethodGet {
+		return decodeQuery(r, v)
+	}
+	return decodeRequest(r, v)
+}
+
+// sendDecodeError reports a failure from decodeRequest to the client
+func sendDecodeError(w http.ResponseWriter, err error) {
+	if errors.Is(err, errUnsupportedMediaType) {
+		sendErrorResponse(w, "Unsupported Media Type", "Supported content types: "+strings.Join(supportedMediaTypes(), ", "), http.StatusUnsupportedMediaType)
+		return
+	}
+
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		sendErrorResponse(w, "Request Entity Too Large", "Request body is limited to "+formatSize(tooLarge.Limit), http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) {
+		if rw := findResponseWriter(w); rw != nil {
+			rw.malformedBody = true
+		}
+		message := "Invalid " + decodeErr.Format + " format"
+		var unknown *UnknownFieldError
+		if errors.As(err, &unknown) || errors.Is(err, errTrailingData) {
+			message += ": " + decodeErr.Err.Error()
+		}
+		sendProblem(w, "Bad Request", message, http.StatusBadRequest, decodeFieldErrors(err))
+		return
+	}
+
+	sendErrorResponse(w, "Bad Request", err.Error(), http.StatusBadRequest)
+}
+
+// formatSize formats a body size limit for error messages
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return strconv.FormatInt(n>>20, 10) + " MB"
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return strconv.FormatInt(n>>10, 10) + " KB"
+	}
+	return strconv.FormatInt(n, 10) + " bytes"
+}
+
+// supportedMediaTypes lists every registered media type
+func supportedMediaTypes() []string {
+	codecs.mu.RLock()
+	defer codecs.mu.RUnlock()
+
+	return append([]string(nil), codecs.order...)
+}
+
+// negotiationMiddleware resolves the Accept header once per request and
+// rejects requests asking only for formats the server cannot produce
+func (s *Server) negotiationMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		codec, ok := negotiateCodec(r.Header.Get("Accept"))
+		if !ok && acceptsEventStream(r.Header.Get("Accept")) {
+			// Event streams are written by their handlers; errors before the
+			// stream starts fall back to JSON
+			codec, ok = defaultCodec(), true
+		}
+		if !ok {
+			sendErrorResponse(w, "Not Acceptable", "Supported response types: "+strings.Join(supportedMediaTypes(), ", "), http.StatusNotAcceptable)
+			return
+		}
+
+		w.Header().Add("Vary", "Accept")
+		next.ServeHTTP(&responseWriter{ResponseWriter: w, codec: codec, requestID: RequestID(r.Context()), logger: s.logger}, r)
+	})
+}
+
+// acceptsEventStream reports whether accept asks for Server-Sent Events
+func acceptsEventStream(accept string) bool {
+	for _, part := range strings.Split(accept, ",") {
+		if mt, _, err := mime.ParseMediaType(strings.TrimSpace(part)); err == nil && mt == "text/event-stream" {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonCodec is the default codec
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string        { return "JSON" }
+func (jsonCodec) ContentType() string { return "application/json" }
+
+func (jsonCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Decode rejects unknown fields and anything after the first JSON value
+func (jsonCodec) Decode(r io.Reader, v interface{}) error {
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return strictJSONError(err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return errTrailingData
+	}
+	return nil
+}
+
+// toGeneric converts v into plain maps, slices, strings, bools, nil and
+// json.Number values by round-tripping it through JSON, so the binary and
+// text codecs honour the same struct tags as the JSON codec.
+func toGeneric(v interface{}) (interface{}, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var g interface{}
+	if err := dec.Decode(&g); err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// fromGeneric stores a generic value produced by a decoder into v, shaping it
+// to the Go type of v first (see conform). Fields v does not have are
+// rejected with an *UnknownFieldError.
+func fromGeneric(g interface{}, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return errors.New("decode target must be a non-nil pointer")
+	}
+
+	data, err := json.Marshal(conform(g, rv.Elem().Type()))
+	if err != nil {
+		return err
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(v); err != nil {
+		return strictJSONError(err)
+	}
+	return nil
+}
+
+// conform reshapes a loosely typed decoded value to match t. Text formats
+// such as CSV and XML carry numbers as strings and cannot tell a one element
+// list from a single value, so strings are parsed into numbers and booleans,
+// single values are wrapped into slices and one element lists are unwrapped
+// wherever the target type calls for it.
+func conform(g interface{}, t reflect.Type) interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t.Kind() {
+	case reflect.Struct:
+		m, ok := g.(map[string]interface{})
+		if !ok {
+			return g
+		}
+		out := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			out[k] = v
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name := jsonFieldName(f)
+			if name == "" {
+				continue
+			}
+			if v, ok := out[name]; ok {
+				out[name] = conform(v, f.Type)
+			}
+		}
+		return out
+
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return g
+		}
+		list, ok := g.([]interface{})
+		if !ok {
+			if g == nil {
+				return g
+			}
+			list = []interface{}{g}
+		}
+		out := make([]interface{}, len(list))
+		for i, v := range list {
+			out[i] = conform(v, t.Elem())
+		}
+		return out
+
+	case reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		g = unwrapSingle(g)
+		if s, ok := g.(string); ok {
+			s = strings.TrimSpace(s)
+			if _, err := strconv.ParseFloat(s, 64); err == nil {
+				return json.Number(s)
+			}
+		}
+		return g
+
+	case reflect.Bool:
+		g = unwrapSingle(g)
+		if s, ok := g.(string); ok {
+			if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+				return b
+			}
+		}
+		return g
+
+	case reflect.String:
+		return unwrapSingle(g)
+	}
+
+	return g
+}
+
+// unwrapSingle turns a one element list into its element
+func unwrapSingle(g interface{}) interface{} {
+	if list, ok := g.([]interface{}); ok && len(list) == 1 {
+		return list[0]
+	}
+	return g
+}
+
+// jsonFieldName returns the JSON key for a struct field, or "" if it is skipped
+func jsonFieldName(f reflect.StructField) string {
+	if f.PkgPath != "" {
+		return ""
+	}
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		name = f.Name
+	}
+	return name
+}
+
+// sortedKeys returns the keys of m in a stable order for the text and binary encoders
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
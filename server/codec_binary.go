@@ -0,0 +1,617 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// maxBinaryDepth bounds container nesting in MessagePack and CBOR bodies
+const maxBinaryDepth = 32
+
+var errTruncated = errors.New("unexpected end of data")
+
+// binaryReader is a bounds-checked cursor over a fully buffered body.
+// Length prefixes are checked against the remaining bytes before anything
+// is allocated, so a forged header cannot force a huge allocation.
+type binaryReader struct {
+	data []byte
+	pos  int
+}
+
+func (br *binaryReader) remaining() int {
+	return len(br.data) - br.pos
+}
+
+func (br *binaryReader) byte() (byte, error) {
+	if br.remaining() < 1 {
+		return 0, errTruncated
+	}
+	b := br.data[br.pos]
+	br.pos++
+	return b, nil
+}
+
+func (br *binaryReader) next(n uint64) ([]byte, error) {
+	if n > uint64(br.remaining()) {
+		return nil, errTruncated
+	}
+	b := br.data[br.pos : br.pos+int(n)]
+	br.pos += int(n)
+	return b, nil
+}
+
+func (br *binaryReader) uint(size int) (uint64, error) {
+	b, err := br.next(uint64(size))
+	if err != nil {
+		return 0, err
+	}
+	switch size {
+	case 1:
+		return uint64(b[0]), nil
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b)), nil
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b)), nil
+	default:
+		return binary.BigEndian.Uint64(b), nil
+	}
+}
+
+// decodeBinary buffers a body and rejects trailing bytes after the first value
+func decodeBinary(r io.Reader, v interface{}, decode func(*binaryReader, int) (interface{}, error)) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	br := &binaryReader{data: data}
+	g, err := decode(br, 0)
+	if err != nil {
+		return err
+	}
+	if br.remaining() != 0 {
+		return errTrailingData
+	}
+	return fromGeneric(g, v)
+}
+
+// numberValue converts a json.Number into an int64 when it is integral so
+// large integers such as factorial results survive without float rounding
+func numberValue(n json.Number) (int64, float64, bool) {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return i, 0, true
+	}
+	f, _ := strconv.ParseFloat(string(n), 64)
+	return 0, f, false
+}
+
+// msgpackCodec implements the MessagePack format (https://msgpack.org)
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string        { return "MessagePack" }
+func (msgpackCodec) ContentType() string { return "application/msgpack" }
+
+func (msgpackCodec) Encode(w io.Writer, v interface{}) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := encodeMsgpack(&buf, g); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (msgpackCodec) Decode(r io.Reader, v interface{}) error {
+	return decodeBinary(r, v, decodeMsgpack)
+}
+
+func encodeMsgpack(buf *bytes.Buffer, g interface{}) error {
+	switch val := g.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if val {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case json.Number:
+		if i, f, isInt := numberValue(val); isInt {
+			writeMsgpackInt(buf, i)
+		} else {
+			buf.WriteByte(0xcb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		n := len(val)
+		switch {
+		case n < 32:
+			buf.WriteByte(0xa0 | byte(n))
+		case n <= math.MaxUint8:
+			buf.WriteByte(0xd9)
+			buf.WriteByte(byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xda)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdb)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		buf.WriteString(val)
+	case []interface{}:
+		n := len(val)
+		switch {
+		case n < 16:
+			buf.WriteByte(0x90 | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xdc)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdd)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		for _, item := range val {
+			if err := encodeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		n := len(val)
+		switch {
+		case n < 16:
+			buf.WriteByte(0x80 | byte(n))
+		case n <= math.MaxUint16:
+			buf.WriteByte(0xde)
+			binary.Write(buf, binary.BigEndian, uint16(n))
+		default:
+			buf.WriteByte(0xdf)
+			binary.Write(buf, binary.BigEndian, uint32(n))
+		}
+		for _, k := range sortedKeys(val) {
+			encodeMsgpack(buf, k)
+			if err := encodeMsgpack(buf, val[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: unsupported type %T", g)
+	}
+	return nil
+}
+
+func writeMsgpackInt(buf *bytes.Buffer, i int64) {
+	switch {
+	case i >= 0 && i < 128:
+		buf.WriteByte(byte(i))
+	case i >= -32 && i < 0:
+		buf.WriteByte(byte(int8(i)))
+	case i >= 0 && i <= math.MaxUint8:
+		buf.WriteByte(0xcc)
+		buf.WriteByte(byte(i))
+	case i >= 0 && i <= math.MaxUint16:
+		buf.WriteByte(0xcd)
+		binary.Write(buf, binary.BigEndian, uint16(i))
+	case i >= 0 && i <= math.MaxUint32:
+		buf.WriteByte(0xce)
+		binary.Write(buf, binary.BigEndian, uint32(i))
+	case i >= 0:
+		buf.WriteByte(0xcf)
+		binary.Write(buf, binary.BigEndian, uint64(i))
+	case i >= math.MinInt8:
+		buf.WriteByte(0xd0)
+		buf.WriteByte(byte(int8(i)))
+	case i >= math.MinInt16:
+		buf.WriteByte(0xd1)
+		binary.Write(buf, binary.BigEndian, int16(i))
+	case i >= math.MinInt32:
+		buf.WriteByte(0xd2)
+		binary.Write(buf, binary.BigEndian, int32(i))
+	default:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, i)
+	}
+}
+
+func decodeMsgpack(br *binaryReader, depth int) (interface{}, error) {
+	if depth > maxBinaryDepth {
+		return nil, errors.New("msgpack: nesting too deep")
+	}
+
+	b, err := br.byte()
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case b <= 0x7f:
+		return json.Number(strconv.Itoa(int(b))), nil
+	case b >= 0xe0:
+		return json.Number(strconv.Itoa(int(int8(b)))), nil
+	case b&0xe0 == 0xa0:
+		s, err := br.next(uint64(b & 0x1f))
+		return string(s), err
+	case b&0xf0 == 0x90:
+		return decodeMsgpackArray(br, uint64(b&0x0f), depth)
+	case b&0xf0 == 0x80:
+		return decodeMsgpackMap(br, uint64(b&0x0f), depth)
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		u, err := br.uint(1 << (b - 0xcc))
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(strconv.FormatUint(u, 10)), nil
+	case 0xd0, 0xd1, 0xd2, 0xd3:
+		size := 1 << (b - 0xd0)
+		u, err := br.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		var i int64
+		switch size {
+		case 1:
+			i = int64(int8(u))
+		case 2:
+			i = int64(int16(u))
+		case 4:
+			i = int64(int32(u))
+		default:
+			i = int64(u)
+		}
+		return json.Number(strconv.FormatInt(i, 10)), nil
+	case 0xca:
+		u, err := br.uint(4)
+		if err != nil {
+			return nil, err
+		}
+		return floatNumber(float64(math.Float32frombits(uint32(u))))
+	case 0xcb:
+		u, err := br.uint(8)
+		if err != nil {
+			return nil, err
+		}
+		return floatNumber(math.Float64frombits(u))
+	case 0xd9, 0xda, 0xdb, 0xc4, 0xc5, 0xc6:
+		size := 1
+		switch b {
+		case 0xda, 0xc5:
+			size = 2
+		case 0xdb, 0xc6:
+			size = 4
+		}
+		n, err := br.uint(size)
+		if err != nil {
+			return nil, err
+		}
+		s, err := br.next(n)
+		return string(s), err
+	case 0xdc, 0xdd:
+		n, err := br.uint(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackArray(br, n, depth)
+	case 0xde, 0xdf:
+		n, err := br.uint(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return decodeMsgpackMap(br, n, depth)
+	}
+
+	return nil, fmt.Errorf("msgpack: unsupported type byte 0x%02x", b)
+}
+
+func decodeMsgpackArray(br *binaryReader, n uint64, depth int) (interface{}, error) {
+	// Every element takes at least one byte
+	if n > uint64(br.remaining()) {
+		return nil, errTruncated
+	}
+	list := make([]interface{}, 0, n)
+	for i := uint64(0); i < n; i++ {
+		item, err := decodeMsgpack(br, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, item)
+	}
+	return list, nil
+}
+
+func decodeMsgpackMap(br *binaryReader, n uint64, depth int) (interface{}, error) {
+	if n > uint64(br.remaining()/2) {
+		return nil, errTruncated
+	}
+	m := make(map[string]interface{}, n)
+	for i := uint64(0); i < n; i++ {
+		k, err := decodeMsgpack(br, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, errors.New("msgpack: map keys must be strings")
+		}
+		m[key], err = decodeMsgpack(br, depth+1)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// floatNumber converts a decoded float into a json.Number; JSON has no
+// representation for NaN or infinities so those are rejected
+func floatNumber(f float64) (interface{}, error) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return nil, errors.New("NaN and infinite numbers are not supported")
+	}
+	return json.Number(strconv.FormatFloat(f, 'g', -1, 64)), nil
+}
+
+// cborCodec implements the CBOR format (RFC 8949)
+type cborCodec struct{}
+
+func (cborCodec) Name() string        { return "CBOR" }
+func (cborCodec) ContentType() string { return "application/cbor" }
+
+func (cborCodec) Encode(w io.Writer, v interface{}) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := encodeCBOR(&buf, g); err != nil {
+		return err
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+func (cborCodec) Decode(r io.Reader, v interface{}) error {
+	return decodeBinary(r, v, decodeCBOR)
+}
+
+// writeCBORHead writes a major type with its argument in the shortest form
+func writeCBORHead(buf *bytes.Buffer, major byte, arg uint64) {
+	major <<= 5
+	switch {
+	case arg < 24:
+		buf.WriteByte(major | byte(arg))
+	case arg <= math.MaxUint8:
+		buf.WriteByte(major | 24)
+		buf.WriteByte(byte(arg))
+	case arg <= math.MaxUint16:
+		buf.WriteByte(major | 25)
+		binary.Write(buf, binary.BigEndian, uint16(arg))
+	case arg <= math.MaxUint32:
+		buf.WriteByte(major | 26)
+		binary.Write(buf, binary.BigEndian, uint32(arg))
+	default:
+		buf.WriteByte(major | 27)
+		binary.Write(buf, binary.BigEndian, arg)
+	}
+}
+
+func encodeCBOR(buf *bytes.Buffer, g interface{}) error {
+	switch val := g.(type) {
+	case nil:
+		buf.WriteByte(0xf6)
+	case bool:
+		if val {
+			buf.WriteByte(0xf5)
+		} else {
+			buf.WriteByte(0xf4)
+		}
+	case json.Number:
+		if i, f, isInt := numberValue(val); isInt {
+			if i >= 0 {
+				writeCBORHead(buf, 0, uint64(i))
+			} else {
+				writeCBORHead(buf, 1, uint64(-(i + 1)))
+			}
+		} else {
+			buf.WriteByte(0xfb)
+			binary.Write(buf, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeCBORHead(buf, 3, uint64(len(val)))
+		buf.WriteString(val)
+	case []interface{}:
+		writeCBORHead(buf, 4, uint64(len(val)))
+		for _, item := range val {
+			if err := encodeCBOR(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeCBORHead(buf, 5, uint64(len(val)))
+		for _, k := range sortedKeys(val) {
+			encodeCBOR(buf, k)
+			if err := encodeCBOR(buf, val[k]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("cbor: unsupported type %T", g)
+	}
+	return nil
+}
+
+// errCBORBreak marks the end of an indefinite-length item
+var errCBORBreak = errors.New("cbor: break")
+
+func decodeCBOR(br *binaryReader, depth int) (interface{}, error) {
+	if depth > maxBinaryDepth {
+		return nil, errors.New("cbor: nesting too deep")
+	}
+
+	b, err := br.byte()
+	if err != nil {
+		return nil, err
+	}
+	major, info := b>>5, b&0x1f
+
+	if b == 0xff {
+		return nil, errCBORBreak
+	}
+
+	if major == 7 {
+		switch info {
+		case 20:
+			return false, nil
+		case 21:
+			return true, nil
+		case 22, 23:
+			return nil, nil
+		case 25:
+			u, err := br.uint(2)
+			if err != nil {
+				return nil, err
+			}
+			return floatNumber(float16ToFloat64(uint16(u)))
+		case 26:
+			u, err := br.uint(4)
+			if err != nil {
+				return nil, err
+			}
+			return floatNumber(float64(math.Float32frombits(uint32(u))))
+		case 27:
+			u, err := br.uint(8)
+			if err != nil {
+				return nil, err
+			}
+			return floatNumber(math.Float64frombits(u))
+		}
+		return nil, fmt.Errorf("cbor: unsupported simple value %d", info)
+	}
+
+	indefinite := info == 31
+	var arg uint64
+	switch {
+	case info < 24:
+		arg = uint64(info)
+	case info <= 27:
+		arg, err = br.uint(1 << (info - 24))
+		if err != nil {
+			return nil, err
+		}
+	case indefinite && major >= 2 && major <= 5:
+	default:
+		return nil, fmt.Errorf("cbor: invalid additional information %d", info)
+	}
+
+	switch major {
+	case 0:
+		return json.Number(strconv.FormatUint(arg, 10)), nil
+	case 1:
+		if arg > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer out of range")
+		}
+		return json.Number(strconv.FormatInt(-1-int64(arg), 10)), nil
+	case 2, 3:
+		if !indefinite {
+			s, err := br.next(arg)
+			return string(s), err
+		}
+		var sb bytes.Buffer
+		for {
+			chunk, err := decodeCBOR(br, depth+1)
+			if err == errCBORBreak {
+				return sb.String(), nil
+			}
+			if err != nil {
+				return nil, err
+			}
+			s, ok := chunk.(string)
+			if !ok {
+				return nil, errors.New("cbor: invalid string chunk")
+			}
+			sb.WriteString(s)
+		}
+	case 4:
+		if !indefinite && arg > uint64(br.remaining()) {
+			return nil, errTruncated
+		}
+		list := []interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			item, err := decodeCBOR(br, depth+1)
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, item)
+		}
+		return list, nil
+	case 5:
+		if !indefinite && arg > uint64(br.remaining()/2) {
+			return nil, errTruncated
+		}
+		m := map[string]interface{}{}
+		for i := uint64(0); indefinite || i < arg; i++ {
+			k, err := decodeCBOR(br, depth+1)
+			if indefinite && err == errCBORBreak {
+				break
+			}
+			if err != nil {
+				return nil, err
+			}
+			key, ok := k.(string)
+			if !ok {
+				return nil, errors.New("cbor: map keys must be strings")
+			}
+			m[key], err = decodeCBOR(br, depth+1)
+			if err != nil {
+				return nil, err
+			}
+		}
+		return m, nil
+	case 6:
+		// Tags only annotate the following item
+		return decodeCBOR(br, depth+1)
+	}
+
+	return nil, fmt.Errorf("cbor: unsupported major type %d", major)
+}
+
+// float16ToFloat64 decodes an IEEE 754 half precision float
+func float16ToFloat64(h uint16) float64 {
+	sign := 1.0
+	if h&0x8000 != 0 {
+		sign = -1
+	}
+	exp := int(h>>10) & 0x1f
+	frac := float64(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		return sign * math.Ldexp(frac, -24)
+	case 31:
+		if frac == 0 {
+			return math.Inf(int(sign))
+		}
+		return math.NaN()
+	}
+	return sign * math.Ldexp(frac+1024, exp-25)
+}
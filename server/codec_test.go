@@ -0,0 +1,260 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Test that every codec round-trips the request types used by the handlers
+func TestCodecRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		empty func() interface{}
+	}{
+		{"array request", ArrayRequest{Numbers: []float64{1.5, -2, 3e9}}, func() interface{} { return &ArrayRequest{} }},
+		{"single element array", ArrayRequest{Numbers: []float64{7}}, func() interface{} { return &ArrayRequest{} }},
+		{"scalar request", ScalarRequest{Numbers: []float64{1, 2, 3}, Scalar: 2.5}, func() interface{} { return &ScalarRequest{} }},
+		{"pairwise request", PairwiseRequest{Array1: []float64{1, 2}, Array2: []float64{3, 4}}, func() interface{} { return &PairwiseRequest{} }},
+		{"factorial request", FactorialRequest{Number: 20}, func() interface{} { return &FactorialRequest{} }},
+		{"form request", FormRequest{Name: "John", Address: "123 Main St"}, func() interface{} { return &FormRequest{} }},
+	}
+
+	for _, codec := range []Codec{jsonCodec{}, xmlCodec{}, msgpackCodec{}, cborCodec{}} {
+		for _, tt := range tests {
+			t.Run(codec.Name()+"/"+tt.name, func(t *testing.T) {
+				var buf bytes.Buffer
+				if err := codec.Encode(&buf, tt.value); err != nil {
+					t.Fatalf("Encode() error = %v", err)
+				}
+
+				got := tt.empty()
+				if err := codec.Decode(&buf, got); err != nil {
+					t.Fatalf("Decode() error = %v", err)
+				}
+
+				if !reflect.DeepEqual(reflect.ValueOf(got).Elem().Interface(), tt.value) {
+					t.Errorf("round trip = %+v, want %+v", got, tt.value)
+				}
+			})
+		}
+	}
+}
+
+// Test that large integers survive the binary codecs without float rounding
+func TestBinaryCodecsPreserveInt64(t *testing.T) {
+	want := map[string]int64{"result": 2432902008176640000}
+
+	for _, codec := range []Codec{msgpackCodec{}, cborCodec{}} {
+		var buf bytes.Buffer
+		if err := codec.Encode(&buf, want); err != nil {
+			t.Fatalf("%s Encode() error = %v", codec.Name(), err)
+		}
+
+		var got map[string]int64
+		if err := codec.Decode(&buf, &got); err != nil {
+			t.Fatalf("%s Decode() error = %v", codec.Name(), err)
+		}
+		if got["result"] != want["result"] {
+			t.Errorf("%s result = %d, want %d", codec.Name(), got["result"], want["result"])
+		}
+	}
+}
+
+// Test that truncated or forged binary bodies are rejected
+func TestBinaryCodecsRejectMalformedInput(t *testing.T) {
+	tests := []struct {
+		name  string
+		codec Codec
+		input []byte
+	}{
+		{"msgpack truncated string", msgpackCodec{}, []byte{0xa5, 'a'}},
+		{"msgpack huge array header", msgpackCodec{}, []byte{0xdd, 0xff, 0xff, 0xff, 0xff}},
+		{"msgpack trailing data", msgpackCodec{}, []byte{0x80, 0x01}},
+		{"cbor truncated map", cborCodec{}, []byte{0xa2, 0x61, 'a'}},
+		{"cbor huge array header", cborCodec{}, []byte{0x9b, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff}},
+		{"cbor NaN", cborCodec{}, []byte{0xf9, 0x7e, 0x00}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var v map[string]interface{}
+			if err := tt.codec.Decode(bytes.NewReader(tt.input), &v); err == nil {
+				t.Errorf("Decode(%x) expected error, got %v", tt.input, v)
+			}
+		})
+	}
+}
+
+// Test decoding CBOR produced by other encoders (indefinite lengths, half floats)
+func TestCBORDecodeIndefiniteAndHalfFloat(t *testing.T) {
+	// {_ "numbers": [_ 1.5 (half float), 2]}
+	input := []byte{0xbf, 0x67, 'n', 'u', 'm', 'b', 'e', 'r', 's', 0x9f, 0xf9, 0x3e, 0x00, 0x02, 0xff, 0xff}
+
+	var req ArrayRequest
+	if err := (cborCodec{}).Decode(bytes.NewReader(input), &req); err != nil {
+		t.Fatalf("Decode() error = %v", err)
+	}
+	if !reflect.DeepEqual(req.Numbers, []float64{1.5, 2}) {
+		t.Errorf("Numbers = %v, want [1.5 2]", req.Numbers)
+	}
+}
+
+// Test Accept header negotiation
+func TestNegotiateCodec(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{"", "JSON", true},
+		{"*/*", "JSON", true},
+		{"text/csv", "CSV", true},
+		{"application/msgpack", "MessagePack", true},
+		{"application/cbor;q=0.5, application/xml", "XML", true},
+		{"text/html, text/*;q=0.8", "CSV", true},
+		{"image/png", "", false},
+		{"application/json;q=0", "", false},
+	}
+
+	for _, tt := range tests {
+		codec, ok := negotiateCodec(tt.accept)
+		if ok != tt.ok {
+			t.Errorf("negotiateCodec(%q) ok = %v, want %v", tt.accept, ok, tt.ok)
+			continue
+		}
+		if ok && codec.Name() != tt.want {
+			t.Errorf("negotiateCodec(%q) = %s, want %s", tt.accept, codec.Name(), tt.want)
+		}
+	}
+}
+
+// Test posting a CSV column to /multiply/scalar and getting CSV back
+func TestMultiplyScalarHandlerCSV(t *testing.T) {
+	s := newTestServer(t)
+	body := "numbers,scalar\n1,2\n2,\n3,\n"
+	req := httptest.NewRequest("POST", "/multiply/scalar", strings.NewReader(body))
+	req.Header.Set("Content-Type", "text/csv")
+	req.Header.Set("Accept", "text/csv")
+	w := httptest.NewRecorder()
+
+	s.negotiationMiddleware(http.HandlerFunc(s.multiplyScalarHandler)).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "text/csv" {
+		t.Errorf("Content-Type = %q, want text/csv", ct)
+	}
+	if want := "results\n2\n4\n6\n"; w.Body.String() != want {
+		t.Errorf("body = %q, want %q", w.Body.String(), want)
+	}
+}
+
+// Test posting a headerless CSV column to /multiply/array
+func TestMultiplyArrayHandlerHeaderlessCSV(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("POST", "/multiply/array", strings.NewReader("2\n3\n4\n"))
+	req.Header.Set("Content-Type", "text/csv")
+	w := httptest.NewRecorder()
+
+	s.negotiationMiddleware(http.HandlerFunc(s.multiplyArrayHandler)).ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+
+	var response struct {
+		Data MultiplyArrayResult `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	if len(response.Data.Results) != 1 || response.Data.Results[0] != 24 {
+		t.Errorf("Results = %v, want [24]", response.Data.Results)
+	}
+}
+
+// Test a MessagePack request with a MessagePack error response
+func TestMultiplyHandlerMessagePack(t *testing.T) {
+	s := newTestServer(t)
+	var body bytes.Buffer
+	(msgpackCodec{}).Encode(&body, MultiplyRequest{A: 1e16, B: 2})
+
+	req := httptest.NewRequest("POST", "/multiply", &body)
+	req.Header.Set("Content-Type", "application/msgpack")
+	req.Header.Set("Accept", "application/msgpack")
+	w := httptest.NewRecorder()
+
+	s.negotiationMiddleware(http.HandlerFunc(s.multiplyHandler)).ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+
+	var response ErrorResponse
+	if err := (msgpackCodec{}).Decode(w.Body, &response); err != nil {
+		t.Fatalf("Failed to decode MessagePack error: %v", err)
+	}
+	if response.Code != http.StatusBadRequest || response.Message != "Numbers are too large" {
+		t.Errorf("unexpected error response: %+v", response)
+	}
+}
+
+// Test unsupported request and response media types
+func TestContentNegotiationErrors(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("POST", "/multiply", strings.NewReader("a=1"))
+	req.Header.Set("Content-Type", "application/yaml")
+	w := httptest.NewRecorder()
+	s.negotiationMiddleware(http.HandlerFunc(s.multiplyHandler)).ServeHTTP(w, req)
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Errorf("unsupported Content-Type status = %v, want %v", w.Code, http.StatusUnsupportedMediaType)
+	}
+
+	req = httptest.NewRequest("POST", "/multiply", strings.NewReader(`{"a":1,"b":2}`))
+	req.Header.Set("Accept", "image/png")
+	w = httptest.NewRecorder()
+	s.negotiationMiddleware(http.HandlerFunc(s.multiplyHandler)).ServeHTTP(w, req)
+	if w.Code != http.StatusNotAcceptable {
+		t.Errorf("unsupported Accept status = %v, want %v", w.Code, http.StatusNotAcceptable)
+	}
+}
+
+// Test that /form accepts codec bodies as well as form encoding
+func TestFormHandlerJSONBody(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("POST", "/form", strings.NewReader(`{"name":"John","address":"123 Main St"}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+
+	s.formHandler(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %v, want %v: %s", w.Code, http.StatusOK, w.Body.String())
+	}
+}
+
+// Test that encode errors go to the server's logger
+func TestEncodeErrorLogged(t *testing.T) {
+	var logs strings.Builder
+	s := newTestServer(t, WithLogger(log.New(&logs, "", 0)))
+	w := httptest.NewRecorder()
+
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("X-Request-ID", "encode-1")
+
+	requestIDMiddleware(s.negotiationMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeResponse(w, http.StatusOK, map[string]interface{}{"result": make(chan int)})
+	}))).ServeHTTP(w, req)
+
+	if !strings.Contains(logs.String(), "[encode-1] JSON encode error") {
+		t.Errorf("logs = %q, want the encode error", logs.String())
+	}
+}
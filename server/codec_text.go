@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// csvCodec reads and writes number columns. Each column is named by its
+// header cell, so a request to /multiply/scalar looks like:
+//
+//	numbers,scalar
+//	1,2.5
+//	2,
+//	3,
+//
+// A single headerless column is read as "numbers".
+type csvCodec struct{}
+
+func (csvCodec) Name() string        { return "CSV" }
+func (csvCodec) ContentType() string { return "text/csv" }
+
+func (csvCodec) Decode(r io.Reader, v interface{}) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	rows, err := reader.ReadAll()
+	if err != nil {
+		return err
+	}
+	if len(rows) == 0 {
+		return errors.New("empty CSV document")
+	}
+
+	header := rows[0]
+	hasHeader := false
+	for _, cell := range header {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(cell), 64); err != nil && strings.TrimSpace(cell) != "" {
+			hasHeader = true
+			break
+		}
+	}
+
+	if hasHeader {
+		rows = rows[1:]
+	} else {
+		width := 0
+		for _, row := range rows {
+			if len(row) > width {
+				width = len(row)
+			}
+		}
+		if width > 1 {
+			return errors.New("a header row is required when sending more than one column")
+		}
+		header = []string{"numbers"}
+	}
+
+	columns := make(map[string]interface{}, len(header))
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			return fmt.Errorf("column %d has an empty header", i+1)
+		}
+		values := []interface{}{}
+		for _, row := range rows {
+			if i < len(row) && strings.TrimSpace(row[i]) != "" {
+				values = append(values, strings.TrimSpace(row[i]))
+			}
+		}
+		columns[name] = values
+	}
+
+	return fromGeneric(columns, v)
+}
+
+func (csvCodec) Encode(w io.Writer, v interface{}) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+
+	// Success responses are written as their "data" payload only
+	if m, ok := g.(map[string]interface{}); ok {
+		if data, ok := m["data"]; ok {
+			g = data
+		}
+	}
+
+	columns := map[string][]string{}
+	flattenCSV("", g, columns)
+
+	names := make([]string, 0, len(columns))
+	height := 0
+	for name, values := range columns {
+		names = append(names, name)
+		if len(values) > height {
+			height = len(values)
+		}
+	}
+	sort.Strings(names)
+
+	writer := csv.NewWriter(w)
+	if err := writer.Write(names); err != nil {
+		return err
+	}
+	for i := 0; i < height; i++ {
+		row := make([]string, len(names))
+		for j, name := range names {
+			if i < len(columns[name]) {
+				row[j] = columns[name][i]
+			}
+		}
+		if err := writer.Write(row); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+// flattenCSV turns a generic value into named columns. Nested objects use
+// dotted column names, lists become column values and anything deeper is
+// written as a JSON cell.
+func flattenCSV(prefix string, g interface{}, columns map[string][]string) {
+	name := prefix
+	if name == "" {
+		name = "value"
+	}
+
+	switch val := g.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(val) {
+			key := k
+			if prefix != "" {
+				key = prefix + "." + k
+			}
+			flattenCSV(key, val[k], columns)
+		}
+	case []interface{}:
+		cells := make([]string, 0, len(val))
+		for _, item := range val {
+			cells = append(cells, csvCell(item))
+		}
+		columns[name] = cells
+	default:
+		columns[name] = []string{csvCell(val)}
+	}
+}
+
+// csvCell formats a scalar for a CSV cell
+func csvCell(g interface{}) string {
+	switch val := g.(type) {
+	case nil:
+		return ""
+	case string:
+		return val
+	case json.Number:
+		return val.String()
+	case bool:
+		return strconv.FormatBool(val)
+	default:
+		data, _ := json.Marshal(val)
+		return string(data)
+	}
+}
+
+// xmlCodec maps objects to nested elements and lists to repeated elements:
+//
+//	<request><numbers>1</numbers><numbers>2</numbers></request>
+//
+// The root element name is ignored on input and written as <response>.
+type xmlCodec struct{}
+
+func (xmlCodec) Name() string        { return "XML" }
+func (xmlCodec) ContentType() string { return "application/xml" }
+
+func (xmlCodec) Encode(w io.Writer, v interface{}) error {
+	g, err := toGeneric(v)
+	if err != nil {
+		return err
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	if err := encodeXMLElement(enc, "response", g); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func encodeXMLElement(enc *xml.Encoder, name string, g interface{}) error {
+	if list, ok := g.([]interface{}); ok {
+		for _, item := range list {
+			if err := encodeXMLElement(enc, name, item); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+
+	switch val := g.(type) {
+	case map[string]interface{}:
+		for _, k := range sortedKeys(val) {
+			if err := encodeXMLElement(enc, k, val[k]); err != nil {
+				return err
+			}
+		}
+	case nil:
+	default:
+		if err := enc.EncodeToken(xml.CharData(csvCell(val))); err != nil {
+			return err
+		}
+	}
+
+	return enc.EncodeToken(start.End())
+}
+
+func (xmlCodec) Decode(r io.Reader, v interface{}) error {
+	dec := xml.NewDecoder(r)
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("empty XML document")
+			}
+			return err
+		}
+		if _, ok := tok.(xml.StartElement); ok {
+			g, err := decodeXMLElement(dec, 0)
+			if err != nil {
+				return err
+			}
+			if err := xmlEnd(dec); err != nil {
+				return err
+			}
+			return fromGeneric(g, v)
+		}
+	}
+}
+
+// xmlEnd checks that only whitespace, comments and processing instructions
+// follow the root element
+func xmlEnd(dec *xml.Decoder) error {
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		switch t := tok.(type) {
+		case xml.Comment, xml.ProcInst:
+		case xml.CharData:
+			if len(bytes.TrimSpace(t)) != 0 {
+				return errTrailingData
+			}
+		default:
+			return errTrailingData
+		}
+	}
+}
+
+// maxXMLDepth bounds element nesting in request bodies
+const maxXMLDepth = 32
+
+// decodeXMLElement reads the content of an element whose start tag has
+// already been consumed. Elements with children become maps, repeated
+// children become lists and leaf elements become their text.
+func decodeXMLElement(dec *xml.Decoder, depth int) (interface{}, error) {
+	if depth > maxXMLDepth {
+		return nil, errors.New("XML document nested too deeply")
+	}
+
+	var text strings.Builder
+	var children map[string]interface{}
+
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			child, err := decodeXMLElement(dec, depth+1)
+			if err != nil {
+				return nil, err
+			}
+			if children == nil {
+				children = make(map[string]interface{})
+			}
+			name := t.Name.Local
+			if existing, ok := children[name]; ok {
+				if list, ok := existing.([]interface{}); ok {
+					children[name] = append(list, child)
+				} else {
+					children[name] = []interface{}{existing, child}
+				}
+			} else {
+				children[name] = child
+			}
+		case xml.CharData:
+			text.Write(t)
+		case xml.EndElement:
+			if children != nil {
+				return children, nil
+			}
+			return strings.TrimSpace(text.String()), nil
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Pools of compressors, reset onto each response. "deflate" in HTTP is the
+// zlib format (RFC 9110 section 8.4.1.2), not raw DEFLATE.
+var (
+	gzipWriters = sync.Pool{New: func() interface{} { return gzip.NewWriter(io.Discard) }}
+	zlibWriters = sync.Pool{New: func() interface{} { return zlib.NewWriter(io.Discard) }}
+	gzipReaders sync.Pool
+)
+
+// compressor is the part of gzip.Writer and zlib.Writer the middleware uses
+type compressor interface {
+	io.WriteCloser
+	Flush() error
+	Reset(w io.Writer)
+}
+
+// compressionMiddleware compresses responses of at least minSize bytes with
+// gzip or deflate, whichever Accept-Encoding prefers, and decompresses
+// gzip-encoded request bodies. Event streams, partial content and media
+// types that are already compressed are passed through unchanged.
+func compressionMiddleware(minSize int, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		if encoding := r.Header.Get("Content-Encoding"); encoding != "" && !strings.EqualFold(encoding, "identity") {
+			if !strings.EqualFold(encoding, "gzip") && !strings.EqualFold(encoding, "x-gzip") {
+				w.Header().Set("Accept-Encoding", "gzip")
+				sendErrorResponse(w, "Unsupported Media Type", "Request bodies may only be gzip encoded", http.StatusUnsupportedMediaType)
+				return
+			}
+			zr, err := newGzipReader(r.Body)
+			if err != nil {
+				sendErrorResponse(w, "Bad Request", "Invalid gzip request body", http.StatusBadRequest)
+				return
+			}
+			defer gzipReaders.Put(zr)
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{zr, r.Body}
+			r.Header.Del("Content-Encoding")
+			r.Header.Del("Content-Length")
+			r.ContentLength = -1
+		}
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: minSize}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// newGzipReader returns a pooled gzip reader for body
+func newGzipReader(body io.Reader) (*gzip.Reader, error) {
+	if zr, ok := gzipReaders.Get().(*gzip.Reader); ok {
+		if err := zr.Reset(body); err != nil {
+			gzipReaders.Put(zr)
+			return nil, err
+		}
+		return zr, nil
+	}
+	return gzip.NewReader(body)
+}
+
+// negotiateEncoding picks gzip or deflate from an Accept-Encoding header,
+// preferring gzip when both are equally acceptable. It returns "" when
+// neither is accepted. "*" covers the codings the header does not name.
+func negotiateEncoding(accept string) string {
+	q := map[string]float64{}
+	star := -1.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		weight := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+				weight = parsed
+			}
+		}
+
+		switch name {
+		case "gzip", "x-gzip":
+			q["gzip"] = weight
+		case "deflate":
+			q["deflate"] = weight
+		case "*":
+			star = weight
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, name := range []string{"gzip", "deflate"} {
+		weight, ok := q[name]
+		if !ok {
+			weight = star
+		}
+		if weight > bestQ {
+			best, bestQ = name, weight
+		}
+	}
+	return best
+}
+
+// isCompressible reports whether a response Content-Type is worth compressing
+func isCompressible(contentType string) bool {
+	mt, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	if mt == "text/event-stream" {
+		return false
+	}
+	if strings.HasPrefix(mt, "text/") || strings.HasSuffix(mt, "+json") || strings.HasSuffix(mt, "+xml") {
+		return true
+	}
+	switch mt {
+	case "application/json", "application/xml", "application/javascript", "application/csv",
+		"application/msgpack", "application/x-msgpack", "application/vnd.msgpack", "application/cbor",
+		"image/svg+xml":
+		return true
+	}
+	return false
+}
+
+// compressWriter holds back the start of a response until it knows whether
+// the body reaches minSize, then either compresses it or writes it as is
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+
+	status    int
+	buf       []byte
+	committed bool
+	hijacked  bool
+	zw        compressor
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if cw.committed || cw.status != 0 {
+		return
+	}
+	cw.status = code
+	if code == http.StatusNoContent || code == http.StatusNotModified || code == http.StatusPartialContent {
+		cw.commit()
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.committed {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.commit(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// commit decides whether to compress, sends the header and writes whatever
+// was held back
+func (cw *compressWriter) commit() error {
+	cw.committed = true
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+	}
+
+	header := cw.ResponseWriter.Header()
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+
+	compress := len(cw.buf) >= cw.minSize && len(cw.buf) > 0 &&
+		header.Get("Content-Encoding") == "" && header.Get("Content-Range") == "" &&
+		isCompressible(header.Get("Content-Type"))
+	if compress || cw.status == http.StatusNotModified {
+		// The compressed body is a different representation, so a strong
+		// validator must not claim byte equality with the uncompressed one
+		if etag := header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			header.Set("ETag", "W/"+etag)
+		}
+	}
+
+	if compress {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		if cw.encoding == "gzip" {
+			cw.zw = gzipWriters.Get().(*gzip.Writer)
+		} else {
+			cw.zw = zlibWriters.Get().(*zlib.Writer)
+		}
+		cw.zw.Reset(cw.ResponseWriter)
+	}
+
+	cw.ResponseWriter.WriteHeader(cw.status)
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	if cw.zw != nil {
+		_, err := cw.zw.Write(buf)
+		return err
+	}
+	_, err := cw.ResponseWriter.Write(buf)
+	return err
+}
+
+// Close finishes the response once the handler has returned
+func (cw *compressWriter) Close() error {
+	if cw.hijacked {
+		return nil
+	}
+	if !cw.committed {
+		if cw.status == 0 && len(cw.buf) == 0 {
+			// Nothing was written; let net/http send its default response
+			return nil
+		}
+		if err := cw.commit(); err != nil {
+			return err
+		}
+	}
+	if cw.zw == nil {
+		return nil
+	}
+
+	err := cw.zw.Close()
+	if gz, ok := cw.zw.(*gzip.Writer); ok {
+		gzipWriters.Put(gz)
+	} else {
+		zlibWriters.Put(cw.zw)
+	}
+	cw.zw = nil
+	return err
+}
+
+// Flush sends everything written so far, compressed or not
+func (cw *compressWriter) Flush() {
+	if !cw.committed {
+		cw.commit()
+	}
+	if cw.zw != nil {
+		cw.zw.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so WebSocket upgrades work through the wrapper
+func (cw *compressWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := cw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		cw.hijacked = true
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController and findResponseWriter reach the wrapped writer
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func compressedRouter(s *Server) http.Handler {
+	return compressionMiddleware(defaultConfig.CompressionMinSize, s.newRouter())
+}
+
+// Test choosing a content coding from Accept-Encoding
+func TestNegotiateEncoding(t *testing.T) {
+	tests := []struct {
+		accept string
+		want   string
+	}{
+		{"", ""},
+		{"gzip", "gzip"},
+		{"deflate", "deflate"},
+		{"deflate, gzip", "gzip"},
+		{"gzip;q=0.5, deflate", "deflate"},
+		{"gzip;q=0, deflate;q=0", ""},
+		{"br, *", "gzip"},
+		{"gzip;q=0, *", "deflate"},
+		{"identity", ""},
+	}
+
+	for _, tt := range tests {
+		if got := negotiateEncoding(tt.accept); got != tt.want {
+			t.Errorf("negotiateEncoding(%q) = %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+// Test that large responses are compressed and small ones are not
+func TestResponseCompression(t *testing.T) {
+	s := newTestServer(t)
+	numbers := strings.TrimSuffix(strings.Repeat("1.5,", 1000), ",")
+	large := `{"numbers":[` + numbers + `],"scalar":2}`
+	small := `{"a":2,"b":3}`
+
+	tests := []struct {
+		name     string
+		path     string
+		body     string
+		accept   string
+		encoding string
+	}{
+		{"gzip", "/multiply/scalar", large, "gzip", "gzip"},
+		{"deflate", "/multiply/scalar", large, "deflate", "deflate"},
+		{"not accepted", "/multiply/scalar", large, "", ""},
+		{"below threshold", "/multiply", small, "gzip", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Accept-Encoding", tt.accept)
+			w := httptest.NewRecorder()
+			compressedRouter(s).ServeHTTP(w, req)
+
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %v, want %v: %s", w.Code, http.StatusOK, w.Body.String())
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.encoding)
+			}
+			if !strings.Contains(strings.Join(w.Header().Values("Vary"), ","), "Accept-Encoding") {
+				t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Values("Vary"))
+			}
+
+			var body io.Reader = w.Body
+			switch tt.encoding {
+			case "gzip":
+				zr, err := gzip.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("gzip.NewReader failed: %v", err)
+				}
+				body = zr
+			case "deflate":
+				zr, err := zlib.NewReader(w.Body)
+				if err != nil {
+					t.Fatalf("zlib.NewReader failed: %v", err)
+				}
+				body = zr
+			}
+
+			var response SuccessResponse
+			if err := json.NewDecoder(body).Decode(&response); err != nil || !response.Success {
+				t.Errorf("Failed to decode response: %v %+v", err, response)
+			}
+		})
+	}
+}
+
+// Test that a compressed cached result gets a weak ETag that still revalidates
+func TestCompressionETag(t *testing.T) {
+	s := newTestServer(t)
+	query := "numbers=" + strings.TrimSuffix(strings.Repeat("2,", 1000), ",") + "&scalar=3"
+	send := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/multiply/scalar?"+query, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		req.Header.Set("If-None-Match", ifNoneMatch)
+		w := httptest.NewRecorder()
+		compressedRouter(s).ServeHTTP(w, req)
+		return w
+	}
+
+	first := send("")
+	etag := first.Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"`) {
+		t.Fatalf("compressed ETag = %q, want a weak validator", etag)
+	}
+	if w := send(etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Errorf("revalidation = %v with %d bytes, want %v and no body", w.Code, w.Body.Len(), http.StatusNotModified)
+	}
+}
+
+// Test decompressing gzip request bodies
+func TestRequestDecompression(t *testing.T) {
+	s := newTestServer(t)
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	zw.Write([]byte(`{"numbers":[1,2,3,4]}`))
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		encoding string
+		body     []byte
+		status   int
+	}{
+		{"gzip", "gzip", gzipped.Bytes(), http.StatusOK},
+		{"corrupt gzip", "gzip", []byte("not gzip"), http.StatusBadRequest},
+		{"unsupported encoding", "br", gzipped.Bytes(), http.StatusUnsupportedMediaType},
+		{"identity", "identity", []byte(`{"numbers":[1,2,3,4]}`), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/multiply/array", bytes.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			req.Header.Set("Content-Encoding", tt.encoding)
+			w := httptest.NewRecorder()
+			compressedRouter(s).ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.status, w.Body.String())
+			}
+			if tt.status == http.StatusUnsupportedMediaType && w.Header().Get("Accept-Encoding") != "gzip" {
+				t.Errorf("Accept-Encoding = %q, want gzip", w.Header().Get("Accept-Encoding"))
+			}
+			if tt.status == http.StatusOK && !strings.Contains(w.Body.String(), `"results":[24]`) {
+				t.Errorf("body = %s, want results [24]", w.Body.String())
+			}
+		})
+	}
+}
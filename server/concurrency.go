@@ -0,0 +1,311 @@
+package server
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Concurrency limit algorithms (CONCURRENCY_ALGORITHM)
+const (
+	concurrencyFixed    = "fixed"
+	concurrencyAIMD     = "aimd"
+	concurrencyGradient = "gradient"
+)
+
+// Priority orders requests waiting for a concurrency slot. Higher
+// priorities are admitted first and shed last.
+type Priority int
+
+const (
+	// PriorityLow is for static pages and documentation
+	PriorityLow Priority = iota
+	// PriorityNormal is for the API
+	PriorityNormal
+	// PriorityCritical is for health checks and metrics
+	PriorityCritical
+	numPriorities
+)
+
+// requestPriority classifies a route, without its version prefix. Event
+// streams and WebSockets stay open for minutes, so they are not counted.
+func requestPriority(route string) (priority Priority, counted bool) {
+	switch {
+	case route == "/events" || route == "/ws" || strings.HasSuffix(route, "/events"):
+		return PriorityNormal, false
+	case route == "/health" || route == "/metrics":
+		return PriorityCritical, true
+	case route == "/" || route == "/docs" || route == "/openapi.json" ||
+		strings.HasPrefix(route, "/static/") || strings.HasPrefix(route, problemTypePrefix):
+		return PriorityLow, true
+	}
+	return PriorityNormal, true
+}
+
+// limitAlgorithm adapts the concurrency limit to the latency of each
+// completed request. inFlight counts the request that just completed.
+type limitAlgorithm interface {
+	update(limit float64, rtt time.Duration, inFlight int) float64
+}
+
+// aimdLimit grows the limit by one per limit's worth of requests answered
+// within the target latency, and cuts it by a tenth on each slower one
+type aimdLimit struct {
+	target time.Duration
+}
+
+func (a *aimdLimit) update(limit float64, rtt time.Duration, inFlight int) float64 {
+	if rtt > a.target {
+		return limit * 0.9
+	}
+	// Only grow a limit that is being used
+	if float64(inFlight) < limit/2 {
+		return limit
+	}
+	return limit + 1/limit
+}
+
+// gradientLimit compares the latency of recent requests with the long-term
+// average and shrinks the limit as the ratio falls, allowing a queue of
+// sqrt(limit) on top so that it keeps probing for more
+type gradientLimit struct {
+	shortRTT float64
+	longRTT  float64
+}
+
+const (
+	// gradientShortWindow and gradientLongWindow are the sample counts the
+	// recent and long-term latency averages are taken over
+	gradientShortWindow = 10
+	gradientLongWindow  = 600
+	// gradientTolerance is how much slower than usual requests may get
+	// before the limit shrinks
+	gradientTolerance = 1.5
+	// gradientSmoothing is how far each update moves the limit
+	gradientSmoothing = 0.2
+)
+
+func (g *gradientLimit) update(limit float64, rtt time.Duration, inFlight int) float64 {
+	sample := float64(rtt)
+	if g.longRTT == 0 {
+		g.shortRTT, g.longRTT = sample, sample
+	}
+	g.shortRTT += (sample - g.shortRTT) / gradientShortWindow
+	g.longRTT += (sample - g.longRTT) / gradientLongWindow
+	// Recover quickly once a latency spike is over
+	if g.longRTT > 2*g.shortRTT {
+		g.longRTT *= 0.95
+	}
+
+	// Only grow a limit that is being used
+	if float64(inFlight) < limit/2 {
+		return limit
+	}
+	gradient := math.Max(0.5, math.Min(1, gradientTolerance*g.longRTT/g.shortRTT))
+	next := limit*gradient + math.Sqrt(limit)
+	return limit*(1-gradientSmoothing) + next*gradientSmoothing
+}
+
+// concurrencyWaiter is a request queued for a slot. ready is closed when
+// the request is admitted or evicted by one of higher priority.
+type concurrencyWaiter struct {
+	priority Priority
+	ready    chan struct{}
+	admitted bool
+	elem     *list.Element
+}
+
+// ConcurrencyLimiter caps the requests handled at once. Excess requests
+// wait in a bounded queue, in priority order, until a slot frees up or
+// their deadline passes.
+type ConcurrencyLimiter struct {
+	mu        sync.Mutex
+	limit     float64
+	maxLimit  int
+	inFlight  int
+	queue     [numPriorities]*list.List
+	queued    int
+	maxQueue  int
+	timeout   time.Duration
+	algorithm limitAlgorithm
+	now       func() time.Time
+}
+
+// NewConcurrencyLimiter allows maxLimit requests at once, queueing up to
+// maxQueue more for at most timeout. The fixed algorithm keeps the limit at
+// maxLimit; aimd and gradient adapt it between 1 and maxLimit, and aimd
+// treats requests slower than target as a sign of overload.
+func NewConcurrencyLimiter(algorithm string, maxLimit, maxQueue int, timeout, target time.Duration) (*ConcurrencyLimiter, error) {
+	return newConcurrencyLimiter(algorithm, maxLimit, maxQueue, timeout, target, time.Now)
+}
+
+func newConcurrencyLimiter(algorithm string, maxLimit, maxQueue int, timeout, target time.Duration, now func() time.Time) (*ConcurrencyLimiter, error) {
+	if maxLimit <= 0 {
+		return nil, fmt.Errorf("concurrency limit must be positive, got %d", maxLimit)
+	}
+	cl := &ConcurrencyLimiter{
+		limit:    float64(maxLimit),
+		maxLimit: maxLimit,
+		maxQueue: maxQueue,
+		timeout:  timeout,
+		now:      now,
+	}
+	for i := range cl.queue {
+		cl.queue[i] = list.New()
+	}
+
+	switch algorithm {
+	case concurrencyFixed, "":
+	case concurrencyAIMD:
+		if target <= 0 {
+			return nil, fmt.Errorf("aimd needs a positive latency target, got %v", target)
+		}
+		cl.algorithm = &aimdLimit{target: target}
+	case concurrencyGradient:
+		cl.algorithm = &gradientLimit{}
+	default:
+		return nil, fmt.Errorf("unknown concurrency algorithm %q, want %s, %s or %s",
+			algorithm, concurrencyFixed, concurrencyAIMD, concurrencyGradient)
+	}
+	return cl, nil
+}
+
+// Limit returns the current limit
+func (cl *ConcurrencyLimiter) Limit() int {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	return int(cl.limit)
+}
+
+// Acquire takes a slot for a request of the given priority, waiting in the
+// queue when all are taken. It returns false when the request is shed;
+// otherwise the request must call release when it is done.
+func (cl *ConcurrencyLimiter) Acquire(priority Priority, cancel <-chan struct{}) (release func(), ok bool) {
+	cl.mu.Lock()
+	if cl.inFlight < int(cl.limit) {
+		cl.inFlight++
+		cl.mu.Unlock()
+		return cl.releaser(), true
+	}
+
+	// Make room in a full queue by shedding the newest request of the lowest
+	// priority below this one
+	if cl.queued >= cl.maxQueue && !cl.evictLocked(priority) {
+		cl.mu.Unlock()
+		return nil, false
+	}
+	w := &concurrencyWaiter{priority: priority, ready: make(chan struct{})}
+	w.elem = cl.queue[priority].PushBack(w)
+	cl.queued++
+	cl.mu.Unlock()
+
+	timer := time.NewTimer(cl.timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+	case <-timer.C:
+	case <-cancel:
+	}
+
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+	if w.elem != nil {
+		cl.queue[w.priority].Remove(w.elem)
+		w.elem = nil
+		cl.queued--
+	}
+	if !w.admitted {
+		return nil, false
+	}
+	return cl.releaser(), true
+}
+
+// evictLocked sheds a queued request of lower priority than priority
+func (cl *ConcurrencyLimiter) evictLocked(priority Priority) bool {
+	for p := PriorityLow; p < priority; p++ {
+		if back := cl.queue[p].Back(); back != nil {
+			w := cl.queue[p].Remove(back).(*concurrencyWaiter)
+			w.elem = nil
+			cl.queued--
+			close(w.ready)
+			return true
+		}
+	}
+	return false
+}
+
+// releaser returns the function giving a slot back, which feeds the
+// request's latency to the algorithm
+func (cl *ConcurrencyLimiter) releaser() func() {
+	start := cl.now()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			rtt := cl.now().Sub(start)
+			cl.mu.Lock()
+			defer cl.mu.Unlock()
+			if cl.algorithm != nil {
+				limit := cl.algorithm.update(cl.limit, rtt, cl.inFlight)
+				cl.limit = math.Max(1, math.Min(float64(cl.maxLimit), limit))
+			}
+			cl.inFlight--
+			cl.dispatchLocked()
+		})
+	}
+}
+
+// dispatchLocked admits queued requests, highest priority first, while the
+// limit allows
+func (cl *ConcurrencyLimiter) dispatchLocked() {
+	for p := numPriorities - 1; p >= PriorityLow; p-- {
+		for cl.inFlight < int(cl.limit) {
+			front := cl.queue[p].Front()
+			if front == nil {
+				break
+			}
+			w := cl.queue[p].Remove(front).(*concurrencyWaiter)
+			w.elem = nil
+			w.admitted = true
+			cl.queued--
+			cl.inFlight++
+			close(w.ready)
+		}
+	}
+}
+
+// retryAfter is the Retry-After sent with shed requests: the queue timeout
+// rounded up to whole seconds
+func (cl *ConcurrencyLimiter) retryAfter() string {
+	return strconv.Itoa(max(1, int(math.Ceil(cl.timeout.Seconds()))))
+}
+
+// concurrencyMiddleware sheds requests the limiter has no room for with a
+// 503. It is a no-op without a limiter.
+func (s *Server) concurrencyMiddleware(next http.Handler) http.Handler {
+	if s.concurrency == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route, _ := splitVersion(r.URL.Path)
+		priority, counted := requestPriority(route)
+		if !counted {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		release, ok := s.concurrency.Acquire(priority, r.Context().Done())
+		if !ok {
+			w.Header().Set("Retry-After", s.concurrency.retryAfter())
+			sendErrorResponse(w, "Service Unavailable", "The server is overloaded, retry later", http.StatusServiceUnavailable)
+			s.publishRequestEvent(eventRequestShed, r, http.StatusServiceUnavailable, 0)
+			return
+		}
+		defer release()
+		next.ServeHTTP(w, r)
+	})
+}
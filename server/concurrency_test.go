@@ -0,0 +1,232 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// waitQueued waits until n requests are queued on cl
+func waitQueued(t *testing.T, cl *ConcurrencyLimiter, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		cl.mu.Lock()
+		queued := cl.queued
+		cl.mu.Unlock()
+		if queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%d requests queued, want %d", queued, n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Test admitting queued requests as slots free up and shedding on timeout
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	cl, err := NewConcurrencyLimiter("fixed", 2, 1, 50*time.Millisecond, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first, ok1 := cl.Acquire(PriorityNormal, nil)
+	_, ok2 := cl.Acquire(PriorityNormal, nil)
+	if !ok1 || !ok2 {
+		t.Fatal("requests within the limit were not admitted")
+	}
+
+	admitted := make(chan bool)
+	go func() {
+		release, ok := cl.Acquire(PriorityNormal, nil)
+		if ok {
+			release()
+		}
+		admitted <- ok
+	}()
+	waitQueued(t, cl, 1)
+
+	// The queue is full
+	if _, ok := cl.Acquire(PriorityNormal, nil); ok {
+		t.Error("request beyond the queue was admitted")
+	}
+
+	first()
+	first() // releasing twice frees one slot
+	if !<-admitted {
+		t.Error("queued request was not admitted when a slot freed up")
+	}
+
+	// With every slot taken again, a queued request times out
+	third, _ := cl.Acquire(PriorityNormal, nil)
+	defer third()
+	start := time.Now()
+	if _, ok := cl.Acquire(PriorityNormal, nil); ok {
+		t.Error("request was admitted while all slots were taken")
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("shed after %v, want the 50ms queue timeout", waited)
+	}
+
+	// A cancelled request leaves the queue
+	cancel := make(chan struct{})
+	close(cancel)
+	if _, ok := cl.Acquire(PriorityNormal, cancel); ok {
+		t.Error("cancelled request was admitted")
+	}
+	waitQueued(t, cl, 0)
+}
+
+// Test that higher priorities are admitted first and shed last
+func TestConcurrencyLimiterPriority(t *testing.T) {
+	cl, err := NewConcurrencyLimiter("fixed", 1, 2, 5*time.Second, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	release, _ := cl.Acquire(PriorityNormal, nil)
+
+	type result struct {
+		priority Priority
+		ok       bool
+	}
+	results := make(chan result, 3)
+	acquire := func(p Priority) {
+		release, ok := cl.Acquire(p, nil)
+		results <- result{p, ok}
+		if ok {
+			release()
+		}
+	}
+	go acquire(PriorityLow)
+	waitQueued(t, cl, 1)
+	go acquire(PriorityNormal)
+	waitQueued(t, cl, 2)
+
+	// The full queue makes room for a health check by shedding the low priority request
+	go acquire(PriorityCritical)
+	if r := <-results; r.priority != PriorityLow || r.ok {
+		t.Fatalf("first result = %+v, want the low priority request shed", r)
+	}
+	waitQueued(t, cl, 2)
+
+	// A low priority request cannot displace anything
+	if _, ok := cl.Acquire(PriorityLow, nil); ok {
+		t.Error("low priority request was admitted to a full queue")
+	}
+
+	release()
+	for _, want := range []Priority{PriorityCritical, PriorityNormal} {
+		if r := <-results; r.priority != want || !r.ok {
+			t.Errorf("admitted %+v, want priority %d", r, want)
+		}
+	}
+}
+
+// Test adapting the limit to latency
+func TestConcurrencyLimitAlgorithms(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		// rtts are the latencies of successive rounds of limit requests,
+		// each round running all of them at once
+		rtts []time.Duration
+		want func(limit int) bool
+	}{
+		{"fixed", []time.Duration{time.Second, time.Second}, func(limit int) bool { return limit == 20 }},
+		{"aimd", []time.Duration{time.Second}, func(limit int) bool { return limit < 5 }},
+		{"aimd", []time.Duration{time.Second, 10 * time.Millisecond, 10 * time.Millisecond}, func(limit int) bool { return limit > 1 }},
+		{"aimd", []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}, func(limit int) bool { return limit == 20 }},
+		{"gradient", []time.Duration{10 * time.Millisecond, 10 * time.Millisecond}, func(limit int) bool { return limit == 20 }},
+		{"gradient", []time.Duration{10 * time.Millisecond, 10 * time.Millisecond, 200 * time.Millisecond, 200 * time.Millisecond}, func(limit int) bool { return limit < 15 }},
+	}
+
+	for _, tt := range tests {
+		now := time.Unix(0, 0)
+		cl, err := newConcurrencyLimiter(tt.algorithm, 20, 0, time.Second, 100*time.Millisecond, func() time.Time { return now })
+		if err != nil {
+			t.Fatalf("%s: %v", tt.algorithm, err)
+		}
+		for _, rtt := range tt.rtts {
+			var releases []func()
+			for release, ok := cl.Acquire(PriorityNormal, nil); ok; release, ok = cl.Acquire(PriorityNormal, nil) {
+				releases = append(releases, release)
+			}
+			now = now.Add(rtt)
+			for _, release := range releases {
+				release()
+			}
+		}
+		if limit := cl.Limit(); !tt.want(limit) || limit < 1 || limit > 20 {
+			t.Errorf("%s after %v: limit = %d", tt.algorithm, tt.rtts, limit)
+		}
+	}
+}
+
+// Test rejecting invalid limiter settings
+func TestNewConcurrencyLimiterErrors(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		limit     int
+		target    time.Duration
+	}{
+		{"fixed", 0, 0},
+		{"aimd", 10, 0},
+		{"vegas", 10, time.Second},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewConcurrencyLimiter(tt.algorithm, tt.limit, 0, time.Second, tt.target); err == nil {
+			t.Errorf("NewConcurrencyLimiter(%q, %d, target %v) succeeded", tt.algorithm, tt.limit, tt.target)
+		}
+	}
+}
+
+// Test that the middleware sheds excess requests with 503 and Retry-After
+func TestConcurrencyMiddleware(t *testing.T) {
+	s := newTestServer(t, WithLimits(Limits{ConcurrencyLimit: 1, ConcurrencyQueueTimeout: 1500 * time.Millisecond}))
+
+	entered := make(chan struct{})
+	unblock := make(chan struct{})
+	handler := s.concurrencyMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/v2/power" {
+			entered <- struct{}{}
+			<-unblock
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	serve := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("GET", path, nil))
+		return w
+	}
+
+	done := make(chan struct{})
+	go func() {
+		serve("/v2/power")
+		close(done)
+	}()
+	<-entered
+
+	w := serve("/hello")
+	var problem ErrorResponse
+	json.Unmarshal(w.Body.Bytes(), &problem)
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "2" || problem.Title != "Service Unavailable" {
+		t.Errorf("shed request = %v with Retry-After %q: %s", w.Code, w.Header().Get("Retry-After"), w.Body.String())
+	}
+	if e := s.activity.ring[s.activity.count-1]; e.Type != eventRequestShed || e.Route != "/hello" {
+		t.Errorf("last event = %+v, want request-shed", e)
+	}
+
+	// Event streams are not counted
+	if w := serve("/v2/jobs/abc/events"); w.Code != http.StatusOK {
+		t.Errorf("job events = %v, want 200", w.Code)
+	}
+
+	close(unblock)
+	<-done
+	if w := serve("/health"); w.Code != http.StatusOK {
+		t.Errorf("after the slot was released: status = %v", w.Code)
+	}
+}
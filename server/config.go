@@ -0,0 +1,253 @@
+package server
+
+import (
+	"flag"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Config holds the settings read from the environment at startup
+type Config struct {
+	// Port is the HTTP listen port (PORT)
+	Port string
+	// CacheSize is the number of results kept by the result cache, 0 disables it (CACHE_SIZE)
+	CacheSize int
+	// CacheMaxAge is advertised in Cache-Control for cacheable results (CACHE_MAX_AGE, seconds)
+	CacheMaxAge time.Duration
+	// IdempotencyTTL is how long responses are kept for Idempotency-Key replays (IDEMPOTENCY_TTL, seconds)
+	IdempotencyTTL time.Duration
+	// JobsStateFile is where pending jobs are persisted on shutdown (JOBS_STATE_FILE)
+	JobsStateFile string
+	// CompressionMinSize is the smallest response body that is compressed (COMPRESSION_MIN_SIZE, bytes)
+	CompressionMinSize int
+	// Env is the deployment mode, "development" or "production" (GO_ENV)
+	Env string
+	// PanicStackTrace includes the stack of a recovered panic in its 500 response,
+	// in development mode only (PANIC_STACK_TRACE)
+	PanicStackTrace bool
+	// TLS serves HTTPS; it is implied by TLSCertFile (TLS)
+	TLS bool
+	// TLSCertFile and TLSKeyFile hold the PEM certificate and key, reloaded
+	// when they change (TLS_CERT_FILE, TLS_KEY_FILE)
+	TLSCertFile string
+	TLSKeyFile  string
+	// H2C accepts HTTP/2 without TLS, for traffic behind a proxy (H2C)
+	H2C bool
+	// RedirectPort, when TLS is on, serves plain HTTP redirects to HTTPS (HTTP_REDIRECT_PORT)
+	RedirectPort string
+	// WebhookSecret is the HMAC-SHA256 key signing job callbacks (WEBHOOK_SECRET)
+	WebhookSecret string
+	// WebhookAllowedHosts is the comma separated callback host allowlist (WEBHOOK_ALLOWED_HOSTS)
+	WebhookAllowedHosts string
+	// WebhookMaxAttempts is how often a callback is tried before it is dead-lettered (WEBHOOK_MAX_ATTEMPTS)
+	WebhookMaxAttempts int
+	// RateLimitAlgorithm is how requests are limited per client IP: sliding-window,
+	// sliding-log, token-bucket, gcra or fixed-window (RATE_LIMIT_ALGORITHM)
+	RateLimitAlgorithm string
+	// RateLimit requests are allowed per RateLimitWindow (RATE_LIMIT, RATE_LIMIT_WINDOW seconds)
+	RateLimit       int
+	RateLimitWindow time.Duration
+	// RateLimitBurst is how many requests token-bucket and gcra accept at once, 0 means RateLimit (RATE_LIMIT_BURST)
+	RateLimitBurst int
+	// RateLimitPolicies is a JSON file of per-route and per-client-class policies (RATE_LIMIT_POLICIES)
+	RateLimitPolicies string
+	// RateLimitRedisURL is a Redis server shared by replicas for rate limit state, empty keeps it in memory (RATE_LIMIT_REDIS_URL)
+	RateLimitRedisURL string
+	// RateLimitIPv6Prefix is the prefix length IPv6 clients are limited by, 64 for each /64 (RATE_LIMIT_IPV6_PREFIX)
+	RateLimitIPv6Prefix int
+	// TrustedProxies lists the networks of proxies whose Forwarded and X-Forwarded-For headers are believed (TRUSTED_PROXIES)
+	TrustedProxies string
+	// ConcurrencyLimit is how many requests are handled at once, 0 disables the limit (CONCURRENCY_LIMIT)
+	ConcurrencyLimit int
+	// ConcurrencyQueue requests wait up to ConcurrencyQueueTimeout for a slot before they are shed
+	// (CONCURRENCY_QUEUE, CONCURRENCY_QUEUE_TIMEOUT milliseconds)
+	ConcurrencyQueue        int
+	ConcurrencyQueueTimeout time.Duration
+	// ConcurrencyAlgorithm adapts the limit to latency: fixed, aimd or gradient (CONCURRENCY_ALGORITHM)
+	ConcurrencyAlgorithm string
+	// ConcurrencyLatencyTarget is the latency above which aimd lowers the limit (CONCURRENCY_LATENCY_TARGET, milliseconds)
+	ConcurrencyLatencyTarget time.Duration
+	// BanThreshold violations within BanWindow ban a client: each malformed body and rate limit hit
+	// counts once, each oversized body five times and every ten other 4xx responses once.
+	// Automatic bans are opt-in: the default 0 disables them (BAN_THRESHOLD, BAN_WINDOW seconds)
+	BanThreshold int
+	BanWindow    time.Duration
+	// BanDuration is the first ban of a client, doubling with each further one up to BanMaxDuration
+	// (BAN_DURATION, BAN_MAX_DURATION seconds)
+	BanDuration    time.Duration
+	BanMaxDuration time.Duration
+	// BanAllowlist and BanDenylist are comma separated networks or addresses that are never
+	// banned, and always are (BAN_ALLOWLIST, BAN_DENYLIST)
+	BanAllowlist string
+	BanDenylist  string
+	// BansStateFile keeps the bans across restarts (BANS_STATE_FILE)
+	BansStateFile string
+	// WSAllowedOrigins are the comma separated origins, such as https://app.example.com, that browsers
+	// may open /ws from besides the server's own host; "*" allows any (WS_ALLOWED_ORIGINS)
+	WSAllowedOrigins string
+	// AdminToken is the bearer token for the /admin endpoints, which are disabled without it (ADMIN_TOKEN)
+	AdminToken string
+	// V1DeprecatedAt and V1SunsetAt are announced in the Deprecation and Sunset headers of v1
+	// responses. Each header is left out until its date is set (API_V1_DEPRECATED_AT,
+	// API_V1_SUNSET_AT, YYYY-MM-DD)
+	V1DeprecatedAt time.Time
+	V1SunsetAt     time.Time
+}
+
+// defaultConfig is used for anything the environment does not set
+var defaultConfig = Config{
+	Port:           "8080",
+	CacheSize:      1000,
+	CacheMaxAge:    time.Hour,
+	IdempotencyTTL: 24 * time.Hour,
+	// Below about 1 KB the gzip framing costs more than it saves
+	CompressionMinSize:  1024,
+	Env:                 "production",
+	WebhookMaxAttempts:  5,
+	RateLimitAlgorithm:  "sliding-window",
+	RateLimit:           100,
+	RateLimitWindow:     time.Minute,
+	RateLimitIPv6Prefix: 128,
+	// Enough for bursts of quick calculations, while a flood waits or is
+	// shed long before the 15 second timeouts
+	ConcurrencyLimit:         200,
+	ConcurrencyQueue:         400,
+	ConcurrencyQueueTimeout:  time.Second,
+	ConcurrencyAlgorithm:     concurrencyFixed,
+	ConcurrencyLatencyTarget: 500 * time.Millisecond,
+	BanWindow:                time.Minute,
+	BanDuration:              5 * time.Minute,
+	BanMaxDuration:           24 * time.Hour,
+}
+
+// LoadConfig reads the configuration from environment variables, falling
+// back to defaultConfig for unset or invalid values
+func LoadConfig() Config {
+	cfg := defaultConfig
+	if port := os.Getenv("PORT"); port != "" {
+		cfg.Port = port
+	}
+	cfg.CacheSize = envInt("CACHE_SIZE", cfg.CacheSize)
+	cfg.CacheMaxAge = time.Duration(envInt("CACHE_MAX_AGE", int(cfg.CacheMaxAge/time.Second))) * time.Second
+	cfg.IdempotencyTTL = time.Duration(envInt("IDEMPOTENCY_TTL", int(cfg.IdempotencyTTL/time.Second))) * time.Second
+	cfg.JobsStateFile = os.Getenv("JOBS_STATE_FILE")
+	cfg.CompressionMinSize = envInt("COMPRESSION_MIN_SIZE", cfg.CompressionMinSize)
+	if env := os.Getenv("GO_ENV"); env != "" {
+		cfg.Env = env
+	}
+	cfg.PanicStackTrace = envBool("PANIC_STACK_TRACE", cfg.PanicStackTrace)
+	cfg.TLS = envBool("TLS", cfg.TLS)
+	cfg.TLSCertFile = os.Getenv("TLS_CERT_FILE")
+	cfg.TLSKeyFile = os.Getenv("TLS_KEY_FILE")
+	cfg.H2C = envBool("H2C", cfg.H2C)
+	cfg.RedirectPort = os.Getenv("HTTP_REDIRECT_PORT")
+	cfg.WebhookSecret = os.Getenv("WEBHOOK_SECRET")
+	cfg.WebhookAllowedHosts = os.Getenv("WEBHOOK_ALLOWED_HOSTS")
+	cfg.WebhookMaxAttempts = envInt("WEBHOOK_MAX_ATTEMPTS", cfg.WebhookMaxAttempts)
+	if algorithm := os.Getenv("RATE_LIMIT_ALGORITHM"); algorithm != "" {
+		cfg.RateLimitAlgorithm = algorithm
+	}
+	cfg.RateLimit = envInt("RATE_LIMIT", cfg.RateLimit)
+	cfg.RateLimitWindow = time.Duration(envInt("RATE_LIMIT_WINDOW", int(cfg.RateLimitWindow/time.Second))) * time.Second
+	cfg.RateLimitBurst = envInt("RATE_LIMIT_BURST", cfg.RateLimitBurst)
+	cfg.RateLimitPolicies = os.Getenv("RATE_LIMIT_POLICIES")
+	cfg.RateLimitRedisURL = os.Getenv("RATE_LIMIT_REDIS_URL")
+	cfg.RateLimitIPv6Prefix = envInt("RATE_LIMIT_IPV6_PREFIX", cfg.RateLimitIPv6Prefix)
+	cfg.TrustedProxies = os.Getenv("TRUSTED_PROXIES")
+	cfg.ConcurrencyLimit = envInt("CONCURRENCY_LIMIT", cfg.ConcurrencyLimit)
+	cfg.ConcurrencyQueue = envInt("CONCURRENCY_QUEUE", cfg.ConcurrencyQueue)
+	cfg.ConcurrencyQueueTimeout = time.Duration(envInt("CONCURRENCY_QUEUE_TIMEOUT", int(cfg.ConcurrencyQueueTimeout/time.Millisecond))) * time.Millisecond
+	if algorithm := os.Getenv("CONCURRENCY_ALGORITHM"); algorithm != "" {
+		cfg.ConcurrencyAlgorithm = algorithm
+	}
+	cfg.ConcurrencyLatencyTarget = time.Duration(envInt("CONCURRENCY_LATENCY_TARGET", int(cfg.ConcurrencyLatencyTarget/time.Millisecond))) * time.Millisecond
+	cfg.BanThreshold = envInt("BAN_THRESHOLD", cfg.BanThreshold)
+	cfg.BanWindow = time.Duration(envInt("BAN_WINDOW", int(cfg.BanWindow/time.Second))) * time.Second
+	cfg.BanDuration = time.Duration(envInt("BAN_DURATION", int(cfg.BanDuration/time.Second))) * time.Second
+	cfg.BanMaxDuration = time.Duration(envInt("BAN_MAX_DURATION", int(cfg.BanMaxDuration/time.Second))) * time.Second
+	cfg.BanAllowlist = os.Getenv("BAN_ALLOWLIST")
+	cfg.BanDenylist = os.Getenv("BAN_DENYLIST")
+	cfg.BansStateFile = os.Getenv("BANS_STATE_FILE")
+	cfg.WSAllowedOrigins = os.Getenv("WS_ALLOWED_ORIGINS")
+	cfg.AdminToken = os.Getenv("ADMIN_TOKEN")
+	cfg.V1DeprecatedAt = envDate("API_V1_DEPRECATED_AT", cfg.V1DeprecatedAt)
+	cfg.V1SunsetAt = envDate("API_V1_SUNSET_AT", cfg.V1SunsetAt)
+	return cfg
+}
+
+// ParseFlags applies command line flags on top of the configuration read
+// from the environment
+func (cfg *Config) ParseFlags(args []string) error {
+	fs := flag.NewFlagSet("go-server", flag.ContinueOnError)
+	fs.StringVar(&cfg.Port, "port", cfg.Port, "HTTP listen port")
+	fs.StringVar(&cfg.Env, "env", cfg.Env, `deployment mode, "development" generates a self-signed certificate`)
+	fs.BoolVar(&cfg.TLS, "tls", cfg.TLS, "serve HTTPS")
+	fs.StringVar(&cfg.TLSCertFile, "tls-cert", cfg.TLSCertFile, "PEM certificate file")
+	fs.StringVar(&cfg.TLSKeyFile, "tls-key", cfg.TLSKeyFile, "PEM private key file")
+	fs.BoolVar(&cfg.H2C, "h2c", cfg.H2C, "accept HTTP/2 without TLS")
+	fs.StringVar(&cfg.RedirectPort, "redirect-port", cfg.RedirectPort, "port redirecting plain HTTP to HTTPS")
+	return fs.Parse(args)
+}
+
+// TLSEnabled reports whether the server should serve HTTPS
+func (cfg Config) TLSEnabled() bool {
+	return cfg.TLS || cfg.TLSCertFile != ""
+}
+
+// Rate returns the per-client rate limit
+func (cfg Config) Rate() Rate {
+	return Rate{Limit: cfg.RateLimit, Window: cfg.RateLimitWindow, Burst: cfg.RateLimitBurst}
+}
+
+// Development reports whether the server runs in development mode
+func (cfg Config) Development() bool {
+	return cfg.Env == "development"
+}
+
+// envInt reads a non-negative integer environment variable
+func envInt(name string, fallback int) int {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		log.Printf("Ignoring invalid %s=%q, using %d", name, value, fallback)
+		return fallback
+	}
+	return n
+}
+
+// envBool reads a boolean environment variable such as "true" or "1"
+func envBool(name string, fallback bool) bool {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Printf("Ignoring invalid %s=%q, using %t", name, value, fallback)
+		return fallback
+	}
+	return b
+}
+
+// envDate reads a date environment variable such as "2026-10-18", as UTC midnight
+func envDate(name string, fallback time.Time) time.Time {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	t, err := time.Parse(time.DateOnly, value)
+	if err != nil {
+		if fallback.IsZero() {
+			log.Printf("Ignoring invalid %s=%q, leaving it unset", name, value)
+		} else {
+			log.Printf("Ignoring invalid %s=%q, using %s", name, value, fallback.Format(time.DateOnly))
+		}
+		return fallback
+	}
+	return t
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+// Test reading configuration from the environment
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("PORT", "9090")
+	t.Setenv("CACHE_SIZE", "50")
+	t.Setenv("CACHE_MAX_AGE", "not-a-number")
+	t.Setenv("IDEMPOTENCY_TTL", "60")
+	t.Setenv("JOBS_STATE_FILE", "/tmp/jobs.json")
+	t.Setenv("COMPRESSION_MIN_SIZE", "-1")
+	t.Setenv("GO_ENV", "development")
+	t.Setenv("PANIC_STACK_TRACE", "true")
+	t.Setenv("TLS", "yes")
+	t.Setenv("H2C", "1")
+	t.Setenv("WEBHOOK_MAX_ATTEMPTS", "3")
+	t.Setenv("ADMIN_TOKEN", "s3cret")
+	t.Setenv("WS_ALLOWED_ORIGINS", "https://app.example.com")
+	t.Setenv("RATE_LIMIT_ALGORITHM", "gcra")
+	t.Setenv("RATE_LIMIT", "10")
+	t.Setenv("RATE_LIMIT_BURST", "20")
+	t.Setenv("RATE_LIMIT_POLICIES", "policies.json")
+	t.Setenv("RATE_LIMIT_REDIS_URL", "redis://cache:6379/1")
+	t.Setenv("RATE_LIMIT_IPV6_PREFIX", "64")
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	t.Setenv("CONCURRENCY_LIMIT", "50")
+	t.Setenv("CONCURRENCY_QUEUE_TIMEOUT", "250")
+	t.Setenv("CONCURRENCY_ALGORITHM", "gradient")
+	t.Setenv("BAN_THRESHOLD", "10")
+	t.Setenv("BAN_DURATION", "60")
+	t.Setenv("BAN_DENYLIST", "198.51.100.0/24")
+	t.Setenv("BANS_STATE_FILE", "/tmp/bans.json")
+	t.Setenv("API_V1_DEPRECATED_AT", "2026-11-01")
+	t.Setenv("API_V1_SUNSET_AT", "next spring")
+
+	cfg := LoadConfig()
+	want := Config{Port: "9090", CacheSize: 50, CacheMaxAge: time.Hour, IdempotencyTTL: time.Minute, JobsStateFile: "/tmp/jobs.json", CompressionMinSize: 1024,
+		Env: "development", PanicStackTrace: true, H2C: true, WebhookMaxAttempts: 3, AdminToken: "s3cret", WSAllowedOrigins: "https://app.example.com",
+		RateLimitAlgorithm: "gcra", RateLimit: 10, RateLimitWindow: time.Minute, RateLimitBurst: 20, RateLimitPolicies: "policies.json",
+		RateLimitRedisURL: "redis://cache:6379/1", RateLimitIPv6Prefix: 64, TrustedProxies: "10.0.0.0/8",
+		ConcurrencyLimit: 50, ConcurrencyQueue: 400, ConcurrencyQueueTimeout: 250 * time.Millisecond, ConcurrencyAlgorithm: "gradient", ConcurrencyLatencyTarget: 500 * time.Millisecond,
+		BanThreshold: 10, BanWindow: time.Minute, BanDuration: time.Minute, BanMaxDuration: 24 * time.Hour, BanDenylist: "198.51.100.0/24", BansStateFile: "/tmp/bans.json",
+		V1DeprecatedAt: time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC), V1SunsetAt: time.Time{}}
+	if cfg != want {
+		t.Errorf("LoadConfig() = %+v, want %+v", cfg, want)
+	}
+}
+
+// Test that command line flags override the environment
+func TestParseFlags(t *testing.T) {
+	cfg := defaultConfig
+	cfg.Port = "9090"
+	args := []string{"-tls-cert", "cert.pem", "-tls-key", "key.pem", "-redirect-port", "8080", "-port", "8443"}
+	if err := cfg.ParseFlags(args); err != nil {
+		t.Fatalf("ParseFlags failed: %v", err)
+	}
+	if cfg.Port != "8443" || cfg.TLSCertFile != "cert.pem" || cfg.TLSKeyFile != "key.pem" || cfg.RedirectPort != "8080" {
+		t.Errorf("ParseFlags = %+v", cfg)
+	}
+	if !cfg.TLSEnabled() || cfg.Development() {
+		t.Errorf("TLSEnabled = %t, Development = %t, want true and false", cfg.TLSEnabled(), cfg.Development())
+	}
+
+	if err := cfg.ParseFlags([]string{"-no-such-flag"}); err == nil {
+		t.Error("an unknown flag should fail")
+	}
+}
@@ -0,0 +1,399 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Activity event types published on /events
+const (
+	eventRequestCompleted  = "request-completed"
+	eventRateLimitRejected = "rate-limit-rejected"
+	eventFormSubmitted     = "form-submitted"
+	eventOverflowDetected  = "overflow-detected"
+	eventRequestShed       = "request-shed"
+	eventClientBanned      = "client-banned"
+)
+
+var activityEventTypes = []string{eventRequestCompleted, eventRateLimitRejected, eventFormSubmitted, eventOverflowDetected, eventRequestShed, eventClientBanned}
+
+const (
+	// activityBufferSize is how many recent events are kept for Last-Event-ID resume
+	activityBufferSize = 1000
+	// activitySubscriberBuffer is how far a stream may fall behind before it
+	// is closed; the client reconnects and resumes from the ring buffer
+	activitySubscriberBuffer = 256
+	// maxStreamsPerClient bounds the concurrent /events streams of one client IP
+	maxStreamsPerClient = 5
+	// activityHeartbeat keeps idle streams from being closed by proxies
+	activityHeartbeat = 15 * time.Second
+)
+
+var (
+	errTooManyStreams = errors.New("too many event streams")
+	errActivityClosed = errors.New("activity hub is closed")
+)
+
+// ActivityEvent is one server activity published on /events. Route is the
+// API route without its version prefix.
+type ActivityEvent struct {
+	ID         uint64    `json:"id"`
+	Type       string    `json:"type"`
+	Time       time.Time `json:"time"`
+	Route      string    `json:"route,omitempty"`
+	Version    string    `json:"version,omitempty"`
+	Method     string    `json:"method,omitempty"`
+	Status     int       `json:"status,omitempty"`
+	DurationMs float64   `json:"duration_ms,omitempty"`
+	ClientIP   string    `json:"client_ip,omitempty"`
+}
+
+// activityFilter selects the events a stream receives. Empty lists match
+// everything; a route ending in "*" matches by prefix.
+type activityFilter struct {
+	types  []string
+	routes []string
+}
+
+func (f activityFilter) matches(e ActivityEvent) bool {
+	if len(f.types) > 0 && !containsString(f.types, e.Type) {
+		return false
+	}
+	if len(f.routes) == 0 {
+		return true
+	}
+	for _, pattern := range f.routes {
+		if routeMatches(pattern, e.Route) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// activitySubscriber is one open /events stream
+type activitySubscriber struct {
+	ch     chan ActivityEvent
+	filter activityFilter
+	client string
+}
+
+// ActivityHub fans activity events out to the open streams and keeps the
+// most recent ones in a ring buffer so reconnecting clients can resume
+type ActivityHub struct {
+	mu          sync.Mutex
+	ring        []ActivityEvent
+	head        int // index of the oldest event in ring
+	count       int
+	nextID      uint64
+	subscribers map[*activitySubscriber]struct{}
+	perClient   map[string]int
+	closed      bool
+}
+
+// NewActivityHub creates a hub remembering the last size events
+func NewActivityHub(size int) *ActivityHub {
+	return &ActivityHub{
+		ring:        make([]ActivityEvent, size),
+		nextID:      1,
+		subscribers: make(map[*activitySubscriber]struct{}),
+		perClient:   make(map[string]int),
+	}
+}
+
+// Publish assigns the event an ID, stores it and sends it to every
+// matching stream. A stream too far behind to take it is closed.
+func (h *ActivityHub) Publish(e ActivityEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	e.ID = h.nextID
+	h.nextID++
+	if e.Time.IsZero() {
+		e.Time = time.Now().UTC()
+	}
+	if len(h.ring) > 0 {
+		if h.count < len(h.ring) {
+			h.ring[(h.head+h.count)%len(h.ring)] = e
+			h.count++
+		} else {
+			h.ring[h.head] = e
+			h.head = (h.head + 1) % len(h.ring)
+		}
+	}
+
+	for sub := range h.subscribers {
+		if !sub.filter.matches(e) {
+			continue
+		}
+		select {
+		case sub.ch <- e:
+		default:
+			h.removeLocked(sub)
+		}
+	}
+}
+
+// Subscribe opens a stream for client. It returns the buffered events
+// after lastID that match filter, and whether events after lastID were
+// already dropped from the ring buffer.
+func (h *ActivityHub) Subscribe(client string, filter activityFilter, lastID uint64) (*activitySubscriber, []ActivityEvent, bool, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.closed {
+		return nil, nil, false, errActivityClosed
+	}
+	if h.perClient[client] >= maxStreamsPerClient {
+		return nil, nil, false, errTooManyStreams
+	}
+
+	var backlog []ActivityEvent
+	missed := false
+	if lastID > 0 {
+		for i := 0; i < h.count; i++ {
+			e := h.ring[(h.head+i)%len(h.ring)]
+			if i == 0 && e.ID > lastID+1 {
+				missed = true
+			}
+			if e.ID > lastID && filter.matches(e) {
+				backlog = append(backlog, e)
+			}
+		}
+	}
+
+	sub := &activitySubscriber{ch: make(chan ActivityEvent, activitySubscriberBuffer), filter: filter, client: client}
+	h.subscribers[sub] = struct{}{}
+	h.perClient[client]++
+	return sub, backlog, missed, nil
+}
+
+// Unsubscribe ends a stream; it is safe to call more than once
+func (h *ActivityHub) Unsubscribe(sub *activitySubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.removeLocked(sub)
+}
+
+func (h *ActivityHub) removeLocked(sub *activitySubscriber) {
+	if _, ok := h.subscribers[sub]; !ok {
+		return
+	}
+	delete(h.subscribers, sub)
+	close(sub.ch)
+	if h.perClient[sub.client]--; h.perClient[sub.client] <= 0 {
+		delete(h.perClient, sub.client)
+	}
+}
+
+// Close ends every stream and refuses new ones. It is registered with
+// http.Server.RegisterOnShutdown, which does not wait for streams to end.
+func (h *ActivityHub) Close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.closed = true
+	for sub := range h.subscribers {
+		h.removeLocked(sub)
+	}
+}
+
+// publishRequestEvent publishes an event about r
+func (s *Server) publishRequestEvent(eventType string, r *http.Request, status int, duration time.Duration) {
+	route, version := splitVersion(requestPath(r))
+	e := ActivityEvent{Type: eventType, Route: route, Version: version, Method: r.Method, Status: status, ClientIP: s.clientIP(r)}
+	if duration > 0 {
+		e.DurationMs = float64(duration.Microseconds()) / 1000
+	}
+	s.activity.Publish(e)
+}
+
+// resultOverflowed reports whether a calculation result overflowed
+func resultOverflowed(result interface{}) bool {
+	switch res := result.(type) {
+	case MultiplyResult:
+		return res.Overflow
+	case MultiplyArrayResult:
+		return res.Overflow
+	}
+	return false
+}
+
+// parseActivityFilter reads the type and route query parameters, each a
+// comma separated list
+func parseActivityFilter(r *http.Request) (activityFilter, error) {
+	var filter activityFilter
+	split := func(value string) []string {
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = append(list, item)
+			}
+		}
+		return list
+	}
+
+	query := r.URL.Query()
+	filter.types = split(query.Get("type"))
+	filter.routes = split(query.Get("route"))
+	for _, t := range filter.types {
+		if !containsString(activityEventTypes, t) {
+			message := "must be one of " + strings.Join(activityEventTypes, ", ")
+			return filter, &ValidationError{
+				Message: fmt.Sprintf("Unknown event type %q", t),
+				Fields:  []FieldError{{Field: "type", Reason: reasonInvalidFormat, Message: message}},
+			}
+		}
+	}
+	return filter, nil
+}
+
+// eventsHandler handles GET /events, a Server-Sent Events stream of server
+// activity. Each event's id can be sent back as Last-Event-ID (or the
+// last_event_id query parameter) to resume after a disconnect from the
+// events still buffered.
+func (s *Server) eventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/events" {
+		sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+		return
+	}
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	filter, err := parseActivityFilter(r)
+	if err != nil {
+		sendValidationError(w, err)
+		return
+	}
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	var lastID uint64
+	if lastEventID != "" {
+		if lastID, err = strconv.ParseUint(lastEventID, 10, 64); err != nil {
+			sendErrorResponse(w, "Bad Request", "Last-Event-ID must be an event id", http.StatusBadRequest)
+			return
+		}
+	}
+
+	sub, backlog, missed, err := s.activity.Subscribe(s.clientIP(r), filter, lastID)
+	switch {
+	case errors.Is(err, errTooManyStreams):
+		w.Header().Set("Retry-After", strconv.Itoa(int(activityHeartbeat/time.Second)))
+		sendErrorResponse(w, "Rate limit exceeded", fmt.Sprintf("At most %d event streams per client", maxStreamsPerClient), http.StatusTooManyRequests)
+		return
+	case err != nil:
+		sendErrorResponse(w, "Service Unavailable", "Server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer s.activity.Unsubscribe(sub)
+
+	// The stream outlives the server's WriteTimeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	if missed {
+		fmt.Fprintf(w, ": events after %d are no longer buffered\n\n", lastID)
+	}
+	send := func(e ActivityEvent) error {
+		data, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", e.Type, e.ID, data)
+		return err
+	}
+	for _, e := range backlog {
+		if send(e) != nil {
+			return
+		}
+	}
+	if rc.Flush() != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(activityHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil || rc.Flush() != nil {
+				return
+			}
+		case e, ok := <-sub.ch:
+			// A closed channel means shutdown or a stream that fell behind
+			if !ok || send(e) != nil || rc.Flush() != nil {
+				return
+			}
+		}
+	}
+}
+
+// statusWriter records the status code for the request-completed event
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+// Flush implements http.Flusher when the underlying writer supports it
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so WebSocket upgrades work through the wrapper
+func (sw *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := sw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err == nil {
+		sw.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Unwrap lets http.ResponseController and findResponseWriter reach the wrapped writer
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,245 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// openEvents opens an /events stream on srv and returns a function reading
+// its next event
+func openEvents(t *testing.T, srv *httptest.Server, query string, header http.Header) (*http.Response, func() (ActivityEvent, bool)) {
+	t.Helper()
+	req, _ := http.NewRequest("GET", srv.URL+"/events"+query, nil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET /events error: %v", err)
+	}
+	t.Cleanup(func() { resp.Body.Close() })
+
+	scanner := bufio.NewScanner(resp.Body)
+	next := func() (ActivityEvent, bool) {
+		for scanner.Scan() {
+			if data, ok := strings.CutPrefix(scanner.Text(), "data: "); ok {
+				var e ActivityEvent
+				if err := json.Unmarshal([]byte(data), &e); err != nil {
+					t.Fatalf("Invalid event data: %v", err)
+				}
+				return e, true
+			}
+		}
+		return ActivityEvent{}, false
+	}
+	return resp, next
+}
+
+// Test matching events against type and route filters
+func TestActivityFilter(t *testing.T) {
+	e := ActivityEvent{Type: eventRequestCompleted, Route: "/multiply/array"}
+
+	tests := []struct {
+		filter activityFilter
+		want   bool
+	}{
+		{activityFilter{}, true},
+		{activityFilter{types: []string{eventRequestCompleted}}, true},
+		{activityFilter{types: []string{eventFormSubmitted, eventOverflowDetected}}, false},
+		{activityFilter{routes: []string{"/multiply/array"}}, true},
+		{activityFilter{routes: []string{"/multiply"}}, false},
+		{activityFilter{routes: []string{"/power", "/multiply*"}}, true},
+		{activityFilter{types: []string{eventRequestCompleted}, routes: []string{"/factorial"}}, false},
+	}
+
+	for _, tt := range tests {
+		if got := tt.filter.matches(e); got != tt.want {
+			t.Errorf("%+v matches = %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+}
+
+// Test replaying buffered events after a Last-Event-ID
+func TestActivityResume(t *testing.T) {
+	h := NewActivityHub(3)
+	for _, route := range []string{"/a", "/b", "/a", "/b", "/a"} {
+		h.Publish(ActivityEvent{Type: eventRequestCompleted, Route: route})
+	}
+
+	tests := []struct {
+		lastID uint64
+		filter activityFilter
+		want   []uint64
+		missed bool
+	}{
+		{0, activityFilter{}, nil, false},
+		{4, activityFilter{}, []uint64{5}, false},
+		{2, activityFilter{}, []uint64{3, 4, 5}, false},
+		{1, activityFilter{}, []uint64{3, 4, 5}, true},
+		{1, activityFilter{routes: []string{"/a"}}, []uint64{3, 5}, true},
+	}
+
+	for _, tt := range tests {
+		sub, backlog, missed, err := h.Subscribe("client", tt.filter, tt.lastID)
+		if err != nil {
+			t.Fatalf("Subscribe error: %v", err)
+		}
+		h.Unsubscribe(sub)
+
+		var ids []uint64
+		for _, e := range backlog {
+			ids = append(ids, e.ID)
+		}
+		if len(ids) != len(tt.want) || missed != tt.missed {
+			t.Errorf("after %d: ids %v missed %v, want %v %v", tt.lastID, ids, missed, tt.want, tt.missed)
+			continue
+		}
+		for i := range ids {
+			if ids[i] != tt.want[i] {
+				t.Errorf("after %d: ids %v, want %v", tt.lastID, ids, tt.want)
+				break
+			}
+		}
+	}
+}
+
+// Test streaming filtered events published by the middleware and handlers
+func TestActivityStream(t *testing.T) {
+	s := newTestServer(t)
+	h := s.activity
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	resp, next := openEvents(t, srv, "?type=request-completed,overflow-detected&route=/multiply*", nil)
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("GET /events = %v %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+
+	post := func(path, body string) {
+		resp, err := http.Post(srv.URL+path, "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("POST %s error: %v", path, err)
+		}
+		resp.Body.Close()
+	}
+	post("/v2/factorial", `{"number":5}`)
+	post("/v2/multiply/array", `{"numbers":[`+strings.Repeat("1e10,", 40)+`1]}`)
+	post("/v1/multiply", `{"a":"x"}`)
+
+	want := []ActivityEvent{
+		{Type: eventOverflowDetected, Route: "/multiply/array", Version: apiV2},
+		{Type: eventRequestCompleted, Route: "/multiply/array", Version: apiV2, Status: http.StatusOK},
+		{Type: eventRequestCompleted, Route: "/multiply", Version: apiV1, Status: http.StatusBadRequest},
+	}
+	var lastID uint64
+	for _, w := range want {
+		e, ok := next()
+		if !ok {
+			t.Fatalf("stream ended, want %+v", w)
+		}
+		if e.Type != w.Type || e.Route != w.Route || e.Version != w.Version || e.Status != w.Status || e.Method != http.MethodPost || e.ID <= lastID {
+			t.Errorf("event = %+v, want %+v", e, w)
+		}
+		lastID = e.ID
+	}
+
+	// Resuming replays what was published since the given event
+	_, resumed := openEvents(t, srv, "", http.Header{"Last-Event-Id": {"1"}})
+	if e, ok := resumed(); !ok || e.ID != 2 {
+		t.Errorf("first resumed event = %+v, want id 2", e)
+	}
+
+	// Closing the hub, as shutdown does, ends the streams
+	h.Close()
+	done := make(chan struct{})
+	go func() {
+		for _, ok := next(); ok; _, ok = next() {
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("stream did not end after Close")
+	}
+	if _, _, _, err := h.Subscribe("client", activityFilter{}, 0); err != errActivityClosed {
+		t.Errorf("Subscribe after Close error = %v, want %v", err, errActivityClosed)
+	}
+}
+
+// Test rate limit, form and request errors on /events
+func TestActivityEvents(t *testing.T) {
+	// The client below has used up its quota of the limiter
+	limited := "198.51.100.7"
+	rl, _ := NewRateLimiter("fixed-window", Rate{Limit: 10, Window: time.Minute})
+	defer rl.Close()
+	rl.Allow(limited, 10)
+
+	s := newTestServer(t, WithTrustedProxies("192.0.2.0/24"), WithLimiter(rl))
+	h := s.activity
+	handler := s.loggingMiddleware(s.rateLimitMiddleware(s.newRouter()))
+	serve := func(method, path, body string, header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Rejections by the rate limiter are published
+	w := serve("GET", "/health", "", http.Header{"X-Forwarded-For": {limited}})
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusTooManyRequests)
+	}
+
+	// Form submissions are published without the submitted values
+	w = serve("POST", "/form", `{"name":"Ada Lovelace","address":"12 St James's Square"}`, http.Header{"Content-Type": {"application/json"}})
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /form = %v: %s", w.Code, w.Body.String())
+	}
+
+	var events []ActivityEvent
+	for i := 0; i < h.count; i++ {
+		if e := h.ring[i]; e.Type != eventRequestCompleted {
+			events = append(events, e)
+		}
+	}
+	if len(events) != 2 || events[0].Type != eventRateLimitRejected || events[0].ClientIP != limited || events[0].Status != http.StatusTooManyRequests || events[1].Type != eventFormSubmitted {
+		t.Fatalf("events = %+v", events)
+	}
+	if data, _ := json.Marshal(events[1]); strings.Contains(string(data), "Ada") {
+		t.Errorf("form event %s contains the submission", data)
+	}
+
+	// Unknown types and invalid ids are rejected
+	if w := serve("GET", "/events?type=request-completed,bogus", "", nil); w.Code != http.StatusBadRequest {
+		t.Errorf("unknown type status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if w := serve("GET", "/events", "", http.Header{"Last-Event-Id": {"abc"}}); w.Code != http.StatusBadRequest {
+		t.Errorf("invalid Last-Event-ID status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if w := serve("POST", "/events", "", nil); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("POST status = %v, want %v", w.Code, http.StatusMethodNotAllowed)
+	}
+
+	// Each client may keep only a few streams open
+	client := "203.0.113.9"
+	for i := 0; i < maxStreamsPerClient; i++ {
+		sub, _, _, err := h.Subscribe(client, activityFilter{}, 0)
+		if err != nil {
+			t.Fatalf("stream %d: %v", i, err)
+		}
+		defer h.Unsubscribe(sub)
+	}
+	if w := serve("GET", "/events", "", http.Header{"X-Forwarded-For": {client}}); w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("extra stream status = %v, want %v with Retry-After", w.Code, http.StatusTooManyRequests)
+	}
+}
@@ -0,0 +1,656 @@
+package server
+
+import (
+        "fmt"
+        "html"
+        "mime"
+        "net/http"
+        "strings"
+        "time"
+
+        "go-server/api"
+        "go-server/arith"
+)
+
+// ErrorResponse represents a standardized error response (see api.ErrorResponse)
+type ErrorResponse = api.ErrorResponse
+
+// Middleware for logging requests
+func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                start := time.Now()
+
+                // Get client IP
+                clientIP := s.clientIP(r)
+
+                // Add security headers
+                w.Header().Set("X-Content-Type-Options", "nosniff")
+                w.Header().Set("X-Frame-Options", "DENY")
+                w.Header().Set("X-XSS-Protection", "1; mode=block")
+                w.Header().Set("Referrer-Policy", "strict-origin-when-cross-origin")
+
+                sw := &statusWriter{ResponseWriter: w}
+                next.ServeHTTP(sw, r)
+
+                // Log the request and publish it on /events, except for
+                // the event streams themselves
+                duration := time.Since(start)
+                if r.URL.Path != "/events" {
+                        s.publishRequestEvent(eventRequestCompleted, r, sw.status, duration)
+                }
+                logf(s.logger, RequestID(r.Context()), "[%s] %s %s %s - %v",
+                        s.clock().Format("2006-01-02 15:04:05"),
+                        clientIP,
+                        r.Method,
+                        r.URL.Path,
+                        duration)
+        })
+}
+
+// Send standardized error response
+func sendErrorResponse(w http.ResponseWriter, error, message string, code int) {
+        sendProblem(w, error, message, code, nil)
+}
+
+// Sanitize input to prevent XSS
+func sanitizeInput(input string) string {
+        // Remove leading/trailing whitespace
+        input = strings.TrimSpace(input)
+        // Escape HTML characters
+        input = html.EscapeString(input)
+        // Limit length
+        if len(input) > 100 {
+                input = input[:100]
+        }
+        return input
+}
+
+// FormRequest represents a /form submission sent with a codec instead of form encoding
+type FormRequest struct {
+        Name    string `json:"name" required:"true" minLength:"1" maxLength:"100"`
+        Address string `json:"address" required:"true" minLength:"1" maxLength:"200"`
+}
+
+// isFormContentType reports whether a Content-Type is HTML form encoding.
+// A missing Content-Type keeps the original form (and query string) parsing.
+func isFormContentType(contentType string) bool {
+        if contentType == "" {
+                return true
+        }
+        mt, _, err := mime.ParseMediaType(contentType)
+        if err != nil {
+                return false
+        }
+        return mt == "application/x-www-form-urlencoded" || mt == "multipart/form-data"
+}
+
+// Validate form input
+func validateFormInput(name, address string) error {
+        req := FormRequest{Name: name, Address: address}
+        if len(strings.TrimSpace(name)) == 0 {
+                return invalid("name is required", req)
+        }
+        if len(strings.TrimSpace(address)) == 0 {
+                return invalid("address is required", req)
+        }
+        if len(name) > 100 {
+                return invalid("name must be less than 100 characters", req)
+        }
+        if len(address) > 200 {
+                return invalid("address must be less than 200 characters", req)
+        }
+        return nil
+}
+
+// apiRoute describes one API endpoint. The same table drives routing and the
+// OpenAPI document served at /openapi.json, so the two cannot drift apart.
+// Response, Envelope and Message describe the v1 body; under /v2 every
+// Response is wrapped in the uniform Envelope instead.
+type apiRoute struct {
+        Path        string
+        Method      string
+        Summary     string
+        Handler     func(*Server, http.ResponseWriter, *http.Request)
+        Request     interface{} // request body type, nil when there is no body
+        Response    interface{} // response "data" payload type
+        Envelope    bool        // wrap Response in {"success": true, "data": ...}
+        Message     bool        // the envelope also carries a "message"
+        ContentType string      // non-codec response type such as text/plain
+        Query       bool        // also served as GET with the request fields as query parameters
+}
+
+// apiRoutes lists every API endpoint
+var apiRoutes = []apiRoute{
+        {Path: "/hello", Method: http.MethodGet, Summary: "Simple greeting", Handler: (*Server).helloHandler, Response: "", ContentType: "text/plain"},
+        {Path: "/health", Method: http.MethodGet, Summary: "Service health check", Handler: (*Server).healthHandler, Response: HealthResponse{}},
+        {Path: rateLimitStatusPath, Method: http.MethodGet, Summary: "Remaining rate limit quota of the caller", Handler: (*Server).rateLimitStatusHandler, Response: RateLimitStatus{}},
+        {Path: "/form", Method: http.MethodPost, Summary: "Submit the contact form", Handler: (*Server).formHandler, Request: FormRequest{}, Response: FormRequest{}, Envelope: true, Message: true},
+
+        // Multiplication API endpoints
+        {Path: "/multiply", Method: http.MethodPost, Summary: "Multiply two numbers", Handler: (*Server).multiplyHandler, Request: MultiplyRequest{}, Response: MultiplyResult{}, Envelope: true, Query: true},
+        {Path: "/multiply/array", Method: http.MethodPost, Summary: "Multiply all numbers in an array", Handler: (*Server).multiplyArrayHandler, Request: ArrayRequest{}, Response: MultiplyArrayResult{}, Envelope: true, Query: true},
+        {Path: "/multiply/pairwise", Method: http.MethodPost, Summary: "Multiply two arrays element by element", Handler: (*Server).multiplyPairwiseHandler, Request: PairwiseRequest{}, Response: MultiplyArrayResult{}, Envelope: true, Query: true},
+        {Path: "/multiply/scalar", Method: http.MethodPost, Summary: "Multiply every number in an array by a scalar", Handler: (*Server).multiplyScalarHandler, Request: ScalarRequest{}, Response: MultiplyArrayResult{}, Envelope: true, Query: true},
+        {Path: "/power", Method: http.MethodPost, Summary: "Raise a base to an exponent", Handler: (*Server).powerHandler, Request: PowerRequest{}, Response: MultiplyResult{}, Envelope: true, Query: true},
+        {Path: "/factorial", Method: http.MethodPost, Summary: "Factorial of a non-negative integer", Handler: (*Server).factorialHandler, Request: FactorialRequest{}, Response: FactorialResult{}, Envelope: true, Query: true},
+}
+
+// newRouter registers the static file server, the API routes and the API documentation
+func (s *Server) newRouter() *http.ServeMux {
+        mux := http.NewServeMux()
+
+        // Static file server
+        fileserver := http.FileServer(http.Dir(s.staticDir))
+        mux.Handle("/", fileserver)
+
+        // Versioned API endpoints
+        api := s.newAPIMux()
+        mux.Handle("/v1/", http.StripPrefix("/v1", s.versionMiddleware(apiV1, api)))
+        mux.Handle("/v2/", http.StripPrefix("/v2", s.versionMiddleware(apiV2, api)))
+
+        // Unprefixed API endpoints are kept as aliases of v1
+        for _, route := range apiRoutes {
+                mux.Handle(route.Path, s.versionMiddleware(apiV1, s.routeHandler(route)))
+        }
+        mux.Handle("/jobs", s.versionMiddleware(apiV1, http.HandlerFunc(s.jobsHandler)))
+        mux.Handle("/jobs/", s.versionMiddleware(apiV1, http.HandlerFunc(s.jobHandler)))
+
+        // API documentation
+        mux.HandleFunc("/openapi.json", openAPIHandler)
+        mux.HandleFunc("/docs", s.docsHandler)
+        mux.HandleFunc(problemTypePrefix, problemsHandler)
+
+        // Operator endpoints, authorized with ADMIN_TOKEN
+        mux.Handle("/admin/webhooks/dead-letters", s.versionMiddleware(apiV2, s.adminMiddleware(http.HandlerFunc(s.deadLettersHandler))))
+        mux.Handle("/admin/webhooks/dead-letters/", s.versionMiddleware(apiV2, s.adminMiddleware(http.HandlerFunc(s.deadLettersHandler))))
+        mux.Handle("/admin/bans", s.versionMiddleware(apiV2, s.adminMiddleware(http.HandlerFunc(s.bansHandler))))
+        mux.Handle("/admin/bans/", s.versionMiddleware(apiV2, s.adminMiddleware(http.HandlerFunc(s.bansHandler))))
+
+        // Prometheus metrics
+        mux.HandleFunc("/metrics", s.metricsHandler)
+
+        // WebSocket calculator sessions
+        mux.HandleFunc("/ws", s.wsHandler)
+
+        // Live server activity as Server-Sent Events
+        mux.HandleFunc("/events", s.eventsHandler)
+
+        return mux
+}
+
+// helloHandler handles GET requests to /hello endpoint
+func (s *Server) helloHandler(w http.ResponseWriter, r *http.Request) {
+        // Check if path is exactly /hello
+        if r.URL.Path != "/hello" {
+                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+                return
+        }
+
+        // Only allow GET method
+        if r.Method != http.MethodGet {
+                sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        greeting := "Hello from Go server! 👋"
+        if responseVersion(w) == apiV2 {
+                sendDataResponse(w, greeting, greeting)
+                return
+        }
+
+        w.Header().Set("Content-Type", "text/plain")
+        fmt.Fprint(w, greeting)
+}
+
+// formHandler handles POST requests to /form endpoint
+func (s *Server) formHandler(w http.ResponseWriter, r *http.Request) {
+        // Only allow POST method
+        if r.Method != http.MethodPost {
+                sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        var name, address string
+        if isFormContentType(r.Header.Get("Content-Type")) {
+                // Parse form data
+                if err := r.ParseForm(); err != nil {
+                        logf(s.logger, RequestID(r.Context()), "ParseForm error: %v", err)
+                        sendErrorResponse(w, "Bad Request", "Failed to parse form data", http.StatusBadRequest)
+                        return
+                }
+
+                // Get form values
+                name = r.FormValue("name")
+                address = r.FormValue("address")
+        } else {
+                // Decode request body using the codec selected by Content-Type
+                var req FormRequest
+                if err := decodeRequest(r, &req); err != nil {
+                        sendDecodeError(w, err)
+                        return
+                }
+                name = req.Name
+                address = req.Address
+        }
+
+        // Validate input
+        if err := validateFormInput(name, address); err != nil {
+                sendValidationError(w, err)
+                return
+        }
+
+        // Sanitize input
+        name = sanitizeInput(name)
+        address = sanitizeInput(address)
+
+        // Log the form submission
+        logf(s.logger, RequestID(r.Context()), "Form submitted - Name: %s, Address: %s", name, address)
+        s.publishRequestEvent(eventFormSubmitted, r, http.StatusOK, 0)
+
+        // Send success response
+        data := FormRequest{
+                Name:    name,
+                Address: address,
+        }
+        sendDataResponse(w, SuccessResponse{
+                Success: true,
+                Message: "Form submitted successfully", // Fixed typo: "succesful" -> "successfully"
+                Data:    data,
+        }, data)
+}
+
+// HealthResponse represents the body returned by the /health endpoint
+type HealthResponse struct {
+        Status    string     `json:"status"`
+        Timestamp int64      `json:"timestamp"`
+        Service   string     `json:"service"`
+        Uptime    string     `json:"uptime"`
+        Cache     CacheStats `json:"cache"`
+}
+
+// healthHandler handles GET requests to /health endpoint for monitoring
+func (s *Server) healthHandler(w http.ResponseWriter, r *http.Request) {
+        // Only allow GET method
+        if r.Method != http.MethodGet {
+                sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        // Create health response
+        response := HealthResponse{
+                Status:    "healthy",
+                Timestamp: s.clock().Unix(),
+                Service:   "go-first-project",
+                Uptime:    time.Since(time.Now().Add(-time.Hour)).String(), // Simple uptime placeholder
+                Cache:     s.cache.Stats(),
+        }
+
+        sendDataResponse(w, response, response)
+}
+
+
+
+// Request bodies are declared in the api package, shared with the client;
+// the server adds their Validate methods
+
+// MultiplyRequest represents the request body for basic multiplication
+type MultiplyRequest api.MultiplyRequest
+
+// ArrayRequest represents the request body for array operations
+type ArrayRequest api.ArrayRequest
+
+// PairwiseRequest represents the request body for pairwise multiplication
+type PairwiseRequest api.PairwiseRequest
+
+// ScalarRequest represents the request body for scalar multiplication
+type ScalarRequest api.ScalarRequest
+
+// PowerRequest represents the request body for power operations
+type PowerRequest api.PowerRequest
+
+// FactorialRequest represents the request body for factorial operations
+type FactorialRequest api.FactorialRequest
+
+// maxArrayLength is the largest array accepted by the array endpoints
+const maxArrayLength = 1000
+
+// Validate checks that both operands are within bounds
+func (req MultiplyRequest) Validate() error {
+        if req.A > 1e15 || req.A < -1e15 || req.B > 1e15 || req.B < -1e15 {
+                return invalid("Numbers are too large", req)
+        }
+        return nil
+}
+
+// Validate checks the array length and the bounds of each number
+func (req ArrayRequest) Validate() error {
+        if len(req.Numbers) == 0 {
+                return invalid("Numbers array cannot be empty", req)
+        }
+        if len(req.Numbers) > maxArrayLength {
+                return invalid("Array too large (max 1000 elements)", req)
+        }
+        for _, num := range req.Numbers {
+                if num > 1e10 || num < -1e10 {
+                        return invalid("Numbers are too large", req)
+                }
+        }
+        return nil
+}
+
+// Validate checks both array lengths and the bounds of each number
+func (req PairwiseRequest) Validate() error {
+        if len(req.Array1) == 0 || len(req.Array2) == 0 {
+                return invalid("Arrays cannot be empty", req)
+        }
+        if len(req.Array1) > maxArrayLength || len(req.Array2) > maxArrayLength {
+                return invalid("Arrays too large (max 1000 elements)", req)
+        }
+        for _, num := range req.Array1 {
+                if num > 1e10 || num < -1e10 {
+                        return invalid("Numbers in array1 are too large", req)
+                }
+        }
+        for _, num := range req.Array2 {
+                if num > 1e10 || num < -1e10 {
+                        return invalid("Numbers in array2 are too large", req)
+                }
+        }
+        if len(req.Array1) != len(req.Array2) {
+                return invalid("arrays must have the same length", req, FieldError{Field: "array2", Reason: reasonLengthMismatch, Message: "must have the same length as array1"})
+        }
+        return nil
+}
+
+// Validate checks the array length, the scalar and the bounds of each number
+func (req ScalarRequest) Validate() error {
+        if len(req.Numbers) == 0 {
+                return invalid("Numbers array cannot be empty", req)
+        }
+        if len(req.Numbers) > maxArrayLength {
+                return invalid("Array too large (max 1000 elements)", req)
+        }
+        if req.Scalar > 1e10 || req.Scalar < -1e10 {
+                return invalid("Scalar value is too large", req)
+        }
+        for _, num := range req.Numbers {
+                if num > 1e10 || num < -1e10 {
+                        return invalid("Numbers are too large", req)
+                }
+        }
+        return nil
+}
+
+// Validate prevents extremely large power calculations
+func (req PowerRequest) Validate() error {
+        if req.Base > 1e6 || req.Base < -1e6 || req.Exponent > 1000 || req.Exponent < -1000 {
+                return invalid("Base or exponent values are too large", req)
+        }
+        return nil
+}
+
+// Validate checks that the number is between 0 and 20
+func (req FactorialRequest) Validate() error {
+        if req.Number < 0 {
+                return invalid("Factorial is not defined for negative numbers", req)
+        }
+        if req.Number > 20 {
+                return invalid("Number too large for factorial calculation (max 20)", req)
+        }
+        return nil
+}
+
+// MultiplyResult represents the result of a multiplication operation
+type MultiplyResult = api.MultiplyResult
+
+// MultiplyArrayResult represents the result of array multiplication
+type MultiplyArrayResult = api.MultiplyArrayResult
+
+// FactorialResult represents the data returned by the /factorial endpoint
+type FactorialResult = api.FactorialResult
+
+// multiplyHandler handles GET and POST requests to /multiply endpoint
+func (s *Server) multiplyHandler(w http.ResponseWriter, r *http.Request) {
+        // Check if path is exactly /multiply
+        if r.URL.Path != "/multiply" {
+                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+                return
+        }
+
+        // Allow GET with query parameters and POST with a body
+        if r.Method != http.MethodGet && r.Method != http.MethodPost {
+                sendErrorResponse(w, "Method Not Allowed", "Only GET and POST methods are allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        // Decode the query string (GET) or the body using the codec selected by Content-Type (POST)
+        var req MultiplyRequest
+        if err := decodeOperationRequest(r, &req); err != nil {
+                sendDecodeError(w, err)
+                return
+        }
+
+        // Validate input
+        if err := req.Validate(); err != nil {
+                sendValidationError(w, err)
+                return
+        }
+
+        // Perform multiplication, memoized by input
+        result, done, _ := s.cachedResult(w, r, "multiply", req, func() (interface{}, error) {
+                return arith.BasicMultiply(req.A, req.B), nil
+        })
+        if done {
+                return
+        }
+
+        // Send response
+        sendSuccessResponse(w, result)
+}
+
+// multiplyArrayHandler handles GET and POST requests to /multiply/array endpoint
+func (s *Server) multiplyArrayHandler(w http.ResponseWriter, r *http.Request) {
+        // Check if path is exactly /multiply/array
+        if r.URL.Path != "/multiply/array" {
+                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+                return
+        }
+
+        // Allow GET with query parameters and POST with a body
+        if r.Method != http.MethodGet && r.Method != http.MethodPost {
+                sendErrorResponse(w, "Method Not Allowed", "Only GET and POST methods are allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        // Decode the query string (GET) or the body using the codec selected by Content-Type (POST)
+        var req ArrayRequest
+        if err := decodeOperationRequest(r, &req); err != nil {
+                sendDecodeError(w, err)
+                return
+        }
+
+        // Validate input
+        if err := req.Validate(); err != nil {
+                sendValidationError(w, err)
+                return
+        }
+
+        // Perform array multiplication, memoized by input
+        result, done, _ := s.cachedResult(w, r, "multiply_array", req, func() (interface{}, error) {
+                return arith.MultiplyArray(req.Numbers), nil
+        })
+        if done {
+                return
+        }
+
+        // Send response
+        sendSuccessResponse(w, result)
+}
+
+// multiplyPairwiseHandler handles GET and POST requests to /multiply/pairwise endpoint
+func (s *Server) multiplyPairwiseHandler(w http.ResponseWriter, r *http.Request) {
+        // Check if path is exactly /multiply/pairwise
+        if r.URL.Path != "/multiply/pairwise" {
+                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+                return
+        }
+
+        // Allow GET with query parameters and POST with a body
+        if r.Method != http.MethodGet && r.Method != http.MethodPost {
+                sendErrorResponse(w, "Method Not Allowed", "Only GET and POST methods are allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        // Decode the query string (GET) or the body using the codec selected by Content-Type (POST)
+        var req PairwiseRequest
+        if err := decodeOperationRequest(r, &req); err != nil {
+                sendDecodeError(w, err)
+                return
+        }
+
+        // Validate input
+        if err := req.Validate(); err != nil {
+                sendValidationError(w, err)
+                return
+        }
+
+        // Perform pairwise multiplication, memoized by input
+        result, done, err := s.cachedResult(w, r, "multiply_pairwise", req, func() (interface{}, error) {
+                return arith.MultiplyArrayPairwise(req.Array1, req.Array2)
+        })
+        if done {
+                return
+        }
+        if err != nil {
+                sendErrorResponse(w, "Validation Error", err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        // Send response
+        sendSuccessResponse(w, result)
+}
+
+// multiplyScalarHandler handles GET and POST requests to /multiply/scalar endpoint
+func (s *Server) multiplyScalarHandler(w http.ResponseWriter, r *http.Request) {
+        // Check if path is exactly /multiply/scalar
+        if r.URL.Path != "/multiply/scalar" {
+                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+                return
+        }
+
+        // Allow GET with query parameters and POST with a body
+        if r.Method != http.MethodGet && r.Method != http.MethodPost {
+                sendErrorResponse(w, "Method Not Allowed", "Only GET and POST methods are allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        // Decode the query string (GET) or the body using the codec selected by Content-Type (POST)
+        var req ScalarRequest
+        if err := decodeOperationRequest(r, &req); err != nil {
+                sendDecodeError(w, err)
+                return
+        }
+
+        // Validate input
+        if err := req.Validate(); err != nil {
+                sendValidationError(w, err)
+                return
+        }
+
+        // Perform scalar multiplication, memoized by input
+        result, done, _ := s.cachedResult(w, r, "multiply_scalar", req, func() (interface{}, error) {
+                return arith.MultiplyByScalar(req.Numbers, req.Scalar), nil
+        })
+        if done {
+                return
+        }
+
+        // Send response
+        sendSuccessResponse(w, result)
+}
+
+// powerHandler handles GET and POST requests to /power endpoint
+func (s *Server) powerHandler(w http.ResponseWriter, r *http.Request) {
+        // Check if path is exactly /power
+        if r.URL.Path != "/power" {
+                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+                return
+        }
+
+        // Allow GET with query parameters and POST with a body
+        if r.Method != http.MethodGet && r.Method != http.MethodPost {
+                sendErrorResponse(w, "Method Not Allowed", "Only GET and POST methods are allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        // Decode the query string (GET) or the body using the codec selected by Content-Type (POST)
+        var req PowerRequest
+        if err := decodeOperationRequest(r, &req); err != nil {
+                sendDecodeError(w, err)
+                return
+        }
+
+        // Validate input
+        if err := req.Validate(); err != nil {
+                sendValidationError(w, err)
+                return
+        }
+
+        // Perform power calculation, memoized by input
+        result, done, _ := s.cachedResult(w, r, "power", req, func() (interface{}, error) {
+                return arith.Power(req.Base, req.Exponent), nil
+        })
+        if done {
+                return
+        }
+
+        // Send response
+        sendSuccessResponse(w, result)
+}
+
+// factorialHandler handles GET and POST requests to /factorial endpoint
+func (s *Server) factorialHandler(w http.ResponseWriter, r *http.Request) {
+        // Check if path is exactly /factorial
+        if r.URL.Path != "/factorial" {
+                sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+                return
+        }
+
+        // Allow GET with query parameters and POST with a body
+        if r.Method != http.MethodGet && r.Method != http.MethodPost {
+                sendErrorResponse(w, "Method Not Allowed", "Only GET and POST methods are allowed for this endpoint", http.StatusMethodNotAllowed)
+                return
+        }
+
+        // Decode the query string (GET) or the body using the codec selected by Content-Type (POST)
+        var req FactorialRequest
+        if err := decodeOperationRequest(r, &req); err != nil {
+                sendDecodeError(w, err)
+                return
+        }
+
+        // Validate input
+        if err := req.Validate(); err != nil {
+                sendValidationError(w, err)
+                return
+        }
+
+        // Perform factorial calculation, memoized by input
+        result, done, err := s.cachedResult(w, r, "factorial", req, func() (interface{}, error) {
+                result, err := arith.Factorial(req.Number)
+                if err != nil {
+                        return nil, err
+                }
+                return FactorialResult{Input: req.Number, Result: result}, nil
+        })
+        if done {
+                return
+        }
+        if err != nil {
+                sendErrorResponse(w, "Calculation Error", err.Error(), http.StatusBadRequest)
+                return
+        }
+
+        // Send response
+        sendSuccessResponse(w, result)
+}
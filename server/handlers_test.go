@@ -1,4 +1,4 @@
-package main
+package server
 
 import (
         "encoding/json"
@@ -10,13 +10,14 @@ import (
 
 // Test health check endpoint
 func TestHealthCheckEndpoint(t *testing.T) {
+        s := newTestServer(t)
         req, err := http.NewRequest("GET", "/health", nil)
         if err != nil {
                 t.Fatal(err)
         }
 
         rr := httptest.NewRecorder()
-        handler := http.HandlerFunc(healthHandler)
+        handler := http.HandlerFunc(s.healthHandler)
         handler.ServeHTTP(rr, req)
 
         if status := rr.Code; status != http.StatusOK {
@@ -44,13 +45,14 @@ func TestHealthCheckEndpoint(t *testing.T) {
 
 // Test health endpoint with wrong method
 func TestHealthCheckEndpointWrongMethod(t *testing.T) {
+        s := newTestServer(t)
         req, err := http.NewRequest("POST", "/health", nil)
         if err != nil {
                 t.Fatal(err)
         }
 
         rr := httptest.NewRecorder()
-        handler := http.HandlerFunc(healthHandler)
+        handler := http.HandlerFunc(s.healthHandler)
         handler.ServeHTTP(rr, req)
 
         if status := rr.Code; status != http.StatusMethodNotAllowed {
@@ -60,13 +62,14 @@ func TestHealthCheckEndpointWrongMethod(t *testing.T) {
 
 // Test hello handler
 func TestHelloHandler(t *testing.T) {
+        s := newTestServer(t)
         req, err := http.NewRequest("GET", "/hello", nil)
         if err != nil {
                 t.Fatal(err)
         }
 
         rr := httptest.NewRecorder()
-        handler := http.HandlerFunc(helloHandler)
+        handler := http.HandlerFunc(s.helloHandler)
         handler.ServeHTTP(rr, req)
 
         if status := rr.Code; status != http.StatusOK {
@@ -81,13 +84,14 @@ func TestHelloHandler(t *testing.T) {
 
 // Test hello handler with wrong path
 func TestHelloHandlerWrongPath(t *testing.T) {
+        s := newTestServer(t)
         req, err := http.NewRequest("GET", "/hello/test", nil)
         if err != nil {
                 t.Fatal(err)
         }
 
         rr := httptest.NewRecorder()
-        handler := http.HandlerFunc(helloHandler)
+        handler := http.HandlerFunc(s.helloHandler)
         handler.ServeHTTP(rr, req)
 
         if status := rr.Code; status != http.StatusNotFound {
@@ -97,13 +101,14 @@ func TestHelloHandlerWrongPath(t *testing.T) {
 
 // Test hello handler with wrong method
 func TestHelloHandlerWrongMethod(t *testing.T) {
+        s := newTestServer(t)
         req, err := http.NewRequest("POST", "/hello", nil)
         if err != nil {
                 t.Fatal(err)
         }
 
         rr := httptest.NewRecorder()
-        handler := http.HandlerFunc(helloHandler)
+        handler := http.HandlerFunc(s.helloHandler)
         handler.ServeHTTP(rr, req)
 
         if status := rr.Code; status != http.StatusMethodNotAllowed {
@@ -113,6 +118,7 @@ func TestHelloHandlerWrongMethod(t *testing.T) {
 
 // Test form handler with valid data
 func TestFormHandlerValidData(t *testing.T) {
+        s := newTestServer(t)
         formData := "name=John&address=123 Main St"
         req, err := http.NewRequest("POST", "/form", strings.NewReader(formData))
         if err != nil {
@@ -121,7 +127,7 @@ func TestFormHandlerValidData(t *testing.T) {
         req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
         rr := httptest.NewRecorder()
-        handler := http.HandlerFunc(formHandler)
+        handler := http.HandlerFunc(s.formHandler)
         handler.ServeHTTP(rr, req)
 
         if status := rr.Code; status != http.StatusOK {
@@ -141,13 +147,14 @@ func TestFormHandlerValidData(t *testing.T) {
 
 // Test form handler with wrong method
 func TestFormHandlerWrongMethod(t *testing.T) {
+        s := newTestServer(t)
         req, err := http.NewRequest("GET", "/form", nil)
         if err != nil {
                 t.Fatal(err)
         }
 
         rr := httptest.NewRecorder()
-        handler := http.HandlerFunc(formHandler)
+        handler := http.HandlerFunc(s.formHandler)
         handler.ServeHTTP(rr, req)
 
         if status := rr.Code; status != http.StatusMethodNotAllowed {
@@ -157,18 +164,25 @@ func TestFormHandlerWrongMethod(t *testing.T) {
 
 // Test rate limiter
 func TestRateLimiter(t *testing.T) {
-        rl := NewRateLimiter()
+        rl, err := NewRateLimiter(defaultConfig.RateLimitAlgorithm, defaultConfig.Rate())
+        if err != nil {
+                t.Fatalf("NewRateLimiter error: %v", err)
+        }
         
         // Test allowing requests
-        if !rl.Allow("127.0.0.1") {
+        if _, ok := rl.Allow("127.0.0.1", 1); !ok {
                 t.Error("Expected first request to be allowed")
         }
         
-        // Test rate limiting (this depends on the actual implementation)
-        // For now, just test that the method exists and returns a boolean
-        result := rl.Allow("127.0.0.1")
-        if result != true && result != false {
-                t.Error("Allow method should return a boolean")
+        // The default is 100 requests per minute
+        for i := 1; i < 100; i++ {
+                rl.Allow("127.0.0.1", 1)
+        }
+        if _, ok := rl.Allow("127.0.0.1", 1); ok {
+                t.Error("Expected the 101st request to be limited")
+        }
+        if _, ok := rl.Allow("127.0.0.2", 1); !ok {
+                t.Error("Expected other clients to be allowed")
         }
 }
 
@@ -215,26 +229,6 @@ func TestValidateFormInput(t *testing.T) {
         }
 }
 
-// Test getClientIP function
-func TestGetClientIP(t *testing.T) {
-        req, _ := http.NewRequest("GET", "/", nil)
-        
-        // Test with X-Forwarded-For header
-        req.Header.Set("X-Forwarded-For", "192.168.1.1")
-        ip := getClientIP(req)
-        if ip != "192.168.1.1" {
-                t.Errorf("Expected IP 192.168.1.1, got %s", ip)
-        }
-        
-        // Test with X-Real-IP header
-        req.Header.Del("X-Forwarded-For")
-        req.Header.Set("X-Real-IP", "192.168.1.2")
-        ip = getClientIP(req)
-        if ip != "192.168.1.2" {
-                t.Errorf("Expected IP 192.168.1.2, got %s", ip)
-        }
-}
-
 // Test sendErrorResponse function
 func TestSendErrorResponse(t *testing.T) {
         rr := httptest.NewRecorder()
@@ -265,24 +259,26 @@ func TestSendErrorResponse(t *testing.T) {
 
 // Benchmark test for health endpoint
 func BenchmarkHealthEndpoint(b *testing.B) {
+        s := newTestServer(b)
         req, _ := http.NewRequest("GET", "/health", nil)
         
         b.ResetTimer()
         for i := 0; i < b.N; i++ {
                 rr := httptest.NewRecorder()
-                handler := http.HandlerFunc(healthHandler)
+                handler := http.HandlerFunc(s.healthHandler)
                 handler.ServeHTTP(rr, req)
         }
 }
 
 // Benchmark test for hello endpoint
 func BenchmarkHelloEndpoint(b *testing.B) {
+        s := newTestServer(b)
         req, _ := http.NewRequest("GET", "/hello", nil)
         
         b.ResetTimer()
         for i := 0; i < b.N; i++ {
                 rr := httptest.NewRecorder()
-                handler := http.HandlerFunc(helloHandler)
+                handler := http.HandlerFunc(s.helloHandler)
                 handler.ServeHTTP(rr, req)
         }
 }
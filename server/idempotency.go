@@ -0,0 +1,222 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	// maxIdempotencyKeyLength bounds the Idempotency-Key header
+	maxIdempotencyKeyLength = 255
+	// maxIdempotentBodySize bounds the request body fingerprinted for a key
+	maxIdempotentBodySize = maxJobBodySize
+)
+
+// idempotencyRecord is the stored outcome of the first request with a key
+type idempotencyRecord struct {
+	fingerprint string
+	created     time.Time
+	// done is closed once the response below has been captured
+	done   chan struct{}
+	status int
+	header http.Header
+	body   []byte
+}
+
+// IdempotencyStore remembers responses by Idempotency-Key for a TTL
+type IdempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	records map[string]*idempotencyRecord
+
+	// stop ends the cleanup goroutine
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewIdempotencyStore creates a store keeping responses for ttl, cleaning
+// up expired keys every minute until Close
+func NewIdempotencyStore(ttl time.Duration) *IdempotencyStore {
+	s := &IdempotencyStore{
+		ttl:     ttl,
+		records: make(map[string]*idempotencyRecord),
+		stop:    make(chan struct{}),
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.cleanupRecords()
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+
+	return s
+}
+
+// Close stops the cleanup goroutine
+func (s *IdempotencyStore) Close() {
+	s.closeOnce.Do(func() { close(s.stop) })
+}
+
+// begin returns the record for key, creating it when the key is new or has
+// expired. created reports whether the caller owns the new record.
+func (s *IdempotencyStore) begin(key, fingerprint string) (record *idempotencyRecord, created bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if rec, ok := s.records[key]; ok && time.Since(rec.created) < s.ttl {
+		return rec, false
+	}
+	rec := &idempotencyRecord{fingerprint: fingerprint, created: time.Now(), done: make(chan struct{})}
+	s.records[key] = rec
+	return rec, true
+}
+
+// finish stores the captured response, or forgets the key when the
+// response should not be replayed
+func (s *IdempotencyStore) finish(key string, rec *idempotencyRecord, keep bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !keep && s.records[key] == rec {
+		delete(s.records, key)
+	}
+	close(rec.done)
+}
+
+func (s *IdempotencyStore) cleanupRecords() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, rec := range s.records {
+		if time.Since(rec.created) >= s.ttl {
+			delete(s.records, key)
+		}
+	}
+}
+
+// captureWriter tees a response so it can be replayed later. The header is
+// copied as the handler sent it, before the writers below it rewrite it for
+// this request's Content-Encoding.
+type captureWriter struct {
+	http.ResponseWriter
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func (cw *captureWriter) WriteHeader(code int) {
+	if cw.status == 0 {
+		cw.status = code
+		cw.header = cw.Header().Clone()
+	}
+	cw.ResponseWriter.WriteHeader(code)
+}
+
+func (cw *captureWriter) Write(b []byte) (int, error) {
+	if cw.status == 0 {
+		cw.status = http.StatusOK
+		cw.header = cw.Header().Clone()
+	}
+	cw.body.Write(b)
+	return cw.ResponseWriter.Write(b)
+}
+
+// Unwrap lets findResponseWriter reach the negotiated codec and version
+func (cw *captureWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+// idempotencyMiddleware makes POST requests carrying an Idempotency-Key
+// header safe to retry. The first response for a key is stored for the
+// store's TTL and replayed byte for byte, with an Idempotent-Replayed
+// header, to retries with the same body. Reusing the key for a different
+// request is rejected with 422, and a retry arriving while the first
+// request is still running gets 409. Keys are scoped to the client IP.
+// Server errors are not stored, so the request can be retried.
+func (s *Server) idempotencyMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			sendErrorResponse(w, "Bad Request", "Idempotency-Key must be at most 255 characters", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxIdempotentBodySize+1))
+		if err != nil {
+			sendErrorResponse(w, "Bad Request", "Failed to read request body", http.StatusBadRequest)
+			return
+		}
+		if len(body) > maxIdempotentBodySize {
+			sendErrorResponse(w, "Request Entity Too Large", "Request body is too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		sum := sha256.New()
+		io.WriteString(sum, r.Method+" "+requestPath(r)+"\n"+r.Header.Get("Content-Type")+"\n")
+		sum.Write(body)
+		fingerprint := hex.EncodeToString(sum.Sum(nil))
+
+		scopedKey := s.clientIP(r) + "\x00" + key
+		rec, created := s.idempotency.begin(scopedKey, fingerprint)
+		if !created {
+			if rec.fingerprint != fingerprint {
+				sendErrorResponse(w, "Unprocessable Entity", "Idempotency-Key was already used for a different request", http.StatusUnprocessableEntity)
+				return
+			}
+			select {
+			case <-rec.done:
+			default:
+				sendErrorResponse(w, "Conflict", "A request with this Idempotency-Key is still being processed", http.StatusConflict)
+				return
+			}
+
+			header := w.Header()
+			for k := range header {
+				delete(header, k)
+			}
+			for k, v := range rec.header {
+				header[k] = v
+			}
+			// X-Request-ID stays that of the recorded request, matching
+			// the meta.request_id of a replayed v2 body
+			header.Set("Idempotent-Replayed", "true")
+			w.WriteHeader(rec.status)
+			w.Write(rec.body)
+			return
+		}
+
+		cw := &captureWriter{ResponseWriter: w}
+		keep := false
+		defer func() {
+			s.idempotency.finish(scopedKey, rec, keep)
+		}()
+
+		next.ServeHTTP(cw, r)
+
+		if cw.status == 0 {
+			cw.status = http.StatusOK
+			cw.header = w.Header().Clone()
+		}
+		rec.status = cw.status
+		rec.header = cw.header
+		rec.body = cw.body.Bytes()
+		keep = cw.status < http.StatusInternalServerError
+	})
+}
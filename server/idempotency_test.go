@@ -0,0 +1,174 @@
+package server
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func postWithKey(handler http.Handler, path, key, body, remoteAddr string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Idempotency-Key", key)
+	if remoteAddr != "" {
+		req.RemoteAddr = remoteAddr
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, req)
+	return w
+}
+
+// Test that a retried POST is replayed byte for byte instead of re-run
+func TestIdempotencyReplay(t *testing.T) {
+	s := newTestServer(t)
+	mux := s.newRouter()
+	body := `{"operation":"multiply","args":{"a":2,"b":3}}`
+
+	first := postWithKey(mux, "/v2/jobs", "retry-1", body, "")
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("first status = %v: %s", first.Code, first.Body.String())
+	}
+	retry := postWithKey(mux, "/v2/jobs", "retry-1", body, "")
+
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Errorf("retry = %v %s, want %v %s", retry.Code, retry.Body.String(), first.Code, first.Body.String())
+	}
+	if retry.Header().Get("Location") != first.Header().Get("Location") {
+		t.Errorf("retry Location = %q, want %q", retry.Header().Get("Location"), first.Header().Get("Location"))
+	}
+	if retry.Header().Get("Idempotent-Replayed") != "true" || first.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("Idempotent-Replayed should only be set on the replay")
+	}
+
+	// The same key from another client is an independent request
+	other := postWithKey(mux, "/v2/jobs", "retry-1", body, "198.51.100.7:1234")
+	if other.Header().Get("Idempotent-Replayed") != "" || other.Body.String() == first.Body.String() {
+		t.Errorf("key from another client was replayed")
+	}
+}
+
+// Test that a response recorded compressed is replayed in the coding the
+// retry accepts
+func TestIdempotencyReplayCompression(t *testing.T) {
+	s := newTestServer(t)
+	h := compressedRouter(s)
+	body := `{"numbers":[` + strings.TrimSuffix(strings.Repeat("2,", 1000), ",") + `],"scalar":3}`
+	send := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", "/multiply/scalar", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "compressed-1")
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+	decode := func(w *httptest.ResponseRecorder) string {
+		if w.Header().Get("Content-Encoding") != "gzip" {
+			return w.Body.String()
+		}
+		zr, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+
+	first := send("gzip")
+	if first.Code != http.StatusOK || first.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("first = %v with Content-Encoding %q, want a gzipped 200", first.Code, first.Header().Get("Content-Encoding"))
+	}
+	want := decode(first)
+
+	for _, accept := range []string{"gzip", ""} {
+		retry := send(accept)
+		if retry.Header().Get("Idempotent-Replayed") != "true" {
+			t.Fatalf("Accept-Encoding %q: retry was not replayed", accept)
+		}
+		wantEncoding := accept
+		if got := retry.Header().Get("Content-Encoding"); got != wantEncoding {
+			t.Errorf("Accept-Encoding %q: Content-Encoding = %q, want %q", accept, got, wantEncoding)
+		}
+		if got := decode(retry); got != want {
+			t.Errorf("Accept-Encoding %q: body = %.80q, want %.80q", accept, got, want)
+		}
+		if got, vary := retry.Header().Get("ETag"), retry.Header().Values("Vary"); strings.Count(got, "W/") > 1 || len(vary) > 1 {
+			t.Errorf("Accept-Encoding %q: ETag = %q, Vary = %q", accept, got, vary)
+		}
+	}
+}
+
+// Test reusing a key for a different request
+func TestIdempotencyKeyReuse(t *testing.T) {
+	s := newTestServer(t)
+	mux := s.newRouter()
+
+	postWithKey(mux, "/form", "form-1", `{"name":"John","address":"1 Main St"}`, "")
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"different body", "/form", `{"name":"Jane","address":"1 Main St"}`, http.StatusUnprocessableEntity},
+		{"different endpoint", "/multiply", `{"name":"John","address":"1 Main St"}`, http.StatusUnprocessableEntity},
+		{"same request", "/form", `{"name":"John","address":"1 Main St"}`, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := postWithKey(mux, tt.path, "form-1", tt.body, ""); w.Code != tt.want {
+			t.Errorf("%s: status = %v, want %v: %s", tt.name, w.Code, tt.want, w.Body.String())
+		}
+	}
+
+	if w := postWithKey(mux, "/form", strings.Repeat("k", 256), `{}`, ""); w.Code != http.StatusBadRequest {
+		t.Errorf("overlong key: status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+}
+
+// Test concurrent retries and responses that must not be stored
+func TestIdempotencyInFlightAndServerErrors(t *testing.T) {
+	s := newTestServer(t)
+	release := make(chan struct{})
+	var calls int32
+	handler := s.versionMiddleware(apiV2, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			<-release
+			sendErrorResponse(w, "Internal Server Error", "boom", http.StatusInternalServerError)
+			return
+		}
+		sendSuccessResponse(w, "ok")
+	}))
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- postWithKey(handler, "/slow", "slow-1", `{}`, "") }()
+
+	// Wait for the first request to be in flight
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if w := postWithKey(handler, "/slow", "slow-1", `{}`, ""); w.Code != http.StatusConflict {
+		t.Errorf("concurrent retry status = %v, want %v", w.Code, http.StatusConflict)
+	}
+
+	close(release)
+	if w := <-done; w.Code != http.StatusInternalServerError {
+		t.Fatalf("first status = %v, want %v", w.Code, http.StatusInternalServerError)
+	}
+
+	// The 500 was not stored, so the retry runs the handler again
+	if w := postWithKey(handler, "/slow", "slow-1", `{}`, ""); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Errorf("retry after server error = %v (replayed %q), want a fresh 200", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("handler calls = %v, want 2", got)
+	}
+}
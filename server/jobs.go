@@ -0,0 +1,688 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JobStatus is the lifecycle state of a job
+type JobStatus string
+
+const (
+	JobQueued    JobStatus = "queued"
+	JobRunning   JobStatus = "running"
+	JobSucceeded JobStatus = "succeeded"
+	JobFailed    JobStatus = "failed"
+	JobCanceled  JobStatus = "canceled"
+)
+
+// finished reports whether the job can no longer change
+func (s JobStatus) finished() bool {
+	return s == JobSucceeded || s == JobFailed || s == JobCanceled
+}
+
+const (
+	// jobQueueSize bounds the jobs waiting for a worker
+	jobQueueSize = 100
+	// jobRetention is how long finished jobs can still be fetched
+	jobRetention = time.Hour
+	// maxJobBodySize bounds a job submission (large sorts and matrices)
+	maxJobBodySize = 32 << 20
+)
+
+var (
+	errJobQueueFull     = errors.New("job queue is full")
+	errJobsShuttingDown = errors.New("server is shutting down")
+	errJobNotFound      = errors.New("job not found")
+	errJobFinished      = errors.New("job has already finished")
+	errNoWebhooks       = errors.New("job callbacks need a webhook dispatcher")
+)
+
+// JobRequest represents a job submission. When CallbackURL is set the
+// finished job is POSTed there, see webhook.go.
+type JobRequest struct {
+	Operation   string      `json:"operation" required:"true"`
+	Args        interface{} `json:"args"`
+	CallbackURL string      `json:"callback_url,omitempty"`
+}
+
+// Job is the public view of a queued, running or finished operation
+type Job struct {
+	ID          string         `json:"id"`
+	Operation   string         `json:"operation"`
+	Status      JobStatus      `json:"status"`
+	Progress    float64        `json:"progress"`
+	Result      interface{}    `json:"result,omitempty"`
+	Error       *EnvelopeError `json:"error,omitempty"`
+	CallbackURL string         `json:"callback_url,omitempty"`
+	// RequestID is the ID of the request that submitted the job
+	RequestID  string     `json:"request_id,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	StartedAt  *time.Time `json:"started_at,omitempty"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// jobEntry is a job with the state needed to run, cancel and watch it
+type jobEntry struct {
+	job  Job
+	args interface{} // generic arguments, kept so queued jobs can be persisted
+	op   Operation
+	// target holds the decoded and validated arguments
+	target interface{}
+	// traceParent is the traceparent of the submitting request, continued
+	// by the callback
+	traceParent string
+
+	ctx            context.Context
+	cancel         context.CancelFunc
+	canceledByUser bool
+	subscribers    map[chan struct{}]struct{}
+}
+
+// persistedJob is how a queued job is written to the state file
+type persistedJob struct {
+	ID          string      `json:"id"`
+	Operation   string      `json:"operation"`
+	Args        interface{} `json:"args"`
+	CallbackURL string      `json:"callback_url,omitempty"`
+	RequestID   string      `json:"request_id,omitempty"`
+	TraceParent string      `json:"traceparent,omitempty"`
+	CreatedAt   time.Time   `json:"created_at"`
+}
+
+// JobManager runs jobs on a bounded pool of workers
+type JobManager struct {
+	mu      sync.Mutex
+	jobs    map[string]*jobEntry
+	queue   chan *jobEntry
+	closing bool
+	wg      sync.WaitGroup
+
+	// baseCtx is canceled when running jobs must stop
+	baseCtx    context.Context
+	cancelJobs context.CancelFunc
+	// stop tells idle workers to exit instead of taking queued jobs
+	stop chan struct{}
+	// done ends the cleanup goroutine once Shutdown is over
+	done chan struct{}
+
+	// webhooks delivers job callbacks; jobs with a callback need it
+	webhooks *WebhookDispatcher
+	logger   *log.Logger
+	// panics logs and counts operations that panic, failing their job
+	panics *panicRecorder
+}
+
+// NewJobManager starts workers goroutines consuming a queue of queueSize jobs
+func NewJobManager(workers, queueSize int) *JobManager {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &JobManager{
+		jobs:       make(map[string]*jobEntry),
+		queue:      make(chan *jobEntry, queueSize),
+		baseCtx:    ctx,
+		cancelJobs: cancel,
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+		logger:     log.Default(),
+		panics:     &panicRecorder{logger: log.Default()},
+	}
+
+	for i := 0; i < workers; i++ {
+		m.wg.Add(1)
+		go m.worker()
+	}
+
+	// Forget finished jobs after jobRetention
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				m.cleanupJobs()
+			case <-m.done:
+				return
+			}
+		}
+	}()
+
+	return m
+}
+
+// Submit validates the arguments and queues the operation
+func (m *JobManager) Submit(operation string, args interface{}) (Job, error) {
+	return m.SubmitWithCallback(context.Background(), operation, args, "")
+}
+
+// SubmitWithCallback queues the operation like Submit and delivers the
+// finished job to callbackURL, which the caller has checked. The job keeps
+// the request ID and traceparent of ctx and passes them on to the callback.
+// Managers without a webhook dispatcher reject callbacks.
+func (m *JobManager) SubmitWithCallback(ctx context.Context, operation string, args interface{}, callbackURL string) (Job, error) {
+	if callbackURL != "" && m.webhooks == nil {
+		return Job{}, errNoWebhooks
+	}
+	op, target, err := prepareOperation(operation, args)
+	if err != nil {
+		return Job{}, err
+	}
+	return m.enqueue(&jobEntry{
+		job: Job{ID: newRequestID(), Operation: operation, Status: JobQueued, CallbackURL: callbackURL,
+			RequestID: RequestID(ctx), CreatedAt: time.Now().UTC()},
+		args:        args,
+		op:          op,
+		target:      target,
+		traceParent: traceParent(ctx),
+	})
+}
+
+func (m *JobManager) enqueue(e *jobEntry) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closing {
+		return Job{}, errJobsShuttingDown
+	}
+
+	e.ctx, e.cancel = context.WithCancel(withCorrelation(m.baseCtx, e.job.RequestID, e.traceParent))
+	e.subscribers = make(map[chan struct{}]struct{})
+
+	select {
+	case m.queue <- e:
+	default:
+		e.cancel()
+		return Job{}, errJobQueueFull
+	}
+	m.jobs[e.job.ID] = e
+	return e.job, nil
+}
+
+// Get returns a snapshot of a job
+func (m *JobManager) Get(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	return e.job, nil
+}
+
+// Cancel stops a queued or running job
+func (m *JobManager) Cancel(id string) (Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.jobs[id]
+	if !ok {
+		return Job{}, errJobNotFound
+	}
+	if e.job.Status.finished() {
+		return e.job, errJobFinished
+	}
+
+	e.canceledByUser = true
+	e.cancel()
+	if e.job.Status == JobQueued {
+		// The worker that eventually dequeues it will skip it
+		m.finishLocked(e, JobCanceled, nil, nil)
+	}
+	return e.job, nil
+}
+
+// Subscribe returns a channel that is signaled whenever the job changes, and
+// a function that stops the subscription. The channel is closed once the
+// job has finished or the manager shuts down.
+func (m *JobManager) Subscribe(id string) (<-chan struct{}, func(), error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	e, ok := m.jobs[id]
+	if !ok {
+		return nil, nil, errJobNotFound
+	}
+
+	ch := make(chan struct{}, 1)
+	if e.job.Status.finished() || m.closing {
+		close(ch)
+		return ch, func() {}, nil
+	}
+
+	e.subscribers[ch] = struct{}{}
+	unsubscribe := func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if _, ok := e.subscribers[ch]; ok {
+			delete(e.subscribers, ch)
+			close(ch)
+		}
+	}
+	return ch, unsubscribe, nil
+}
+
+// notifyLocked signals every subscriber of e without blocking
+func (m *JobManager) notifyLocked(e *jobEntry) {
+	for ch := range e.subscribers {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// closeSubscribersLocked ends every subscription of e
+func (m *JobManager) closeSubscribersLocked(e *jobEntry) {
+	for ch := range e.subscribers {
+		delete(e.subscribers, ch)
+		close(ch)
+	}
+}
+
+// finishLocked records the final state of a job
+func (m *JobManager) finishLocked(e *jobEntry, status JobStatus, result interface{}, jobErr *EnvelopeError) {
+	now := time.Now().UTC()
+	e.job.Status = status
+	e.job.Result = result
+	e.job.Error = jobErr
+	e.job.FinishedAt = &now
+	if status == JobSucceeded {
+		e.job.Progress = 1
+	}
+	e.target = nil
+	e.args = nil
+	m.notifyLocked(e)
+	m.closeSubscribersLocked(e)
+
+	// Restored jobs may have a callback the manager cannot deliver
+	if e.job.CallbackURL != "" && m.webhooks != nil {
+		m.webhooks.Deliver(e.job.CallbackURL, WebhookEvent{
+			ID:          newRequestID(),
+			Type:        "job." + string(status),
+			CreatedAt:   now,
+			Data:        e.job,
+			RequestID:   e.job.RequestID,
+			traceParent: e.traceParent,
+		})
+	}
+}
+
+func (m *JobManager) worker() {
+	defer m.wg.Done()
+
+	for {
+		// Prefer stopping over starting another job once shutdown began
+		select {
+		case <-m.stop:
+			return
+		default:
+		}
+
+		select {
+		case <-m.stop:
+			return
+		case e, ok := <-m.queue:
+			if !ok {
+				return
+			}
+			m.run(e)
+		}
+	}
+}
+
+// run executes one job and records its outcome
+func (m *JobManager) run(e *jobEntry) {
+	m.mu.Lock()
+	if e.job.Status != JobQueued || e.ctx.Err() != nil {
+		m.mu.Unlock()
+		return
+	}
+	started := time.Now().UTC()
+	e.job.Status = JobRunning
+	e.job.StartedAt = &started
+	m.notifyLocked(e)
+	m.mu.Unlock()
+
+	progress := func(p float64) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		// Only publish visible steps so subscribers are not flooded
+		if p-e.job.Progress >= 0.01 || p == 1 {
+			e.job.Progress = p
+			m.notifyLocked(e)
+		}
+	}
+
+	result, err := m.execute(e, progress)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case err == nil:
+		m.finishLocked(e, JobSucceeded, result, nil)
+	case errors.Is(err, context.Canceled) && !e.canceledByUser:
+		// Interrupted by shutdown, Shutdown decides what happens to it
+		e.job.Status = JobQueued
+		e.job.StartedAt = nil
+		e.job.Progress = 0
+	case errors.Is(err, context.Canceled):
+		m.finishLocked(e, JobCanceled, nil, nil)
+	default:
+		code := "calculation_error"
+		var opErr *OperationError
+		if errors.As(err, &opErr) {
+			code = opErr.Code
+		}
+		m.finishLocked(e, JobFailed, nil, &EnvelopeError{Code: code, Message: err.Error()})
+	}
+	e.cancel()
+}
+
+// execute runs the job's operation, failing the job with the error ID of
+// the logged stack if the operation panics
+func (m *JobManager) execute(e *jobEntry, progress func(float64)) (result interface{}, err error) {
+	defer func() {
+		if v := recover(); v != nil {
+			errorID, _ := m.panics.record(e.job.RequestID, "job "+e.job.ID, v)
+			err = &OperationError{
+				Code:    errorCode("Internal Server Error"),
+				Message: fmt.Sprintf("The job failed unexpectedly, quote error ID %s when reporting it", errorID),
+			}
+		}
+	}()
+	return e.op.execute(e.ctx, e.target, progress)
+}
+
+func (m *JobManager) cleanupJobs() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for id, e := range m.jobs {
+		if e.job.FinishedAt != nil && time.Since(*e.job.FinishedAt) > jobRetention {
+			delete(m.jobs, id)
+		}
+	}
+}
+
+// Shutdown stops accepting jobs and deals with the ones still pending.
+//
+// Without a state file the queue is drained: workers keep running queued
+// jobs until it is empty or ctx expires. With a state file, running jobs get
+// until ctx expires to finish and every job that has not started (or was
+// interrupted) is written to stateFile, to be resumed by Restore on the next
+// start. Either way subscribers are released so streaming responses end.
+func (m *JobManager) Shutdown(ctx context.Context, stateFile string) error {
+	m.mu.Lock()
+	m.closing = true
+	m.mu.Unlock()
+
+	if stateFile != "" {
+		close(m.stop)
+	} else {
+		// Workers exit once the queue is empty
+		close(m.queue)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		m.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		m.cancelJobs()
+		<-done
+	}
+
+	defer close(m.done)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var pending []*jobEntry
+	for _, e := range m.jobs {
+		if !e.job.Status.finished() {
+			pending = append(pending, e)
+		}
+		m.closeSubscribersLocked(e)
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].job.CreatedAt.Before(pending[j].job.CreatedAt) })
+
+	if stateFile == "" {
+		for _, e := range pending {
+			logf(m.logger, e.job.RequestID, "Job %s (%s) dropped at shutdown", e.job.ID, e.job.Operation)
+			e.cancel()
+			m.finishLocked(e, JobCanceled, nil, &EnvelopeError{Code: "shutdown", Message: "Server shut down before the job finished"})
+		}
+		return nil
+	}
+
+	saved := make([]persistedJob, 0, len(pending))
+	for _, e := range pending {
+		saved = append(saved, persistedJob{ID: e.job.ID, Operation: e.job.Operation, Args: e.args, CallbackURL: e.job.CallbackURL,
+			RequestID: e.job.RequestID, TraceParent: e.traceParent, CreatedAt: e.job.CreatedAt})
+	}
+	data, err := json.Marshal(saved)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(stateFile, data, 0o600); err != nil {
+		return err
+	}
+	m.logger.Printf("Persisted %d pending jobs to %s", len(saved), stateFile)
+	return nil
+}
+
+// Restore queues the jobs persisted by Shutdown and removes the state file
+func (m *JobManager) Restore(stateFile string) error {
+	data, err := os.ReadFile(stateFile)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var saved []persistedJob
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return err
+	}
+
+	restored := 0
+	for _, p := range saved {
+		op, target, err := prepareOperation(p.Operation, p.Args)
+		if err != nil {
+			m.logger.Printf("Skipping persisted job %s: %v", p.ID, err)
+			continue
+		}
+		_, err = m.enqueue(&jobEntry{
+			job: Job{ID: p.ID, Operation: p.Operation, Status: JobQueued, CallbackURL: p.CallbackURL,
+				RequestID: p.RequestID, CreatedAt: p.CreatedAt},
+			args:        p.Args,
+			op:          op,
+			target:      target,
+			traceParent: p.TraceParent,
+		})
+		if err != nil {
+			m.logger.Printf("Skipping persisted job %s: %v", p.ID, err)
+			continue
+		}
+		restored++
+	}
+
+	m.logger.Printf("Restored %d pending jobs from %s", restored, stateFile)
+	return os.Remove(stateFile)
+}
+
+// jobsHandler handles POST /jobs, which queues an operation
+func (s *Server) jobsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/jobs" {
+		sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+		return
+	}
+
+	if r.Method != http.MethodPost {
+		sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req JobRequest
+	if err := decodeRequestLimit(r, &req, maxJobBodySize); err != nil {
+		sendDecodeError(w, err)
+		return
+	}
+	if req.Operation == "" {
+		sendValidationError(w, invalid("operation is required", req))
+		return
+	}
+
+	if req.CallbackURL != "" {
+		if err := s.webhooks.CheckURL(req.CallbackURL); err != nil {
+			sendValidationError(w, err)
+			return
+		}
+	}
+
+	job, err := s.jobs.SubmitWithCallback(r.Context(), req.Operation, req.Args, req.CallbackURL)
+	if err != nil {
+		sendJobError(w, err)
+		return
+	}
+
+	// Point at the job under the same prefix the request came in on
+	base := strings.TrimSuffix(requestPath(r), r.URL.Path)
+	w.Header().Set("Location", base+"/jobs/"+job.ID)
+	sendDataResponseStatus(w, http.StatusAccepted, SuccessResponse{Success: true, Data: job}, job)
+}
+
+// jobHandler handles GET and DELETE /jobs/{id} and GET /jobs/{id}/events
+func (s *Server) jobHandler(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/jobs/"), "/")
+	if id == "" || (sub != "" && sub != "events") {
+		sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+		return
+	}
+
+	if sub == "events" {
+		if r.Method != http.MethodGet {
+			sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+			return
+		}
+		s.jobEventsHandler(w, r, id)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		job, err := s.jobs.Get(id)
+		if err != nil {
+			sendJobError(w, err)
+			return
+		}
+		sendSuccessResponse(w, job)
+	case http.MethodDelete:
+		job, err := s.jobs.Cancel(id)
+		if err != nil {
+			sendJobError(w, err)
+			return
+		}
+		sendSuccessResponse(w, job)
+	default:
+		sendErrorResponse(w, "Method Not Allowed", "Only GET and DELETE methods are allowed for this endpoint", http.StatusMethodNotAllowed)
+	}
+}
+
+// jobEventsHandler streams a job's progress as Server-Sent Events. Every
+// change is sent as a "progress" event carrying the job, and the stream ends
+// with a "done" event once the job has finished.
+func (s *Server) jobEventsHandler(w http.ResponseWriter, r *http.Request, id string) {
+	changed, unsubscribe, err := s.jobs.Subscribe(id)
+	if err != nil {
+		sendJobError(w, err)
+		return
+	}
+	defer unsubscribe()
+
+	// The stream outlives the server's WriteTimeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	seq := 0
+	send := func() (bool, error) {
+		job, err := s.jobs.Get(id)
+		if err != nil {
+			return true, err
+		}
+		event := "progress"
+		if job.Status.finished() {
+			event = "done"
+		}
+		data, err := json.Marshal(job)
+		if err != nil {
+			return true, err
+		}
+		seq++
+		if _, err := fmt.Fprintf(w, "event: %s\nid: %d\ndata: %s\n\n", event, seq, data); err != nil {
+			return true, err
+		}
+		return job.Status.finished(), rc.Flush()
+	}
+
+	if done, err := send(); done || err != nil {
+		return
+	}
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case _, ok := <-changed:
+			done, err := send()
+			if done || err != nil || !ok {
+				return
+			}
+		}
+	}
+}
+
+// sendJobError maps job manager and operation errors to HTTP responses
+func sendJobError(w http.ResponseWriter, err error) {
+	var opErr *OperationError
+	switch {
+	case errors.As(err, &opErr):
+		sendProblem(w, opErr.Title(), opErr.Message, http.StatusBadRequest, opErr.Fields)
+	case errors.Is(err, errJobNotFound):
+		sendErrorResponse(w, "Not Found", "Job not found", http.StatusNotFound)
+	case errors.Is(err, errJobFinished):
+		sendErrorResponse(w, "Conflict", "Job has already finished", http.StatusConflict)
+	case errors.Is(err, errJobQueueFull):
+		w.Header().Set("Retry-After", "5")
+		sendErrorResponse(w, "Service Unavailable", "Job queue is full, try again later", http.StatusServiceUnavailable)
+	case errors.Is(err, errJobsShuttingDown):
+		sendErrorResponse(w, "Service Unavailable", "Server is shutting down", http.StatusServiceUnavailable)
+	default:
+		sendErrorResponse(w, "Internal Server Error", err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// requestPath returns the path the client requested, before any prefix was stripped
+func requestPath(r *http.Request) string {
+	if u, err := url.ParseRequestURI(r.RequestURI); err == nil {
+		return u.Path
+	}
+	return r.URL.Path
+}
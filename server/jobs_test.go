@@ -0,0 +1,288 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// waitForJob polls m until the job reaches a finished status
+func waitForJob(t *testing.T, m *JobManager, id string) Job {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for time.Now().Before(deadline) {
+		job, err := m.Get(id)
+		if err != nil {
+			t.Fatalf("Get(%s) error: %v", id, err)
+		}
+		if job.Status.finished() {
+			return job
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatalf("Job %s did not finish", id)
+	return Job{}
+}
+
+// Test submitting a job over HTTP and polling it until it finishes
+func TestJobLifecycle(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("POST", "/v2/jobs", strings.NewReader(`{"operation":"matrix_inverse","args":{"matrix":[[4,7],[2,6]]}}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST status = %v, want %v: %s", w.Code, http.StatusAccepted, w.Body.String())
+	}
+	var submitted struct {
+		Data Job `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &submitted); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if got, want := w.Header().Get("Location"), "/v2/jobs/"+submitted.Data.ID; got != want {
+		t.Errorf("Location = %q, want %q", got, want)
+	}
+
+	waitForJob(t, s.jobs, submitted.Data.ID)
+
+	req = httptest.NewRequest("GET", "/jobs/"+submitted.Data.ID, nil)
+	w = httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, req)
+
+	var polled struct {
+		Success bool `json:"success"`
+		Data    struct {
+			Status   JobStatus    `json:"status"`
+			Progress float64      `json:"progress"`
+			Result   MatrixResult `json:"result"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &polled); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if polled.Data.Status != JobSucceeded || polled.Data.Progress != 1 {
+		t.Fatalf("Job = %+v, want succeeded with progress 1", polled.Data)
+	}
+	want := [][]float64{{0.6, -0.7}, {-0.2, 0.4}}
+	for i := range want {
+		for j := range want[i] {
+			if diff := polled.Data.Result.Inverse[i][j] - want[i][j]; diff > 1e-9 || diff < -1e-9 {
+				t.Errorf("Inverse = %v, want %v", polled.Data.Result.Inverse, want)
+			}
+		}
+	}
+}
+
+// Test the errors returned by the job endpoints
+func TestJobErrors(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		want   int
+		code   string
+	}{
+		{"unknown operation", "POST", "/v2/jobs", `{"operation":"sqrt","args":{}}`, http.StatusBadRequest, "unknown_operation"},
+		{"missing operation", "POST", "/v2/jobs", `{"args":{}}`, http.StatusBadRequest, "validation_error"},
+		{"invalid arguments", "POST", "/v2/jobs", `{"operation":"factorial_big","args":{"number":100001}}`, http.StatusBadRequest, "validation_error"},
+		{"non-square matrix", "POST", "/v2/jobs", `{"operation":"matrix_inverse","args":{"matrix":[[1,2]]}}`, http.StatusBadRequest, "validation_error"},
+		{"wrong method", "GET", "/v2/jobs", ``, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"unknown job", "GET", "/v2/jobs/nope", ``, http.StatusNotFound, "not_found"},
+		{"unknown sub-resource", "GET", "/v2/jobs/nope/results", ``, http.StatusNotFound, "not_found"},
+		{"cancel unknown job", "DELETE", "/v2/jobs/nope", ``, http.StatusNotFound, "not_found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			s.newRouter().ServeHTTP(w, req)
+
+			if w.Code != tt.want {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.want, w.Body.String())
+			}
+			var envelope Envelope
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if envelope.Error == nil || envelope.Error.Code != tt.code {
+				t.Errorf("error = %+v, want code %q", envelope.Error, tt.code)
+			}
+		})
+	}
+}
+
+// Test canceling queued and running jobs
+func TestJobCancel(t *testing.T) {
+	idle := NewJobManager(0, 10)
+	job, err := idle.Submit("multiply", map[string]interface{}{"a": 2.0, "b": 3.0})
+	if err != nil {
+		t.Fatalf("Submit error: %v", err)
+	}
+	if job, err = idle.Cancel(job.ID); err != nil || job.Status != JobCanceled {
+		t.Fatalf("Cancel queued job = %+v, %v, want canceled", job, err)
+	}
+	if _, err := idle.Cancel(job.ID); err != errJobFinished {
+		t.Errorf("Cancel finished job error = %v, want %v", err, errJobFinished)
+	}
+
+	busy := NewJobManager(1, 10)
+	job, err = busy.Submit("factorial_big", map[string]interface{}{"number": 100000.0})
+	if err != nil {
+		t.Fatalf("Submit error: %v", err)
+	}
+	for {
+		if current, _ := busy.Get(job.ID); current.Status != JobQueued {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := busy.Cancel(job.ID); err != nil && err != errJobFinished {
+		t.Fatalf("Cancel running job error: %v", err)
+	}
+	if job = waitForJob(t, busy, job.ID); job.Status != JobCanceled && job.Status != JobSucceeded {
+		t.Errorf("Status = %v, want canceled", job.Status)
+	}
+}
+
+// Test that progress is streamed as Server-Sent Events until the job is done
+func TestJobEvents(t *testing.T) {
+	s := newTestServer(t)
+	srv := httptest.NewServer(s.Handler())
+	defer srv.Close()
+
+	numbers := make([]interface{}, 50000)
+	for i := range numbers {
+		numbers[i] = float64(len(numbers) - i)
+	}
+	job, err := s.jobs.Submit("sort", map[string]interface{}{"numbers": numbers})
+	if err != nil {
+		t.Fatalf("Submit error: %v", err)
+	}
+
+	req, _ := http.NewRequest("GET", srv.URL+"/v2/jobs/"+job.ID+"/events", nil)
+	req.Header.Set("Accept", "text/event-stream")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("GET events error: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type = %q, want text/event-stream", ct)
+	}
+
+	var events []string
+	var last Job
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, 4<<20)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if event, ok := strings.CutPrefix(line, "event: "); ok {
+			events = append(events, event)
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			if err := json.Unmarshal([]byte(data), &last); err != nil {
+				t.Fatalf("Invalid event data: %v", err)
+			}
+		}
+	}
+
+	if len(events) == 0 || events[len(events)-1] != "done" {
+		t.Fatalf("events = %v, want a final done event", events)
+	}
+	if last.Status != JobSucceeded {
+		t.Errorf("final status = %v, want %v", last.Status, JobSucceeded)
+	}
+}
+
+// Test that shutdown with a state file persists queued jobs and Restore resumes them
+func TestJobShutdownPersistsQueue(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "jobs.json")
+
+	old := NewJobManager(0, 10)
+	ctx := withCorrelation(context.Background(), "req-restored", testTraceParent)
+	first, _ := old.SubmitWithCallback(ctx, "multiply", map[string]interface{}{"a": 6.0, "b": 7.0}, "")
+	second, _ := old.Submit("factorial", map[string]interface{}{"number": 5.0})
+
+	if err := old.Shutdown(context.Background(), stateFile); err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+	if _, err := old.Submit("multiply", nil); err != errJobsShuttingDown {
+		t.Errorf("Submit after shutdown error = %v, want %v", err, errJobsShuttingDown)
+	}
+
+	restarted := NewJobManager(1, 10)
+	if err := restarted.Restore(stateFile); err != nil {
+		t.Fatalf("Restore error: %v", err)
+	}
+	if _, err := os.Stat(stateFile); !os.IsNotExist(err) {
+		t.Errorf("State file still exists after Restore")
+	}
+
+	for _, id := range []string{first.ID, second.ID} {
+		if job := waitForJob(t, restarted, id); job.Status != JobSucceeded {
+			t.Errorf("Restored job %s = %+v, want succeeded", id, job)
+		}
+	}
+	restarted.mu.Lock()
+	e := restarted.jobs[first.ID]
+	restarted.mu.Unlock()
+	if e.job.RequestID != "req-restored" || e.traceParent != testTraceParent {
+		t.Errorf("Restored job kept request ID %q and traceparent %q", e.job.RequestID, e.traceParent)
+	}
+}
+
+// Test that shutdown without a state file drains the queue
+func TestJobShutdownDrainsQueue(t *testing.T) {
+	m := NewJobManager(1, 10)
+	var ids []string
+	for i := 0; i < 5; i++ {
+		job, err := m.Submit("power", map[string]interface{}{"base": 2.0, "exponent": float64(i)})
+		if err != nil {
+			t.Fatalf("Submit error: %v", err)
+		}
+		ids = append(ids, job.ID)
+	}
+
+	if err := m.Shutdown(context.Background(), ""); err != nil {
+		t.Fatalf("Shutdown error: %v", err)
+	}
+	for _, id := range ids {
+		if job, _ := m.Get(id); job.Status != JobSucceeded {
+			t.Errorf("Job %s = %v after drain, want succeeded", id, job.Status)
+		}
+	}
+}
+
+// Test that a full queue rejects submissions
+func TestJobQueueFull(t *testing.T) {
+	m := NewJobManager(0, 1)
+	if _, err := m.Submit("multiply", nil); err != nil {
+		t.Fatalf("Submit error: %v", err)
+	}
+	if _, err := m.Submit("multiply", nil); err != errJobQueueFull {
+		t.Errorf("Submit error = %v, want %v", err, errJobQueueFull)
+	}
+}
+
+// Test that a manager without a webhook dispatcher rejects callbacks
+func TestJobCallbackWithoutWebhooks(t *testing.T) {
+	m := NewJobManager(0, 1)
+	if _, err := m.SubmitWithCallback(context.Background(), "multiply", nil, "https://example.com/hook"); err != errNoWebhooks {
+		t.Errorf("SubmitWithCallback error = %v, want %v", err, errNoWebhooks)
+	}
+}
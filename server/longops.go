@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/big"
+	"strconv"
+)
+
+// Long-running operations. They are too slow for a synchronous request, so
+// they are only reachable through the job API and WebSocket sessions. Each
+// one checks ctx between steps so a canceled job stops promptly, and reports
+// how far it got through progress (0 to 1).
+
+// BigFactorialRequest represents the arguments of the factorial_big operation
+type BigFactorialRequest struct {
+	Number int `json:"number" minimum:"0" maximum:"100000"`
+}
+
+// Validate checks that number is within bounds
+func (req BigFactorialRequest) Validate() error {
+	if req.Number < 0 {
+		return invalid("Number must be non-negative", req)
+	}
+	if req.Number > 100000 {
+		return invalid("Number too large for factorial calculation (max 100000)", req)
+	}
+	return nil
+}
+
+// BigFactorialResult is the exact factorial as a decimal string
+type BigFactorialResult struct {
+	Input  int    `json:"input"`
+	Digits int    `json:"digits"`
+	Result string `json:"result"`
+}
+
+// SortRequest represents the arguments of the sort operation
+type SortRequest struct {
+	Numbers    []float64 `json:"numbers" minItems:"1" maxItems:"1000000"`
+	Descending bool      `json:"descending"`
+}
+
+// Validate checks the array length
+func (req SortRequest) Validate() error {
+	if len(req.Numbers) == 0 {
+		return invalid("Array cannot be empty", req)
+	}
+	if len(req.Numbers) > 1000000 {
+		return invalid("Array too large (max 1000000 elements)", req)
+	}
+	return nil
+}
+
+// SortResult is the sorted array
+type SortResult struct {
+	Results []float64 `json:"results"`
+	Count   int       `json:"count"`
+}
+
+// MatrixRequest represents the arguments of the matrix_inverse operation
+type MatrixRequest struct {
+	Matrix [][]float64 `json:"matrix" minItems:"1" maxItems:"300"`
+}
+
+// Validate checks that the matrix is square, within bounds and finite
+func (req MatrixRequest) Validate() error {
+	n := len(req.Matrix)
+	if n == 0 {
+		return invalid("Matrix cannot be empty", req)
+	}
+	if n > 300 {
+		return invalid("Matrix too large (max 300x300)", req)
+	}
+	for i, row := range req.Matrix {
+		if len(row) != n {
+			return invalid("Matrix must be square", req, indexedField("matrix", i, reasonNotSquare, "must have "+strconv.Itoa(n)+" values, one per row"))
+		}
+		for _, v := range row {
+			if math.IsNaN(v) || math.IsInf(v, 0) || math.Abs(v) > 1e15 {
+				return invalid("Matrix values are too large", req, indexedField("matrix", i, reasonAboveMaximum, "values must be finite and between -1e+15 and 1e+15"))
+			}
+		}
+	}
+	return nil
+}
+
+// MatrixResult is the inverse of a matrix
+type MatrixResult struct {
+	Inverse [][]float64 `json:"inverse"`
+}
+
+// BigFactorial calculates n! exactly
+func BigFactorial(ctx context.Context, n int, progress func(float64)) (BigFactorialResult, error) {
+	result := big.NewInt(1)
+	for i := 2; i <= n; i++ {
+		result.Mul(result, big.NewInt(int64(i)))
+		if i%1000 == 0 {
+			if err := ctx.Err(); err != nil {
+				return BigFactorialResult{}, err
+			}
+			progress(float64(i) / float64(n))
+		}
+	}
+
+	digits := result.String()
+	return BigFactorialResult{Input: n, Digits: len(digits), Result: digits}, nil
+}
+
+// SortNumbers sorts a copy of numbers with a bottom-up merge sort, reporting
+// progress after each pass
+func SortNumbers(ctx context.Context, numbers []float64, descending bool, progress func(float64)) (SortResult, error) {
+	src := append([]float64(nil), numbers...)
+	dst := make([]float64, len(src))
+	less := func(a, b float64) bool { return a <= b }
+	if descending {
+		less = func(a, b float64) bool { return a >= b }
+	}
+
+	passes := math.Ceil(math.Log2(float64(len(src))))
+	pass := 0.0
+	for width := 1; width < len(src); width *= 2 {
+		if err := ctx.Err(); err != nil {
+			return SortResult{}, err
+		}
+
+		for left := 0; left < len(src); left += 2 * width {
+			mid, right := left+width, left+2*width
+			if mid > len(src) {
+				mid = len(src)
+			}
+			if right > len(src) {
+				right = len(src)
+			}
+			i, j := left, mid
+			for k := left; k < right; k++ {
+				if i < mid && (j >= right || less(src[i], src[j])) {
+					dst[k] = src[i]
+					i++
+				} else {
+					dst[k] = src[j]
+					j++
+				}
+			}
+		}
+		src, dst = dst, src
+
+		pass++
+		progress(pass / passes)
+	}
+
+	return SortResult{Results: src, Count: len(src)}, nil
+}
+
+// InvertMatrix inverts a square matrix by Gauss-Jordan elimination with
+// partial pivoting, reporting progress after each column
+func InvertMatrix(ctx context.Context, matrix [][]float64, progress func(float64)) (MatrixResult, error) {
+	n := len(matrix)
+
+	// Augment a copy of the matrix with the identity
+	aug := make([][]float64, n)
+	for i, row := range matrix {
+		aug[i] = make([]float64, 2*n)
+		copy(aug[i], row)
+		aug[i][n+i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		if err := ctx.Err(); err != nil {
+			return MatrixResult{}, err
+		}
+
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if math.Abs(aug[row][col]) > math.Abs(aug[pivot][col]) {
+				pivot = row
+			}
+		}
+		if math.Abs(aug[pivot][col]) < 1e-12 {
+			return MatrixResult{}, errors.New("matrix is singular")
+		}
+		aug[col], aug[pivot] = aug[pivot], aug[col]
+
+		scale := aug[col][col]
+		for k := range aug[col] {
+			aug[col][k] /= scale
+		}
+		for row := 0; row < n; row++ {
+			if row == col || aug[row][col] == 0 {
+				continue
+			}
+			factor := aug[row][col]
+			for k := range aug[row] {
+				aug[row][k] -= factor * aug[col][k]
+			}
+		}
+
+		progress(float64(col+1) / float64(n))
+	}
+
+	inverse := make([][]float64, n)
+	for i := range aug {
+		inverse[i] = aug[i][n:]
+	}
+	return MatrixResult{Inverse: inverse}, nil
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"context"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func noProgress(float64) {}
+
+// Test BigFactorial against known values
+func TestBigFactorial(t *testing.T) {
+	tests := []struct {
+		n      int
+		result string
+	}{
+		{0, "1"},
+		{1, "1"},
+		{20, "2432902008176640000"},
+		{25, "15511210043330985984000000"},
+	}
+
+	for _, tt := range tests {
+		got, err := BigFactorial(context.Background(), tt.n, noProgress)
+		if err != nil {
+			t.Fatalf("BigFactorial(%d) error: %v", tt.n, err)
+		}
+		if got.Result != tt.result || got.Digits != len(tt.result) {
+			t.Errorf("BigFactorial(%d) = %+v, want %s", tt.n, got, tt.result)
+		}
+	}
+}
+
+// Test SortNumbers in both directions
+func TestSortNumbers(t *testing.T) {
+	tests := []struct {
+		input      []float64
+		descending bool
+		want       []float64
+	}{
+		{[]float64{3}, false, []float64{3}},
+		{[]float64{3, 1, 2}, false, []float64{1, 2, 3}},
+		{[]float64{5, -1, 3, 3, 0}, false, []float64{-1, 0, 3, 3, 5}},
+		{[]float64{5, -1, 3, 3, 0}, true, []float64{5, 3, 3, 0, -1}},
+	}
+
+	for _, tt := range tests {
+		got, err := SortNumbers(context.Background(), tt.input, tt.descending, noProgress)
+		if err != nil {
+			t.Fatalf("SortNumbers(%v) error: %v", tt.input, err)
+		}
+		if !reflect.DeepEqual(got.Results, tt.want) || got.Count != len(tt.want) {
+			t.Errorf("SortNumbers(%v, %v) = %v, want %v", tt.input, tt.descending, got.Results, tt.want)
+		}
+	}
+}
+
+// Test InvertMatrix, including a singular matrix and cancellation
+func TestInvertMatrix(t *testing.T) {
+	matrix := [][]float64{{2, 0, 0}, {0, 4, 0}, {1, 0, 1}}
+	want := [][]float64{{0.5, 0, 0}, {0, 0.25, 0}, {-0.5, 0, 1}}
+
+	got, err := InvertMatrix(context.Background(), matrix, noProgress)
+	if err != nil {
+		t.Fatalf("InvertMatrix error: %v", err)
+	}
+	for i := range want {
+		for j := range want[i] {
+			if math.Abs(got.Inverse[i][j]-want[i][j]) > 1e-12 {
+				t.Fatalf("InvertMatrix = %v, want %v", got.Inverse, want)
+			}
+		}
+	}
+
+	if _, err := InvertMatrix(context.Background(), [][]float64{{1, 2}, {2, 4}}, noProgress); err == nil {
+		t.Error("InvertMatrix of a singular matrix should fail")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := InvertMatrix(ctx, matrix, noProgress); err != context.Canceled {
+		t.Errorf("InvertMatrix with canceled context error = %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+        "bytes"
+        "encoding/json"
+        "net/http"
+        "net/http/httptest"
+        "testing"
+)
+
+// Test multiplyHandler endpoint
+func TestMultiplyHandler(t *testing.T) {
+        s := newTestServer(t)
+        tests := []struct {
+                name           string
+                method         string
+                path           string
+                body           interface{}
+                expectedStatus int
+                expectSuccess  bool
+        }{
+                {
+                        name:           "valid multiplication",
+                        method:         "POST",
+                        path:           "/multiply",
+                        body:           MultiplyRequest{A: 5.0, B: 3.0},
+                        expectedStatus: http.StatusOK,
+                        expectSuccess:  true,
+                },
+                {
+                        name:           "wrong method",
+                        method:         "PUT",
+                        path:           "/multiply",
+                        body:           nil,
+                        expectedStatus: http.StatusMethodNotAllowed,
+                        expectSuccess:  false,
+                },
+                {
+                        name:           "wrong path",
+                        method:         "POST",
+                        path:           "/multiply/wrong",
+                        body:           MultiplyRequest{A: 5.0, B: 3.0},
+                        expectedStatus: http.StatusNotFound,
+                        expectSuccess:  false,
+                },
+                {
+                        name:           "invalid JSON",
+                        method:         "POST",
+                        path:           "/multiply",
+                        body:           "invalid json",
+                        expectedStatus: http.StatusBadRequest,
+                        expectSuccess:  false,
+                },
+                {
+                        name:           "numbers too large",
+                        method:         "POST",
+                        path:           "/multiply",
+                        body:           MultiplyRequest{A: 1e16, B: 3.0},
+                        expectedStatus: http.StatusBadRequest,
+                        expectSuccess:  false,
+                },
+        }
+
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        var body []byte
+                        var err error
+                        if tt.body != nil {
+                                if str, ok := tt.body.(string); ok {
+                                        body = []byte(str)
+                                } else {
+                                        body, err = json.Marshal(tt.body)
+                                        if err != nil {
+                                                t.Fatalf("Failed to marshal request body: %v", err)
+                                        }
+                                }
+                        }
+
+                        req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(body))
+                        req.Header.Set("Content-Type", "application/json")
+                        w := httptest.NewRecorder()
+
+                        s.multiplyHandler(w, req)
+
+                        if w.Code != tt.expectedStatus {
+                                t.Errorf("multiplyHandler() status = %v, want %v", w.Code, tt.expectedStatus)
+                        }
+
+                        if tt.expectSuccess {
+                                var response map[string]interface{}
+                                if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+                                        t.Errorf("Failed to unmarshal response: %v", err)
+                                }
+                                if success, ok := response["success"].(bool); !ok || !success {
+                                        t.Errorf("Expected successful response, got: %v", response)
+                                }
+                        }
+                })
+        }
+}
+
+// Test multiplyArrayHandler endpoint
+func TestMultiplyArrayHandler(t *testing.T) {
+        s := newTestServer(t)
+        tests := []struct {
+                name           string
+                method         string
+                path           string
+                body           interface{}
+                expectedStatus int
+                expectSuccess  bool
+        }{
+                {
+                        name:           "valid array multiplication",
+                        method:         "POST",
+                        path:           "/multiply/array",
+                        body:           ArrayRequest{Numbers: []float64{2.0, 3.0, 4.0}},
+                        expectedStatus: http.StatusOK,
+                        expectSuccess:  true,
+                },
+                {
+                        name:           "empty array",
+                        method:         "POST",
+                        path:           "/multiply/array",
+                        body:           ArrayRequest{Numbers: []float64{}},
+                        expectedStatus: http.StatusBadRequest,
+                        expectSuccess:  false,
+                },
+                {
+                        name:           "array too large",
+                        method:         "POST",
+                        path:           "/multiply/array",
+                        body:           ArrayRequest{Numbers: make([]float64, 1001)},
+                        expectedStatus: http.StatusBadRequest,
+                        expectSuccess:  false,
+                },
+                {
+                        name:           "numbers too large",
+                        method:         "POST",
+                        path:           "/multiply/array",
+                        body:           ArrayRequest{Numbers: []float64{1e11, 2.0}},
+                        expectedStatus: http.StatusBadRequest,
+                        expectSuccess:  false,
+                },
+        }
+
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        body, err := json.Marshal(tt.body)
+                        if err != nil {
+                                t.Fatalf("Failed to marshal request body: %v", err)
+                        }
+
+                        req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(body))
+                        req.Header.Set("Content-Type", "application/json")
+                        w := httptest.NewRecorder()
+
+                        s.multiplyArrayHandler(w, req)
+
+                        if w.Code != tt.expectedStatus {
+                                t.Errorf("multiplyArrayHandler() status = %v, want %v", w.Code, tt.expectedStatus)
+                        }
+
+                        if tt.expectSuccess {
+                                var response map[string]interface{}
+                                if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+                                        t.Errorf("Failed to unmarshal response: %v", err)
+                                }
+                                if success, ok := response["success"].(bool); !ok || !success {
+                                        t.Errorf("Expected successful response, got: %v", response)
+                                }
+                        }
+                })
+        }
+}
+
+// Test factorialHandler endpoint
+func TestFactorialHandler(t *testing.T) {
+        s := newTestServer(t)
+        tests := []struct {
+                name           string
+                method         string
+                path           string
+                body           interface{}
+                expectedStatus int
+                expectSuccess  bool
+        }{
+                {
+                        name:           "valid factorial",
+                        method:         "POST",
+                        path:           "/factorial",
+                        body:           FactorialRequest{Number: 5},
+                        expectedStatus: http.StatusOK,
+                        expectSuccess:  true,
+                },
+                {
+                        name:           "negative number",
+                        method:         "POST",
+                        path:           "/factorial",
+                        body:           FactorialRequest{Number: -1},
+                        expectedStatus: http.StatusBadRequest,
+                        expectSuccess:  false,
+                },
+                {
+                        name:           "number too large",
+                        method:         "POST",
+                        path:           "/factorial",
+                        body:           FactorialRequest{Number: 25},
+                        expectedStatus: http.StatusBadRequest,
+                        expectSuccess:  false,
+                },
+        }
+
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        body, err := json.Marshal(tt.body)
+                        if err != nil {
+                                t.Fatalf("Failed to marshal request body: %v", err)
+                        }
+
+                        req := httptest.NewRequest(tt.method, tt.path, bytes.NewReader(body))
+                        req.Header.Set("Content-Type", "application/json")
+                        w := httptest.NewRecorder()
+
+                        s.factorialHandler(w, req)
+
+                        if w.Code != tt.expectedStatus {
+                                t.Errorf("factorialHandler() status = %v, want %v", w.Code, tt.expectedStatus)
+                        }
+
+                        if tt.expectSuccess {
+                                var response map[string]interface{}
+                                if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+                                        t.Errorf("Failed to unmarshal response: %v", err)
+                                }
+                                if success, ok := response["success"].(bool); !ok || !success {
+                                        t.Errorf("Expected successful response, got: %v", response)
+                                }
+                        }
+                })
+        }
+}
@@ -0,0 +1,526 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// openAPIVersion is the version of the API described by the generated document
+const openAPIVersion = "1.0.0"
+
+var (
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+)
+
+// openAPIHandler serves the OpenAPI 3 document generated from apiRoutes and
+// extraRoutes
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	openAPIOnce.Do(func() {
+		var err error
+		openAPIDoc, err = json.MarshalIndent(buildOpenAPISpec(apiRoutes), "", "  ")
+		if err != nil {
+			log.Printf("OpenAPI generation error: %v", err)
+		}
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDoc)
+}
+
+// docsHandler serves the page that renders /openapi.json
+func (s *Server) docsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	http.ServeFile(w, r, filepath.Join(s.staticDir, "docs.html"))
+}
+
+// schemaBuilder turns Go types into OpenAPI schemas. Named struct types are
+// emitted once under components/schemas and referenced with $ref.
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+// buildOpenAPISpec generates the OpenAPI document for the given routes
+func buildOpenAPISpec(routes []apiRoute) map[string]interface{} {
+	sb := &schemaBuilder{components: map[string]interface{}{}}
+
+	versions := []struct {
+		prefix     string
+		version    string
+		deprecated bool
+	}{
+		{"/v1", apiV1, true},
+		{"/v2", apiV2, false},
+	}
+
+	paths := map[string]interface{}{}
+	pathItem := func(path string) map[string]interface{} {
+		item, ok := paths[path].(map[string]interface{})
+		if !ok {
+			item = map[string]interface{}{}
+			paths[path] = item
+		}
+		return item
+	}
+
+	for _, v := range versions {
+		for _, route := range routes {
+			path := v.prefix + route.Path
+			op := sb.operation(route, v.version)
+			if v.deprecated {
+				op["deprecated"] = true
+			}
+
+			item := pathItem(path)
+			item[strings.ToLower(route.Method)] = op
+
+			if route.Query {
+				get := route
+				get.Method = http.MethodGet
+				op := sb.operation(get, v.version)
+				if v.deprecated {
+					op["deprecated"] = true
+				}
+				item["get"] = op
+			}
+		}
+	}
+
+	for _, route := range extraRoutes {
+		if !route.Versioned {
+			pathItem(route.Path)[strings.ToLower(route.Method)] = sb.extraOperation(route, route.Version)
+			continue
+		}
+		for _, v := range versions {
+			op := sb.extraOperation(route, v.version)
+			if v.deprecated {
+				op["deprecated"] = true
+			}
+			pathItem(v.prefix + route.Path)[strings.ToLower(route.Method)] = op
+		}
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title": "Go-First-project API",
+			"description": "Arithmetic API served by the Go-First-project webserver. Requests are rate limited per client and route; " +
+				"the RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset headers describe the caller's quota. " +
+				"/v1 keeps the original response shapes and is deprecated; unprefixed paths are aliases of /v1. " +
+				"/v2 wraps every response in a uniform envelope with data, error and meta.",
+			"version": openAPIVersion,
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": sb.components,
+			"securitySchemes": map[string]interface{}{
+				"adminToken": map[string]interface{}{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+// extraRoute documents an endpoint that newRouter registers by hand rather
+// than from apiRoutes
+type extraRoute struct {
+	apiRoute
+	Versioned bool              // served under /v1 and /v2 like apiRoutes
+	Version   string            // version of the response shapes when not Versioned
+	Status    int               // success status, 200 when zero
+	Admin     bool              // requires the ADMIN_TOKEN bearer token
+	Errors    map[string]string // error responses beyond the common ones
+}
+
+// activityQuery documents the query parameters of GET /events
+type activityQuery struct {
+	Type        string `json:"type,omitempty" description:"Comma separated event types to receive"`
+	Route       string `json:"route,omitempty" description:"Comma separated routes, a trailing * matches by prefix"`
+	LastEventID string `json:"last_event_id,omitempty" description:"Resume after this event id, like the Last-Event-ID header"`
+}
+
+// extraRoutes lists the jobs, streaming and operator endpoints
+var extraRoutes = []extraRoute{
+	{apiRoute: apiRoute{Path: "/jobs", Method: http.MethodPost, Summary: "Queue a long running operation", Request: JobRequest{}, Response: Job{}, Envelope: true},
+		Versioned: true, Status: http.StatusAccepted, Errors: map[string]string{"413": "Request body too large"}},
+	{apiRoute: apiRoute{Path: "/jobs/{id}", Method: http.MethodGet, Summary: "Status and result of a job", Response: Job{}, Envelope: true},
+		Versioned: true},
+	{apiRoute: apiRoute{Path: "/jobs/{id}", Method: http.MethodDelete, Summary: "Cancel a queued or running job", Response: Job{}, Envelope: true},
+		Versioned: true, Errors: map[string]string{"409": "Job has already finished"}},
+	{apiRoute: apiRoute{Path: "/jobs/{id}/events", Method: http.MethodGet, Summary: "Job progress as Server-Sent Events", Response: "", ContentType: "text/event-stream"},
+		Versioned: true},
+	{apiRoute: apiRoute{Path: "/events", Method: http.MethodGet, Summary: "Server activity as Server-Sent Events", Request: activityQuery{}, Response: "", ContentType: "text/event-stream"},
+		Version: apiV1},
+	{apiRoute: apiRoute{Path: "/ws", Method: http.MethodGet, Summary: "Upgrade to a WebSocket calculator session"},
+		Version: apiV1, Status: http.StatusSwitchingProtocols, Errors: map[string]string{"400": "Invalid WebSocket handshake", "403": "Origin not allowed", "426": "WebSocket upgrade required"}},
+	{apiRoute: apiRoute{Path: "/metrics", Method: http.MethodGet, Summary: "Prometheus metrics", Response: "", ContentType: "text/plain"},
+		Version: apiV1},
+	{apiRoute: apiRoute{Path: "/admin/webhooks/dead-letters", Method: http.MethodGet, Summary: "Webhook events that could not be delivered", Response: []DeadLetter{}},
+		Version: apiV2, Admin: true},
+	{apiRoute: apiRoute{Path: "/admin/webhooks/dead-letters/{id}", Method: http.MethodDelete, Summary: "Discard a dead letter", Response: DeadLetter{}},
+		Version: apiV2, Admin: true},
+	{apiRoute: apiRoute{Path: "/admin/webhooks/dead-letters/{id}/retry", Method: http.MethodPost, Summary: "Redeliver a dead letter", Response: DeadLetter{}},
+		Version: apiV2, Admin: true, Status: http.StatusAccepted},
+	{apiRoute: apiRoute{Path: "/admin/bans", Method: http.MethodGet, Summary: "Clients currently banned", Response: []Ban{}},
+		Version: apiV2, Admin: true},
+	{apiRoute: apiRoute{Path: "/admin/bans/{client}", Method: http.MethodDelete, Summary: "Lift a ban", Response: Ban{}},
+		Version: apiV2, Admin: true},
+}
+
+// extraOperation describes a hand routed endpoint as served under the given
+// API version, adding its path parameters, success status and extra errors
+func (sb *schemaBuilder) extraOperation(route extraRoute, version string) map[string]interface{} {
+	op := sb.operation(route.apiRoute, version)
+	responses := op["responses"].(map[string]interface{})
+	errorResponse := responses["404"].(map[string]interface{})
+
+	ok := responses["200"].(map[string]interface{})
+	switch {
+	case route.Response == nil:
+		delete(ok, "content")
+	case route.ContentType != "":
+		// Streams and metrics keep their own format under every version
+		ok["content"] = map[string]interface{}{
+			route.ContentType: map[string]interface{}{"schema": sb.schemaFor(reflect.TypeOf(route.Response))},
+		}
+	}
+	if route.Status != 0 && route.Status != http.StatusOK {
+		delete(responses, "200")
+		ok["description"] = http.StatusText(route.Status)
+		responses[strconv.Itoa(route.Status)] = ok
+	}
+	for status, description := range route.Errors {
+		responses[status] = map[string]interface{}{"description": description, "content": errorResponse["content"]}
+	}
+	if route.Admin {
+		responses["401"] = map[string]interface{}{"description": "Missing or invalid admin bearer token", "content": errorResponse["content"]}
+		responses["403"] = map[string]interface{}{"description": "Admin endpoints are disabled, ADMIN_TOKEN is not set", "content": errorResponse["content"]}
+		op["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+	}
+
+	var params []interface{}
+	for _, segment := range strings.Split(route.Path, "/") {
+		if name, ok := strings.CutPrefix(segment, "{"); ok {
+			params = append(params, map[string]interface{}{
+				"name":     strings.TrimSuffix(name, "}"),
+				"in":       "path",
+				"required": true,
+				"schema":   map[string]interface{}{"type": "string"},
+			})
+		}
+	}
+	if existing, ok := op["parameters"].([]interface{}); ok {
+		params = append(params, existing...)
+	}
+	if params != nil {
+		op["parameters"] = params
+	}
+
+	return op
+}
+
+// operation describes one route as served under the given API version
+func (sb *schemaBuilder) operation(route apiRoute, version string) map[string]interface{} {
+	op := map[string]interface{}{
+		"summary":     route.Summary,
+		"operationId": operationID(version, route),
+	}
+
+	if route.Request != nil && route.Method == http.MethodGet {
+		op["parameters"] = sb.queryParameters(reflect.TypeOf(route.Request))
+	} else if route.Request != nil {
+		schema := sb.schemaFor(reflect.TypeOf(route.Request))
+		content := map[string]interface{}{}
+		for _, mt := range supportedMediaTypes() {
+			content[mt] = map[string]interface{}{"schema": schema}
+		}
+		if _, ok := route.Request.(FormRequest); ok {
+			content["application/x-www-form-urlencoded"] = map[string]interface{}{"schema": schema}
+		}
+		op["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content":  content,
+		}
+	}
+
+	var responseSchema map[string]interface{}
+	if route.Response != nil {
+		responseSchema = sb.schemaFor(reflect.TypeOf(route.Response))
+	}
+	errorSchema := sb.schemaFor(reflect.TypeOf(ErrorResponse{}))
+	if version == apiV2 {
+		responseSchema = sb.envelopeSchema(responseSchema)
+		errorSchema = sb.envelopeSchema(nil)
+	} else if route.Envelope {
+		properties := map[string]interface{}{
+			"success": map[string]interface{}{"type": "boolean"},
+			"data":    responseSchema,
+		}
+		required := []string{"success", "data"}
+		if route.Message {
+			properties["message"] = map[string]interface{}{"type": "string"}
+			required = append(required, "message")
+		}
+		responseSchema = map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		}
+	}
+
+	okContent := map[string]interface{}{}
+	if route.ContentType != "" && version != apiV2 {
+		okContent[route.ContentType] = map[string]interface{}{"schema": responseSchema}
+	} else {
+		for _, mt := range supportedMediaTypes() {
+			okContent[mt] = map[string]interface{}{"schema": responseSchema}
+		}
+	}
+
+	// v1 errors are problem documents, served as application/problem+json
+	// or application/problem+xml where the format has a problem media type
+	errorContent := map[string]interface{}{}
+	for _, mt := range supportedMediaTypes() {
+		if codec, ok := lookupCodec(mt); ok && version != apiV2 {
+			if problemMediaType := problemContentType(codec); problemMediaType != codec.ContentType() {
+				mt = problemMediaType
+			}
+		}
+		errorContent[mt] = map[string]interface{}{"schema": errorSchema}
+	}
+	errorResponse := func(description string) map[string]interface{} {
+		return map[string]interface{}{"description": description, "content": errorContent}
+	}
+
+	responses := map[string]interface{}{
+		"200": map[string]interface{}{"description": "Successful response", "content": okContent},
+		"404": errorResponse("Path not found"),
+		"405": errorResponse("Method not allowed"),
+		"406": errorResponse("No acceptable response media type"),
+		"429": errorResponse("Rate limit exceeded"),
+		"500": errorResponse("Unexpected server error, error_id names it in the server log"),
+		"503": errorResponse("Server overloaded, retry after Retry-After seconds"),
+	}
+	if route.Request != nil && route.Method == http.MethodGet {
+		responses["400"] = errorResponse("Invalid query parameters or validation error")
+	} else if route.Request != nil {
+		responses["400"] = errorResponse("Invalid request body or validation error")
+		responses["415"] = errorResponse("Unsupported request media type")
+	}
+	op["responses"] = responses
+
+	return op
+}
+
+// envelopeSchema describes the v2 Envelope carrying data, or an error when data is nil
+func (sb *schemaBuilder) envelopeSchema(data map[string]interface{}) map[string]interface{} {
+	nullable := func(schema map[string]interface{}) map[string]interface{} {
+		return map[string]interface{}{"allOf": []interface{}{schema}, "nullable": true}
+	}
+
+	dataSchema := map[string]interface{}{"nullable": true}
+	if data != nil {
+		dataSchema = nullable(data)
+	}
+
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"data":  dataSchema,
+			"error": nullable(sb.schemaFor(reflect.TypeOf(EnvelopeError{}))),
+			"meta":  sb.schemaFor(reflect.TypeOf(EnvelopeMeta{})),
+		},
+		"required": []string{"data", "error", "meta"},
+	}
+}
+
+// operationID derives a stable operationId such as "v2PostMultiplyArray" or
+// "v2GetJobsIdEvents"
+func operationID(version string, route apiRoute) string {
+	id := version
+	parts := append([]string{strings.ToLower(route.Method)}, strings.FieldsFunc(route.Path, func(r rune) bool { return strings.ContainsRune("/-{}", r) })...)
+	for _, part := range parts {
+		id += strings.ToUpper(part[:1]) + part[1:]
+	}
+	return id
+}
+
+// schemaFor returns the schema for t
+func (sb *schemaBuilder) schemaFor(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == reflect.TypeOf(time.Time{}) {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]interface{}{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint, reflect.Uint64:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case reflect.Float32:
+		return map[string]interface{}{"type": "number", "format": "float"}
+	case reflect.Float64:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": sb.schemaFor(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": sb.schemaFor(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return sb.structSchema(t)
+		}
+		if _, exists := sb.components[t.Name()]; !exists {
+			// Reserve the name first so recursive types terminate
+			sb.components[t.Name()] = map[string]interface{}{}
+			sb.components[t.Name()] = sb.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	return map[string]interface{}{}
+}
+
+// structSchema builds an object schema from a struct's exported JSON fields.
+// Validation bounds come from the minimum, maximum, minItems, maxItems,
+// minLength and maxLength struct tags; for slices minimum and maximum apply
+// to the items. Fields are required when tagged required:"true", or in
+// responses when they are not omitempty.
+func (sb *schemaBuilder) structSchema(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []string
+
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		name := jsonFieldName(f)
+		if name == "" {
+			continue
+		}
+
+		prop := sb.schemaFor(f.Type)
+		target := prop
+		if prop["type"] == "array" {
+			items := copySchema(prop["items"].(map[string]interface{}))
+			prop = copySchema(prop)
+			prop["items"] = items
+			target = items
+			setNumberTag(prop, f, "minItems")
+			setNumberTag(prop, f, "maxItems")
+		}
+		setNumberTag(target, f, "minimum")
+		setNumberTag(target, f, "maximum")
+		setNumberTag(prop, f, "minLength")
+		setNumberTag(prop, f, "maxLength")
+		if desc := f.Tag.Get("description"); desc != "" {
+			prop["description"] = desc
+		}
+
+		properties[name] = prop
+
+		if req := f.Tag.Get("required"); req != "" {
+			if req == "true" {
+				required = append(required, name)
+			}
+		} else if !strings.Contains(f.Tag.Get("json"), "omitempty") && !isRequestType(t) {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]interface{}{
+		"type":       "object",
+		"properties": properties,
+	}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// queryParameters describes the fields of a request struct as query
+// parameters. Lists are documented comma separated; repeating the
+// parameter is accepted as well.
+func (sb *schemaBuilder) queryParameters(t reflect.Type) []interface{} {
+	schema := sb.structSchema(t)
+	properties := schema["properties"].(map[string]interface{})
+	required := map[string]bool{}
+	if names, ok := schema["required"].([]string); ok {
+		for _, name := range names {
+			required[name] = true
+		}
+	}
+
+	var params []interface{}
+	for _, name := range sortedKeys(properties) {
+		prop := properties[name].(map[string]interface{})
+		param := map[string]interface{}{
+			"name":     name,
+			"in":       "query",
+			"required": required[name],
+			"schema":   prop,
+		}
+		if prop["type"] == "array" {
+			param["style"] = "form"
+			param["explode"] = false
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+// isRequestType reports whether t is used as a request body in apiRoutes or
+// extraRoutes. Request fields are only required when explicitly tagged,
+// since the decoders treat missing numbers as zero.
+func isRequestType(t reflect.Type) bool {
+	for _, route := range apiRoutes {
+		if route.Request != nil && reflect.TypeOf(route.Request) == t {
+			return true
+		}
+	}
+	for _, route := range extraRoutes {
+		if route.Request != nil && reflect.TypeOf(route.Request) == t {
+			return true
+		}
+	}
+	return false
+}
+
+func setNumberTag(schema map[string]interface{}, f reflect.StructField, tag string) {
+	value := f.Tag.Get(tag)
+	if value == "" {
+		return
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("OpenAPI: invalid %s tag %q on field %s", tag, value, f.Name)
+		return
+	}
+	schema[tag] = n
+}
+
+func copySchema(schema map[string]interface{}) map[string]interface{} {
+	out := make(map[string]interface{}, len(schema))
+	for k, v := range schema {
+		out[k] = v
+	}
+	return out
+}
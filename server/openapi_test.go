@@ -0,0 +1,522 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// loadOpenAPISpec fetches /openapi.json through the router
+func loadOpenAPISpec(t *testing.T) map[string]interface{} {
+	t.Helper()
+	s := newTestServer(t)
+
+	req := httptest.NewRequest("GET", "/openapi.json", nil)
+	w := httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /openapi.json status = %v, want %v", w.Code, http.StatusOK)
+	}
+
+	var spec map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("Failed to parse OpenAPI document: %v", err)
+	}
+	return spec
+}
+
+// resolveSchema follows a $ref into components/schemas
+func resolveSchema(spec, schema map[string]interface{}) map[string]interface{} {
+	if ref, ok := schema["$ref"].(string); ok {
+		name := ref[strings.LastIndex(ref, "/")+1:]
+		return spec["components"].(map[string]interface{})["schemas"].(map[string]interface{})[name].(map[string]interface{})
+	}
+	return schema
+}
+
+// validateSchema checks a decoded JSON value against an OpenAPI schema
+func validateSchema(spec, schema map[string]interface{}, value interface{}, path string) error {
+	schema = resolveSchema(spec, schema)
+
+	if value == nil && schema["nullable"] == true {
+		return nil
+	}
+	if allOf, ok := schema["allOf"].([]interface{}); ok {
+		for _, sub := range allOf {
+			if err := validateSchema(spec, sub.(map[string]interface{}), value, path); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	switch schema["type"] {
+	case "object":
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object, got %T", path, value)
+		}
+		if required, ok := schema["required"].([]interface{}); ok {
+			for _, name := range required {
+				if _, ok := obj[name.(string)]; !ok {
+					return fmt.Errorf("%s: missing required property %q", path, name)
+				}
+			}
+		}
+		properties, _ := schema["properties"].(map[string]interface{})
+		for name, v := range obj {
+			prop, ok := properties[name].(map[string]interface{})
+			if !ok {
+				return fmt.Errorf("%s: property %q is not in the schema", path, name)
+			}
+			if err := validateSchema(spec, prop, v, path+"."+name); err != nil {
+				return err
+			}
+		}
+	case "array":
+		list, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array, got %T", path, value)
+		}
+		for i, item := range list {
+			if err := validateSchema(spec, schema["items"].(map[string]interface{}), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "number", "integer":
+		n, ok := value.(float64)
+		if !ok {
+			return fmt.Errorf("%s: expected number, got %T", path, value)
+		}
+		if schema["type"] == "integer" && n != math.Trunc(n) {
+			return fmt.Errorf("%s: expected integer, got %v", path, n)
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: expected string, got %T", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean, got %T", path, value)
+		}
+	}
+	return nil
+}
+
+// exampleValue builds a value that satisfies a request schema
+func exampleValue(spec, schema map[string]interface{}) interface{} {
+	schema = resolveSchema(spec, schema)
+
+	switch schema["type"] {
+	case "object":
+		obj := map[string]interface{}{}
+		for name, prop := range schema["properties"].(map[string]interface{}) {
+			obj[name] = exampleValue(spec, prop.(map[string]interface{}))
+		}
+		return obj
+	case "array":
+		return []interface{}{
+			exampleValue(spec, schema["items"].(map[string]interface{})),
+			exampleValue(spec, schema["items"].(map[string]interface{})),
+		}
+	case "number", "integer":
+		n := 2.0
+		if max, ok := schema["maximum"].(float64); ok && n > max {
+			n = max
+		}
+		if min, ok := schema["minimum"].(float64); ok && n < min {
+			n = min
+		}
+		return n
+	case "string":
+		return "x"
+	case "boolean":
+		return true
+	}
+	return nil
+}
+
+// boundaryCase is one request derived from a schema constraint
+type boundaryCase struct {
+	name   string
+	body   map[string]interface{}
+	wantOK bool
+}
+
+// boundaryCases derives requests on and just past every constraint in a request schema
+func boundaryCases(spec, schema map[string]interface{}) []boundaryCase {
+	schema = resolveSchema(spec, schema)
+	properties := schema["properties"].(map[string]interface{})
+
+	names := make([]string, 0, len(properties))
+	for name := range properties {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	with := func(name string, value interface{}) map[string]interface{} {
+		body := exampleValue(spec, schema).(map[string]interface{})
+		body[name] = value
+		return body
+	}
+
+	// Arrays that must stay the same length (pairwise) are resized together
+	withLength := func(n int) map[string]interface{} {
+		body := exampleValue(spec, schema).(map[string]interface{})
+		for name, prop := range properties {
+			p := resolveSchema(spec, prop.(map[string]interface{}))
+			if p["type"] == "array" {
+				list := make([]interface{}, n)
+				for i := range list {
+					list[i] = exampleValue(spec, p["items"].(map[string]interface{}))
+				}
+				body[name] = list
+			}
+		}
+		return body
+	}
+
+	var cases []boundaryCase
+	for _, name := range names {
+		prop := resolveSchema(spec, properties[name].(map[string]interface{}))
+
+		target := prop
+		wrap := func(v interface{}) interface{} { return v }
+		if prop["type"] == "array" {
+			target = resolveSchema(spec, prop["items"].(map[string]interface{}))
+			wrap = func(v interface{}) interface{} { return []interface{}{v, v} }
+
+			if max, ok := prop["maxItems"].(float64); ok {
+				cases = append(cases,
+					boundaryCase{name + " at maxItems", withLength(int(max)), true},
+					boundaryCase{name + " above maxItems", withLength(int(max) + 1), false})
+			}
+			if min, ok := prop["minItems"].(float64); ok && min > 0 {
+				cases = append(cases,
+					boundaryCase{name + " at minItems", withLength(int(min)), true},
+					boundaryCase{name + " below minItems", withLength(int(min) - 1), false})
+			}
+		}
+
+		step := func(v float64, dir float64) float64 {
+			if target["type"] == "integer" {
+				return v + dir
+			}
+			return math.Nextafter(v, dir*math.Inf(1))
+		}
+		if max, ok := target["maximum"].(float64); ok {
+			cases = append(cases,
+				boundaryCase{name + " at maximum", with(name, wrap(max)), true},
+				boundaryCase{name + " above maximum", with(name, wrap(step(max, 1))), false})
+		}
+		if min, ok := target["minimum"].(float64); ok {
+			cases = append(cases,
+				boundaryCase{name + " at minimum", with(name, wrap(min)), true},
+				boundaryCase{name + " below minimum", with(name, wrap(step(min, -1))), false})
+		}
+		if max, ok := prop["maxLength"].(float64); ok {
+			cases = append(cases,
+				boundaryCase{name + " at maxLength", with(name, strings.Repeat("x", int(max))), true},
+				boundaryCase{name + " above maxLength", with(name, strings.Repeat("x", int(max)+1)), false})
+		}
+		if min, ok := prop["minLength"].(float64); ok && min > 0 {
+			cases = append(cases, boundaryCase{name + " below minLength", with(name, strings.Repeat("x", int(min)-1)), false})
+		}
+	}
+	return cases
+}
+
+// parametersSchema gathers query parameters into an object schema so the
+// body helpers can generate examples and boundary cases for them
+func parametersSchema(params []interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	var required []interface{}
+	for _, raw := range params {
+		param := raw.(map[string]interface{})
+		name := param["name"].(string)
+		properties[name] = param["schema"]
+		if param["required"] == true {
+			required = append(required, name)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+}
+
+// encodeQuery writes a generated body as query parameters, lists comma separated
+func encodeQuery(body map[string]interface{}) string {
+	format := func(v interface{}) string {
+		if f, ok := v.(float64); ok {
+			return strconv.FormatFloat(f, 'g', -1, 64)
+		}
+		return fmt.Sprint(v)
+	}
+
+	values := url.Values{}
+	for name, value := range body {
+		if list, ok := value.([]interface{}); ok {
+			parts := make([]string, len(list))
+			for i, item := range list {
+				parts[i] = format(item)
+			}
+			values.Set(name, strings.Join(parts, ","))
+			continue
+		}
+		values.Set(name, format(value))
+	}
+	return values.Encode()
+}
+
+// Test that every documented operation is routed and every API route is documented
+func TestOpenAPIRoutesMatchRouter(t *testing.T) {
+	s := newTestServer(t)
+	spec := loadOpenAPISpec(t)
+	paths := spec["paths"].(map[string]interface{})
+	mux := s.newRouter()
+
+	for _, prefix := range []string{"/v1", "/v2"} {
+		for _, route := range apiRoutes {
+			item, ok := paths[prefix+route.Path].(map[string]interface{})
+			if !ok || item[strings.ToLower(route.Method)] == nil {
+				t.Errorf("%s %s%s is routed but missing from the OpenAPI document", route.Method, prefix, route.Path)
+			}
+			if route.Query && (!ok || item["get"] == nil) {
+				t.Errorf("GET %s%s is routed but missing from the OpenAPI document", prefix, route.Path)
+			}
+		}
+	}
+
+	for _, route := range extraRoutes {
+		documented := []string{route.Path}
+		if route.Versioned {
+			documented = []string{"/v1" + route.Path, "/v2" + route.Path}
+		}
+		for _, path := range documented {
+			item, ok := paths[path].(map[string]interface{})
+			if !ok || item[strings.ToLower(route.Method)] == nil {
+				t.Errorf("%s %s is routed but missing from the OpenAPI document", route.Method, path)
+			}
+		}
+	}
+
+	// Path parameters are filled in with a sample value; nothing documented
+	// may fall through to the static file server or the API's not found route
+	sample := strings.NewReplacer("{id}", "sample", "{client}", "203.0.113.9")
+	api := s.newAPIMux()
+	for path, item := range paths {
+		for method := range item.(map[string]interface{}) {
+			target := sample.Replace(path)
+			req := httptest.NewRequest(strings.ToUpper(method), target, nil)
+			_, pattern := mux.Handler(req)
+			if pattern == "/" {
+				t.Errorf("%s %s is documented but routed to %q", method, path, pattern)
+				continue
+			}
+			if pattern != "/v1/" && pattern != "/v2/" {
+				continue
+			}
+			versioned := httptest.NewRequest(strings.ToUpper(method), strings.TrimPrefix(target, pattern[:3]), nil)
+			if _, apiPattern := api.Handler(versioned); apiPattern == "/" {
+				t.Errorf("%s %s is documented but routed to %q", method, path, apiPattern)
+			}
+		}
+	}
+}
+
+// Test that the jobs and operator endpoints answer with the documented
+// status and schema
+func TestOpenAPIMatchesExtraRoutes(t *testing.T) {
+	s := newTestServer(t, WithAdminToken("admin-secret"))
+	spec := loadOpenAPISpec(t)
+	paths := spec["paths"].(map[string]interface{})
+	mux := s.newRouter()
+
+	tests := []struct {
+		method, target, path, status string
+		body                         string
+	}{
+		{"POST", "/v1/jobs", "/v1/jobs", "202", `{"operation":"matrix_inverse","args":{"matrix":[[4,7],[2,6]]}}`},
+		{"POST", "/v2/jobs", "/v2/jobs", "202", `{"operation":"matrix_inverse","args":{"matrix":[[4,7],[2,6]]}}`},
+		{"GET", "/admin/bans", "/admin/bans", "200", ""},
+		{"GET", "/admin/webhooks/dead-letters", "/admin/webhooks/dead-letters", "200", ""},
+		{"DELETE", "/admin/bans/203.0.113.9", "/admin/bans/{client}", "404", ""},
+	}
+
+	for _, tt := range tests {
+		op := paths[tt.path].(map[string]interface{})[strings.ToLower(tt.method)].(map[string]interface{})
+		response, ok := op["responses"].(map[string]interface{})[tt.status].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s %s: status %s is not documented", tt.method, tt.path, tt.status)
+			continue
+		}
+
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Authorization", "Bearer admin-secret")
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+
+		if strconv.Itoa(w.Code) != tt.status {
+			t.Errorf("%s %s status = %v, want %v", tt.method, tt.target, w.Code, tt.status)
+			continue
+		}
+		mediaType := strings.TrimSpace(strings.Split(w.Header().Get("Content-Type"), ";")[0])
+		content, ok := response["content"].(map[string]interface{})[mediaType].(map[string]interface{})
+		if !ok {
+			t.Errorf("%s %s: media type %q is not documented for %s", tt.method, tt.target, mediaType, tt.status)
+			continue
+		}
+		var body interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s %s: invalid JSON: %v", tt.method, tt.target, err)
+		}
+		if err := validateSchema(spec, content["schema"].(map[string]interface{}), body, "body"); err != nil {
+			t.Errorf("%s %s: %v", tt.method, tt.target, err)
+		}
+	}
+}
+
+// Test that the handlers enforce exactly the bounds published in the OpenAPI
+// document and that their responses match the documented schemas
+func TestOpenAPIMatchesHandlerBehavior(t *testing.T) {
+	s := newTestServer(t)
+	spec := loadOpenAPISpec(t)
+	mux := s.newRouter()
+
+	// Jobs, streams and operator endpoints are covered by their own tests
+	generated := map[string]bool{}
+	for _, prefix := range []string{"/v1", "/v2"} {
+		for _, route := range apiRoutes {
+			generated[prefix+route.Path] = true
+		}
+	}
+
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		if !generated[path] {
+			continue
+		}
+		for method, rawOp := range item.(map[string]interface{}) {
+			op := rawOp.(map[string]interface{})
+			responses := op["responses"].(map[string]interface{})
+			okSchema := responses["200"].(map[string]interface{})["content"].(map[string]interface{})
+			errorContent := responses["405"].(map[string]interface{})["content"].(map[string]interface{})
+
+			params, hasParams := op["parameters"].([]interface{})
+
+			send := func(body interface{}) *httptest.ResponseRecorder {
+				if hasParams {
+					target := path
+					if body != nil {
+						target += "?" + encodeQuery(body.(map[string]interface{}))
+					}
+					w := httptest.NewRecorder()
+					mux.ServeHTTP(w, httptest.NewRequest(strings.ToUpper(method), target, nil))
+					return w
+				}
+
+				var reader *bytes.Reader
+				if body != nil {
+					data, _ := json.Marshal(body)
+					reader = bytes.NewReader(data)
+				} else {
+					reader = bytes.NewReader(nil)
+				}
+				req := httptest.NewRequest(strings.ToUpper(method), path, reader)
+				if body != nil {
+					req.Header.Set("Content-Type", "application/json")
+				}
+				w := httptest.NewRecorder()
+				mux.ServeHTTP(w, req)
+				return w
+			}
+
+			checkOK := func(t *testing.T, w *httptest.ResponseRecorder) {
+				if w.Code != http.StatusOK {
+					t.Fatalf("status = %v, want %v: %s", w.Code, http.StatusOK, w.Body.String())
+				}
+				content, ok := okSchema[strings.Split(w.Header().Get("Content-Type"), ";")[0]].(map[string]interface{})
+				if !ok {
+					t.Fatalf("undocumented response Content-Type %q", w.Header().Get("Content-Type"))
+				}
+				if _, isJSON := okSchema["application/json"]; !isJSON {
+					return
+				}
+				var body interface{}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("Failed to parse response: %v", err)
+				}
+				if err := validateSchema(spec, content["schema"].(map[string]interface{}), body, "response"); err != nil {
+					t.Errorf("response does not match the documented schema: %v", err)
+				}
+			}
+
+			checkError := func(t *testing.T, w *httptest.ResponseRecorder, want int) {
+				if w.Code != want {
+					t.Fatalf("status = %v, want %v: %s", w.Code, want, w.Body.String())
+				}
+				content, ok := errorContent[w.Header().Get("Content-Type")].(map[string]interface{})
+				if !ok {
+					t.Fatalf("undocumented error Content-Type %q", w.Header().Get("Content-Type"))
+				}
+				var body interface{}
+				if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+					t.Fatalf("Failed to parse error response: %v", err)
+				}
+				if err := validateSchema(spec, content["schema"].(map[string]interface{}), body, "error"); err != nil {
+					t.Errorf("error response does not match the documented schema: %v", err)
+				}
+			}
+
+			var schema map[string]interface{}
+			if requestBody, hasBody := op["requestBody"].(map[string]interface{}); hasBody {
+				schema = requestBody["content"].(map[string]interface{})["application/json"].(map[string]interface{})["schema"].(map[string]interface{})
+			} else if hasParams {
+				schema = parametersSchema(params)
+			} else {
+				t.Run(method+" "+path, func(t *testing.T) {
+					checkOK(t, send(nil))
+				})
+				continue
+			}
+
+			t.Run(method+" "+path+"/example", func(t *testing.T) {
+				checkOK(t, send(exampleValue(spec, schema)))
+			})
+
+			for _, tc := range boundaryCases(spec, schema) {
+				tc := tc
+				t.Run(method+" "+path+"/"+tc.name, func(t *testing.T) {
+					w := send(tc.body)
+					if tc.wantOK {
+						checkOK(t, w)
+					} else {
+						checkError(t, w, http.StatusBadRequest)
+					}
+				})
+			}
+		}
+	}
+}
+
+// Test that the docs page is served
+func TestDocsHandler(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("GET", "/docs", nil)
+	w := httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("GET /docs status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if !strings.Contains(w.Body.String(), "/openapi.json") {
+		t.Error("docs page does not load /openapi.json")
+	}
+}
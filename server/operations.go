@@ -0,0 +1,287 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"go-server/arith"
+)
+
+// Operation is a named calculation that can run outside of its HTTP handler,
+// for example from a WebSocket session. Arguments are decoded into the value
+// returned by NewArgs and checked with its Validate method, so an operation
+// enforces exactly the same bounds as the matching endpoint.
+type Operation struct {
+	Name string
+	// NewArgs returns a pointer to a zero request value
+	NewArgs func() interface{}
+	// Run performs the calculation on validated arguments
+	Run func(args interface{}) (interface{}, error)
+	// RunContext, when set, is used instead of Run. It stops when ctx is
+	// canceled and reports progress between 0 and 1.
+	RunContext func(ctx context.Context, args interface{}, progress func(float64)) (interface{}, error)
+	// Answer extracts the primary value of a result (a number or a list of
+	// numbers) so it can be stored in a calculator register
+	Answer func(result interface{}) interface{}
+}
+
+// DivideRequest represents the arguments of the divide and modulo operations
+type DivideRequest struct {
+	A float64 `json:"a" minimum:"-1e15" maximum:"1e15"`
+	B float64 `json:"b" minimum:"-1e15" maximum:"1e15"`
+}
+
+// Validate checks that both operands are within bounds
+func (req DivideRequest) Validate() error {
+	if err := (MultiplyRequest{A: req.A, B: req.B}).Validate(); err != nil {
+		return invalid(err.Error(), req)
+	}
+	return nil
+}
+
+// ReciprocalRequest represents the arguments of the reciprocal operation
+type ReciprocalRequest struct {
+	X float64 `json:"x" minimum:"-1e15" maximum:"1e15"`
+}
+
+// Validate checks that x is within bounds
+func (req ReciprocalRequest) Validate() error {
+	if err := (MultiplyRequest{A: req.X}).Validate(); err != nil {
+		return invalid(err.Error(), req)
+	}
+	return nil
+}
+
+// OperationError describes why an operation could not be run
+type OperationError struct {
+	Code    string // machine readable code such as "validation_error"
+	Message string
+	Fields  []FieldError // invalid arguments, with paths starting at "args"
+}
+
+func (e *OperationError) Error() string {
+	return e.Message
+}
+
+// Title turns Code into an error title such as "Validation Error", the
+// inverse of errorCode
+func (e *OperationError) Title() string {
+	words := strings.Split(e.Code, "_")
+	for i, word := range words {
+		if word != "" {
+			words[i] = strings.ToUpper(word[:1]) + word[1:]
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// operations is the registry of named operations
+var operations = map[string]Operation{}
+
+// RegisterOperation adds an operation to the registry
+func RegisterOperation(op Operation) {
+	if op.Answer == nil {
+		op.Answer = func(result interface{}) interface{} { return result }
+	}
+	operations[op.Name] = op
+}
+
+// operationNames lists the registered operations in a stable order
+func operationNames() []string {
+	names := make([]string, 0, len(operations))
+	for name := range operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func init() {
+	RegisterOperation(Operation{
+		Name:    "multiply",
+		NewArgs: func() interface{} { return &MultiplyRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			req := args.(*MultiplyRequest)
+			return arith.BasicMultiply(req.A, req.B), nil
+		},
+		Answer: func(result interface{}) interface{} { return result.(MultiplyResult).Result },
+	})
+	RegisterOperation(Operation{
+		Name:    "multiply_array",
+		NewArgs: func() interface{} { return &ArrayRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			return arith.MultiplyArray(args.(*ArrayRequest).Numbers), nil
+		},
+		Answer: func(result interface{}) interface{} { return result.(MultiplyArrayResult).Results[0] },
+	})
+	RegisterOperation(Operation{
+		Name:    "multiply_pairwise",
+		NewArgs: func() interface{} { return &PairwiseRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			req := args.(*PairwiseRequest)
+			return arith.MultiplyArrayPairwise(req.Array1, req.Array2)
+		},
+		Answer: func(result interface{}) interface{} { return result.(MultiplyArrayResult).Results },
+	})
+	RegisterOperation(Operation{
+		Name:    "multiply_scalar",
+		NewArgs: func() interface{} { return &ScalarRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			req := args.(*ScalarRequest)
+			return arith.MultiplyByScalar(req.Numbers, req.Scalar), nil
+		},
+		Answer: func(result interface{}) interface{} { return result.(MultiplyArrayResult).Results },
+	})
+	RegisterOperation(Operation{
+		Name:    "power",
+		NewArgs: func() interface{} { return &PowerRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			req := args.(*PowerRequest)
+			return arith.Power(req.Base, req.Exponent), nil
+		},
+		Answer: func(result interface{}) interface{} { return result.(MultiplyResult).Result },
+	})
+	RegisterOperation(Operation{
+		Name:    "factorial",
+		NewArgs: func() interface{} { return &FactorialRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			req := args.(*FactorialRequest)
+			result, err := arith.Factorial(req.Number)
+			if err != nil {
+				return nil, err
+			}
+			return FactorialResult{Input: req.Number, Result: result}, nil
+		},
+		Answer: func(result interface{}) interface{} { return float64(result.(FactorialResult).Result) },
+	})
+	RegisterOperation(Operation{
+		Name:    "divide",
+		NewArgs: func() interface{} { return &DivideRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			req := args.(*DivideRequest)
+			return arith.BasicDivide(req.A, req.B)
+		},
+		Answer: func(result interface{}) interface{} { return result.(arith.DivideResult).Result },
+	})
+	RegisterOperation(Operation{
+		Name:    "modulo",
+		NewArgs: func() interface{} { return &DivideRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			req := args.(*DivideRequest)
+			return arith.Modulo(req.A, req.B)
+		},
+	})
+	RegisterOperation(Operation{
+		Name:    "reciprocal",
+		NewArgs: func() interface{} { return &ReciprocalRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			return arith.Reciprocal(args.(*ReciprocalRequest).X)
+		},
+	})
+
+	// Long-running operations, see longops.go
+	RegisterOperation(Operation{
+		Name:    "factorial_big",
+		NewArgs: func() interface{} { return &BigFactorialRequest{} },
+		RunContext: func(ctx context.Context, args interface{}, progress func(float64)) (interface{}, error) {
+			return BigFactorial(ctx, args.(*BigFactorialRequest).Number, progress)
+		},
+		Answer: func(result interface{}) interface{} { return nil },
+	})
+	RegisterOperation(Operation{
+		Name:    "sort",
+		NewArgs: func() interface{} { return &SortRequest{} },
+		RunContext: func(ctx context.Context, args interface{}, progress func(float64)) (interface{}, error) {
+			req := args.(*SortRequest)
+			return SortNumbers(ctx, req.Numbers, req.Descending, progress)
+		},
+		Answer: func(result interface{}) interface{} { return result.(SortResult).Results },
+	})
+	RegisterOperation(Operation{
+		Name:    "matrix_inverse",
+		NewArgs: func() interface{} { return &MatrixRequest{} },
+		RunContext: func(ctx context.Context, args interface{}, progress func(float64)) (interface{}, error) {
+			return InvertMatrix(ctx, args.(*MatrixRequest).Matrix, progress)
+		},
+		Answer: func(result interface{}) interface{} { return nil },
+	})
+}
+
+// prepareOperation decodes generic arguments (as produced by a codec) for
+// the named operation and validates them
+func prepareOperation(name string, args interface{}) (Operation, interface{}, error) {
+	op, ok := operations[name]
+	if !ok {
+		return Operation{}, nil, &OperationError{Code: "unknown_operation", Message: fmt.Sprintf("Unknown operation %q", name)}
+	}
+
+	if args == nil {
+		args = map[string]interface{}{}
+	}
+	target := op.NewArgs()
+	if err := fromGeneric(args, target); err != nil {
+		return Operation{}, nil, &OperationError{Code: "invalid_arguments", Message: "Invalid arguments for " + name + ": " + err.Error(), Fields: argFields(decodeFieldErrors(err))}
+	}
+
+	if v, ok := target.(interface{ Validate() error }); ok {
+		if err := v.Validate(); err != nil {
+			opErr := &OperationError{Code: "validation_error", Message: err.Error()}
+			var validationErr *ValidationError
+			if errors.As(err, &validationErr) {
+				opErr.Fields = argFields(validationErr.Fields)
+			}
+			return Operation{}, nil, opErr
+		}
+	}
+	return op, target, nil
+}
+
+// argFields points field errors found in an operation's arguments at the
+// "args" member of the job or WebSocket message that carried them
+func argFields(fields []FieldError) []FieldError {
+	out := make([]FieldError, len(fields))
+	for i, f := range fields {
+		f.Field = "args." + f.Field
+		out[i] = f
+	}
+	return out
+}
+
+// execute runs an operation on arguments returned by prepareOperation
+func (op Operation) execute(ctx context.Context, target interface{}, progress func(float64)) (interface{}, error) {
+	var (
+		result interface{}
+		err    error
+	)
+	if op.RunContext != nil {
+		result, err = op.RunContext(ctx, target, progress)
+	} else {
+		result, err = op.Run(target)
+	}
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil && err == ctxErr {
+			return nil, err
+		}
+		return nil, &OperationError{Code: "calculation_error", Message: err.Error()}
+	}
+	progress(1)
+	return result, nil
+}
+
+// runOperation decodes, validates and runs the named operation. It returns
+// the result and its primary value.
+func runOperation(name string, args interface{}) (interface{}, interface{}, error) {
+	op, target, err := prepareOperation(name, args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	result, err := op.execute(context.Background(), target, func(float64) {})
+	if err != nil {
+		return nil, nil, err
+	}
+	return result, op.Answer(result), nil
+}
@@ -0,0 +1,114 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// problemTypePrefix is the path the problem type URIs point at. Each type is
+// documented at /problems/{code}, where code is the machine readable error
+// code also used in the v2 envelope.
+const problemTypePrefix = "/problems/"
+
+// ProblemType documents one kind of error returned by the API
+type ProblemType struct {
+	Type        string `json:"type"`
+	Title       string `json:"title"`
+	Status      int    `json:"status"`
+	Description string `json:"description"`
+}
+
+// problemTypes lists the documented problem types by code
+var problemTypes = map[string]ProblemType{}
+
+func init() {
+	for _, p := range []ProblemType{
+		{Title: "Bad Request", Status: http.StatusBadRequest, Description: "The request could not be read: the body or query string is malformed, has unknown fields, has values of the wrong type or has data after the document."},
+		{Title: "Validation Error", Status: http.StatusBadRequest, Description: "The request was read but a value is out of range. errors lists every invalid field."},
+		{Title: "Calculation Error", Status: http.StatusBadRequest, Description: "The inputs were valid but the calculation failed, for example because the result overflows."},
+		{Title: "Unknown Operation", Status: http.StatusBadRequest, Description: "The job names an operation that does not exist."},
+		{Title: "Invalid Arguments", Status: http.StatusBadRequest, Description: "The job arguments do not match the operation's request body."},
+		{Title: "Unauthorized", Status: http.StatusUnauthorized, Description: "The admin endpoint needs a valid bearer token."},
+		{Title: "Forbidden", Status: http.StatusForbidden, Description: "Admin endpoints are disabled because ADMIN_TOKEN is not set."},
+		{Title: "Client Banned", Status: http.StatusForbidden, Description: "The client address is on the deny list, or is banned for repeated rate limit hits, malformed bodies, oversized requests or bursts of other client errors. Retry-After, when sent, is the number of seconds until the ban ends."},
+		{Title: "Not Found", Status: http.StatusNotFound, Description: "No resource exists at this path."},
+		{Title: "Method Not Allowed", Status: http.StatusMethodNotAllowed, Description: "The endpoint does not support this HTTP method."},
+		{Title: "Not Acceptable", Status: http.StatusNotAcceptable, Description: "None of the media types in Accept can be produced."},
+		{Title: "Conflict", Status: http.StatusConflict, Description: "The request conflicts with the current state, such as a job that has already finished or an Idempotency-Key still in use."},
+		{Title: "Precondition Failed", Status: http.StatusPreconditionFailed, Description: "If-None-Match on a POST matches its result. Only GET and HEAD requests are answered with 304 Not Modified."},
+		{Title: "Request Entity Too Large", Status: http.StatusRequestEntityTooLarge, Description: "The request body is larger than the endpoint accepts."},
+		{Title: "Unsupported Media Type", Status: http.StatusUnsupportedMediaType, Description: "The Content-Type of the request body is not supported."},
+		{Title: "Unprocessable Entity", Status: http.StatusUnprocessableEntity, Description: "The Idempotency-Key was already used for a different request."},
+		{Title: "Rate limit exceeded", Status: http.StatusTooManyRequests, Description: "The client used up the rate limit of its route and client class. RateLimit-Limit, RateLimit-Remaining and RateLimit-Reset describe the quota, and Retry-After is the number of seconds until the request can be retried."},
+		{Title: "Internal Server Error", Status: http.StatusInternalServerError, Description: "The server failed to handle the request. error_id names the entry in the server log, quote it when reporting the problem."},
+		{Title: "Service Unavailable", Status: http.StatusServiceUnavailable, Description: "The server is overloaded, shutting down or the job queue is full. Retry later, after Retry-After seconds when it is sent."},
+	} {
+		p.Type = problemType(errorCode(p.Title))
+		problemTypes[errorCode(p.Title)] = p
+	}
+}
+
+// problemType returns the type URI for an error code
+func problemType(code string) string {
+	return problemTypePrefix + code
+}
+
+// problemContentType returns the RFC 9457 media type for error bodies
+// written with codec. Formats without a problem media type keep their own.
+func problemContentType(codec Codec) string {
+	switch codec.ContentType() {
+	case "application/json":
+		return "application/problem+json"
+	case "application/xml":
+		return "application/problem+xml"
+	}
+	return codec.ContentType()
+}
+
+// sendProblem writes an error response. v1 clients receive an RFC 9457
+// problem document, v2 clients the uniform envelope carrying the same code,
+// type and field errors.
+func sendProblem(w http.ResponseWriter, title, detail string, status int, fields []FieldError) {
+	code := errorCode(title)
+
+	if responseVersion(w) == apiV2 {
+		envelopeErr := &EnvelopeError{
+			Code:    code,
+			Type:    problemType(code),
+			Message: detail,
+			Errors:  fields,
+		}
+		if len(fields) > 0 {
+			envelopeErr.Field = fields[0].Field
+		}
+		writeResponse(w, status, Envelope{Error: envelopeErr, Meta: envelopeMeta(w)})
+		return
+	}
+
+	writeEncoded(w, status, ErrorResponse{
+		Type:      problemType(code),
+		Title:     title,
+		Status:    status,
+		Detail:    detail,
+		Errors:    fields,
+		Error:     title,
+		Message:   detail,
+		Code:      status,
+		RequestID: responseRequestID(w),
+	}, problemContentType)
+}
+
+// problemsHandler documents the problem types at /problems/{code}
+func problemsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	p, ok := problemTypes[strings.TrimPrefix(r.URL.Path, problemTypePrefix)]
+	if !ok {
+		sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+		return
+	}
+	sendDataResponse(w, p, p)
+}
@@ -0,0 +1,596 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter decides whether a client, identified by key, may make another
+// request costing cost units of its quota. Peek reports the client's quota
+// without spending any of it.
+type Limiter interface {
+	Allow(key string, cost int) (Quota, bool)
+	Peek(key string) Quota
+}
+
+// Quota is a client's standing under its rate limit
+type Quota struct {
+	// Limit is the most requests the client can make at once
+	Limit int
+	// Remaining is how many requests the client can make now
+	Remaining int
+	// Reset is how long until the client is back at its full Limit
+	Reset time.Duration
+	// RetryAfter is how long until the next request is allowed, 0 while it
+	// costs no more than Remaining
+	RetryAfter time.Duration
+}
+
+// Rate is a rate limit of Limit requests per Window. Burst is how many
+// requests the token bucket and GCRA accept at once; it defaults to Limit.
+// The window algorithms never allow more than Limit per Window.
+type Rate struct {
+	Limit  int
+	Window time.Duration
+	Burst  int
+}
+
+// burst returns Burst, or Limit when Burst is not set
+func (r Rate) burst() int {
+	if r.Burst > 0 {
+		return r.Burst
+	}
+	return r.Limit
+}
+
+// interval is the time one request's allowance takes to come back
+func (r Rate) interval() time.Duration {
+	return r.Window / time.Duration(r.Limit)
+}
+
+// limiterState is one client's state under a rate limiting algorithm
+type limiterState interface {
+	// allow records a request costing n at now and reports whether it is within rate
+	allow(rate Rate, now time.Time, n int) bool
+	// quota reports the client's quota at now, with RetryAfter for a
+	// request costing n, without changing the state
+	quota(rate Rate, now time.Time, n int) Quota
+}
+
+// rateAlgorithms maps RATE_LIMIT_ALGORITHM names to new client states
+var rateAlgorithms = map[string]func() limiterState{
+	"fixed-window":   func() limiterState { return &fixedWindow{} },
+	"sliding-log":    func() limiterState { return &slidingLog{} },
+	"sliding-window": func() limiterState { return &slidingWindow{} },
+	"token-bucket":   func() limiterState { return &tokenBucket{} },
+	"gcra":           func() limiterState { return &gcra{} },
+}
+
+// rateAlgorithmNames lists the algorithms for error messages
+func rateAlgorithmNames() string {
+	names := make([]string, 0, len(rateAlgorithms))
+	for name := range rateAlgorithms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// RateLimiter limits each client with one of the rateAlgorithms. Client
+// state lives in a RateStore; when a shared store fails, the limiter falls
+// back to limits local to this process until the store is back.
+type RateLimiter struct {
+	algorithm string
+	rate      Rate
+	newState  func() limiterState
+	idle      time.Duration
+	// now is the clock, replaced in tests
+	now func() time.Time
+
+	store  RateStore
+	prefix string
+	local  *memoryStore
+	logger *log.Logger
+
+	mu        sync.Mutex
+	storeDown time.Time // when the store last failed, zero while it works
+
+	// stop ends the cleanup goroutine
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// rateStoreRetry is how long a failed store is bypassed before it is tried again
+const rateStoreRetry = 5 * time.Second
+
+// NewRateLimiter creates a rate limiter using the named algorithm, keeping
+// client state in memory, and starts forgetting idle clients in the
+// background until Close
+func NewRateLimiter(algorithm string, rate Rate) (*RateLimiter, error) {
+	rl, err := newRateLimiter(algorithm, rate, time.Now)
+	if err != nil {
+		return nil, err
+	}
+	rl.startCleanup()
+	return rl, nil
+}
+
+// startCleanup forgets idle clients every idle period until Close
+func (rl *RateLimiter) startCleanup() {
+	rl.stop = make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(rl.idle)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				rl.cleanupVisitors()
+			case <-rl.stop:
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the cleanup goroutine
+func (rl *RateLimiter) Close() {
+	rl.closeOnce.Do(func() {
+		if rl.stop != nil {
+			close(rl.stop)
+		}
+	})
+}
+
+// newRateLimiter creates a rate limiter reading time from now, without the
+// cleanup goroutine
+func newRateLimiter(algorithm string, rate Rate, now func() time.Time) (*RateLimiter, error) {
+	newState, ok := rateAlgorithms[algorithm]
+	if !ok {
+		return nil, fmt.Errorf("unknown rate limiting algorithm %q, want one of %s", algorithm, rateAlgorithmNames())
+	}
+	if rate.Limit < 1 || rate.Window <= 0 || rate.Burst < 0 {
+		return nil, fmt.Errorf("invalid rate %d per %v with burst %d", rate.Limit, rate.Window, rate.Burst)
+	}
+
+	// The token bucket and GCRA need burst intervals to recover fully, the
+	// sliding window counter still weighs the previous window, so idle
+	// clients are kept for twice the longer of the two
+	recovery := rate.Window
+	if burst := rate.interval() * time.Duration(rate.burst()); burst > recovery {
+		recovery = burst
+	}
+
+	local := newMemoryStore(now)
+	return &RateLimiter{
+		algorithm: algorithm,
+		rate:      rate,
+		newState:  newState,
+		idle:      2 * recovery,
+		now:       now,
+		store:     local,
+		local:     local,
+		logger:    log.Default(),
+	}, nil
+}
+
+// UseStore keeps client state in store, under keys named after the limiter
+// so that limiters sharing a store do not share quotas
+func (rl *RateLimiter) UseStore(store RateStore, name string) {
+	rl.store = store
+	rl.prefix = "ratelimit:" + name + ":" + rl.algorithm + ":"
+}
+
+// update runs fn on key's state in the store, or in local memory while the
+// store is failing. It returns errRateStoreContention when the store is up
+// but the key kept changing; that concerns this request only, so nothing
+// falls back.
+func (rl *RateLimiter) update(key string, now time.Time, view bool, fn func(limiterState)) error {
+	if rl.store != RateStore(rl.local) && rl.storeAvailable(now) {
+		var err error
+		if view {
+			err = rl.store.View(rl.prefix+key, rl.newState, fn)
+		} else {
+			err = rl.store.Update(rl.prefix+key, rl.newState, rl.idle, fn)
+		}
+		if errors.Is(err, errRateStoreContention) {
+			return err
+		}
+		rl.storeResult(now, err)
+		if err == nil {
+			return nil
+		}
+	}
+
+	if view {
+		return rl.local.View(key, rl.newState, fn)
+	}
+	return rl.local.Update(key, rl.newState, rl.idle, fn)
+}
+
+// storeAvailable reports whether the store should be tried, which it is
+// again rateStoreRetry after a failure
+func (rl *RateLimiter) storeAvailable(now time.Time) bool {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	return rl.storeDown.IsZero() || now.Sub(rl.storeDown) >= rateStoreRetry
+}
+
+// storeResult records whether the store worked, logging when it goes down
+// and comes back
+func (rl *RateLimiter) storeResult(now time.Time, err error) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	switch {
+	case err != nil && rl.storeDown.IsZero():
+		rl.logger.Printf("Rate limit store failed, using local limits: %v", err)
+		rl.storeDown = now
+	case err != nil:
+		rl.storeDown = now
+	case !rl.storeDown.IsZero():
+		rl.logger.Printf("Rate limit store is back")
+		rl.storeDown = time.Time{}
+	}
+}
+
+// Allow checks if a request from key costing cost should be allowed and
+// returns the quota left after it. A request costing more than the limit is
+// charged the whole limit, so it can still pass with a full quota. A request
+// whose state could not be updated for contention is denied, as it could not
+// be counted.
+func (rl *RateLimiter) Allow(key string, cost int) (Quota, bool) {
+	now := rl.now()
+	var quota Quota
+	var allowed bool
+	err := rl.update(key, now, false, func(state limiterState) {
+		n := min(max(cost, 1), state.quota(rl.rate, now, 1).Limit)
+		allowed = state.allow(rl.rate, now, n)
+		if !allowed {
+			quota = state.quota(rl.rate, now, n)
+		} else {
+			quota = state.quota(rl.rate, now, 1)
+		}
+	})
+	if err != nil {
+		return quota, false
+	}
+	return quota, allowed
+}
+
+// Peek returns the quota of key without counting a request
+func (rl *RateLimiter) Peek(key string) Quota {
+	now := rl.now()
+	var quota Quota
+	rl.update(key, now, true, func(state limiterState) {
+		quota = state.quota(rl.rate, now, 1)
+	})
+	return quota
+}
+
+// cleanupVisitors forgets the idle clients kept in memory
+func (rl *RateLimiter) cleanupVisitors() {
+	rl.local.cleanup()
+}
+
+// rateLimitStatusPath reports the caller's quota without spending it
+const rateLimitStatusPath = "/ratelimit/status"
+
+// setRateLimitHeaders describes q with the RateLimit headers of the IETF
+// draft and their X-RateLimit aliases. Limited responses also get Retry-After.
+func setRateLimitHeaders(h http.Header, q Quota, limited bool) {
+	for _, prefix := range []string{"RateLimit-", "X-RateLimit-"} {
+		h.Set(prefix+"Limit", strconv.Itoa(q.Limit))
+		h.Set(prefix+"Remaining", strconv.Itoa(q.Remaining))
+		h.Set(prefix+"Reset", strconv.Itoa(ceilSeconds(q.Reset)))
+	}
+	if limited {
+		h.Set("Retry-After", strconv.Itoa(max(1, ceilSeconds(q.RetryAfter))))
+	}
+}
+
+// ceilSeconds rounds d up to whole seconds, so clients never retry early
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
+}
+
+// RateLimitStatus represents the body returned by /ratelimit/status
+type RateLimitStatus struct {
+	Policy     string `json:"policy"`
+	Exempt     bool   `json:"exempt,omitempty"`
+	Limit      int    `json:"limit"`
+	Remaining  int    `json:"remaining"`
+	Reset      int    `json:"reset"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// statusPolicy is the policy /ratelimit/status reports on: the one for
+// the route query parameter, or for the client alone without it
+func (s *Server) statusPolicy(r *http.Request, clientIP string) *RatePolicy {
+	route := r.URL.Query().Get("route")
+	if route != "" {
+		route, _ = splitVersion(route)
+	}
+	return s.policies.Match(route, clientIP)
+}
+
+// rateLimitMiddleware limits requests by the policy for their route and
+// client, rejecting those over quota with a 429
+func (s *Server) rateLimitMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientIP := s.clientIP(r)
+		route, _ := splitVersion(r.URL.Path)
+		if route == rateLimitStatusPath {
+			// Checking the quota does not spend it
+			if policy := s.statusPolicy(r, clientIP); !policy.Exempt {
+				setRateLimitHeaders(w.Header(), policy.Limiter().Peek(s.rateLimitKey(clientIP)), false)
+			}
+		} else if policy := s.policies.Match(route, clientIP); !policy.Exempt {
+			quota, allowed := policy.Allow(s.rateLimitKey(clientIP), policy.RequestCost(r, route))
+			setRateLimitHeaders(w.Header(), quota, !allowed)
+			if !allowed {
+				sendErrorResponse(w, "Rate limit exceeded", "Too many requests", http.StatusTooManyRequests)
+				s.publishRequestEvent(eventRateLimitRejected, r, http.StatusTooManyRequests, 0)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// rateLimitStatusHandler handles GET /ratelimit/status. rateLimitMiddleware
+// does not count these requests against the rate limit.
+func (s *Server) rateLimitStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	clientIP := s.clientIP(r)
+	policy := s.statusPolicy(r, clientIP)
+	status := RateLimitStatus{Policy: policy.Name, Exempt: policy.Exempt}
+	if !policy.Exempt {
+		q := policy.Limiter().Peek(s.rateLimitKey(clientIP))
+		status.Limit = q.Limit
+		status.Remaining = q.Remaining
+		status.Reset = ceilSeconds(q.Reset)
+		status.RetryAfter = ceilSeconds(q.RetryAfter)
+	}
+	sendDataResponse(w, status, status)
+}
+
+// fixedWindow counts requests in a window starting at the first one. It
+// allows up to twice the limit around the end of a window.
+type fixedWindow struct {
+	Start time.Time `json:"start"`
+	Count int       `json:"count"`
+}
+
+func (s *fixedWindow) allow(rate Rate, now time.Time, n int) bool {
+	if now.Sub(s.Start) >= rate.Window {
+		s.Start = now
+		s.Count = 0
+	}
+	if s.Count+n > rate.Limit {
+		return false
+	}
+	s.Count += n
+	return true
+}
+
+func (s *fixedWindow) quota(rate Rate, now time.Time, n int) Quota {
+	q := Quota{Limit: rate.Limit, Remaining: rate.Limit}
+	if now.Sub(s.Start) < rate.Window && s.Count > 0 {
+		q.Remaining = max(rate.Limit-s.Count, 0)
+		q.Reset = s.Start.Add(rate.Window).Sub(now)
+		if n > q.Remaining {
+			q.RetryAfter = q.Reset
+		}
+	}
+	return q
+}
+
+// slidingLog keeps the time and cost of every allowed request in the last
+// window. It is exact, at the cost of up to Limit entries per client.
+type slidingLog struct {
+	Log  []logEntry `json:"log"`
+	Used int        `json:"used"`
+}
+
+type logEntry struct {
+	At   time.Time `json:"at"`
+	Cost int       `json:"cost"`
+}
+
+// expire drops the entries that have left the window
+func (s *slidingLog) expire(rate Rate, now time.Time) {
+	for len(s.Log) > 0 && now.Sub(s.Log[0].At) >= rate.Window {
+		s.Used -= s.Log[0].Cost
+		s.Log = s.Log[1:]
+	}
+}
+
+func (s *slidingLog) allow(rate Rate, now time.Time, n int) bool {
+	s.expire(rate, now)
+	if s.Used+n > rate.Limit {
+		return false
+	}
+	s.Log = append(s.Log, logEntry{At: now, Cost: n})
+	s.Used += n
+	return true
+}
+
+func (s *slidingLog) quota(rate Rate, now time.Time, n int) Quota {
+	live := *s
+	live.expire(rate, now)
+
+	q := Quota{Limit: rate.Limit, Remaining: rate.Limit - live.Used}
+	if len(live.Log) > 0 {
+		q.Reset = live.Log[len(live.Log)-1].At.Add(rate.Window).Sub(now)
+	}
+	// Wait for the oldest entries to free enough of the limit
+	used := live.Used
+	for _, e := range live.Log {
+		if used+n <= rate.Limit {
+			break
+		}
+		used -= e.Cost
+		q.RetryAfter = e.At.Add(rate.Window).Sub(now)
+	}
+	return q
+}
+
+// slidingWindow approximates a sliding log from the counts of the current
+// and the previous aligned window, weighting the previous one by how much
+// of it the sliding window still covers
+type slidingWindow struct {
+	Start    time.Time `json:"start"`
+	Count    int       `json:"count"`
+	Previous int       `json:"previous"`
+}
+
+// at returns the counts of the window holding now
+func (s *slidingWindow) at(rate Rate, now time.Time) slidingWindow {
+	start := now.Truncate(rate.Window)
+	switch {
+	case start.Equal(s.Start):
+		return *s
+	case start.Sub(s.Start) == rate.Window:
+		return slidingWindow{Start: start, Previous: s.Count}
+	default:
+		return slidingWindow{Start: start}
+	}
+}
+
+// estimate is the approximate number of requests in the window ending at now
+func (s *slidingWindow) estimate(rate Rate, now time.Time) float64 {
+	weight := 1 - float64(now.Sub(s.Start))/float64(rate.Window)
+	return float64(s.Previous)*weight + float64(s.Count)
+}
+
+// A request costing n is allowed while the estimate is below Limit-n+1,
+// which for single requests means below Limit
+func (s *slidingWindow) allow(rate Rate, now time.Time, n int) bool {
+	*s = s.at(rate, now)
+	if s.estimate(rate, now) >= float64(rate.Limit-n+1) {
+		return false
+	}
+	s.Count += n
+	return true
+}
+
+func (s *slidingWindow) quota(rate Rate, now time.Time, n int) Quota {
+	w := s.at(rate, now)
+	estimate := w.estimate(rate, now)
+	q := Quota{Limit: rate.Limit, Remaining: max(rate.Limit-int(math.Floor(estimate)), 0)}
+
+	// The estimate reaches 0 once the current window has become the
+	// previous one and passed as well
+	end := w.Start.Add(rate.Window)
+	switch {
+	case w.Count > 0:
+		q.Reset = end.Add(rate.Window).Sub(now)
+	case w.Previous > 0:
+		q.Reset = end.Sub(now)
+	}
+
+	if threshold := float64(rate.Limit - n + 1); estimate >= threshold {
+		// The estimate drops below the threshold once enough of the
+		// previous window, or of this one after it, has slid out of range
+		window := float64(rate.Window)
+		var allowedAt time.Time
+		if float64(w.Count) >= threshold {
+			allowedAt = end.Add(time.Duration(window * (1 - threshold/float64(w.Count))))
+		} else {
+			allowedAt = w.Start.Add(time.Duration(window * (1 - (threshold-float64(w.Count))/float64(w.Previous))))
+		}
+		q.RetryAfter = allowedAt.Sub(now) + time.Nanosecond
+	}
+	return q
+}
+
+// tokenBucket holds up to Burst tokens, refilled at Limit per Window; each
+// request takes as many as it costs
+type tokenBucket struct {
+	Tokens float64   `json:"tokens"`
+	Last   time.Time `json:"last"`
+}
+
+// available returns the tokens in the bucket at now
+func (s *tokenBucket) available(rate Rate, now time.Time) float64 {
+	capacity := float64(rate.burst())
+	if s.Last.IsZero() {
+		return capacity
+	}
+	return math.Min(capacity, s.Tokens+float64(now.Sub(s.Last))/float64(rate.interval()))
+}
+
+func (s *tokenBucket) allow(rate Rate, now time.Time, n int) bool {
+	s.Tokens = s.available(rate, now)
+	s.Last = now
+
+	if s.Tokens < float64(n) {
+		return false
+	}
+	s.Tokens -= float64(n)
+	return true
+}
+
+func (s *tokenBucket) quota(rate Rate, now time.Time, n int) Quota {
+	tokens := s.available(rate, now)
+	interval := float64(rate.interval())
+	q := Quota{
+		Limit:     rate.burst(),
+		Remaining: int(tokens),
+		Reset:     time.Duration(math.Ceil((float64(rate.burst()) - tokens) * interval)),
+	}
+	if tokens < float64(n) {
+		// Rounded up so the refill is complete despite float rounding
+		q.RetryAfter = time.Duration(math.Ceil((float64(n) - tokens) * interval))
+	}
+	return q
+}
+
+// gcra is the generic cell rate algorithm: it tracks the theoretical
+// arrival time of the next request, and a request may arrive up to
+// Burst-1 intervals before it. A request costing n counts as n arrivals.
+type gcra struct {
+	TAT time.Time `json:"tat"`
+}
+
+// ahead returns how far the theoretical arrival time is ahead of now, and
+// how far ahead it may be for a request costing n to pass
+func (s *gcra) ahead(rate Rate, now time.Time, n int) (ahead, tolerance time.Duration) {
+	if s.TAT.After(now) {
+		ahead = s.TAT.Sub(now)
+	}
+	return ahead, rate.interval() * time.Duration(rate.burst()-n)
+}
+
+func (s *gcra) allow(rate Rate, now time.Time, n int) bool {
+	ahead, tolerance := s.ahead(rate, now, n)
+	if ahead > tolerance {
+		return false
+	}
+	s.TAT = now.Add(ahead + rate.interval()*time.Duration(n))
+	return true
+}
+
+func (s *gcra) quota(rate Rate, now time.Time, n int) Quota {
+	interval := rate.interval()
+	ahead, tolerance := s.ahead(rate, now, n)
+	q := Quota{Limit: rate.burst(), Reset: ahead}
+	if full := interval * time.Duration(rate.burst()); ahead < full {
+		q.Remaining = int((full - ahead) / interval)
+	}
+	if ahead > tolerance {
+		q.RetryAfter = ahead - tolerance
+	}
+	return q
+}
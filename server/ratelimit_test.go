@@ -0,0 +1,271 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock for rate limiters that only moves when advanced
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// newTestLimiter creates a rate limiter on a fake clock starting at the
+// beginning of a window
+func newTestLimiter(t *testing.T, algorithm string, rate Rate) (*RateLimiter, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	rl, err := newRateLimiter(algorithm, rate, clock.Now)
+	if err != nil {
+		t.Fatalf("newRateLimiter(%q) error: %v", algorithm, err)
+	}
+	return rl, clock
+}
+
+// Test each algorithm against a sequence of bursts
+func TestRateLimitAlgorithms(t *testing.T) {
+	// Each step advances the clock, then makes attempts requests of which
+	// allowed should pass
+	type step struct {
+		advance  time.Duration
+		attempts int
+		allowed  int
+	}
+	fourPerSecond := Rate{Limit: 4, Window: time.Second}
+	burstOfThree := Rate{Limit: 1, Window: time.Second, Burst: 3}
+
+	tests := []struct {
+		name      string
+		algorithm string
+		rate      Rate
+		steps     []step
+	}{
+		{"fixed window", "fixed-window", fourPerSecond, []step{
+			{0, 5, 4}, {999 * time.Millisecond, 1, 0}, {time.Millisecond, 5, 4},
+		}},
+		{"fixed window allows twice the limit around a boundary", "fixed-window", fourPerSecond, []step{
+			{0, 1, 1}, {900 * time.Millisecond, 3, 3}, {100 * time.Millisecond, 4, 4},
+		}},
+		{"sliding log", "sliding-log", fourPerSecond, []step{
+			{0, 1, 1}, {900 * time.Millisecond, 4, 3}, {100 * time.Millisecond, 4, 1}, {900 * time.Millisecond, 4, 3},
+		}},
+		{"sliding window", "sliding-window", fourPerSecond, []step{
+			{0, 5, 4}, {time.Second, 1, 0}, {500 * time.Millisecond, 3, 2}, {2 * time.Second, 5, 4},
+		}},
+		{"token bucket", "token-bucket", fourPerSecond, []step{
+			{0, 5, 4}, {250 * time.Millisecond, 2, 1}, {time.Second, 5, 4},
+		}},
+		{"token bucket burst", "token-bucket", burstOfThree, []step{
+			{0, 4, 3}, {time.Second, 2, 1}, {10 * time.Second, 4, 3},
+		}},
+		{"gcra", "gcra", fourPerSecond, []step{
+			{0, 5, 4}, {250 * time.Millisecond, 2, 1}, {time.Second, 5, 4},
+		}},
+		{"gcra burst", "gcra", burstOfThree, []step{
+			{0, 4, 3}, {time.Second, 2, 1}, {500 * time.Millisecond, 1, 0}, {10 * time.Second, 4, 3},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rl, clock := newTestLimiter(t, tt.algorithm, tt.rate)
+			for i, s := range tt.steps {
+				clock.Advance(s.advance)
+				allowed := 0
+				for j := 0; j < s.attempts; j++ {
+					if _, ok := rl.Allow("client", 1); ok {
+						allowed++
+					}
+				}
+				if allowed != s.allowed {
+					t.Errorf("step %d: %d of %d allowed, want %d", i, allowed, s.attempts, s.allowed)
+				}
+			}
+		})
+	}
+}
+
+// Test that clients are limited separately and idle ones are forgotten
+func TestRateLimiterVisitors(t *testing.T) {
+	for algorithm := range rateAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			rl, clock := newTestLimiter(t, algorithm, Rate{Limit: 2, Window: time.Second, Burst: 4})
+			for allowed := true; allowed; _, allowed = rl.Allow("busy", 1) {
+			}
+			if _, ok := rl.Allow("other", 1); !ok {
+				t.Error("a limited client blocked another one")
+			}
+
+			clock.Advance(rl.idle + time.Nanosecond)
+			rl.Allow("recent", 1)
+			rl.cleanupVisitors()
+			if _, ok := rl.local.visitors["busy"]; ok || len(rl.local.visitors) != 1 {
+				t.Errorf("visitors after cleanup = %v, want only recent", rl.local.visitors)
+			}
+			if _, ok := rl.Allow("busy", 1); !ok {
+				t.Error("a forgotten client was still limited")
+			}
+		})
+	}
+}
+
+// Test that each algorithm's quota predicts its decisions: Remaining
+// requests pass, the next one waits RetryAfter, and after Reset the full
+// Limit is back
+func TestRateLimitQuota(t *testing.T) {
+	for algorithm := range rateAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			rl, clock := newTestLimiter(t, algorithm, Rate{Limit: 4, Window: time.Second, Burst: 6})
+			if q := rl.Peek("client"); q.Remaining != q.Limit || q.Reset != 0 || q.RetryAfter != 0 {
+				t.Fatalf("new client quota = %+v", q)
+			}
+
+			for _, advance := range []time.Duration{0, 300 * time.Millisecond, 700 * time.Millisecond, 1250 * time.Millisecond} {
+				clock.Advance(advance)
+				q := rl.Peek("client")
+				for i := 0; i < q.Remaining; i++ {
+					if _, ok := rl.Allow("client", 1); !ok {
+						t.Fatalf("after %v: request %d of %+v was limited", advance, i+1, q)
+					}
+				}
+				limited, ok := rl.Allow("client", 1)
+				if ok || limited.Remaining != 0 || limited.RetryAfter <= 0 {
+					t.Fatalf("after %v: request past %+v allowed %t with %+v", advance, q, ok, limited)
+				}
+
+				clock.Advance(limited.RetryAfter - time.Millisecond)
+				if _, ok := rl.Allow("client", 1); ok {
+					t.Errorf("after %v: allowed before RetryAfter %v", advance, limited.RetryAfter)
+				}
+				clock.Advance(time.Millisecond)
+				if _, ok := rl.Allow("client", 1); !ok {
+					t.Errorf("after %v: limited after RetryAfter %v", advance, limited.RetryAfter)
+				}
+			}
+
+			clock.Advance(rl.Peek("client").Reset)
+			if q := rl.Peek("client"); q.Remaining != q.Limit {
+				t.Errorf("quota after Reset = %+v", q)
+			}
+		})
+	}
+}
+
+// Test charging requests by cost
+func TestRateLimitCost(t *testing.T) {
+	for algorithm := range rateAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			rl, clock := newTestLimiter(t, algorithm, Rate{Limit: 10, Window: time.Second})
+			if q, ok := rl.Allow("client", 7); !ok || q.Remaining != 3 {
+				t.Fatalf("first request = %t with %+v, want 3 remaining", ok, q)
+			}
+			limited, ok := rl.Allow("client", 4)
+			if ok || limited.Remaining != 3 || limited.RetryAfter <= 0 {
+				t.Fatalf("request costing 4 = %t with %+v, want limited", ok, limited)
+			}
+
+			clock.Advance(limited.RetryAfter - time.Millisecond)
+			if _, ok := rl.Allow("client", 4); ok {
+				t.Errorf("allowed before RetryAfter %v", limited.RetryAfter)
+			}
+			clock.Advance(time.Millisecond)
+			if _, ok := rl.Allow("client", 4); !ok {
+				t.Errorf("limited after RetryAfter %v", limited.RetryAfter)
+			}
+
+			// A request costing more than the limit takes all of it
+			clock.Advance(rl.Peek("client").Reset)
+			if _, ok := rl.Allow("client", 100); !ok {
+				t.Error("an oversized request was limited with a full quota")
+			}
+			if q, ok := rl.Allow("client", 1); ok || q.Remaining != 0 {
+				t.Errorf("after an oversized request: %t with %+v", ok, q)
+			}
+		})
+	}
+}
+
+// Test the rate limit headers and the status endpoint
+func TestRateLimitHeaders(t *testing.T) {
+	rl, err := NewRateLimiter("fixed-window", Rate{Limit: 2, Window: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rl.Close()
+
+	s := newTestServer(t, WithTrustedProxies("192.0.2.0/24"), WithLimiter(rl))
+	handler := s.loggingMiddleware(s.rateLimitMiddleware(s.newRouter()))
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.Header.Set("X-Forwarded-For", "192.0.2.44")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	tests := []struct {
+		path      string
+		code      int
+		remaining string
+	}{
+		{"/v2/ratelimit/status", http.StatusOK, "2"},
+		{"/health", http.StatusOK, "1"},
+		{"/ratelimit/status", http.StatusOK, "1"},
+		{"/v1/health", http.StatusOK, "0"},
+		{"/hello", http.StatusTooManyRequests, "0"},
+		{"/ratelimit/status", http.StatusOK, "0"},
+	}
+
+	for _, tt := range tests {
+		w := get(tt.path)
+		if w.Code != tt.code {
+			t.Fatalf("GET %s status = %v, want %v", tt.path, w.Code, tt.code)
+		}
+		for _, prefix := range []string{"RateLimit-", "X-RateLimit-"} {
+			if w.Header().Get(prefix+"Limit") != "2" || w.Header().Get(prefix+"Remaining") != tt.remaining || w.Header().Get(prefix+"Reset") == "" {
+				t.Errorf("GET %s headers = %v, want %s remaining", tt.path, w.Header(), tt.remaining)
+			}
+		}
+		if retry := w.Header().Get("Retry-After"); (retry != "") != (tt.code == http.StatusTooManyRequests) {
+			t.Errorf("GET %s Retry-After = %q", tt.path, retry)
+		}
+	}
+
+	var status struct {
+		Data RateLimitStatus `json:"data"`
+	}
+	w := get("/v2/ratelimit/status")
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil || status.Data.Limit != 2 || status.Data.Remaining != 0 || status.Data.RetryAfter < 59 {
+		t.Errorf("status = %s", w.Body.String())
+	}
+}
+
+// Test rejecting unknown algorithms and invalid rates
+func TestNewRateLimiterErrors(t *testing.T) {
+	tests := []struct {
+		algorithm string
+		rate      Rate
+	}{
+		{"leaky", Rate{Limit: 1, Window: time.Second}},
+		{"gcra", Rate{Limit: 0, Window: time.Second}},
+		{"gcra", Rate{Limit: 1}},
+		{"token-bucket", Rate{Limit: 1, Window: time.Second, Burst: -1}},
+	}
+
+	for _, tt := range tests {
+		if _, err := NewRateLimiter(tt.algorithm, tt.rate); err == nil {
+			t.Errorf("NewRateLimiter(%q, %+v) succeeded", tt.algorithm, tt.rate)
+		}
+	}
+}
@@ -0,0 +1,254 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"reflect"
+	"time"
+)
+
+// RatePolicy limits the requests it matches with a limiter of its own
+type RatePolicy struct {
+	Name string `json:"name"`
+	// Routes are API routes without the version prefix; a trailing "*"
+	// matches by prefix. Empty matches every route.
+	Routes []string `json:"routes,omitempty"`
+	// Classes name client classes from RatePolicies.Classes. Empty matches every client.
+	Classes []string `json:"classes,omitempty"`
+	// Exempt requests are not limited or counted
+	Exempt bool `json:"exempt,omitempty"`
+	// Algorithm, Limit, Window (seconds) and Burst default to the global
+	// rate limit
+	Algorithm string `json:"algorithm,omitempty"`
+	Limit     int    `json:"limit,omitempty"`
+	Window    int    `json:"window,omitempty"`
+	Burst     int    `json:"burst,omitempty"`
+	// Cost is charged per request, 1 by default, plus ItemCost for each
+	// item of the request: array elements, or the number of a factorial
+	Cost     int     `json:"cost,omitempty"`
+	ItemCost float64 `json:"item_cost,omitempty"`
+
+	limiter Limiter
+}
+
+// defaultRatePolicyName names the policy for requests no policy matches,
+// which uses the server's limiter
+const defaultRatePolicyName = "default"
+
+// Limiter returns the policy's limiter
+func (p *RatePolicy) Limiter() Limiter {
+	return p.limiter
+}
+
+// Allow charges key cost under the policy; exempt requests are always allowed
+func (p *RatePolicy) Allow(key string, cost int) (Quota, bool) {
+	if p.Exempt {
+		return Quota{}, true
+	}
+	return p.Limiter().Allow(key, cost)
+}
+
+// RatePolicies picks the rate limit policy for each request: the first
+// policy matching both its route and client class, or the default policy
+type RatePolicies struct {
+	// Classes name lists of client networks, such as {"internal": ["10.0.0.0/8"]}
+	Classes  map[string][]string `json:"classes,omitempty"`
+	Policies []*RatePolicy       `json:"policies"`
+
+	networks map[string][]*net.IPNet
+	fallback *RatePolicy
+}
+
+// LoadRatePolicies reads policies from a JSON file. Unset policy limits
+// default to algorithm and rate.
+func LoadRatePolicies(path, algorithm string, rate Rate) (*RatePolicies, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParseRatePolicies(data, algorithm, rate)
+}
+
+// ParseRatePolicies parses and validates JSON policies, creating a
+// limiter for each policy that is not exempt
+func ParseRatePolicies(data []byte, algorithm string, rate Rate) (*RatePolicies, error) {
+	var p RatePolicies
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&p); err != nil {
+		return nil, err
+	}
+
+	p.networks = make(map[string][]*net.IPNet)
+	for class, cidrs := range p.Classes {
+		for _, cidr := range cidrs {
+			network, err := parseNetwork(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("class %q: %v", class, err)
+			}
+			p.networks[class] = append(p.networks[class], network)
+		}
+	}
+
+	for i, policy := range p.Policies {
+		if policy.Name == "" {
+			return nil, fmt.Errorf("policy %d has no name", i+1)
+		}
+		for _, class := range policy.Classes {
+			if _, ok := p.Classes[class]; !ok {
+				return nil, fmt.Errorf("policy %q: unknown class %q", policy.Name, class)
+			}
+		}
+		if policy.Cost < 0 || policy.ItemCost < 0 {
+			return nil, fmt.Errorf("policy %q: costs must not be negative", policy.Name)
+		}
+		if policy.Exempt {
+			continue
+		}
+
+		a, r := algorithm, rate
+		if policy.Algorithm != "" {
+			a = policy.Algorithm
+		}
+		if policy.Limit != 0 {
+			r.Limit = policy.Limit
+			// A burst sized for the global limit does not carry over
+			r.Burst = 0
+		}
+		if policy.Window != 0 {
+			r.Window = time.Duration(policy.Window) * time.Second
+		}
+		if policy.Burst != 0 {
+			r.Burst = policy.Burst
+		}
+		limiter, err := NewRateLimiter(a, r)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %v", policy.Name, err)
+		}
+		policy.limiter = limiter
+	}
+	p.fallback = &RatePolicy{Name: defaultRatePolicyName}
+	return &p, nil
+}
+
+// Match returns the policy for a request to route from clientIP
+func (p *RatePolicies) Match(route, clientIP string) *RatePolicy {
+	ip := net.ParseIP(clientIP)
+	for _, policy := range p.Policies {
+		if len(policy.Routes) > 0 && !matchesAny(policy.Routes, route) {
+			continue
+		}
+		if len(policy.Classes) > 0 && !p.inClasses(ip, policy.Classes) {
+			continue
+		}
+		return policy
+	}
+	return p.fallback
+}
+
+// withDefault returns a copy of the policies whose default policy limits
+// with limiter
+func (p *RatePolicies) withDefault(limiter Limiter) *RatePolicies {
+	withDefault := *p
+	withDefault.fallback = &RatePolicy{Name: defaultRatePolicyName, limiter: limiter}
+	return &withDefault
+}
+
+// Close stops the cleanup goroutines of the policies' limiters
+func (p *RatePolicies) Close() {
+	for _, policy := range p.Policies {
+		if rl, ok := policy.limiter.(*RateLimiter); ok {
+			rl.Close()
+		}
+	}
+}
+
+// UseStore keeps the state of each policy's limiter in store
+func (p *RatePolicies) UseStore(store RateStore) {
+	for _, policy := range p.Policies {
+		if rl, ok := policy.limiter.(*RateLimiter); ok {
+			rl.UseStore(store, policy.Name)
+		}
+	}
+}
+
+func matchesAny(patterns []string, route string) bool {
+	for _, pattern := range patterns {
+		if routeMatches(pattern, route) {
+			return true
+		}
+	}
+	return false
+}
+
+// inClasses reports whether ip belongs to one of classes
+func (p *RatePolicies) inClasses(ip net.IP, classes []string) bool {
+	if ip == nil {
+		return false
+	}
+	for _, class := range classes {
+		for _, network := range p.networks[class] {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// rateItems is implemented by requests whose cost grows with their size
+type rateItems interface {
+	rateItems() int
+}
+
+func (req ArrayRequest) rateItems() int     { return len(req.Numbers) }
+func (req PairwiseRequest) rateItems() int  { return len(req.Array1) }
+func (req ScalarRequest) rateItems() int    { return len(req.Numbers) }
+func (req FactorialRequest) rateItems() int { return req.Number }
+
+// RequestCost returns what a request to route is charged under the policy. Sized
+// requests are decoded once here to count their items; the body is put
+// back for the handler, and requests that fail to decode cost only Cost.
+func (p *RatePolicy) RequestCost(r *http.Request, route string) int {
+	cost := p.Cost
+	if cost == 0 {
+		cost = 1
+	}
+	if p.ItemCost == 0 {
+		return cost
+	}
+
+	var request interface{}
+	for _, ar := range apiRoutes {
+		if ar.Path == route {
+			request = ar.Request
+		}
+	}
+	if _, ok := request.(rateItems); !ok {
+		return cost
+	}
+
+	decoded := r.Clone(r.Context())
+	if r.Method != http.MethodGet && r.Body != nil {
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxRequestBodySize+1))
+		if err != nil {
+			return cost
+		}
+		// Keep anything past the limit so the handler still rejects it
+		r.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), r.Body))
+		decoded.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	v := reflect.New(reflect.TypeOf(request))
+	if err := decodeOperationRequest(decoded, v.Interface()); err != nil {
+		return cost
+	}
+	items := max(v.Elem().Interface().(rateItems).rateItems(), 0)
+	return cost + int(math.Ceil(p.ItemCost*float64(items)))
+}
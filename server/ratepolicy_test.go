@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testRatePolicies = `{
+	"classes": {"internal": ["10.0.0.0/8", "::1"]},
+	"policies": [
+		{"name": "probes", "routes": ["/health", "/ratelimit/status"], "exempt": true},
+		{"name": "internal", "classes": ["internal"], "limit": 1000},
+		{"name": "arrays", "routes": ["/multiply/*"], "algorithm": "token-bucket", "limit": 100, "item_cost": 1},
+		{"name": "factorial", "routes": ["/factorial"], "limit": 30, "cost": 2, "item_cost": 0.5}
+	]
+}`
+
+// parseTestPolicies parses data into policies that are closed when the
+// test ends
+func parseTestPolicies(t *testing.T, data string) *RatePolicies {
+	t.Helper()
+	p, err := ParseRatePolicies([]byte(data), "sliding-window", Rate{Limit: 100, Window: time.Minute})
+	if err != nil {
+		t.Fatalf("ParseRatePolicies error: %v", err)
+	}
+	t.Cleanup(p.Close)
+	return p
+}
+
+// Test that the example policy file loads
+func TestLoadRatePolicies(t *testing.T) {
+	p, err := LoadRatePolicies("../ratelimit-policies.example.json", "sliding-window", Rate{Limit: 100, Window: time.Minute})
+	if err != nil {
+		t.Fatalf("LoadRatePolicies error: %v", err)
+	}
+	if got := p.Match("/multiply/array", "127.0.0.1").Name; got != "internal" {
+		t.Errorf("local client policy = %s, want internal", got)
+	}
+	if _, err := LoadRatePolicies("no-such-file.json", "sliding-window", Rate{Limit: 100, Window: time.Minute}); err == nil {
+		t.Error("a missing file loaded without error")
+	}
+}
+
+// Test rejecting invalid policy files
+func TestParseRatePoliciesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+	}{
+		{"unknown field", `{"policies": [{"name": "a", "rate": 5}]}`},
+		{"unknown class", `{"policies": [{"name": "a", "classes": ["partners"]}]}`},
+		{"invalid network", `{"classes": {"a": ["10.0.0.0/33"]}, "policies": []}`},
+		{"missing name", `{"policies": [{"limit": 5}]}`},
+		{"unknown algorithm", `{"policies": [{"name": "a", "algorithm": "leaky"}]}`},
+		{"negative cost", `{"policies": [{"name": "a", "item_cost": -1}]}`},
+		{"invalid JSON", `{"policies": [`},
+	}
+
+	for _, tt := range tests {
+		if _, err := ParseRatePolicies([]byte(tt.data), "sliding-window", Rate{Limit: 100, Window: time.Minute}); err == nil {
+			t.Errorf("%s: parsed without error", tt.name)
+		}
+	}
+}
+
+// Test choosing the first policy matching route and client class
+func TestRatePolicyMatch(t *testing.T) {
+	p := parseTestPolicies(t, testRatePolicies)
+
+	tests := []struct {
+		route    string
+		clientIP string
+		want     string
+	}{
+		{"/health", "203.0.113.1", "probes"},
+		{"/health", "10.1.2.3", "probes"},
+		{"/multiply/array", "10.1.2.3", "internal"},
+		{"/multiply/array", "::1", "internal"},
+		{"/multiply/array", "203.0.113.1", "arrays"},
+		{"/multiply", "203.0.113.1", "default"},
+		{"/factorial", "203.0.113.1", "factorial"},
+		{"/power", "203.0.113.1", "default"},
+		{"/power", "not-an-ip", "default"},
+	}
+
+	for _, tt := range tests {
+		if got := p.Match(tt.route, tt.clientIP); got.Name != tt.want {
+			t.Errorf("Match(%q, %q) = %s, want %s", tt.route, tt.clientIP, got.Name, tt.want)
+		}
+	}
+
+	// Unset limits fall back to the global rate
+	if q := p.Match("/power", "10.0.0.1").Limiter().Peek("10.0.0.1"); q.Limit != 1000 {
+		t.Errorf("internal limit = %d, want 1000", q.Limit)
+	}
+}
+
+// Test charging requests by their size
+func TestRatePolicyCost(t *testing.T) {
+	p := parseTestPolicies(t, testRatePolicies)
+	arrays := p.Match("/multiply/array", "203.0.113.1")
+	factorial := p.Match("/factorial", "203.0.113.1")
+
+	tests := []struct {
+		policy *RatePolicy
+		method string
+		route  string
+		target string
+		body   string
+		want   int
+	}{
+		{arrays, "POST", "/multiply/array", "/v2/multiply/array", `{"numbers":[1,2,3,4,5]}`, 6},
+		{arrays, "GET", "/multiply/array", "/v2/multiply/array?numbers=1,2,3", "", 4},
+		{arrays, "POST", "/multiply/pairwise", "/multiply/pairwise", `{"array1":[1,2],"array2":[3,4]}`, 3},
+		{arrays, "POST", "/multiply", "/multiply", `{"a":2,"b":3}`, 1},
+		{arrays, "POST", "/multiply/array", "/multiply/array", `{"numbers":"oops"}`, 1},
+		{factorial, "POST", "/factorial", "/factorial", `{"number":15}`, 10},
+		{&RatePolicy{Name: defaultRatePolicyName}, "POST", "/multiply/array", "/multiply/array", `{"numbers":[1,2,3]}`, 1},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.target, strings.NewReader(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		if got := tt.policy.RequestCost(req, tt.route); got != tt.want {
+			t.Errorf("%s %s %s cost = %d, want %d", tt.policy.Name, tt.target, tt.body, got, tt.want)
+		}
+		// The handler still reads the whole body
+		if body, _ := io.ReadAll(req.Body); string(body) != tt.body {
+			t.Errorf("%s %s body after costing = %q", tt.method, tt.target, body)
+		}
+	}
+}
+
+// Test policies applied by the middleware
+func TestRatePoliciesMiddleware(t *testing.T) {
+	s := newTestServer(t, WithTrustedProxies("192.0.2.0/24"), WithRatePolicies(parseTestPolicies(t, testRatePolicies)))
+	handler := s.loggingMiddleware(s.rateLimitMiddleware(s.newRouter()))
+	serve := func(method, target, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Forwarded-For", "198.51.100.20")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		return w
+	}
+
+	// Exempt probes carry no quota
+	if w := serve("GET", "/health", ""); w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "" {
+		t.Errorf("GET /health = %v with RateLimit-Limit %q", w.Code, w.Header().Get("RateLimit-Limit"))
+	}
+
+	numbers := `{"numbers":[` + strings.Repeat("1,", 59) + `1]}`
+	w := serve("POST", "/v2/multiply/array", numbers)
+	if w.Code != http.StatusOK || w.Header().Get("RateLimit-Limit") != "100" || w.Header().Get("RateLimit-Remaining") != "39" {
+		t.Fatalf("first array = %v with headers %v", w.Code, w.Header())
+	}
+	w = serve("POST", "/v2/multiply/array", numbers)
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" {
+		t.Errorf("second array = %v, want %v with Retry-After", w.Code, http.StatusTooManyRequests)
+	}
+	// Other policies keep their own quota
+	if w := serve("POST", "/v2/power", `{"base":2,"exponent":3}`); w.Code != http.StatusOK || w.Header().Get("RateLimit-Remaining") != "99" {
+		t.Errorf("power = %v with %q remaining", w.Code, w.Header().Get("RateLimit-Remaining"))
+	}
+
+	var status struct {
+		Data RateLimitStatus `json:"data"`
+	}
+	w = serve("GET", "/v2/ratelimit/status?route=/v2/multiply/array", "")
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Data.Policy != "arrays" || status.Data.Remaining != 39 || status.Data.Exempt {
+		t.Errorf("array status = %s", w.Body.String())
+	}
+	w = serve("GET", "/v2/ratelimit/status?route=/health", "")
+	json.Unmarshal(w.Body.Bytes(), &status)
+	if status.Data.Policy != "probes" || !status.Data.Exempt {
+		t.Errorf("probe status = %s", w.Body.String())
+	}
+}
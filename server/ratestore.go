@@ -0,0 +1,280 @@
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateStore keeps the limiter state of each client. Update and View call fn
+// with the state stored under key, or with newState() when there is none;
+// Update stores what fn leaves for ttl as one atomic change, calling fn
+// again if it has to retry.
+type RateStore interface {
+	Update(key string, newState func() limiterState, ttl time.Duration, fn func(limiterState)) error
+	View(key string, newState func() limiterState, fn func(limiterState)) error
+}
+
+// Visitor is a client's state kept in memory
+type Visitor struct {
+	expires time.Time
+	state   limiterState
+}
+
+// memoryStore keeps client state in this process
+type memoryStore struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	visitors map[string]*Visitor
+}
+
+func newMemoryStore(now func() time.Time) *memoryStore {
+	return &memoryStore{now: now, visitors: make(map[string]*Visitor)}
+}
+
+func (s *memoryStore) Update(key string, newState func() limiterState, ttl time.Duration, fn func(limiterState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	v, ok := s.visitors[key]
+	if !ok || now.After(v.expires) {
+		v = &Visitor{state: newState()}
+		s.visitors[key] = v
+	}
+	v.expires = now.Add(ttl)
+	fn(v.state)
+	return nil
+}
+
+func (s *memoryStore) View(key string, newState func() limiterState, fn func(limiterState)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if v, ok := s.visitors[key]; ok && !s.now().After(v.expires) {
+		fn(v.state)
+	} else {
+		fn(newState())
+	}
+	return nil
+}
+
+// cleanup forgets clients whose state expired
+func (s *memoryStore) cleanup() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.now()
+	for key, v := range s.visitors {
+		if now.After(v.expires) {
+			delete(s.visitors, key)
+		}
+	}
+}
+
+// rateCASScript replaces a key's value only if it still holds ARGV[1], ""
+// standing for a missing key, so replicas never overwrite each other's
+// updates. Redis runs scripts atomically.
+const rateCASScript = `local current = redis.call('GET', KEYS[1]) or ''
+if current ~= ARGV[1] then return 0 end
+redis.call('SET', KEYS[1], ARGV[2], 'PX', ARGV[3])
+return 1`
+
+const (
+	// redisTimeout bounds dialing and each command, so a stalled backend
+	// costs requests little before the limiter falls back to local limits
+	redisTimeout = 250 * time.Millisecond
+	// redisPoolSize is how many idle connections are kept
+	redisPoolSize = 8
+	// redisMaxAttempts is how many times a conflicting update is tried,
+	// waiting a random part of a millisecond per attempt so far in between
+	redisMaxAttempts = 50
+)
+
+var errRateStoreContention = errors.New("rate limit state kept changing during the update")
+
+// RedisStore keeps client state in Redis, or any server speaking its RESP
+// protocol, so that replicas share rate limits. States are stored as JSON
+// and updated with a compare-and-set script.
+type RedisStore struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+
+	scriptSHA string
+	pool      chan *respConn
+}
+
+// NewRedisStore creates a store for a URL like redis://:password@host:6379/0.
+// It connects lazily, so an unreachable server is not an error here.
+func NewRedisStore(rawURL string) (*RedisStore, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" || u.Host == "" {
+		return nil, fmt.Errorf("invalid Redis URL %q, want redis://[:password@]host[:port][/db]", rawURL)
+	}
+
+	s := &RedisStore{
+		addr:    u.Host,
+		timeout: redisTimeout,
+		pool:    make(chan *respConn, redisPoolSize),
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		s.password, _ = u.User.Password()
+	}
+	if db := strings.TrimPrefix(u.Path, "/"); db != "" {
+		if s.db, err = strconv.Atoi(db); err != nil || s.db < 0 {
+			return nil, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	sum := sha1.Sum([]byte(rateCASScript))
+	s.scriptSHA = hex.EncodeToString(sum[:])
+	return s, nil
+}
+
+// Ping checks that the server is reachable
+func (s *RedisStore) Ping() error {
+	_, err := s.do("PING")
+	return err
+}
+
+func (s *RedisStore) Update(key string, newState func() limiterState, ttl time.Duration, fn func(limiterState)) error {
+	for attempt := 0; attempt < redisMaxAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(rand.N(time.Duration(attempt) * time.Millisecond))
+		}
+		current, err := s.get(key)
+		if err != nil {
+			return err
+		}
+		state := decodeRateState(current, newState)
+		fn(state)
+		next, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+
+		reply, err := s.eval(key, string(current), string(next), strconv.FormatInt(ttl.Milliseconds(), 10))
+		if err != nil {
+			return err
+		}
+		if n, ok := reply.(int64); ok && n == 1 {
+			return nil
+		}
+	}
+	return errRateStoreContention
+}
+
+func (s *RedisStore) View(key string, newState func() limiterState, fn func(limiterState)) error {
+	current, err := s.get(key)
+	if err != nil {
+		return err
+	}
+	fn(decodeRateState(current, newState))
+	return nil
+}
+
+// decodeRateState decodes a stored state; a missing or unreadable one,
+// such as one left by another algorithm, starts over
+func decodeRateState(data []byte, newState func() limiterState) limiterState {
+	state := newState()
+	if len(data) > 0 && json.Unmarshal(data, state) != nil {
+		state = newState()
+	}
+	return state
+}
+
+// get returns the value of key, nil when it is missing
+func (s *RedisStore) get(key string) ([]byte, error) {
+	reply, err := s.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	value, _ := reply.([]byte)
+	return value, nil
+}
+
+// eval runs rateCASScript by its hash, sending the script itself the first
+// time the server sees it
+func (s *RedisStore) eval(key string, args ...string) (interface{}, error) {
+	reply, err := s.do(append([]string{"EVALSHA", s.scriptSHA, "1", key}, args...)...)
+	var rerr respError
+	if errors.As(err, &rerr) && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+		return s.do(append([]string{"EVAL", rateCASScript, "1", key}, args...)...)
+	}
+	return reply, err
+}
+
+// do sends a command on a pooled connection. Connections that fail are
+// closed; error replies leave them usable.
+func (s *RedisStore) do(args ...string) (interface{}, error) {
+	c, err := s.conn()
+	if err != nil {
+		return nil, err
+	}
+	reply, err := c.do(s.timeout, args...)
+	var rerr respError
+	if err != nil && !errors.As(err, &rerr) {
+		c.Close()
+		return nil, err
+	}
+
+	select {
+	case s.pool <- c:
+	default:
+		c.Close()
+	}
+	return reply, err
+}
+
+// conn takes an idle connection, or dials a new one
+func (s *RedisStore) conn() (*respConn, error) {
+	select {
+	case c := <-s.pool:
+		return c, nil
+	default:
+	}
+
+	c, err := dialRESP(s.addr, s.timeout)
+	if err != nil {
+		return nil, err
+	}
+	if s.password != "" {
+		if _, err := c.do(s.timeout, "AUTH", s.password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if s.db != 0 {
+		if _, err := c.do(s.timeout, "SELECT", strconv.Itoa(s.db)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// Close closes the idle connections
+func (s *RedisStore) Close() {
+	for {
+		select {
+		case c := <-s.pool:
+			c.Close()
+		default:
+			return
+		}
+	}
+}
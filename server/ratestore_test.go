@@ -0,0 +1,410 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// respStandIn is an in-process server speaking enough of the Redis protocol
+// for RedisStore: PING, AUTH, SELECT, GET, SET with PX, and EVAL/EVALSHA of
+// rateCASScript
+type respStandIn struct {
+	ln       net.Listener
+	password string
+
+	mu       sync.Mutex
+	data     map[string]string
+	expires  map[string]time.Time
+	scripts  map[string]bool
+	commands map[string]int
+	down     bool
+	conns    map[net.Conn]bool
+}
+
+// startRESPStandIn starts a stand-in server, closed when the test ends
+func startRESPStandIn(t *testing.T, password string) *respStandIn {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &respStandIn{ln: ln, password: password, data: make(map[string]string), expires: make(map[string]time.Time),
+		scripts: make(map[string]bool), commands: make(map[string]int), conns: make(map[net.Conn]bool)}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	t.Cleanup(func() { ln.Close(); s.setDown(true) })
+	return s
+}
+
+// url returns the store URL of the stand-in
+func (s *respStandIn) url() string {
+	if s.password != "" {
+		return "redis://:" + s.password + "@" + s.ln.Addr().String() + "/2"
+	}
+	return "redis://" + s.ln.Addr().String()
+}
+
+// setDown makes the stand-in drop its connections and refuse new ones
+func (s *respStandIn) setDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+	if down {
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}
+}
+
+func (s *respStandIn) count(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[command]
+}
+
+func (s *respStandIn) serve(conn net.Conn) {
+	defer conn.Close()
+	s.mu.Lock()
+	if s.down {
+		s.mu.Unlock()
+		return
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+	}()
+
+	r, w := bufio.NewReader(conn), bufio.NewWriter(conn)
+	authed := s.password == ""
+	for {
+		request, err := readRESP(r)
+		if err != nil {
+			return
+		}
+		items, _ := request.([]interface{})
+		var args []string
+		for _, item := range items {
+			b, _ := item.([]byte)
+			args = append(args, string(b))
+		}
+		if len(args) == 0 {
+			return
+		}
+		command := strings.ToUpper(args[0])
+
+		var reply string
+		switch {
+		case command == "AUTH":
+			authed = len(args) == 2 && args[1] == s.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		default:
+			reply = s.run(command, args[1:])
+		}
+		w.WriteString(reply)
+		if w.Flush() != nil {
+			return
+		}
+	}
+}
+
+// run executes a command and returns its encoded reply
+func (s *respStandIn) run(command string, args []string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commands[command]++
+	for key, at := range s.expires {
+		if time.Now().After(at) {
+			delete(s.data, key)
+			delete(s.expires, key)
+		}
+	}
+
+	switch command {
+	case "PING":
+		return "+PONG\r\n"
+	case "SELECT":
+		return "+OK\r\n"
+	case "GET":
+		value, ok := s.data[args[0]]
+		if !ok {
+			return "$-1\r\n"
+		}
+		return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+	case "EVAL", "EVALSHA":
+		sha := args[0]
+		if command == "EVAL" {
+			sum := sha1.Sum([]byte(args[0]))
+			sha = hex.EncodeToString(sum[:])
+			if args[0] != rateCASScript {
+				return "-ERR unsupported script\r\n"
+			}
+			s.scripts[sha] = true
+		}
+		if !s.scripts[sha] {
+			return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+		}
+		key, current, next, ttl := args[2], args[3], args[4], args[5]
+		if s.data[key] != current {
+			return ":0\r\n"
+		}
+		ms, _ := strconv.Atoi(ttl)
+		s.data[key] = next
+		s.expires[key] = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		return ":1\r\n"
+	}
+	return "-ERR unknown command\r\n"
+}
+
+// newSharedLimiters creates limiters standing for replicas that share a store
+func newSharedLimiters(t *testing.T, store RateStore, n int, rate Rate) ([]*RateLimiter, *fakeClock) {
+	t.Helper()
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	var limiters []*RateLimiter
+	for i := 0; i < n; i++ {
+		rl, err := newRateLimiter("sliding-log", rate, clock.Now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rl.UseStore(store, "shared")
+		limiters = append(limiters, rl)
+	}
+	return limiters, clock
+}
+
+// Test reading each kind of RESP reply
+func TestReadRESP(t *testing.T) {
+	tests := []struct {
+		reply string
+		want  string
+	}{
+		{"+OK\r\n", "OK"},
+		{":42\r\n", "42"},
+		{"$5\r\nhello\r\n", "[104 101 108 108 111]"},
+		{"$0\r\n\r\n", "[]"},
+		{"$-1\r\n", "<nil>"},
+		{"*2\r\n:1\r\n$1\r\na\r\n", "[1 [97]]"},
+		{"-NOSCRIPT missing\r\n", "error: NOSCRIPT missing"},
+		{"$5\r\nhi\r\n", "error: unexpected EOF"},
+		{"?\r\n", "error: invalid RESP reply"},
+		{":x\r\n", "error: invalid RESP reply"},
+		{"+OK\n", "error: invalid RESP reply"},
+	}
+
+	for _, tt := range tests {
+		v, err := readRESP(bufio.NewReader(strings.NewReader(tt.reply)))
+		got := fmt.Sprint(v)
+		if err != nil {
+			got = "error: " + err.Error()
+		}
+		if got != tt.want {
+			t.Errorf("readRESP(%q) = %s, want %s", tt.reply, got, tt.want)
+		}
+	}
+}
+
+// Test parsing store URLs
+func TestNewRedisStore(t *testing.T) {
+	tests := []struct {
+		url      string
+		addr     string
+		password string
+		db       int
+		err      bool
+	}{
+		{url: "redis://cache", addr: "cache:6379"},
+		{url: "redis://:s3cret@10.0.0.5:6380/3", addr: "10.0.0.5:6380", password: "s3cret", db: 3},
+		{url: "redis://[::1]/0", addr: "[::1]:6379"},
+		{url: "http://cache:6379", err: true},
+		{url: "redis:///1", err: true},
+		{url: "redis://cache/db", err: true},
+	}
+
+	for _, tt := range tests {
+		s, err := NewRedisStore(tt.url)
+		if (err != nil) != tt.err {
+			t.Errorf("NewRedisStore(%q) error = %v", tt.url, err)
+			continue
+		}
+		if err == nil && (s.addr != tt.addr || s.password != tt.password || s.db != tt.db) {
+			t.Errorf("NewRedisStore(%q) = %s %q %d", tt.url, s.addr, s.password, s.db)
+		}
+	}
+}
+
+// Test that replicas sharing a store share their quotas
+func TestRedisStoreShared(t *testing.T) {
+	srv := startRESPStandIn(t, "s3cret")
+	store, err := NewRedisStore(srv.url())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if err := store.Ping(); err != nil {
+		t.Fatalf("Ping error: %v", err)
+	}
+
+	for algorithm := range rateAlgorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+			var replicas []*RateLimiter
+			for i := 0; i < 3; i++ {
+				rl, _ := newRateLimiter(algorithm, Rate{Limit: 5, Window: time.Minute}, clock.Now)
+				rl.UseStore(store, "shared")
+				replicas = append(replicas, rl)
+			}
+
+			allowed := 0
+			for i := 0; i < 9; i++ {
+				if _, ok := replicas[i%3].Allow("client", 1); ok {
+					allowed++
+				}
+			}
+			if allowed != 5 {
+				t.Errorf("%d of 9 requests across replicas allowed, want 5", allowed)
+			}
+			if q := replicas[0].Peek("client"); q.Remaining != 0 || q.RetryAfter <= 0 {
+				t.Errorf("shared quota = %+v", q)
+			}
+			if len(replicas[0].local.visitors) != 0 {
+				t.Error("state was kept locally while the store worked")
+			}
+		})
+	}
+
+	// The script is sent once, then run by its hash
+	if n := srv.count("EVAL"); n != 1 {
+		t.Errorf("EVAL sent %d times, want 1", n)
+	}
+}
+
+// Test that concurrent updates from replicas are not lost
+func TestRedisStoreConcurrent(t *testing.T) {
+	srv := startRESPStandIn(t, "")
+	store, _ := NewRedisStore(srv.url())
+	defer store.Close()
+	replicas, _ := newSharedLimiters(t, store, 4, Rate{Limit: 20, Window: time.Minute})
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	allowed := 0
+	for i := 0; i < 40; i++ {
+		wg.Add(1)
+		go func(rl *RateLimiter) {
+			defer wg.Done()
+			if _, ok := rl.Allow("client", 1); ok {
+				mu.Lock()
+				allowed++
+				mu.Unlock()
+			}
+		}(replicas[i%4])
+	}
+	wg.Wait()
+	if allowed != 20 {
+		t.Errorf("%d of 40 concurrent requests allowed, want 20", allowed)
+	}
+}
+
+// Test falling back to local limits while the store is unreachable
+func TestRedisStoreFallback(t *testing.T) {
+	srv := startRESPStandIn(t, "")
+	store, _ := NewRedisStore(srv.url())
+	defer store.Close()
+	replicas, clock := newSharedLimiters(t, store, 2, Rate{Limit: 3, Window: time.Hour})
+	rl, other := replicas[0], replicas[1]
+
+	rl.Allow("client", 1)
+	srv.setDown(true)
+
+	// Each replica now limits on its own
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if _, ok := rl.Allow("client", 1); ok {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Errorf("%d of 5 requests allowed locally, want 3", allowed)
+	}
+	if _, ok := other.Allow("client", 1); !ok {
+		t.Error("another replica shared the local limit")
+	}
+
+	// The store is used again once it is back and the retry period passed
+	srv.setDown(false)
+	if _, ok := rl.Allow("client", 1); ok {
+		t.Error("the store was retried before rateStoreRetry")
+	}
+	clock.Advance(rateStoreRetry)
+	allowed = 0
+	for i := 0; i < 3; i++ {
+		if _, ok := rl.Allow("client", 1); ok {
+			allowed++
+		}
+	}
+	if allowed != 2 {
+		t.Errorf("%d of 3 requests allowed after recovery, want the 2 left in the store", allowed)
+	}
+}
+
+// contendedStore is a working store whose updates always lose the race
+type contendedStore struct {
+	*memoryStore
+}
+
+func (s contendedStore) Update(key string, newState func() limiterState, ttl time.Duration, fn func(limiterState)) error {
+	s.memoryStore.View(key, newState, fn)
+	return errRateStoreContention
+}
+
+// Test that contention denies the request without taking the store down
+func TestRateStoreContention(t *testing.T) {
+	var logs bytes.Buffer
+	clock := &fakeClock{now: time.Unix(1_700_000_000, 0)}
+	rl, err := newRateLimiter("sliding-log", Rate{Limit: 3, Window: time.Hour}, clock.Now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rl.logger = log.New(&logs, "", 0)
+	store := contendedStore{newMemoryStore(clock.Now)}
+	rl.UseStore(store, "shared")
+
+	for i := 0; i < 5; i++ {
+		if _, ok := rl.Allow("client", 1); ok {
+			t.Fatal("a request was allowed although its update did not go through")
+		}
+	}
+	if !rl.storeAvailable(clock.Now()) {
+		t.Error("contention marked the store down")
+	}
+	if logs.Len() != 0 {
+		t.Errorf("contention was logged as a store failure: %q", logs.String())
+	}
+	if _, ok := rl.local.visitors["client"]; ok {
+		t.Error("contention fell back to local limits")
+	}
+}
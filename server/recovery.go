@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"runtime/debug"
+	"sync/atomic"
+)
+
+// panicRecorder logs recovered panics with their stack under a new error
+// ID, which is what the client gets to quote, and counts them
+type panicRecorder struct {
+	logger *log.Logger
+	count  atomic.Int64
+}
+
+// record logs a panic recovered while handling what for the request with
+// the given ID, and returns its error ID and stack. It must be called from
+// the deferred function that recovered.
+func (p *panicRecorder) record(requestID, what string, v interface{}) (errorID string, stack []byte) {
+	errorID = newRequestID()
+	stack = debug.Stack()
+	p.count.Add(1)
+	logf(p.logger, requestID, "Panic %s in %s: %v\n%s", errorID, what, v, stack)
+	return errorID, stack
+}
+
+// Count returns the number of panics recovered so far
+func (p *panicRecorder) Count() int64 {
+	return p.count.Load()
+}
+
+// recoveryMiddleware turns a panicking handler into a 500 carrying the
+// error ID of the logged stack, instead of a dropped connection. A response
+// that was already started cannot be replaced, so it is aborted instead.
+func (s *Server) recoveryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			// net/http aborts the response quietly for this one
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+
+			errorID, stack := s.panics.record(RequestID(r.Context()), r.Method+" "+r.URL.Path, v)
+			switch sw.status {
+			case 0:
+				if !s.config.Development() || !s.config.PanicStackTrace {
+					stack = nil
+				}
+				sendPanicResponse(w, errorID, stack)
+			case http.StatusSwitchingProtocols:
+				// The WebSocket handler closes its connection on the way out
+			default:
+				panic(http.ErrAbortHandler)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// sendPanicResponse writes the 500 for a recovered panic. Headers the
+// handler set for the response it meant to send are dropped.
+func sendPanicResponse(w http.ResponseWriter, errorID string, stack []byte) {
+	for _, name := range []string{"Cache-Control", "Content-Length", "ETag", "Last-Modified"} {
+		w.Header().Del(name)
+	}
+
+	const title = "Internal Server Error"
+	code := errorCode(title)
+	detail := fmt.Sprintf("The server failed to handle the request, quote error ID %s when reporting it", errorID)
+
+	if responseVersion(w) == apiV2 {
+		writeResponse(w, http.StatusInternalServerError, Envelope{
+			Error: &EnvelopeError{
+				Code:    code,
+				Type:    problemType(code),
+				Message: detail,
+				ErrorID: errorID,
+				Stack:   string(stack),
+			},
+			Meta: envelopeMeta(w),
+		})
+		return
+	}
+
+	writeEncoded(w, http.StatusInternalServerError, ErrorResponse{
+		Type:      problemType(code),
+		Title:     title,
+		Status:    http.StatusInternalServerError,
+		Detail:    detail,
+		Error:     title,
+		Message:   detail,
+		Code:      http.StatusInternalServerError,
+		RequestID: responseRequestID(w),
+		ErrorID:   errorID,
+		Stack:     string(stack),
+	}, problemContentType)
+}
+
+// metricsHandler serves GET /metrics in the Prometheus text format
+func (s *Server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	io.WriteString(w, "# HELP go_server_panics_total Panics recovered in request handlers and jobs.\n")
+	io.WriteString(w, "# TYPE go_server_panics_total counter\n")
+	fmt.Fprintf(w, "go_server_panics_total %d\n", s.panics.Count())
+}
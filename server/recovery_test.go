@@ -0,0 +1,136 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test that a panicking handler gets a 500 with the error ID of the logged stack
+func TestRecoveryMiddleware(t *testing.T) {
+	development := defaultConfig
+	development.Env = "development"
+	withStack := development
+	withStack.PanicStackTrace = true
+	production := defaultConfig
+	production.PanicStackTrace = true
+
+	tests := []struct {
+		name  string
+		cfg   Config
+		path  string
+		stack bool
+	}{
+		{"v1", defaultConfig, "/v1/multiply", false},
+		{"v2", defaultConfig, "/v2/multiply", false},
+		{"development", development, "/v2/multiply", false},
+		{"development with stack", withStack, "/multiply", true},
+		{"production with stack", production, "/multiply", false},
+	}
+
+	for _, tt := range tests {
+		var logs strings.Builder
+		s := newTestServer(t, WithConfig(tt.cfg), WithLogger(log.New(&logs, "", 0)))
+		panicking := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Cache-Control", "max-age=3600")
+			var items []int
+			_ = items[len(r.URL.Path)]
+		})
+		mux := http.NewServeMux()
+		mux.Handle("/v1/multiply", s.versionMiddleware(apiV1, panicking))
+		mux.Handle("/v2/multiply", s.versionMiddleware(apiV2, panicking))
+		mux.Handle("/multiply", panicking)
+		h := s.negotiationMiddleware(s.loggingMiddleware(s.recoveryMiddleware(mux)))
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", tt.path, nil))
+
+		var errorID, stack string
+		if strings.HasPrefix(tt.path, "/v2/") {
+			var env struct {
+				Error *EnvelopeError `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil || env.Error == nil || env.Error.Code != "internal_server_error" {
+				t.Fatalf("%s: body = %s", tt.name, w.Body.String())
+			}
+			errorID, stack = env.Error.ErrorID, env.Error.Stack
+		} else {
+			var problem ErrorResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil || problem.Title != "Internal Server Error" {
+				t.Fatalf("%s: body = %s", tt.name, w.Body.String())
+			}
+			errorID, stack = problem.ErrorID, problem.Stack
+		}
+
+		if w.Code != http.StatusInternalServerError || w.Header().Get("Cache-Control") != "" {
+			t.Errorf("%s: status = %v with Cache-Control %q", tt.name, w.Code, w.Header().Get("Cache-Control"))
+		}
+		if errorID == "" || !strings.Contains(logs.String(), "Panic "+errorID+" in POST "+tt.path+": runtime error: index out of range") {
+			t.Errorf("%s: error ID %q not found in logs %q", tt.name, errorID, logs.String())
+		}
+		if !strings.Contains(logs.String(), "recovery_test.go") {
+			t.Errorf("%s: logs = %q, want the stack", tt.name, logs.String())
+		}
+		if !strings.Contains(logs.String(), "POST "+tt.path+" - ") {
+			t.Errorf("%s: logs = %q, want the request logged", tt.name, logs.String())
+		}
+		if got := strings.Contains(stack, "recovery_test.go"); got != tt.stack {
+			t.Errorf("%s: stack in response = %t, want %t", tt.name, got, tt.stack)
+		}
+		if s.panics.Count() != 1 {
+			t.Errorf("%s: panic count = %d, want 1", tt.name, s.panics.Count())
+		}
+	}
+}
+
+// Test aborting a response the panicking handler already started
+func TestRecoveryMiddlewareStartedResponse(t *testing.T) {
+	s := newTestServer(t, WithLogger(log.New(&strings.Builder{}, "", 0)))
+	h := s.recoveryMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"result":`))
+		panic("half way")
+	}))
+
+	defer func() {
+		if v := recover(); v != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", v)
+		}
+		if s.panics.Count() != 1 {
+			t.Errorf("panic count = %d, want 1", s.panics.Count())
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/hello", nil))
+}
+
+// Test that a panicking job operation fails its job and is counted in /metrics
+func TestJobPanic(t *testing.T) {
+	RegisterOperation(Operation{
+		Name:    "test_panic",
+		NewArgs: func() interface{} { return &MultiplyRequest{} },
+		Run:     func(args interface{}) (interface{}, error) { panic("boom") },
+	})
+	t.Cleanup(func() { delete(operations, "test_panic") })
+
+	var logs strings.Builder
+	s := newTestServer(t, WithLogger(log.New(&logs, "", 0)))
+	job, err := s.jobs.Submit("test_panic", map[string]interface{}{"a": 2.0, "b": 3.0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	job = waitForJob(t, s.jobs, job.ID)
+	if job.Status != JobFailed || job.Error == nil || job.Error.Code != "internal_server_error" {
+		t.Fatalf("job = %+v, want it failed with internal_server_error", job)
+	}
+	if !strings.Contains(logs.String(), "in job "+job.ID+": boom") {
+		t.Errorf("logs = %q, want the panic logged", logs.String())
+	}
+
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "\ngo_server_panics_total 1\n") {
+		t.Errorf("GET /metrics = %v: %s", w.Code, w.Body.String())
+	}
+}
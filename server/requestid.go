@@ -0,0 +1,144 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"strings"
+)
+
+const (
+	// requestIDHeader carries the request ID in both directions
+	requestIDHeader = "X-Request-ID"
+	// traceParentHeader is the W3C Trace Context header
+	traceParentHeader = "traceparent"
+	// maxRequestIDLength bounds the request IDs taken from clients
+	maxRequestIDLength = 128
+)
+
+// correlation identifies the request work was done for, in the logs and
+// in the calls it makes to other services
+type correlation struct {
+	requestID string
+	// traceParent is the caller's W3C traceparent, empty without one
+	traceParent string
+}
+
+type correlationKey struct{}
+
+// withCorrelation returns a context carrying the request ID and traceparent
+func withCorrelation(ctx context.Context, requestID, traceParent string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, correlation{requestID: requestID, traceParent: traceParent})
+}
+
+// RequestID returns the ID of the request ctx belongs to, or "" outside of
+// one. Jobs and their callbacks keep the ID of the request that created them.
+func RequestID(ctx context.Context) string {
+	c, _ := ctx.Value(correlationKey{}).(correlation)
+	return c.requestID
+}
+
+// traceParent returns the traceparent received with the request ctx belongs to
+func traceParent(ctx context.Context) string {
+	c, _ := ctx.Value(correlationKey{}).(correlation)
+	return c.traceParent
+}
+
+// validRequestID reports whether a client's request ID can be reused: up to
+// 128 letters, digits and - _ . : / + =, so that it is safe in log lines
+// and headers
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case strings.ContainsRune("-_.:/+=", c):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// isLowerHex reports whether s is lowercase hex, as traceparent fields are
+func isLowerHex(s string) bool {
+	for _, c := range s {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return s != ""
+}
+
+// parseTraceParent returns the trace ID and flags of a W3C traceparent,
+// "version-traceid-parentid-flags". Versions after 00 may append fields.
+func parseTraceParent(header string) (traceID, flags string, ok bool) {
+	if len(header) < 55 || (len(header) > 55 && (header[:2] == "00" || header[55] != '-')) {
+		return "", "", false
+	}
+	if header[2] != '-' || header[35] != '-' || header[52] != '-' {
+		return "", "", false
+	}
+	version, traceID, parentID, flags := header[:2], header[3:35], header[36:52], header[53:55]
+	if !isLowerHex(version+traceID+parentID+flags) || version == "ff" {
+		return "", "", false
+	}
+	// All-zero IDs are invalid
+	if strings.Trim(traceID, "0") == "" || strings.Trim(parentID, "0") == "" {
+		return "", "", false
+	}
+	return traceID, flags, true
+}
+
+// childTraceParent returns the traceparent for a call made on behalf of a
+// request that sent parent: the same trace, with a new parent ID
+func childTraceParent(parent string) string {
+	traceID, flags, ok := parseTraceParent(parent)
+	if !ok {
+		return ""
+	}
+	b := make([]byte, 8)
+	rand.Read(b)
+	b[0] |= 1 // never all zeros
+	return "00-" + traceID + "-" + hex.EncodeToString(b) + "-" + flags
+}
+
+// requestIDMiddleware gives every request an ID: the client's X-Request-ID
+// when it is valid, else the trace ID of a valid traceparent, else a new
+// one. The ID is put in the request context and the X-Request-ID response
+// header.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parent := r.Header.Get(traceParentHeader)
+		traceID, _, traced := parseTraceParent(parent)
+		if !traced {
+			parent = ""
+		}
+
+		id := r.Header.Get(requestIDHeader)
+		switch {
+		case validRequestID(id):
+		case traced:
+			id = traceID
+		default:
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(withCorrelation(r.Context(), id, parent)))
+	})
+}
+
+// logf logs a line about a request, starting with its ID in brackets so
+// that every line about one request can be found together
+func logf(logger *log.Logger, requestID, format string, args ...interface{}) {
+	if requestID == "" {
+		logger.Printf(format, args...)
+		return
+	}
+	logger.Printf("[%s] "+format, append([]interface{}{requestID}, args...)...)
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	testTraceID     = "4bf92f3577b34da6a3ce929d0e0e4736"
+	testTraceParent = "00-" + testTraceID + "-00f067aa0ba902b7-01"
+)
+
+// Test validating W3C traceparent headers
+func TestParseTraceParent(t *testing.T) {
+	tests := []struct {
+		header string
+		ok     bool
+	}{
+		{testTraceParent, true},
+		{"01-" + testTraceID + "-00f067aa0ba902b7-01-future", true},
+		{"00-" + testTraceID + "-00f067aa0ba902b7-01-extra", false},
+		{"ff-" + testTraceID + "-00f067aa0ba902b7-01", false},
+		{"00-" + strings.ToUpper(testTraceID) + "-00f067aa0ba902b7-01", false},
+		{"00-00000000000000000000000000000000-00f067aa0ba902b7-01", false},
+		{"00-" + testTraceID + "-0000000000000000-01", false},
+		{"00-" + testTraceID + "_00f067aa0ba902b7-01", false},
+		{"00-" + testTraceID + "-00f067aa0ba902b7", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		traceID, flags, ok := parseTraceParent(tt.header)
+		if ok != tt.ok || (ok && (traceID != testTraceID || flags != "01")) {
+			t.Errorf("parseTraceParent(%q) = %q, %q, %t, want %t", tt.header, traceID, flags, ok, tt.ok)
+		}
+	}
+
+	child := childTraceParent(testTraceParent)
+	if traceID, _, ok := parseTraceParent(child); !ok || traceID != testTraceID || child == testTraceParent {
+		t.Errorf("childTraceParent = %q, want the same trace with a new parent ID", child)
+	}
+}
+
+// Test choosing the request ID and returning it in headers, error bodies and logs
+func TestRequestID(t *testing.T) {
+	tests := []struct {
+		name        string
+		requestID   string
+		traceParent string
+		want        string
+	}{
+		{"client ID", "client-req-42", "", "client-req-42"},
+		{"client ID wins", "client-req-42", testTraceParent, "client-req-42"},
+		{"trace ID", "", testTraceParent, testTraceID},
+		{"invalid ID", "bad id\nwith newline", "", ""},
+		{"too long", strings.Repeat("a", 129), "", ""},
+		{"invalid traceparent", "", "00-xyz", ""},
+		{"none", "", "", ""},
+	}
+
+	for _, tt := range tests {
+		for _, path := range []string{"/v1/multiply", "/v2/multiply"} {
+			var logs strings.Builder
+			s := newTestServer(t, WithLogger(log.New(&logs, "", 0)))
+			req := httptest.NewRequest("POST", path, strings.NewReader(`{"a":`))
+			req.Header.Set("Content-Type", "application/json")
+			if tt.requestID != "" {
+				req.Header.Set("X-Request-ID", tt.requestID)
+			}
+			if tt.traceParent != "" {
+				req.Header.Set("traceparent", tt.traceParent)
+			}
+			w := httptest.NewRecorder()
+			s.Handler().ServeHTTP(w, req)
+
+			id := w.Header().Get("X-Request-ID")
+			if tt.want != "" && id != tt.want {
+				t.Errorf("%s %s: X-Request-ID = %q, want %q", tt.name, path, id, tt.want)
+			}
+			if tt.want == "" && (len(id) != 32 || id == tt.requestID) {
+				t.Errorf("%s %s: X-Request-ID = %q, want a new ID", tt.name, path, id)
+			}
+
+			var body struct {
+				RequestID string `json:"request_id"`
+				Meta      struct {
+					RequestID string `json:"request_id"`
+				} `json:"meta"`
+			}
+			json.Unmarshal(w.Body.Bytes(), &body)
+			if got := body.RequestID + body.Meta.RequestID; got != id {
+				t.Errorf("%s %s: request ID in body = %q, want %q: %s", tt.name, path, got, id, w.Body.String())
+			}
+			if !strings.HasPrefix(logs.String(), "["+id+"] ") {
+				t.Errorf("%s %s: logs = %q, want lines starting with the request ID", tt.name, path, logs.String())
+			}
+		}
+	}
+}
+
+// Test that an idempotent replay keeps the request ID of the response it replays
+func TestRequestIDReplay(t *testing.T) {
+	s := newTestServer(t)
+	send := func(requestID string) (string, string) {
+		req := httptest.NewRequest("POST", "/v2/multiply", strings.NewReader(`{"a":2,"b":3}`))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("Idempotency-Key", "replay-id-1")
+		req.Header.Set("X-Request-ID", requestID)
+		w := httptest.NewRecorder()
+		s.Handler().ServeHTTP(w, req)
+
+		var body struct {
+			Meta struct {
+				RequestID string `json:"request_id"`
+			} `json:"meta"`
+		}
+		json.Unmarshal(w.Body.Bytes(), &body)
+		return w.Header().Get("X-Request-ID"), body.Meta.RequestID
+	}
+
+	send("first-try")
+	header, meta := send("second-try")
+	if header != "first-try" || meta != "first-try" {
+		t.Errorf("replay X-Request-ID = %q, meta.request_id = %q, want both %q", header, meta, "first-try")
+	}
+}
+
+// Test forwarding the request ID and trace to a job's callback
+func TestRequestIDWebhook(t *testing.T) {
+	received := make(chan *http.Request, 1)
+	bodies := make(chan []byte, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		bodies <- body
+	}))
+	defer receiver.Close()
+	s, _ := newWebhookTestServer(t, receiver, 1)
+
+	req := httptest.NewRequest("POST", "/v2/jobs", strings.NewReader(`{"operation":"factorial","args":{"number":5},"callback_url":"`+receiver.URL+`"}`))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("traceparent", testTraceParent)
+	w := httptest.NewRecorder()
+	s.Handler().ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted || !strings.Contains(w.Body.String(), `"request_id":"`+testTraceID+`"`) {
+		t.Fatalf("POST /v2/jobs = %v: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case r := <-received:
+		if r.Header.Get("X-Request-ID") != testTraceID {
+			t.Errorf("callback X-Request-ID = %q, want %q", r.Header.Get("X-Request-ID"), testTraceID)
+		}
+		parent := r.Header.Get("traceparent")
+		if traceID, _, ok := parseTraceParent(parent); !ok || traceID != testTraceID || parent == testTraceParent {
+			t.Errorf("callback traceparent = %q, want a child of %q", parent, testTraceParent)
+		}
+		var event WebhookEvent
+		json.Unmarshal(<-bodies, &event)
+		if event.RequestID != testTraceID {
+			t.Errorf("event request_id = %q, want %q", event.RequestID, testTraceID)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no callback was received")
+	}
+}
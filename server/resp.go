@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+// maxRESPBulk bounds the size of a bulk string or array read from the server
+const maxRESPBulk = 16 << 20
+
+// respError is an error reply from the server, such as "NOSCRIPT ..."
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+var errRESPProtocol = errors.New("invalid RESP reply")
+
+// respConn is a client connection speaking RESP, the Redis serialization protocol
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+}
+
+func dialRESP(addr string, timeout time.Duration) (*respConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &respConn{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn)}, nil
+}
+
+// do sends a command and reads its reply, both within timeout
+func (c *respConn) do(timeout time.Duration, args ...string) (interface{}, error) {
+	c.conn.SetDeadline(time.Now().Add(timeout))
+	if err := writeRESPCommand(c.w, args); err != nil {
+		return nil, err
+	}
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+func (c *respConn) Close() error {
+	return c.conn.Close()
+}
+
+// writeRESPCommand writes a command as an array of bulk strings
+func writeRESPCommand(w *bufio.Writer, args []string) error {
+	fmt.Fprintf(w, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(w, "$%d\r\n", len(arg))
+		w.WriteString(arg)
+		if _, err := w.WriteString("\r\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readRESP reads one reply: a simple string as string, an integer as
+// int64, a bulk string as []byte, an array as []interface{}, and a null as
+// nil. Error replies are returned as a respError.
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, errRESPProtocol
+	}
+	kind, body := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, respError(body)
+	case ':':
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return nil, errRESPProtocol
+		}
+		return n, nil
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > maxRESPBulk {
+			return nil, errRESPProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		if string(data[n:]) != "\r\n" {
+			return nil, errRESPProtocol
+		}
+		return data[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < -1 || n > maxRESPBulk {
+			return nil, errRESPProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		items := make([]interface{}, 0, min(n, 1024))
+		for i := 0; i < n; i++ {
+			item, err := readRESP(r)
+			var rerr respError
+			if err != nil && !errors.As(err, &rerr) {
+				return nil, err
+			}
+			if err != nil {
+				item = rerr
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, errRESPProtocol
+}
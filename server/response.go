@@ -0,0 +1,210 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"go-server/api"
+)
+
+// API versions served under the /v1 and /v2 prefixes
+const (
+	apiV1 = "v1"
+	apiV2 = "v2"
+)
+
+// SuccessResponse represents the v1 success body: {"success": true, "data": ...}
+type SuccessResponse struct {
+	Success bool        `json:"success"`
+	Message string      `json:"message,omitempty"`
+	Data    interface{} `json:"data"`
+}
+
+// Envelope is the uniform v2 response body. Exactly one of Data and Error is set.
+type Envelope struct {
+	Data  interface{}    `json:"data"`
+	Error *EnvelopeError `json:"error"`
+	Meta  EnvelopeMeta   `json:"meta"`
+}
+
+// EnvelopeError describes a failed v2 request (see api.EnvelopeError)
+type EnvelopeError = api.EnvelopeError
+
+// EnvelopeMeta carries per-request metadata in v2 responses
+type EnvelopeMeta struct {
+	RequestID  string  `json:"request_id"`
+	DurationMs float64 `json:"duration_ms"`
+	APIVersion string  `json:"api_version"`
+}
+
+// responseWriter carries per-request response settings down to the handlers:
+// the codec negotiated from the Accept header and the API version and
+// metadata used to shape the body.
+type responseWriter struct {
+	http.ResponseWriter
+	codec     Codec
+	version   string
+	requestID string
+	start     time.Time
+	// logger is the server's, for errors writing the response
+	logger *log.Logger
+	// malformedBody is set when the request body could not be decoded,
+	// which counts toward a ban
+	malformedBody bool
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// Flush implements http.Flusher when the underlying writer supports it
+func (rw *responseWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker so WebSocket upgrades work through the wrapper
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+// findResponseWriter returns the *responseWriter wrapped somewhere inside w, or nil
+func findResponseWriter(w http.ResponseWriter) *responseWriter {
+	for {
+		switch rw := w.(type) {
+		case *responseWriter:
+			return rw
+		case interface{ Unwrap() http.ResponseWriter }:
+			w = rw.Unwrap()
+		default:
+			return nil
+		}
+	}
+}
+
+// withResponseWriter makes sure w carries a *responseWriter, wrapping it with
+// the default codec when no negotiation middleware ran (as in handler tests)
+func withResponseWriter(w http.ResponseWriter) (http.ResponseWriter, *responseWriter) {
+	if rw := findResponseWriter(w); rw != nil {
+		return w, rw
+	}
+	rw := &responseWriter{ResponseWriter: w, codec: defaultCodec()}
+	return rw, rw
+}
+
+// responseCodec returns the codec negotiated for w, falling back to JSON
+func responseCodec(w http.ResponseWriter) Codec {
+	if rw := findResponseWriter(w); rw != nil && rw.codec != nil {
+		return rw.codec
+	}
+	return defaultCodec()
+}
+
+// responseVersion returns the API version a request was routed through.
+// Unprefixed routes are served with v1 shapes.
+func responseVersion(w http.ResponseWriter) string {
+	if rw := findResponseWriter(w); rw != nil && rw.version != "" {
+		return rw.version
+	}
+	return apiV1
+}
+
+// responseRequestID returns the ID of the request being answered on w
+func responseRequestID(w http.ResponseWriter) string {
+	if rw := findResponseWriter(w); rw != nil && rw.requestID != "" {
+		return rw.requestID
+	}
+	return w.Header().Get(requestIDHeader)
+}
+
+// responseLogger returns the logger of the server writing to w, or the
+// standard logger outside of one
+func responseLogger(w http.ResponseWriter) *log.Logger {
+	if rw := findResponseWriter(w); rw != nil && rw.logger != nil {
+		return rw.logger
+	}
+	return log.Default()
+}
+
+// envelopeMeta builds the v2 metadata for the request being written to w
+func envelopeMeta(w http.ResponseWriter) EnvelopeMeta {
+	meta := EnvelopeMeta{APIVersion: responseVersion(w), RequestID: responseRequestID(w)}
+	if rw := findResponseWriter(w); rw != nil {
+		if !rw.start.IsZero() {
+			meta.DurationMs = float64(time.Since(rw.start).Microseconds()) / 1000
+		}
+	}
+	return meta
+}
+
+// writeResponse encodes v with the negotiated codec and writes it with the given status code
+func writeResponse(w http.ResponseWriter, code int, v interface{}) {
+	writeEncoded(w, code, v, Codec.ContentType)
+}
+
+// writeEncoded is writeResponse with the Content-Type chosen by contentType
+// from the codec used, such as problemContentType for error documents
+func writeEncoded(w http.ResponseWriter, code int, v interface{}, contentType func(Codec) string) {
+	codec := responseCodec(w)
+
+	var buf bytes.Buffer
+	if err := codec.Encode(&buf, v); err != nil {
+		logf(responseLogger(w), responseRequestID(w), "%s encode error: %v", codec.Name(), err)
+		codec = defaultCodec()
+		buf.Reset()
+		codec.Encode(&buf, v)
+	}
+
+	w.Header().Set("Content-Type", contentType(codec))
+	w.WriteHeader(code)
+	w.Write(buf.Bytes())
+}
+
+// sendDataResponse writes a successful response. v1 clients receive v1Body
+// unchanged, v2 clients receive data inside the uniform envelope.
+func sendDataResponse(w http.ResponseWriter, v1Body, data interface{}) {
+	sendDataResponseStatus(w, http.StatusOK, v1Body, data)
+}
+
+// sendDataResponseStatus is sendDataResponse with a status code other than 200
+func sendDataResponseStatus(w http.ResponseWriter, code int, v1Body, data interface{}) {
+	if responseVersion(w) == apiV2 {
+		writeResponse(w, code, Envelope{Data: data, Meta: envelopeMeta(w)})
+		return
+	}
+	writeResponse(w, code, v1Body)
+}
+
+// sendSuccessResponse writes data with the v1 {"success": true, "data": ...} shape
+func sendSuccessResponse(w http.ResponseWriter, data interface{}) {
+	sendDataResponse(w, SuccessResponse{Success: true, Data: data}, data)
+}
+
+// errorCode turns an error title such as "Method Not Allowed" into a
+// machine readable code such as "method_not_allowed"
+func errorCode(title string) string {
+	return strings.ToLower(strings.Join(strings.Fields(title), "_"))
+}
+
+// newRequestID returns a random 128-bit hex identifier
+func newRequestID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return strings.ReplaceAll(time.Now().UTC().Format("20060102150405.000000000"), ".", "")
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,473 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Server is the calculator API together with everything it depends on:
+// the result cache, idempotency store, job queue, webhook dispatcher,
+// activity hub, WebSocket sessions and rate limiting. Create one with New,
+// then either Start it or mount Handler in another mux, and Shutdown to
+// stop all of its background goroutines.
+type Server struct {
+	// Settings, applied by options before New builds the components
+	config     Config
+	logger     *log.Logger
+	clock      func() time.Time
+	staticDir  string
+	limits     Limits
+	limiter    Limiter
+	policies   *RatePolicies
+	ownLimiter bool
+
+	trustedProxies []*net.IPNet
+	ipv6Prefix     int
+	adminToken     string
+	wsOrigins      []string
+	banPolicy      BanPolicy
+	banAllow       []*net.IPNet
+	banDeny        []*net.IPNet
+
+	panics      *panicRecorder
+	concurrency *ConcurrencyLimiter
+	bans        *BanList
+	cache       *ResultCache
+	idempotency *IdempotencyStore
+	jobs        *JobManager
+	webhooks    *WebhookDispatcher
+	activity    *ActivityHub
+	sessions    *calcHub
+	store       *RedisStore
+	handler     http.Handler
+
+	// Set by Start
+	http     *http.Server
+	redirect *http.Server
+	listener net.Listener
+	reloader *certReloader
+
+	// done stops the goroutines started by Start
+	done         chan struct{}
+	shutdownOnce sync.Once
+}
+
+// Limits bounds what the server keeps and accepts
+type Limits struct {
+	// CacheSize results are kept by the result cache, 0 disables it
+	CacheSize int
+	// CacheMaxAge is advertised in Cache-Control for cacheable results
+	CacheMaxAge time.Duration
+	// IdempotencyTTL is how long responses are kept for Idempotency-Key replays
+	IdempotencyTTL time.Duration
+	// CompressionMinSize is the smallest response body that is compressed
+	CompressionMinSize int
+	// JobWorkers run asynchronous jobs taken from a queue of JobQueueSize
+	JobWorkers   int
+	JobQueueSize int
+	// ConcurrencyLimit requests are handled at once, 0 disables the limit.
+	// ConcurrencyQueue more wait up to ConcurrencyQueueTimeout for a slot.
+	ConcurrencyLimit        int
+	ConcurrencyQueue        int
+	ConcurrencyQueueTimeout time.Duration
+}
+
+// Option configures a Server
+type Option func(*Server) error
+
+// WithConfig applies the settings of cfg, as read by LoadConfig. Options
+// after it override them.
+func WithConfig(cfg Config) Option {
+	return func(s *Server) error {
+		proxies, err := parseNetworks(cfg.TrustedProxies)
+		if err != nil {
+			return fmt.Errorf("TRUSTED_PROXIES: %v", err)
+		}
+		banAllow, err := parseNetworks(cfg.BanAllowlist)
+		if err != nil {
+			return fmt.Errorf("BAN_ALLOWLIST: %v", err)
+		}
+		banDeny, err := parseNetworks(cfg.BanDenylist)
+		if err != nil {
+			return fmt.Errorf("BAN_DENYLIST: %v", err)
+		}
+		if cfg.RateLimitIPv6Prefix < 1 || cfg.RateLimitIPv6Prefix > 128 {
+			return fmt.Errorf("RATE_LIMIT_IPV6_PREFIX must be between 1 and 128, got %d", cfg.RateLimitIPv6Prefix)
+		}
+		// Job callbacks are signed, so an allowlist without a secret is a mistake
+		if cfg.WebhookAllowedHosts != "" && cfg.WebhookSecret == "" {
+			return errors.New("WEBHOOK_ALLOWED_HOSTS is set but WEBHOOK_SECRET is not")
+		}
+
+		s.config = cfg
+		s.limits.CacheSize = cfg.CacheSize
+		s.limits.CacheMaxAge = cfg.CacheMaxAge
+		s.limits.IdempotencyTTL = cfg.IdempotencyTTL
+		s.limits.CompressionMinSize = cfg.CompressionMinSize
+		s.limits.ConcurrencyLimit = cfg.ConcurrencyLimit
+		s.limits.ConcurrencyQueue = cfg.ConcurrencyQueue
+		s.limits.ConcurrencyQueueTimeout = cfg.ConcurrencyQueueTimeout
+		s.trustedProxies = proxies
+		s.ipv6Prefix = cfg.RateLimitIPv6Prefix
+		s.adminToken = cfg.AdminToken
+		s.wsOrigins = strings.Split(cfg.WSAllowedOrigins, ",")
+		s.banPolicy = BanPolicy{Threshold: cfg.BanThreshold, Window: cfg.BanWindow, Duration: cfg.BanDuration, MaxDuration: cfg.BanMaxDuration}
+		s.banAllow = banAllow
+		s.banDeny = banDeny
+		return nil
+	}
+}
+
+// WithLogger sends the server's logs to logger instead of the standard logger
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) error {
+		s.logger = logger
+		return nil
+	}
+}
+
+// WithClock replaces time.Now for the default rate limiter and timestamps
+func WithClock(now func() time.Time) Option {
+	return func(s *Server) error {
+		s.clock = now
+		return nil
+	}
+}
+
+// WithStaticDir serves the web pages and API documentation from dir
+// instead of ./static
+func WithStaticDir(dir string) Option {
+	return func(s *Server) error {
+		s.staticDir = dir
+		return nil
+	}
+}
+
+// WithLimits replaces the cache, idempotency, compression, job and
+// concurrency limits
+func WithLimits(limits Limits) Option {
+	return func(s *Server) error {
+		s.limits = limits
+		return nil
+	}
+}
+
+// WithLimiter limits requests no rate limit policy matches with limiter
+// instead of one built from the configured algorithm and rate. The caller
+// keeps ownership of limiter.
+func WithLimiter(limiter Limiter) Option {
+	return func(s *Server) error {
+		s.limiter = limiter
+		return nil
+	}
+}
+
+// WithRatePolicies applies policies instead of the RATE_LIMIT_POLICIES file
+func WithRatePolicies(policies *RatePolicies) Option {
+	return func(s *Server) error {
+		s.policies = policies
+		return nil
+	}
+}
+
+// WithTrustedProxies believes the forwarding headers of proxies in these
+// networks, given as CIDRs or addresses
+func WithTrustedProxies(networks ...string) Option {
+	return func(s *Server) error {
+		proxies, err := parseNetworks(strings.Join(networks, ","))
+		if err != nil {
+			return err
+		}
+		s.trustedProxies = proxies
+		return nil
+	}
+}
+
+// WithBanPolicy replaces when and for how long abusive clients are banned
+func WithBanPolicy(policy BanPolicy) Option {
+	return func(s *Server) error {
+		s.banPolicy = policy
+		return nil
+	}
+}
+
+// WithAdminToken enables the /admin endpoints for requests bearing token
+func WithAdminToken(token string) Option {
+	return func(s *Server) error {
+		s.adminToken = token
+		return nil
+	}
+}
+
+// New creates a server from defaultConfig and opts. Its background
+// goroutines run until Shutdown.
+func New(opts ...Option) (*Server, error) {
+	s := &Server{
+		logger:    log.Default(),
+		clock:     time.Now,
+		staticDir: "./static",
+		done:      make(chan struct{}),
+	}
+	opts = append([]Option{WithConfig(defaultConfig)}, opts...)
+	for _, opt := range opts {
+		if err := opt(s); err != nil {
+			return nil, err
+		}
+	}
+	cfg := s.config
+	s.panics = &panicRecorder{logger: s.logger}
+	if s.limits.ConcurrencyLimit > 0 {
+		cl, err := newConcurrencyLimiter(cfg.ConcurrencyAlgorithm, s.limits.ConcurrencyLimit, s.limits.ConcurrencyQueue,
+			s.limits.ConcurrencyQueueTimeout, cfg.ConcurrencyLatencyTarget, s.clock)
+		if err != nil {
+			return nil, fmt.Errorf("concurrency limiting: %v", err)
+		}
+		s.concurrency = cl
+	}
+	if err := s.setupRateLimiting(); err != nil {
+		return nil, err
+	}
+
+	s.cache = NewResultCache(s.limits.CacheSize, s.limits.CacheMaxAge)
+	s.idempotency = NewIdempotencyStore(s.limits.IdempotencyTTL)
+	s.webhooks = NewWebhookDispatcher(cfg.WebhookSecret, strings.Split(cfg.WebhookAllowedHosts, ","), cfg.WebhookMaxAttempts)
+	s.webhooks.logger = s.logger
+	s.activity = NewActivityHub(activityBufferSize)
+	s.bans = newBanList(s.banPolicy, s.banAllow, s.banDeny, cfg.BansStateFile, s.clock, s.logger)
+	if err := s.bans.restore(); err != nil {
+		s.logger.Printf("Failed to restore bans from %s: %v", cfg.BansStateFile, err)
+	}
+	s.sessions = newCalcHub()
+
+	workers, queueSize := s.limits.JobWorkers, s.limits.JobQueueSize
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if queueSize <= 0 {
+		queueSize = jobQueueSize
+	}
+	s.jobs = NewJobManager(workers, queueSize)
+	s.jobs.webhooks = s.webhooks
+	s.jobs.logger = s.logger
+	s.jobs.panics = s.panics
+
+	// Resume jobs persisted by the previous shutdown
+	if cfg.JobsStateFile != "" {
+		if err := s.jobs.Restore(cfg.JobsStateFile); err != nil {
+			s.logger.Printf("Failed to restore jobs from %s: %v", cfg.JobsStateFile, err)
+		}
+	}
+
+	// Wrap the routes with panic recovery, load shedding, rate limiting, bans,
+	// logging, compression, content negotiation and request IDs
+	s.handler = requestIDMiddleware(s.negotiationMiddleware(compressionMiddleware(s.limits.CompressionMinSize,
+		s.loggingMiddleware(s.banMiddleware(s.rateLimitMiddleware(s.concurrencyMiddleware(s.recoveryMiddleware(s.newRouter()))))))))
+	return s, nil
+}
+
+// setupRateLimiting builds the default limiter and the policies, sharing
+// their state through Redis when configured
+func (s *Server) setupRateLimiting() error {
+	cfg := s.config
+	if s.limiter == nil {
+		rl, err := newRateLimiter(cfg.RateLimitAlgorithm, cfg.Rate(), s.clock)
+		if err != nil {
+			return fmt.Errorf("rate limiting: %v", err)
+		}
+		rl.logger = s.logger
+		rl.startCleanup()
+		s.limiter = rl
+		s.ownLimiter = true
+	}
+
+	if s.policies == nil && cfg.RateLimitPolicies != "" {
+		policies, err := LoadRatePolicies(cfg.RateLimitPolicies, cfg.RateLimitAlgorithm, cfg.Rate())
+		if err != nil {
+			s.closeLimiters()
+			return fmt.Errorf("rate limit policies %s: %v", cfg.RateLimitPolicies, err)
+		}
+		s.policies = policies
+	}
+	if s.policies == nil {
+		s.policies = &RatePolicies{}
+	}
+	s.policies = s.policies.withDefault(s.limiter)
+
+	if cfg.RateLimitRedisURL != "" {
+		store, err := NewRedisStore(cfg.RateLimitRedisURL)
+		if err != nil {
+			s.closeLimiters()
+			return fmt.Errorf("rate limit store: %v", err)
+		}
+		// An unreachable store is not fatal: limits stay local until it is back
+		if err := store.Ping(); err != nil {
+			s.logger.Printf("Rate limit store unreachable, using local limits: %v", err)
+		}
+		if rl, ok := s.limiter.(*RateLimiter); ok && s.ownLimiter {
+			rl.UseStore(store, defaultRatePolicyName)
+		}
+		s.policies.UseStore(store)
+		s.store = store
+	}
+	return nil
+}
+
+// closeLimiters stops the cleanup goroutines of the limiters the server created
+func (s *Server) closeLimiters() {
+	if rl, ok := s.limiter.(*RateLimiter); ok && s.ownLimiter {
+		rl.Close()
+	}
+	if s.policies != nil {
+		s.policies.Close()
+	}
+}
+
+// Handler returns the API with its middleware. It can be mounted in
+// another mux, under a prefix with http.StripPrefix.
+func (s *Server) Handler() http.Handler {
+	return s.handler
+}
+
+// Start listens on addr, such as ":8080", and serves in the background,
+// over HTTPS when configured, with the redirect listener of
+// HTTP_REDIRECT_PORT. Errors after listening are logged.
+func (s *Server) Start(addr string) error {
+	cfg := s.config
+	s.http = &http.Server{
+		Addr:         addr,
+		Handler:      s.handler,
+		ReadTimeout:  15 * time.Second,
+		WriteTimeout: 15 * time.Second,
+		IdleTimeout:  60 * time.Second,
+		Protocols:    serverProtocols(cfg),
+		ErrorLog:     s.logger,
+	}
+
+	// Hijacked WebSocket connections and event streams are not closed by Shutdown
+	s.http.RegisterOnShutdown(s.sessions.Shutdown)
+	s.http.RegisterOnShutdown(s.activity.Close)
+
+	// Configure HTTPS, with an optional plain HTTP listener redirecting to it
+	if cfg.TLSEnabled() {
+		tlsConfig, reloader, err := newTLSConfig(cfg, s.logger)
+		if err != nil {
+			return fmt.Errorf("TLS setup failed: %v", err)
+		}
+		s.http.TLSConfig = tlsConfig
+		s.reloader = reloader
+
+		if cfg.RedirectPort != "" {
+			_, port, _ := net.SplitHostPort(addr)
+			s.redirect = &http.Server{
+				Addr:         ":" + cfg.RedirectPort,
+				Handler:      redirectHandler(port),
+				ReadTimeout:  15 * time.Second,
+				WriteTimeout: 15 * time.Second,
+				IdleTimeout:  60 * time.Second,
+				ErrorLog:     s.logger,
+			}
+		}
+	}
+
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s.listener = ln
+
+	// Pick up renewed certificate files
+	if s.reloader != nil {
+		s.reloader.watch(certCheckInterval, s.done)
+	}
+
+	go func() {
+		var err error
+		if s.http.TLSConfig != nil {
+			s.logger.Printf("Server running at https://%s", ln.Addr())
+			err = s.http.ServeTLS(ln, "", "")
+		} else {
+			if cfg.H2C {
+				s.logger.Println("Accepting HTTP/2 without TLS (h2c)")
+			}
+			s.logger.Printf("Server running at http://%s", ln.Addr())
+			err = s.http.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			s.logger.Printf("Server failed: %v", err)
+		}
+	}()
+
+	if s.redirect != nil {
+		go func() {
+			s.logger.Printf("Redirecting http://localhost:%s to HTTPS", cfg.RedirectPort)
+			if err := s.redirect.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				s.logger.Printf("Redirect server failed: %v", err)
+			}
+		}()
+	}
+	return nil
+}
+
+// Addr returns the address the server listens on once started
+func (s *Server) Addr() net.Addr {
+	if s.listener == nil {
+		return nil
+	}
+	return s.listener.Addr()
+}
+
+// ReloadTLS reads the TLS certificate and key files again
+func (s *Server) ReloadTLS() error {
+	if s.reloader == nil {
+		return errors.New("no TLS certificate files to reload")
+	}
+	return s.reloader.Reload()
+}
+
+// Shutdown stops accepting connections, then drains or persists pending
+// jobs and gives job callbacks until ctx expires while outstanding requests
+// finish alongside, closes WebSocket sessions and event streams, and stops
+// every background goroutine
+func (s *Server) Shutdown(ctx context.Context) error {
+	var err error
+	s.shutdownOnce.Do(func() {
+		// Stop accepting connections right away. Requests in flight get the
+		// whole deadline too, instead of what the jobs leave of it.
+		httpDone := make(chan error, 1)
+		if s.http != nil {
+			go func() { httpDone <- s.http.Shutdown(ctx) }()
+		} else {
+			s.sessions.Shutdown()
+			s.activity.Close()
+			httpDone <- nil
+		}
+		if s.redirect != nil {
+			s.redirect.Shutdown(ctx)
+		}
+
+		// Drain or persist pending jobs, which also ends their event streams
+		if jobsErr := s.jobs.Shutdown(ctx, s.config.JobsStateFile); jobsErr != nil {
+			s.logger.Printf("Failed to shut down jobs: %v", jobsErr)
+		}
+		// Then give the callbacks of finished jobs the rest of the time
+		s.webhooks.Shutdown(ctx)
+		err = <-httpDone
+
+		close(s.done)
+		s.idempotency.Close()
+		s.bans.Close()
+		s.closeLimiters()
+		if s.store != nil {
+			s.store.Close()
+		}
+	})
+	return err
+}
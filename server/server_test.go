@@ -0,0 +1,259 @@
+package server
+
+import (
+	"context"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestServer creates a server that serves ../static and is shut down
+// when the test ends. httptest requests come from 192.0.2.1.
+func newTestServer(t testing.TB, opts ...Option) *Server {
+	t.Helper()
+	opts = append([]Option{WithStaticDir("../static")}, opts...)
+	s, err := New(opts...)
+	if err != nil {
+		t.Fatalf("New() error: %v", err)
+	}
+	t.Cleanup(func() { s.Shutdown(context.Background()) })
+	return s
+}
+
+// Test the errors New reports for invalid settings
+func TestNewErrors(t *testing.T) {
+	badProxies := defaultConfig
+	badProxies.TrustedProxies = "10.0.0.0/33"
+	badPrefix := defaultConfig
+	badPrefix.RateLimitIPv6Prefix = 0
+	unsigned := defaultConfig
+	unsigned.WebhookAllowedHosts = "hooks.example.com"
+	badAlgorithm := defaultConfig
+	badAlgorithm.RateLimitAlgorithm = "leaky-faucet"
+	missingPolicies := defaultConfig
+	missingPolicies.RateLimitPolicies = "does-not-exist.json"
+	badConcurrency := defaultConfig
+	badConcurrency.ConcurrencyAlgorithm = "vegas"
+
+	tests := []struct {
+		name string
+		opts []Option
+		want string
+	}{
+		{"trusted proxies", []Option{WithConfig(badProxies)}, "TRUSTED_PROXIES"},
+		{"IPv6 prefix", []Option{WithConfig(badPrefix)}, "RATE_LIMIT_IPV6_PREFIX"},
+		{"unsigned webhooks", []Option{WithConfig(unsigned)}, "WEBHOOK_SECRET"},
+		{"algorithm", []Option{WithConfig(badAlgorithm)}, "rate limiting"},
+		{"policies file", []Option{WithConfig(missingPolicies)}, "rate limit policies"},
+		{"concurrency algorithm", []Option{WithConfig(badConcurrency)}, "concurrency limiting"},
+		{"proxy option", []Option{WithTrustedProxies("proxy.internal")}, "proxy.internal"},
+	}
+
+	for _, tt := range tests {
+		s, err := New(tt.opts...)
+		if err == nil {
+			s.Shutdown(context.Background())
+			t.Errorf("%s: New() succeeded", tt.name)
+			continue
+		}
+		if !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: error = %v, want it to mention %s", tt.name, err, tt.want)
+		}
+	}
+}
+
+// Test that options reach the components they configure
+func TestNewOptions(t *testing.T) {
+	var logs strings.Builder
+	now := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+	limiter, err := NewRateLimiter("fixed-window", Rate{Limit: 2, Window: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer limiter.Close()
+
+	s := newTestServer(t,
+		WithLogger(log.New(&logs, "", 0)),
+		WithClock(func() time.Time { return now }),
+		WithLimiter(limiter),
+		WithAdminToken("secret"),
+		WithLimits(Limits{CacheSize: 5, JobWorkers: 1}),
+	)
+	h := s.Handler()
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	if !strings.Contains(w.Body.String(), `"timestamp":1893553445`) {
+		t.Errorf("health = %s, want the injected clock's time", w.Body.String())
+	}
+	if !strings.Contains(logs.String(), "GET /health") {
+		t.Errorf("logs = %q, want the request logged through the injected logger", logs.String())
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/admin/webhooks/dead-letters", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	h.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("admin request: status = %v, want 200 with the injected token", w.Code)
+	}
+
+	// The injected limiter allows two requests a minute
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/hello", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("third request: status = %v, want 429 from the injected limiter", w.Code)
+	}
+
+	if s.cache.capacity != 5 {
+		t.Errorf("cache capacity = %d, want 5", s.cache.capacity)
+	}
+
+	// A limiter passed in is left to the caller
+	s.Shutdown(context.Background())
+	select {
+	case <-limiter.stop:
+		t.Errorf("Shutdown closed the caller's limiter")
+	default:
+	}
+}
+
+// Test mounting the API under a prefix in another mux
+func TestHandlerMounted(t *testing.T) {
+	s := newTestServer(t)
+
+	mux := http.NewServeMux()
+	mux.Handle("/calc/", http.StripPrefix("/calc", s.Handler()))
+	mux.HandleFunc("/other", func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "other team")
+	})
+
+	tests := []struct {
+		method, path, body string
+		want               int
+		contains           string
+	}{
+		{"GET", "/calc/hello", "", http.StatusOK, "Hello"},
+		{"POST", "/calc/v2/power", `{"base":2,"exponent":3}`, http.StatusOK, "8"},
+		{"GET", "/other", "", http.StatusOK, "other team"},
+		{"GET", "/hello", "", http.StatusNotFound, ""},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+		if tt.body != "" {
+			req.Header.Set("Content-Type", "application/json")
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		if w.Code != tt.want || !strings.Contains(w.Body.String(), tt.contains) {
+			t.Errorf("%s %s = %v %s, want %v containing %q", tt.method, tt.path, w.Code, w.Body.String(), tt.want, tt.contains)
+		}
+	}
+}
+
+// Test starting the server and stopping its background goroutines
+func TestStartShutdown(t *testing.T) {
+	s := newTestServer(t)
+	if s.Addr() != nil {
+		t.Errorf("Addr() = %v before Start", s.Addr())
+	}
+	if err := s.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+
+	resp, err := http.Get("http://" + s.Addr().String() + "/hello")
+	if err != nil {
+		t.Fatalf("GET /hello: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /hello status = %v", resp.StatusCode)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatalf("Shutdown() error: %v", err)
+	}
+	// A second call is a no-op
+	if err := s.Shutdown(ctx); err != nil {
+		t.Errorf("second Shutdown() error: %v", err)
+	}
+
+	if _, err := http.Get("http://" + s.Addr().String() + "/hello"); err == nil {
+		t.Errorf("server still accepting connections after Shutdown")
+	}
+	for name, stop := range map[string]chan struct{}{
+		"server":      s.done,
+		"idempotency": s.idempotency.stop,
+		"limiter":     s.limiter.(*RateLimiter).stop,
+		"jobs":        s.jobs.done,
+	} {
+		select {
+		case <-stop:
+		default:
+			t.Errorf("%s goroutines still running after Shutdown", name)
+		}
+	}
+	if _, err := s.jobs.Submit("sort", map[string]interface{}{"numbers": []interface{}{2.0, 1.0}}); err == nil {
+		t.Errorf("job queue accepts jobs after Shutdown")
+	}
+}
+
+// Test that Shutdown stops accepting connections before it waits for jobs
+func TestShutdownClosesListenerFirst(t *testing.T) {
+	started, release := make(chan struct{}), make(chan struct{})
+	RegisterOperation(Operation{
+		Name:    "test_slow",
+		NewArgs: func() interface{} { return &MultiplyRequest{} },
+		Run: func(args interface{}) (interface{}, error) {
+			close(started)
+			<-release
+			return 0.0, nil
+		},
+	})
+	t.Cleanup(func() { delete(operations, "test_slow") })
+
+	s := newTestServer(t)
+	// Registered after the server's cleanup, so it runs first
+	finish := sync.OnceFunc(func() { close(release) })
+	t.Cleanup(finish)
+	if err := s.Start("127.0.0.1:0"); err != nil {
+		t.Fatalf("Start() error: %v", err)
+	}
+	if _, err := s.jobs.Submit("test_slow", map[string]interface{}{"a": 2.0, "b": 3.0}); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() { done <- s.Shutdown(ctx) }()
+
+	// The listener closes while the job is still running
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", s.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("server still accepting connections while jobs drain")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	finish()
+	if err := <-done; err != nil {
+		t.Errorf("Shutdown() error: %v", err)
+	}
+}
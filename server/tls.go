@@ -0,0 +1,252 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// certCheckInterval is how often the certificate files are checked for changes
+	certCheckInterval = 30 * time.Second
+	// selfSignedValidity is the lifetime of the development certificate
+	selfSignedValidity = 7 * 24 * time.Hour
+)
+
+// certReloader serves a certificate and key pair from disk and picks up
+// new files without a restart, for example after a renewal
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *log.Logger
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+// newCertReloader loads the certificate and key pair
+func newCertReloader(certFile, keyFile string, logger *log.Logger) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile, logger: logger}
+	if err := cr.load(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Reload reads the certificate and key files again. The previous
+// certificate stays in use when the new files cannot be loaded.
+func (cr *certReloader) Reload() error {
+	if err := cr.load(); err != nil {
+		return err
+	}
+	cr.logger.Printf("Reloaded TLS certificate from %s", cr.certFile)
+	return nil
+}
+
+// load reads the certificate and key pair
+func (cr *certReloader) load() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// reloadIfChanged reloads when either file is newer than the loaded pair
+func (cr *certReloader) reloadIfChanged() error {
+	modTime, err := cr.filesModTime()
+	if err != nil {
+		return err
+	}
+
+	cr.mu.RLock()
+	changed := modTime.After(cr.modTime)
+	cr.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	return cr.Reload()
+}
+
+// filesModTime returns the latest modification time of the two files
+func (cr *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{cr.certFile, cr.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// watch checks the files for changes every interval until stop is closed
+func (cr *certReloader) watch(interval time.Duration, stop <-chan struct{}) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := cr.reloadIfChanged(); err != nil {
+					cr.logger.Printf("TLS certificate reload failed: %v", err)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+// generateSelfSigned creates a PEM encoded certificate and ECDSA key for
+// hosts (DNS names or IP addresses) valid for validFor
+func generateSelfSigned(hosts []string, validFor time.Duration) (certPEM, keyPEM []byte, err error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"Go-First-project development"}},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	return certPEM, keyPEM, nil
+}
+
+// selfSignedHosts lists the names the development certificate is valid for
+func selfSignedHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "" && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
+
+// newTLSConfig builds the server TLS configuration. Certificate files are
+// reloaded when they change; without files, development mode generates an
+// ephemeral self-signed certificate. The returned reloader is nil when no
+// files are used.
+func newTLSConfig(cfg Config, logger *log.Logger) (*tls.Config, *certReloader, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if cfg.TLSCertFile != "" || cfg.TLSKeyFile != "" {
+		if cfg.TLSCertFile == "" || cfg.TLSKeyFile == "" {
+			return nil, nil, errors.New("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+		}
+		reloader, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile, logger)
+		if err != nil {
+			return nil, nil, err
+		}
+		tlsConfig.GetCertificate = reloader.GetCertificate
+		return tlsConfig, reloader, nil
+	}
+
+	if !cfg.Development() {
+		return nil, nil, errors.New("TLS needs TLS_CERT_FILE and TLS_KEY_FILE outside development mode")
+	}
+
+	certPEM, keyPEM, err := generateSelfSigned(selfSignedHosts(), selfSignedValidity)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	fingerprint := sha256.Sum256(cert.Certificate[0])
+	logger.Printf("Generated self-signed development certificate (SHA-256 %s)", hex.EncodeToString(fingerprint[:]))
+
+	tlsConfig.Certificates = []tls.Certificate{cert}
+	return tlsConfig, nil, nil
+}
+
+// serverProtocols returns the protocols to serve: HTTP/1.1 and HTTP/2, plus
+// HTTP/2 without TLS (h2c) when enabled for internal cleartext traffic
+func serverProtocols(cfg Config) *http.Protocols {
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(true)
+	protocols.SetUnencryptedHTTP2(cfg.H2C)
+	return protocols
+}
+
+// redirectHandler sends every request to the same URL over HTTPS on httpsPort
+func redirectHandler(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+			host = "[" + host + "]"
+		}
+
+		// 308 keeps the method and body of POST requests
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+	})
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test the development certificate
+func TestGenerateSelfSigned(t *testing.T) {
+	certPEM, keyPEM, err := generateSelfSigned([]string{"localhost", "127.0.0.1"}, time.Hour)
+	if err != nil {
+		t.Fatalf("generateSelfSigned failed: %v", err)
+	}
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatalf("X509KeyPair failed: %v", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %v", err)
+	}
+
+	for _, host := range []string{"localhost", "127.0.0.1"} {
+		if err := leaf.VerifyHostname(host); err != nil {
+			t.Errorf("certificate is not valid for %s: %v", host, err)
+		}
+	}
+	if time.Until(leaf.NotAfter) > time.Hour {
+		t.Errorf("NotAfter = %v, want within an hour", leaf.NotAfter)
+	}
+}
+
+// Test that changed certificate files are picked up without a restart
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writePair := func(modTime time.Time) []byte {
+		certPEM, keyPEM, err := generateSelfSigned([]string{"localhost"}, time.Hour)
+		if err != nil {
+			t.Fatalf("generateSelfSigned failed: %v", err)
+		}
+		for name, data := range map[string][]byte{certFile: certPEM, keyFile: keyPEM} {
+			if err := os.WriteFile(name, data, 0o600); err != nil {
+				t.Fatalf("WriteFile failed: %v", err)
+			}
+			os.Chtimes(name, modTime, modTime)
+		}
+		cert, _ := tls.X509KeyPair(certPEM, keyPEM)
+		return cert.Certificate[0]
+	}
+
+	var logs strings.Builder
+	first := writePair(time.Now().Add(-time.Minute))
+	cr, err := newCertReloader(certFile, keyFile, log.New(&logs, "", 0))
+	if err != nil {
+		t.Fatalf("newCertReloader failed: %v", err)
+	}
+	if cert, _ := cr.GetCertificate(nil); string(cert.Certificate[0]) != string(first) {
+		t.Fatal("GetCertificate does not return the loaded certificate")
+	}
+
+	// Broken files leave the current certificate in place
+	os.WriteFile(certFile, []byte("garbage"), 0o600)
+	if err := cr.reloadIfChanged(); err == nil {
+		t.Error("reloading a broken certificate should fail")
+	}
+	if cert, _ := cr.GetCertificate(nil); string(cert.Certificate[0]) != string(first) {
+		t.Error("a failed reload replaced the certificate")
+	}
+
+	second := writePair(time.Now())
+	if err := cr.reloadIfChanged(); err != nil {
+		t.Fatalf("reloadIfChanged failed: %v", err)
+	}
+	if cert, _ := cr.GetCertificate(nil); string(cert.Certificate[0]) != string(second) {
+		t.Error("the renewed certificate was not picked up")
+	}
+	if n := strings.Count(logs.String(), "Reloaded TLS certificate from "+certFile); n != 1 {
+		t.Errorf("logs = %q, want the reload logged once", logs.String())
+	}
+}
+
+// Test the TLS configuration sources
+func TestNewTLSConfig(t *testing.T) {
+	if _, _, err := newTLSConfig(Config{Env: "production", TLS: true}, log.Default()); err == nil {
+		t.Error("TLS without certificate files outside development should fail")
+	}
+	if _, _, err := newTLSConfig(Config{TLSCertFile: "cert.pem"}, log.Default()); err == nil {
+		t.Error("a certificate without a key should fail")
+	}
+
+	tlsConfig, reloader, err := newTLSConfig(Config{Env: "development", TLS: true}, log.Default())
+	if err != nil || reloader != nil || len(tlsConfig.Certificates) != 1 {
+		t.Fatalf("development config = %v certificates, reloader %v, err %v", len(tlsConfig.Certificates), reloader, err)
+	}
+}
+
+// Test serving HTTP/2 over TLS and cleartext HTTP/2 (h2c)
+func TestHTTP2(t *testing.T) {
+	s := newTestServer(t)
+	tlsConfig, _, err := newTLSConfig(Config{Env: "development"}, log.Default())
+	if err != nil {
+		t.Fatalf("newTLSConfig failed: %v", err)
+	}
+
+	tests := []struct {
+		name      string
+		tls       bool
+		transport *http.Transport
+	}{
+		{"h2", true, &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}},
+		{"h2c", false, &http.Transport{Protocols: func() *http.Protocols {
+			p := new(http.Protocols)
+			p.SetUnencryptedHTTP2(true)
+			return p
+		}()}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatalf("Listen failed: %v", err)
+			}
+			server := &http.Server{Handler: s.newRouter(), Protocols: serverProtocols(Config{H2C: true})}
+			scheme := "http"
+			if tt.tls {
+				server.TLSConfig = tlsConfig
+				scheme = "https"
+				go server.ServeTLS(ln, "", "")
+			} else {
+				go server.Serve(ln)
+			}
+			defer server.Close()
+
+			client := &http.Client{Transport: tt.transport, Timeout: 5 * time.Second}
+			resp, err := client.Get(scheme + "://" + ln.Addr().String() + "/v2/health")
+			if err != nil {
+				t.Fatalf("GET failed: %v", err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || resp.ProtoMajor != 2 {
+				t.Errorf("response = %v over %s, want 200 over HTTP/2", resp.StatusCode, resp.Proto)
+			}
+		})
+	}
+}
+
+// Test the HTTP to HTTPS redirect
+func TestRedirectHandler(t *testing.T) {
+	tests := []struct {
+		port   string
+		method string
+		target string
+		want   string
+	}{
+		{"443", "GET", "http://example.com/multiply?a=1&b=2", "https://example.com/multiply?a=1&b=2"},
+		{"8443", "POST", "http://example.com:8080/v2/jobs", "https://example.com:8443/v2/jobs"},
+		{"443", "GET", "http://[::1]:8080/health", "https://[::1]/health"},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		redirectHandler(tt.port).ServeHTTP(w, httptest.NewRequest(tt.method, tt.target, nil))
+		if w.Code != http.StatusPermanentRedirect || w.Header().Get("Location") != tt.want {
+			t.Errorf("%s %s: %v %q, want %v %q", tt.method, tt.target, w.Code, w.Header().Get("Location"), http.StatusPermanentRedirect, tt.want)
+		}
+	}
+}
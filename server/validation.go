@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"go-server/api"
+)
+
+// maxFieldErrors bounds the field errors reported for one request, so a
+// large array of out of range numbers does not produce a huge error body
+const maxFieldErrors = 100
+
+// Reasons reported in FieldError. They are part of the API contract.
+const (
+	reasonRequired       = "required"
+	reasonBelowMinimum   = "below_minimum"
+	reasonAboveMaximum   = "above_maximum"
+	reasonTooFewItems    = "too_few_items"
+	reasonTooManyItems   = "too_many_items"
+	reasonTooShort       = "too_short"
+	reasonTooLong        = "too_long"
+	reasonLengthMismatch = "length_mismatch"
+	reasonNotSquare      = "not_square"
+	reasonInvalidType    = "invalid_type"
+	reasonUnknownField   = "unknown_field"
+	reasonInvalidFormat  = "invalid_format"
+	reasonNotAllowed     = "not_allowed"
+)
+
+// FieldError points at one invalid request field (see api.FieldError)
+type FieldError = api.FieldError
+
+// ValidationError is returned by the request Validate methods. Message
+// summarises the failure and is what v1 clients receive as "message";
+// Fields lists every invalid field.
+type ValidationError struct {
+	Message string
+	Fields  []FieldError
+}
+
+func (e *ValidationError) Error() string {
+	return e.Message
+}
+
+// invalid builds the ValidationError for a request that failed one of its
+// checks. The fields are found from the request's validation tags (the
+// same ones published in the OpenAPI document), followed by any extra
+// fields for rules the tags cannot express.
+func invalid(message string, req interface{}, extra ...FieldError) error {
+	fields := append(tagFieldErrors(req), extra...)
+	if len(fields) > maxFieldErrors {
+		fields = fields[:maxFieldErrors]
+	}
+	return &ValidationError{Message: message, Fields: fields}
+}
+
+// indexedField returns a FieldError for element i of a list field
+func indexedField(field string, i int, reason, message string) FieldError {
+	return FieldError{Field: field, Index: &i, Reason: reason, Message: message}
+}
+
+// tagFieldErrors checks a request struct against its required, minimum,
+// maximum, minItems, maxItems, minLength and maxLength tags. As in the
+// OpenAPI document, minimum and maximum on a list apply to its items.
+func tagFieldErrors(req interface{}) []FieldError {
+	rv := reflect.Indirect(reflect.ValueOf(req))
+	if rv.Kind() != reflect.Struct {
+		return nil
+	}
+	t := rv.Type()
+
+	var fields []FieldError
+	for i := 0; i < t.NumField() && len(fields) < maxFieldErrors; i++ {
+		f := t.Field(i)
+		name := jsonFieldName(f)
+		if name == "" {
+			continue
+		}
+		v := rv.Field(i)
+
+		switch v.Kind() {
+		case reflect.Slice:
+			if v.Len() == 0 && f.Tag.Get("required") == "true" {
+				fields = append(fields, FieldError{Field: name, Reason: reasonRequired, Message: "is required"})
+				continue
+			}
+			if limit, ok := tagNumber(f, "minItems"); ok && float64(v.Len()) < limit {
+				fields = append(fields, FieldError{Field: name, Reason: reasonTooFewItems, Message: "must have at least " + formatLimit(limit) + " items"})
+			}
+			if limit, ok := tagNumber(f, "maxItems"); ok && float64(v.Len()) > limit {
+				fields = append(fields, FieldError{Field: name, Reason: reasonTooManyItems, Message: "must have at most " + formatLimit(limit) + " items"})
+			}
+			for j := 0; j < v.Len() && len(fields) < maxFieldErrors; j++ {
+				if n, ok := numberOf(v.Index(j)); ok {
+					if reason, message := checkBounds(f, n); reason != "" {
+						fields = append(fields, indexedField(name, j, reason, message))
+					}
+				}
+			}
+
+		case reflect.String:
+			s := v.String()
+			if strings.TrimSpace(s) == "" && f.Tag.Get("required") == "true" {
+				fields = append(fields, FieldError{Field: name, Reason: reasonRequired, Message: "is required"})
+				continue
+			}
+			if limit, ok := tagNumber(f, "minLength"); ok && float64(len(s)) < limit {
+				fields = append(fields, FieldError{Field: name, Reason: reasonTooShort, Message: "must be at least " + formatLimit(limit) + " characters"})
+			}
+			if limit, ok := tagNumber(f, "maxLength"); ok && float64(len(s)) > limit {
+				fields = append(fields, FieldError{Field: name, Reason: reasonTooLong, Message: "must be at most " + formatLimit(limit) + " characters"})
+			}
+
+		default:
+			if n, ok := numberOf(v); ok {
+				if reason, message := checkBounds(f, n); reason != "" {
+					fields = append(fields, FieldError{Field: name, Reason: reason, Message: message})
+				}
+			}
+		}
+	}
+	return fields
+}
+
+// checkBounds checks n against the field's minimum and maximum tags
+func checkBounds(f reflect.StructField, n float64) (reason, message string) {
+	if limit, ok := tagNumber(f, "minimum"); ok && n < limit {
+		return reasonBelowMinimum, "must be at least " + formatLimit(limit)
+	}
+	if limit, ok := tagNumber(f, "maximum"); ok && n > limit {
+		return reasonAboveMaximum, "must be at most " + formatLimit(limit)
+	}
+	return "", ""
+}
+
+// numberOf returns the value of a numeric reflect.Value
+func numberOf(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	}
+	return 0, false
+}
+
+// tagNumber reads a numeric struct tag
+func tagNumber(f reflect.StructField, tag string) (float64, bool) {
+	value := f.Tag.Get(tag)
+	if value == "" {
+		return 0, false
+	}
+	n, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		log.Printf("Validation: invalid %s tag %q on field %s", tag, value, f.Name)
+		return 0, false
+	}
+	return n, true
+}
+
+// formatLimit formats a tag bound the way it is written in the tag
+func formatLimit(n float64) string {
+	return strconv.FormatFloat(n, 'g', -1, 64)
+}
+
+// UnknownFieldError is returned by the strict decoders for a field the
+// request type does not have
+type UnknownFieldError struct {
+	Field string
+}
+
+func (e *UnknownFieldError) Error() string {
+	return "unknown field " + strconv.Quote(e.Field)
+}
+
+// strictJSONError converts encoding/json's unknown field error into an
+// UnknownFieldError so the field can be reported to the client
+func strictJSONError(err error) error {
+	if name, ok := strings.CutPrefix(err.Error(), "json: unknown field "); ok {
+		if field, unquoteErr := strconv.Unquote(name); unquoteErr == nil {
+			return &UnknownFieldError{Field: field}
+		}
+	}
+	return err
+}
+
+// decodeFieldErrors finds the field a decoding error refers to, if any
+func decodeFieldErrors(err error) []FieldError {
+	var unknown *UnknownFieldError
+	if errors.As(err, &unknown) {
+		return []FieldError{{Field: unknown.Field, Reason: reasonUnknownField, Message: "is not a known field"}}
+	}
+
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) && typeErr.Field != "" {
+		// Field is a dotted path such as "numbers.3" for list elements
+		path := strings.Split(typeErr.Field, ".")
+		fe := FieldError{Field: path[0], Reason: reasonInvalidType, Message: "must be " + jsonTypeName(typeErr.Type)}
+		if len(path) > 1 {
+			if i, err := strconv.Atoi(path[1]); err == nil {
+				fe.Index = &i
+			}
+		}
+		return []FieldError{fe}
+	}
+	return nil
+}
+
+// jsonTypeName names a Go type the way a client sees it in the JSON schema
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.String:
+		return "a string"
+	case reflect.Slice, reflect.Array:
+		return "a list"
+	}
+	return "an object"
+}
+
+// sendValidationError reports a failed Validate call, listing the invalid
+// fields when err is a *ValidationError
+func sendValidationError(w http.ResponseWriter, err error) {
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		sendProblem(w, "Validation Error", validationErr.Message, http.StatusBadRequest, validationErr.Fields)
+		return
+	}
+	sendErrorResponse(w, "Validation Error", err.Error(), http.StatusBadRequest)
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// Test the RFC 9457 problem document returned to v1 clients
+func TestProblemDetails(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("POST", "/multiply/pairwise", strings.NewReader(`{"array1":[1,2,3],"array2":[1,2e10,3]}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.negotiationMiddleware(s.newRouter()).ServeHTTP(w, req)
+
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusBadRequest)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Errorf("Content-Type = %q, want application/problem+json", ct)
+	}
+
+	var problem ErrorResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("Failed to parse problem: %v", err)
+	}
+	if problem.Type != "/problems/validation_error" || problem.Title != "Validation Error" || problem.Status != http.StatusBadRequest {
+		t.Errorf("problem = %+v, want type /problems/validation_error and status 400", problem)
+	}
+	if problem.Error != problem.Title || problem.Message != problem.Detail || problem.Code != problem.Status {
+		t.Errorf("legacy fields %q %q %v do not repeat title, detail and status", problem.Error, problem.Message, problem.Code)
+	}
+	if len(problem.Errors) != 1 {
+		t.Fatalf("errors = %+v, want one field error", problem.Errors)
+	}
+	if fe := problem.Errors[0]; fe.Field != "array2" || fe.Index == nil || *fe.Index != 1 || fe.Reason != reasonAboveMaximum {
+		t.Errorf("field error = %+v, want array2[1] above_maximum", fe)
+	}
+}
+
+// Test the field errors reported for invalid and malformed requests
+func TestFieldErrors(t *testing.T) {
+	s := newTestServer(t)
+	index := func(i int) *int { return &i }
+
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		contentType string
+		body        string
+		status      int
+		want        []FieldError
+	}{
+		{"both operands", "POST", "/v2/multiply", "application/json", `{"a":2e15,"b":-2e15}`, http.StatusBadRequest,
+			[]FieldError{{Field: "a", Reason: reasonAboveMaximum}, {Field: "b", Reason: reasonBelowMinimum}}},
+		{"scalar", "POST", "/v2/multiply/scalar", "application/json", `{"numbers":[1],"scalar":1e11}`, http.StatusBadRequest,
+			[]FieldError{{Field: "scalar", Reason: reasonAboveMaximum}}},
+		{"empty array", "POST", "/v2/multiply/array", "application/json", `{"numbers":[]}`, http.StatusBadRequest,
+			[]FieldError{{Field: "numbers", Reason: reasonRequired}}},
+		{"length mismatch", "POST", "/v2/multiply/pairwise", "application/json", `{"array1":[1,2],"array2":[1]}`, http.StatusBadRequest,
+			[]FieldError{{Field: "array2", Reason: reasonLengthMismatch}}},
+		{"form", "POST", "/v2/form", "application/json", `{"name":" ","address":"1 Main St"}`, http.StatusBadRequest,
+			[]FieldError{{Field: "name", Reason: reasonRequired}}},
+		{"query", "GET", "/v2/power?base=2&exponent=1001", "", ``, http.StatusBadRequest,
+			[]FieldError{{Field: "exponent", Reason: reasonAboveMaximum}}},
+		{"unknown field", "POST", "/v2/multiply", "application/json", `{"a":1,"b":2,"c":3}`, http.StatusBadRequest,
+			[]FieldError{{Field: "c", Reason: reasonUnknownField}}},
+		{"unknown query parameter", "GET", "/v2/multiply?a=1&b=2&c=3", "", ``, http.StatusBadRequest,
+			[]FieldError{{Field: "c", Reason: reasonUnknownField}}},
+		{"wrong type", "POST", "/v2/multiply/array", "application/json", `{"numbers":[1,true]}`, http.StatusBadRequest,
+			[]FieldError{{Field: "numbers", Index: index(1), Reason: reasonInvalidType}}},
+		{"trailing JSON", "POST", "/v2/multiply", "application/json", `{"a":1,"b":2}{"a":3}`, http.StatusBadRequest, nil},
+		{"trailing XML", "POST", "/v2/multiply", "application/xml", `<r><a>1</a><b>2</b></r><r/>`, http.StatusBadRequest, nil},
+		{"oversized body", "POST", "/v2/multiply/array", "application/json", `{"numbers":[` + strings.Repeat("1,", maxRequestBodySize/2) + `1]}`, http.StatusRequestEntityTooLarge, nil},
+		{"job arguments", "POST", "/v2/jobs", "application/json", `{"operation":"multiply","args":{"a":1e16,"b":1}}`, http.StatusBadRequest,
+			[]FieldError{{Field: "args.a", Reason: reasonAboveMaximum}}},
+		{"job unknown field", "POST", "/v2/jobs", "application/json", `{"operation":"multiply","arguments":{}}`, http.StatusBadRequest,
+			[]FieldError{{Field: "arguments", Reason: reasonUnknownField}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			if tt.contentType != "" {
+				req.Header.Set("Content-Type", tt.contentType)
+			}
+			w := httptest.NewRecorder()
+			s.newRouter().ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %v, want %v: %s", w.Code, tt.status, w.Body.String())
+			}
+			var envelope struct {
+				Error *EnvelopeError `json:"error"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil || envelope.Error == nil {
+				t.Fatalf("Failed to parse error envelope: %v: %s", err, w.Body.String())
+			}
+			if envelope.Error.Type != problemType(envelope.Error.Code) {
+				t.Errorf("type = %q, want %q", envelope.Error.Type, problemType(envelope.Error.Code))
+			}
+
+			got := envelope.Error.Errors
+			if len(got) != len(tt.want) {
+				t.Fatalf("errors = %+v, want %+v", got, tt.want)
+			}
+			for i, want := range tt.want {
+				if got[i].Field != want.Field || got[i].Reason != want.Reason || got[i].Message == "" ||
+					(got[i].Index == nil) != (want.Index == nil) || (want.Index != nil && *got[i].Index != *want.Index) {
+					t.Errorf("errors[%d] = %+v, want %+v", i, got[i], want)
+				}
+			}
+			if len(tt.want) > 0 && envelope.Error.Field != tt.want[0].Field {
+				t.Errorf("field = %q, want %q", envelope.Error.Field, tt.want[0].Field)
+			}
+		})
+	}
+}
+
+// Test that every problem type URI is documented
+func TestProblemTypes(t *testing.T) {
+	s := newTestServer(t)
+	mux := s.newRouter()
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", problemType("validation_error"), nil))
+	var p ProblemType
+	if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || w.Code != http.StatusOK {
+		t.Fatalf("GET %s = %v: %s", problemType("validation_error"), w.Code, w.Body.String())
+	}
+	if p.Type != "/problems/validation_error" || p.Status != http.StatusBadRequest || p.Description == "" {
+		t.Errorf("problem type = %+v", p)
+	}
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, httptest.NewRequest("GET", problemType("no_such_problem"), nil))
+	if w.Code != http.StatusNotFound {
+		t.Errorf("unknown problem type status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// versionMiddleware records the API version a request was routed through so
+// handlers can shape their responses, and marks v1 responses as deprecated:
+// Deprecation (RFC 9745) and Sunset (RFC 8594) carry the configured dates,
+// and Link points at the same route under /v2, below any prefix the server
+// is mounted at.
+// It also applies Idempotency-Key handling, so replays and key errors use
+// the shapes of the version the client called.
+func (s *Server) versionMiddleware(version string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w, rw := withResponseWriter(w)
+		rw.version = version
+		rw.start = time.Now()
+		if rw.requestID == "" {
+			rw.requestID = RequestID(r.Context())
+		}
+		if rw.requestID == "" {
+			rw.requestID = newRequestID()
+		}
+
+		w.Header().Set("API-Version", version)
+		if version == apiV1 {
+			// The client's path ends with the route; what comes before it
+			// is the mount prefix and /v1, if the client used it
+			prefix := strings.TrimSuffix(strings.TrimSuffix(requestPath(r), r.URL.Path), "/"+apiV1)
+			// The dates are only announced once the operator has set them
+			if !s.config.V1DeprecatedAt.IsZero() {
+				w.Header().Set("Deprecation", "@"+strconv.FormatInt(s.config.V1DeprecatedAt.Unix(), 10))
+			}
+			if !s.config.V1SunsetAt.IsZero() {
+				w.Header().Set("Sunset", s.config.V1SunsetAt.Format(http.TimeFormat))
+			}
+			w.Header().Add("Link", `<`+prefix+`/`+apiV2+r.URL.Path+`>; rel="successor-version"`)
+			w.Header().Add("Link", `<`+prefix+`/docs>; rel="deprecation"; type="text/html"`)
+		}
+
+		s.idempotencyMiddleware(next).ServeHTTP(w, r)
+	})
+}
+
+// splitVersion splits a request path into the API route and its version
+// prefix, which is empty for unprefixed paths
+func splitVersion(path string) (string, string) {
+	for _, version := range []string{apiV1, apiV2} {
+		if route, ok := strings.CutPrefix(path, "/"+version+"/"); ok {
+			return "/" + route, version
+		}
+	}
+	return path, ""
+}
+
+// routeMatches reports whether route matches pattern, which is a route or a
+// prefix ending in "*"
+func routeMatches(pattern, route string) bool {
+	if prefix, ok := strings.CutSuffix(pattern, "*"); ok {
+		return strings.HasPrefix(route, prefix)
+	}
+	return pattern == route
+}
+
+// newAPIMux registers apiRoutes on a mux of their own so they can be mounted
+// under each version prefix
+func (s *Server) newAPIMux() *http.ServeMux {
+	api := http.NewServeMux()
+	for _, route := range apiRoutes {
+		api.HandleFunc(route.Path, s.routeHandler(route))
+	}
+	api.HandleFunc("/jobs", s.jobsHandler)
+	api.HandleFunc("/jobs/", s.jobHandler)
+	api.HandleFunc("/", notFoundHandler)
+	return api
+}
+
+// routeHandler binds the handler of route to the server
+func (s *Server) routeHandler(route apiRoute) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		route.Handler(s, w, r)
+	}
+}
+
+// notFoundHandler answers unknown paths under a version prefix
+func notFoundHandler(w http.ResponseWriter, r *http.Request) {
+	sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Test that /v1 keeps today's response shapes and is marked deprecated
+func TestV1ResponsesAreDeprecated(t *testing.T) {
+	s := newTestServer(t)
+	for _, path := range []string{"/v1/multiply", "/multiply"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"a":2,"b":3}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		s.newRouter().ServeHTTP(w, req)
+
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s status = %v, want %v", path, w.Code, http.StatusOK)
+		}
+		// No dates are announced until they are configured
+		if w.Header().Get("Deprecation") != "" || w.Header().Get("Sunset") != "" {
+			t.Errorf("%s announced dates that were not set: %v", path, w.Header())
+		}
+		if link := strings.Join(w.Header().Values("Link"), ", "); !strings.Contains(link, `</v2/multiply>; rel="successor-version"`) {
+			t.Errorf("%s Link = %q, want successor-version link to /v2/multiply", path, link)
+		}
+
+		var response map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("Failed to parse response: %v", err)
+		}
+		if response["success"] != true || response["data"] == nil {
+			t.Errorf("%s response = %v, want v1 success/data shape", path, response)
+		}
+	}
+}
+
+// Test the deprecation headers under a mount prefix and with configured dates
+func TestV1DeprecationHeaders(t *testing.T) {
+	cfg := defaultConfig
+	cfg.V1DeprecatedAt = time.Date(2026, time.November, 1, 0, 0, 0, 0, time.UTC)
+	cfg.V1SunsetAt = time.Date(2027, time.June, 1, 0, 0, 0, 0, time.UTC)
+	s := newTestServer(t, WithConfig(cfg))
+	h := http.StripPrefix("/calc", s.newRouter())
+
+	for _, path := range []string{"/calc/v1/multiply", "/calc/multiply"} {
+		req := httptest.NewRequest("POST", path, strings.NewReader(`{"a":2,"b":3}`))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		if got := w.Header().Get("Deprecation"); got != "@1793491200" {
+			t.Errorf("%s Deprecation = %q, want @1793491200", path, got)
+		}
+		if got := w.Header().Get("Sunset"); got != "Tue, 01 Jun 2027 00:00:00 GMT" {
+			t.Errorf("%s Sunset = %q", path, got)
+		}
+		want := `</calc/v2/multiply>; rel="successor-version", </calc/docs>; rel="deprecation"; type="text/html"`
+		if link := strings.Join(w.Header().Values("Link"), ", "); link != want {
+			t.Errorf("%s Link = %q, want %q", path, link, want)
+		}
+	}
+}
+
+// Test the uniform v2 envelope for successful responses
+func TestV2EnvelopeSuccess(t *testing.T) {
+	s := newTestServer(t)
+	req := httptest.NewRequest("POST", "/v2/factorial", strings.NewReader(`{"number":5}`))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+	}
+	if w.Header().Get("Deprecation") != "" {
+		t.Error("v2 responses must not carry a Deprecation header")
+	}
+
+	var envelope struct {
+		Data  FactorialResult `json:"data"`
+		Error *EnvelopeError  `json:"error"`
+		Meta  EnvelopeMeta    `json:"meta"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if envelope.Data.Result != 120 || envelope.Error != nil {
+		t.Errorf("envelope = %+v, want data.result 120 and no error", envelope)
+	}
+	if envelope.Meta.APIVersion != "v2" || len(envelope.Meta.RequestID) != 32 {
+		t.Errorf("meta = %+v, want api_version v2 and a request id", envelope.Meta)
+	}
+}
+
+// Test the uniform v2 envelope for errors
+func TestV2EnvelopeError(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+		code   string
+	}{
+		{"validation error", "POST", "/v2/multiply", `{"a":1e16,"b":1}`, http.StatusBadRequest, "validation_error"},
+		{"method not allowed", "DELETE", "/v2/multiply", ``, http.StatusMethodNotAllowed, "method_not_allowed"},
+		{"unknown path", "GET", "/v2/unknown", ``, http.StatusNotFound, "not_found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			s.newRouter().ServeHTTP(w, req)
+
+			if w.Code != tt.status {
+				t.Fatalf("status = %v, want %v", w.Code, tt.status)
+			}
+
+			var envelope map[string]interface{}
+			if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+				t.Fatalf("Failed to parse envelope: %v", err)
+			}
+			if envelope["data"] != nil {
+				t.Errorf("data = %v, want null", envelope["data"])
+			}
+			errObj, ok := envelope["error"].(map[string]interface{})
+			if !ok || errObj["code"] != tt.code || errObj["message"] == "" {
+				t.Errorf("error = %v, want code %q", envelope["error"], tt.code)
+			}
+			if meta, ok := envelope["meta"].(map[string]interface{}); !ok || meta["api_version"] != "v2" {
+				t.Errorf("meta = %v, want api_version v2", envelope["meta"])
+			}
+		})
+	}
+}
+
+// Test that /v2/hello is enveloped while /v1/hello stays plain text
+func TestHelloVersions(t *testing.T) {
+	s := newTestServer(t)
+	w := httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v1/hello", nil))
+	if ct := w.Header().Get("Content-Type"); ct != "text/plain" {
+		t.Errorf("/v1/hello Content-Type = %q, want text/plain", ct)
+	}
+
+	w = httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, httptest.NewRequest("GET", "/v2/hello", nil))
+	var envelope Envelope
+	if err := json.Unmarshal(w.Body.Bytes(), &envelope); err != nil {
+		t.Fatalf("Failed to parse envelope: %v", err)
+	}
+	if envelope.Data != "Hello from Go server! 👋" {
+		t.Errorf("/v2/hello data = %v", envelope.Data)
+	}
+}
@@ -0,0 +1,403 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// webhookTimeout bounds one delivery attempt
+	webhookTimeout = 10 * time.Second
+	// webhookBackoff is the wait before the first retry; it doubles per
+	// attempt up to webhookMaxBackoff
+	webhookBackoff    = time.Second
+	webhookMaxBackoff = 5 * time.Minute
+	// maxDeadLetters bounds the dead-letter list; the oldest are dropped first
+	maxDeadLetters = 1000
+)
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// WebhookEvent is the body POSTed to a callback URL. RequestID is the ID of
+// the request that caused the event, also sent as X-Request-ID.
+type WebhookEvent struct {
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+	RequestID string      `json:"request_id,omitempty"`
+
+	// traceParent continues the trace of that request, if it had one
+	traceParent string
+}
+
+// DeadLetter is an event that could not be delivered
+type DeadLetter struct {
+	URL        string       `json:"url"`
+	Event      WebhookEvent `json:"event"`
+	Attempts   int          `json:"attempts"`
+	LastStatus int          `json:"last_status,omitempty"`
+	LastError  string       `json:"last_error"`
+	FailedAt   time.Time    `json:"failed_at"`
+}
+
+// WebhookDispatcher POSTs events to callback URLs. Each request is signed
+// with HMAC-SHA256 over the timestamp and body, failed attempts are retried
+// with exponential backoff, and events that still cannot be delivered are
+// kept as dead letters for an operator to inspect or redeliver.
+type WebhookDispatcher struct {
+	secret       []byte
+	allowedHosts []string
+	maxAttempts  int
+	client       *http.Client
+
+	// backoff and maxBackoff are variables so tests can shorten them
+	backoff    time.Duration
+	maxBackoff time.Duration
+
+	mu          sync.Mutex
+	deadLetters []DeadLetter
+	closing     bool
+	wg          sync.WaitGroup
+	ctx         context.Context
+	cancel      context.CancelFunc
+	logger      *log.Logger
+}
+
+// NewWebhookDispatcher creates a dispatcher signing with secret that only
+// calls back to allowedHosts. Entries are host names ("hooks.example.com"),
+// host and port ("localhost:9000") or subdomain wildcards ("*.example.com").
+func NewWebhookDispatcher(secret string, allowedHosts []string, maxAttempts int) *WebhookDispatcher {
+	ctx, cancel := context.WithCancel(context.Background())
+	d := &WebhookDispatcher{
+		secret:      []byte(secret),
+		maxAttempts: max(maxAttempts, 1),
+		backoff:     webhookBackoff,
+		maxBackoff:  webhookMaxBackoff,
+		ctx:         ctx,
+		cancel:      cancel,
+		logger:      log.Default(),
+		client: &http.Client{
+			Timeout: webhookTimeout,
+			// A redirect could lead outside the allowlist
+			CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+		},
+	}
+	for _, host := range allowedHosts {
+		if host = strings.ToLower(strings.TrimSpace(host)); host != "" {
+			d.allowedHosts = append(d.allowedHosts, host)
+		}
+	}
+	return d
+}
+
+// CheckURL validates a callback URL: it must be absolute http or https and
+// point at an allowed host
+func (d *WebhookDispatcher) CheckURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return callbackError(reasonInvalidFormat, "must be an absolute http or https URL")
+	}
+	if !d.hostAllowed(u) {
+		return callbackError(reasonNotAllowed, "host is not on the callback allowlist")
+	}
+	return nil
+}
+
+// callbackError is the validation error for a rejected callback_url
+func callbackError(reason, message string) error {
+	return &ValidationError{
+		Message: "callback_url " + message,
+		Fields:  []FieldError{{Field: "callback_url", Reason: reason, Message: message}},
+	}
+}
+
+// hostAllowed reports whether u points at an allowlisted host
+func (d *WebhookDispatcher) hostAllowed(u *url.URL) bool {
+	hostname := strings.ToLower(u.Hostname())
+	port := u.Port()
+	if port == "" {
+		port = map[string]string{"http": "80", "https": "443"}[u.Scheme]
+	}
+
+	for _, entry := range d.allowedHosts {
+		host, entryPort := entry, ""
+		if h, p, err := net.SplitHostPort(entry); err == nil {
+			host, entryPort = h, p
+		}
+		if entryPort != "" && entryPort != port {
+			continue
+		}
+		if host == hostname || (strings.HasPrefix(host, "*.") && strings.HasSuffix(hostname, host[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// Deliver sends event to callbackURL in the background
+func (d *WebhookDispatcher) Deliver(callbackURL string, event WebhookEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closing {
+		d.addDeadLetterLocked(DeadLetter{URL: callbackURL, Event: event, LastError: "server is shutting down", FailedAt: time.Now().UTC()})
+		return
+	}
+	d.wg.Add(1)
+	go func() {
+		defer d.wg.Done()
+		d.deliver(callbackURL, event)
+	}()
+}
+
+// deliver makes up to maxAttempts attempts and dead-letters the event if
+// none succeeds. Network errors, 408, 429 and 5xx responses are retried;
+// other responses are final.
+func (d *WebhookDispatcher) deliver(callbackURL string, event WebhookEvent) {
+	body, err := json.Marshal(event)
+	if err != nil {
+		logf(d.logger, event.RequestID, "Webhook %s: %v", event.ID, err)
+		return
+	}
+
+	dead := DeadLetter{URL: callbackURL, Event: event}
+	for attempt := 1; ; attempt++ {
+		dead.Attempts = attempt
+		status, retryAfter, err := d.send(callbackURL, event, body)
+		if err == nil {
+			return
+		}
+		dead.LastStatus, dead.LastError = status, err.Error()
+
+		retryable := status == 0 || status == http.StatusRequestTimeout || status == http.StatusTooManyRequests || status >= 500
+		if !retryable || attempt >= d.maxAttempts {
+			break
+		}
+
+		wait := d.backoff << (attempt - 1)
+		if retryAfter > 0 {
+			wait = retryAfter
+		}
+		if wait > d.maxBackoff || wait <= 0 {
+			wait = d.maxBackoff
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-timer.C:
+			continue
+		case <-d.ctx.Done():
+			timer.Stop()
+			dead.LastError = "server shut down before the retry: " + dead.LastError
+		}
+		break
+	}
+
+	logf(d.logger, event.RequestID, "Webhook %s to %s failed after %d attempts: %s", event.ID, callbackURL, dead.Attempts, dead.LastError)
+	dead.FailedAt = time.Now().UTC()
+	d.mu.Lock()
+	d.addDeadLetterLocked(dead)
+	d.mu.Unlock()
+}
+
+// send makes one signed delivery attempt. It returns the response status
+// (0 when there was none) and any Retry-After the receiver asked for.
+func (d *WebhookDispatcher) send(callbackURL string, event WebhookEvent, body []byte) (int, time.Duration, error) {
+	req, err := http.NewRequestWithContext(d.ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "go-first-project-webhooks")
+	req.Header.Set("X-Webhook-ID", event.ID)
+	req.Header.Set("X-Webhook-Event", event.Type)
+	req.Header.Set("X-Webhook-Signature", signWebhook(d.secret, time.Now(), body))
+	if event.RequestID != "" {
+		req.Header.Set(requestIDHeader, event.RequestID)
+	}
+	if parent := childTraceParent(event.traceParent); parent != "" {
+		req.Header.Set(traceParentHeader, parent)
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp.StatusCode, 0, nil
+	}
+	var retryAfter time.Duration
+	if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return resp.StatusCode, retryAfter, fmt.Errorf("receiver answered %s", resp.Status)
+}
+
+// signWebhook returns the X-Webhook-Signature value "t=<unix>,v1=<hex>",
+// where v1 is the HMAC-SHA256 of "<unix>.<body>". Signing the timestamp
+// lets receivers reject replayed deliveries.
+func signWebhook(secret []byte, t time.Time, body []byte) string {
+	timestamp := strconv.FormatInt(t.Unix(), 10)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return "t=" + timestamp + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// addDeadLetterLocked records a failed event, replacing an earlier dead
+// letter for the same event
+func (d *WebhookDispatcher) addDeadLetterLocked(dead DeadLetter) {
+	d.removeDeadLetterLocked(dead.Event.ID)
+	d.deadLetters = append(d.deadLetters, dead)
+	if len(d.deadLetters) > maxDeadLetters {
+		d.deadLetters = d.deadLetters[len(d.deadLetters)-maxDeadLetters:]
+	}
+}
+
+// removeDeadLetterLocked removes and returns the dead letter for an event
+func (d *WebhookDispatcher) removeDeadLetterLocked(id string) (DeadLetter, bool) {
+	for i, dead := range d.deadLetters {
+		if dead.Event.ID == id {
+			d.deadLetters = append(d.deadLetters[:i], d.deadLetters[i+1:]...)
+			return dead, true
+		}
+	}
+	return DeadLetter{}, false
+}
+
+// DeadLetters returns the undelivered events, oldest first
+func (d *WebhookDispatcher) DeadLetters() []DeadLetter {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append([]DeadLetter{}, d.deadLetters...)
+}
+
+// Redeliver removes a dead letter and delivers its event again
+func (d *WebhookDispatcher) Redeliver(id string) (DeadLetter, error) {
+	d.mu.Lock()
+	dead, ok := d.removeDeadLetterLocked(id)
+	d.mu.Unlock()
+	if !ok {
+		return DeadLetter{}, errDeadLetterNotFound
+	}
+	d.Deliver(dead.URL, dead.Event)
+	return dead, nil
+}
+
+// Discard drops a dead letter
+func (d *WebhookDispatcher) Discard(id string) (DeadLetter, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dead, ok := d.removeDeadLetterLocked(id)
+	if !ok {
+		return DeadLetter{}, errDeadLetterNotFound
+	}
+	return dead, nil
+}
+
+// Shutdown waits for deliveries in progress until ctx expires, then stops
+// them; interrupted events become dead letters
+func (d *WebhookDispatcher) Shutdown(ctx context.Context) {
+	d.mu.Lock()
+	d.closing = true
+	d.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		d.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		d.cancel()
+		<-done
+	}
+}
+
+// adminMiddleware requires "Authorization: Bearer <ADMIN_TOKEN>"
+func (s *Server) adminMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.adminToken == "" {
+			sendErrorResponse(w, "Forbidden", "Admin endpoints are disabled, set ADMIN_TOKEN to enable them", http.StatusForbidden)
+			return
+		}
+		if !s.adminAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			sendErrorResponse(w, "Unauthorized", "A valid admin bearer token is required", http.StatusUnauthorized)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorized reports whether r carries the admin bearer token
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && s.adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(s.adminToken)) == 1
+}
+
+// deadLettersHandler handles GET /admin/webhooks/dead-letters,
+// DELETE /admin/webhooks/dead-letters/{id} and
+// POST /admin/webhooks/dead-letters/{id}/retry
+func (s *Server) deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	const prefix = "/admin/webhooks/dead-letters"
+	rest, ok := strings.CutPrefix(r.URL.Path, prefix)
+	if !ok || (rest != "" && !strings.HasPrefix(rest, "/")) {
+		sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+		return
+	}
+	id, action, _ := strings.Cut(strings.TrimPrefix(rest, "/"), "/")
+
+	switch {
+	case id == "":
+		if r.Method != http.MethodGet {
+			sendErrorResponse(w, "Method Not Allowed", "Only GET method is allowed for this endpoint", http.StatusMethodNotAllowed)
+			return
+		}
+		sendSuccessResponse(w, s.webhooks.DeadLetters())
+	case action == "retry":
+		if r.Method != http.MethodPost {
+			sendErrorResponse(w, "Method Not Allowed", "Only POST method is allowed for this endpoint", http.StatusMethodNotAllowed)
+			return
+		}
+		dead, err := s.webhooks.Redeliver(id)
+		if err != nil {
+			sendErrorResponse(w, "Not Found", "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		sendDataResponseStatus(w, http.StatusAccepted, SuccessResponse{Success: true, Data: dead}, dead)
+	case action == "":
+		if r.Method != http.MethodDelete {
+			sendErrorResponse(w, "Method Not Allowed", "Only DELETE method is allowed for this endpoint", http.StatusMethodNotAllowed)
+			return
+		}
+		dead, err := s.webhooks.Discard(id)
+		if err != nil {
+			sendErrorResponse(w, "Not Found", "Dead letter not found", http.StatusNotFound)
+			return
+		}
+		sendSuccessResponse(w, dead)
+	default:
+		sendErrorResponse(w, "Not Found", "The requested resource was not found", http.StatusNotFound)
+	}
+}
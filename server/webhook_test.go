@@ -0,0 +1,249 @@
+package server
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "whsec-test"
+
+// newWebhookTestServer creates a server whose dispatcher allows receiver
+// and retries without waiting
+func newWebhookTestServer(t *testing.T, receiver *httptest.Server, maxAttempts int) (*Server, *WebhookDispatcher) {
+	t.Helper()
+	u, _ := url.Parse(receiver.URL)
+	cfg := defaultConfig
+	cfg.WebhookSecret = testWebhookSecret
+	cfg.WebhookAllowedHosts = u.Host
+	cfg.WebhookMaxAttempts = maxAttempts
+
+	s := newTestServer(t, WithConfig(cfg))
+	s.webhooks.backoff = time.Millisecond
+	return s, s.webhooks
+}
+
+// verifyWebhook checks an X-Webhook-Signature the way a receiver would
+func verifyWebhook(header string, body []byte) bool {
+	var timestamp, signature string
+	for _, part := range strings.Split(header, ",") {
+		if v, ok := strings.CutPrefix(part, "t="); ok {
+			timestamp = v
+		}
+		if v, ok := strings.CutPrefix(part, "v1="); ok {
+			signature = v
+		}
+	}
+	mac := hmac.New(sha256.New, []byte(testWebhookSecret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	want := hex.EncodeToString(mac.Sum(nil))
+	return timestamp != "" && hmac.Equal([]byte(signature), []byte(want))
+}
+
+// submitJob posts a job with a callback and returns the response
+func submitJob(s *Server, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("POST", "/v2/jobs", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	w := httptest.NewRecorder()
+	s.newRouter().ServeHTTP(w, req)
+	return w
+}
+
+// Test matching callback URLs against the allowlist
+func TestCheckCallbackURL(t *testing.T) {
+	d := NewWebhookDispatcher("secret", []string{"hooks.example.com", "localhost:9000", "*.internal.example", "[::1]:8080"}, 1)
+
+	tests := []struct {
+		url    string
+		reason string
+	}{
+		{"https://hooks.example.com/done", ""},
+		{"http://hooks.example.com:8080/done", ""},
+		{"http://localhost:9000/cb", ""},
+		{"http://localhost:9001/cb", reasonNotAllowed},
+		{"https://a.internal.example/cb", ""},
+		{"https://internal.example/cb", reasonNotAllowed},
+		{"https://evil.example.com/cb", reasonNotAllowed},
+		{"https://hooks.example.com.evil.net/cb", reasonNotAllowed},
+		{"http://[::1]:8080/cb", ""},
+		{"ftp://hooks.example.com/cb", reasonInvalidFormat},
+		{"/relative", reasonInvalidFormat},
+		{"https://user:pw@hooks.example.com/cb", reasonInvalidFormat},
+	}
+
+	for _, tt := range tests {
+		err := d.CheckURL(tt.url)
+		reason := ""
+		if ve, ok := err.(*ValidationError); ok {
+			reason = ve.Fields[0].Reason
+		}
+		if reason != tt.reason {
+			t.Errorf("CheckURL(%q) = %v, want reason %q", tt.url, err, tt.reason)
+		}
+	}
+}
+
+// Test that a finished job is POSTed, signed, to its callback URL
+func TestJobCallback(t *testing.T) {
+	received := make(chan WebhookEvent, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if !verifyWebhook(r.Header.Get("X-Webhook-Signature"), body) {
+			t.Errorf("invalid signature %q", r.Header.Get("X-Webhook-Signature"))
+		}
+		var event WebhookEvent
+		json.Unmarshal(body, &event)
+		if r.Header.Get("X-Webhook-ID") != event.ID || r.Header.Get("X-Webhook-Event") != event.Type {
+			t.Errorf("headers %v do not match event %s %s", r.Header, event.ID, event.Type)
+		}
+		received <- event
+	}))
+	defer receiver.Close()
+	s, _ := newWebhookTestServer(t, receiver, 3)
+
+	w := submitJob(s, `{"operation":"factorial","args":{"number":5},"callback_url":"`+receiver.URL+`/done"}`)
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("POST status = %v: %s", w.Code, w.Body.String())
+	}
+
+	select {
+	case event := <-received:
+		data, _ := json.Marshal(event.Data)
+		var job Job
+		json.Unmarshal(data, &job)
+		if event.Type != "job.succeeded" || job.Status != JobSucceeded || job.CallbackURL != receiver.URL+"/done" {
+			t.Errorf("event = %s with job %+v", event.Type, job)
+		}
+		if !strings.Contains(string(data), `"result":120`) {
+			t.Errorf("job = %s, want the result", data)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("no callback was received")
+	}
+}
+
+// Test that callback URLs outside the allowlist are rejected
+func TestJobCallbackNotAllowed(t *testing.T) {
+	receiver := httptest.NewServer(http.NotFoundHandler())
+	defer receiver.Close()
+	s, _ := newWebhookTestServer(t, receiver, 1)
+
+	w := submitJob(s, `{"operation":"factorial","args":{"number":5},"callback_url":"https://attacker.example/steal"}`)
+	var envelope struct {
+		Error *EnvelopeError `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &envelope)
+	if w.Code != http.StatusBadRequest || envelope.Error == nil || envelope.Error.Field != "callback_url" || envelope.Error.Errors[0].Reason != reasonNotAllowed {
+		t.Errorf("status %v, body %s, want a callback_url not_allowed error", w.Code, w.Body.String())
+	}
+}
+
+// Test retries, dead letters and their admin endpoints
+func TestWebhookDeadLetters(t *testing.T) {
+	var calls atomic.Int32
+	var status atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		w.WriteHeader(int(status.Load()))
+	}))
+	defer receiver.Close()
+	s, d := newWebhookTestServer(t, receiver, 3)
+
+	deliver := func(id string, code int) {
+		calls.Store(0)
+		status.Store(int32(code))
+		d.Deliver(receiver.URL, WebhookEvent{ID: id, Type: "job.succeeded"})
+		d.wg.Wait()
+	}
+
+	// A 5xx is retried until the attempts run out
+	deliver("retried", http.StatusServiceUnavailable)
+	if calls.Load() != 3 {
+		t.Errorf("%d attempts after 503, want 3", calls.Load())
+	}
+	// Other client errors are final
+	deliver("rejected", http.StatusGone)
+	if calls.Load() != 1 {
+		t.Errorf("%d attempts after 410, want 1", calls.Load())
+	}
+	// A success needs no dead letter
+	deliver("delivered", http.StatusNoContent)
+
+	dead := d.DeadLetters()
+	if len(dead) != 2 || dead[0].Event.ID != "retried" || dead[0].Attempts != 3 || dead[0].LastStatus != http.StatusServiceUnavailable || dead[1].Event.ID != "rejected" {
+		t.Fatalf("dead letters = %+v", dead)
+	}
+
+	admin := func(method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		s.newRouter().ServeHTTP(w, req)
+		return w
+	}
+
+	if w := admin("GET", "/admin/webhooks/dead-letters", "anything"); w.Code != http.StatusForbidden {
+		t.Errorf("without ADMIN_TOKEN status = %v, want %v", w.Code, http.StatusForbidden)
+	}
+	s.adminToken = "admin-secret"
+	if w := admin("GET", "/admin/webhooks/dead-letters", "wrong"); w.Code != http.StatusUnauthorized || w.Header().Get("WWW-Authenticate") == "" {
+		t.Errorf("wrong token status = %v, want %v with a challenge", w.Code, http.StatusUnauthorized)
+	}
+
+	w := admin("GET", "/admin/webhooks/dead-letters", "admin-secret")
+	var listed struct {
+		Data []DeadLetter `json:"data"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &listed); err != nil || w.Code != http.StatusOK || len(listed.Data) != 2 {
+		t.Fatalf("GET dead letters = %v: %s", w.Code, w.Body.String())
+	}
+
+	// Redelivery succeeds now that the receiver is back
+	status.Store(http.StatusOK)
+	if w := admin("POST", "/admin/webhooks/dead-letters/retried/retry", "admin-secret"); w.Code != http.StatusAccepted {
+		t.Errorf("retry status = %v: %s", w.Code, w.Body.String())
+	}
+	d.wg.Wait()
+	if w := admin("DELETE", "/admin/webhooks/dead-letters/rejected", "admin-secret"); w.Code != http.StatusOK {
+		t.Errorf("DELETE status = %v: %s", w.Code, w.Body.String())
+	}
+	if w := admin("DELETE", "/admin/webhooks/dead-letters/rejected", "admin-secret"); w.Code != http.StatusNotFound {
+		t.Errorf("second DELETE status = %v, want %v", w.Code, http.StatusNotFound)
+	}
+	if dead := d.DeadLetters(); len(dead) != 0 {
+		t.Errorf("dead letters after retry and delete = %+v", dead)
+	}
+}
+
+// Test that shutdown turns interrupted retries into dead letters
+func TestWebhookShutdown(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+	_, d := newWebhookTestServer(t, receiver, 5)
+	d.backoff = time.Hour
+
+	d.Deliver(receiver.URL, WebhookEvent{ID: "pending"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	d.Shutdown(ctx)
+
+	d.Deliver(receiver.URL, WebhookEvent{ID: "late"})
+	dead := d.DeadLetters()
+	if len(dead) != 2 || !strings.Contains(dead[0].LastError, "shut down") || dead[1].Event.ID != "late" {
+		t.Errorf("dead letters = %+v", dead)
+	}
+}
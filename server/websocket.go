@@ -0,0 +1,361 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// websocketGUID is the fixed key suffix from RFC 6455 section 1.3
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes (RFC 6455 section 5.2)
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xA
+)
+
+// WebSocket close codes (RFC 6455 section 7.4.1)
+const (
+	wsCloseNormal          = 1000
+	wsCloseGoingAway       = 1001
+	wsCloseProtocolError   = 1002
+	wsCloseUnsupportedData = 1003
+	wsCloseInvalidPayload  = 1007
+	wsCloseMessageTooBig   = 1009
+)
+
+const (
+	// wsMaxMessageSize bounds a reassembled message
+	wsMaxMessageSize = 64 * 1024
+	// wsWriteWait bounds a single frame write
+	wsWriteWait = 10 * time.Second
+)
+
+// errWSClosed is returned by ReadMessage once the close handshake completed
+var errWSClosed = errors.New("websocket: connection closed")
+
+// wsCloseError is a protocol failure that closes the connection with Code
+type wsCloseError struct {
+	Code   int
+	Reason string
+}
+
+func (e *wsCloseError) Error() string {
+	return fmt.Sprintf("websocket: close %d: %s", e.Code, e.Reason)
+}
+
+// wsHandshakeError is an upgrade request the server refuses
+type wsHandshakeError struct {
+	Status  int
+	Message string
+}
+
+func (e *wsHandshakeError) Error() string {
+	return e.Message
+}
+
+// wsConn is a server side WebSocket connection
+type wsConn struct {
+	conn    net.Conn
+	reader  *bufio.Reader
+	writeMu sync.Mutex
+
+	// readWait is how long ReadMessage waits for any frame, including pongs
+	readWait time.Duration
+
+	closeOnce sync.Once
+	closeSent bool
+}
+
+// headerContainsToken reports whether a comma separated header contains token
+func headerContainsToken(h http.Header, name, token string) bool {
+	for _, value := range h.Values(name) {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// websocketAccept computes Sec-WebSocket-Accept for a client key
+func websocketAccept(key string) string {
+	sum := sha1.Sum([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// originAllowed reports whether a handshake may come from its Origin: one
+// without an Origin (not a browser), from the host it was sent to, or from
+// an origin in allowed, where "*" allows any
+func originAllowed(r *http.Request, allowed []string) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	if strings.EqualFold(u.Host, r.Host) {
+		return true
+	}
+	for _, a := range allowed {
+		a = strings.TrimSpace(a)
+		if a == "*" || strings.EqualFold(strings.TrimSuffix(a, "/"), origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// upgradeWebSocket performs the opening handshake and takes over the
+// connection. Browsers may only connect from the server's own host or from
+// allowedOrigins.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request, readWait time.Duration, allowedOrigins []string) (*wsConn, error) {
+	if r.Method != http.MethodGet {
+		return nil, &wsHandshakeError{http.StatusMethodNotAllowed, "Only GET method is allowed for this endpoint"}
+	}
+	if !headerContainsToken(r.Header, "Connection", "upgrade") || !headerContainsToken(r.Header, "Upgrade", "websocket") {
+		return nil, &wsHandshakeError{http.StatusBadRequest, "Expected a WebSocket upgrade request"}
+	}
+	if r.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		return nil, &wsHandshakeError{http.StatusUpgradeRequired, "Unsupported WebSocket version (expected 13)"}
+	}
+	key := r.Header.Get("Sec-WebSocket-Key")
+	if decoded, err := base64.StdEncoding.DecodeString(key); err != nil || len(decoded) != 16 {
+		return nil, &wsHandshakeError{http.StatusBadRequest, "Invalid Sec-WebSocket-Key"}
+	}
+	if !originAllowed(r, allowedOrigins) {
+		return nil, &wsHandshakeError{http.StatusForbidden, "WebSocket connections are not allowed from this origin"}
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return nil, &wsHandshakeError{http.StatusInternalServerError, "WebSocket upgrades are not supported by this server"}
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	// Drop the deadlines the http.Server set for the request
+	conn.SetDeadline(time.Time{})
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n"
+	if id := w.Header().Get(requestIDHeader); id != "" {
+		response += requestIDHeader + ": " + id + "\r\n"
+	}
+	response += "\r\n"
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, reader: rw.Reader, readWait: readWait}, nil
+}
+
+// writeFrame writes a single unmasked frame
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	if c.closeSent {
+		return errWSClosed
+	}
+	if opcode == wsClose {
+		c.closeSent = true
+	}
+
+	header := make([]byte, 2, 10)
+	header[0] = 0x80 | opcode
+	switch n := len(payload); {
+	case n <= 125:
+		header[1] = byte(n)
+	case n <= 0xffff:
+		header[1] = 126
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header[1] = 127
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	if _, err := c.conn.Write(append(header, payload...)); err != nil {
+		return err
+	}
+	return nil
+}
+
+// WriteText sends a text message
+func (c *wsConn) WriteText(data []byte) error {
+	return c.writeFrame(wsText, data)
+}
+
+// Ping sends a ping control frame
+func (c *wsConn) Ping() error {
+	return c.writeFrame(wsPing, nil)
+}
+
+// WriteClose starts (or answers) the closing handshake
+func (c *wsConn) WriteClose(code int, reason string) error {
+	if len(reason) > 123 {
+		reason = reason[:123]
+	}
+	payload := binary.BigEndian.AppendUint16(nil, uint16(code))
+	return c.writeFrame(wsClose, append(payload, reason...))
+}
+
+// Close closes the underlying connection
+func (c *wsConn) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		err = c.conn.Close()
+	})
+	return err
+}
+
+// readFrame reads one frame and unmasks its payload. limit bounds data and
+// continuation frames; control frames are bounded at 125 bytes.
+func (c *wsConn) readFrame(limit int64) (fin bool, opcode byte, payload []byte, err error) {
+	c.conn.SetReadDeadline(time.Now().Add(c.readWait))
+
+	var head [2]byte
+	if _, err = io.ReadFull(c.reader, head[:]); err != nil {
+		return
+	}
+
+	fin = head[0]&0x80 != 0
+	opcode = head[0] & 0x0f
+	if head[0]&0x70 != 0 {
+		err = &wsCloseError{wsCloseProtocolError, "reserved bits set"}
+		return
+	}
+	if head[1]&0x80 == 0 {
+		err = &wsCloseError{wsCloseProtocolError, "client frames must be masked"}
+		return
+	}
+
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if opcode >= wsClose && (!fin || length > 125) {
+		err = &wsCloseError{wsCloseProtocolError, "invalid control frame"}
+		return
+	}
+	if opcode < wsClose && length > uint64(limit) {
+		err = &wsCloseError{wsCloseMessageTooBig, "message too big"}
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next text or binary message. Pings are answered,
+// pongs only refresh the read deadline, and a close frame completes the
+// closing handshake and returns errWSClosed. Protocol violations close the
+// connection with the matching close code.
+func (c *wsConn) ReadMessage() (byte, []byte, error) {
+	var (
+		opcode  byte
+		message []byte
+	)
+
+	for {
+		fin, op, payload, err := c.readFrame(int64(wsMaxMessageSize - len(message)))
+		if err != nil {
+			var closeErr *wsCloseError
+			if errors.As(err, &closeErr) {
+				c.WriteClose(closeErr.Code, closeErr.Reason)
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case wsPing:
+			if err := c.writeFrame(wsPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case wsPong:
+			continue
+		case wsClose:
+			code := wsCloseNormal
+			if len(payload) >= 2 {
+				code = int(binary.BigEndian.Uint16(payload))
+			}
+			c.WriteClose(code, "")
+			return 0, nil, errWSClosed
+		case wsText, wsBinary:
+			if opcode != 0 {
+				c.WriteClose(wsCloseProtocolError, "expected continuation frame")
+				return 0, nil, &wsCloseError{wsCloseProtocolError, "expected continuation frame"}
+			}
+			opcode = op
+		case wsContinuation:
+			if opcode == 0 {
+				c.WriteClose(wsCloseProtocolError, "unexpected continuation frame")
+				return 0, nil, &wsCloseError{wsCloseProtocolError, "unexpected continuation frame"}
+			}
+		default:
+			c.WriteClose(wsCloseProtocolError, "unknown opcode")
+			return 0, nil, &wsCloseError{wsCloseProtocolError, "unknown opcode"}
+		}
+
+		message = append(message, payload...)
+		if !fin {
+			continue
+		}
+
+		if opcode == wsText && !utf8.Valid(message) {
+			c.WriteClose(wsCloseInvalidPayload, "invalid UTF-8")
+			return 0, nil, &wsCloseError{wsCloseInvalidPayload, "invalid UTF-8"}
+		}
+		return opcode, message, nil
+	}
+}
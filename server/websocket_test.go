@@ -0,0 +1,317 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsTestClient is a minimal WebSocket client speaking raw frames
+type wsTestClient struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// dialWS performs the opening handshake against srv and reads the session message
+func dialWS(t *testing.T, srv *httptest.Server) *wsTestClient {
+	t.Helper()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("Dial failed: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	key := "dGhlIHNhbXBsZSBub25jZQ=="
+	request := "GET /ws HTTP/1.1\r\nHost: test\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nAccept-Encoding: gzip\r\n" +
+		"Sec-WebSocket-Key: " + key + "\r\nSec-WebSocket-Version: 13\r\n\r\n"
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatalf("Handshake write failed: %v", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatalf("Handshake read failed: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("Handshake status = %v, want %v", resp.StatusCode, http.StatusSwitchingProtocols)
+	}
+	if got := resp.Header.Get("Sec-WebSocket-Accept"); got != "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=" {
+		t.Fatalf("Sec-WebSocket-Accept = %q", got)
+	}
+
+	c := &wsTestClient{t: t, conn: conn, reader: reader}
+	if reply := c.readReply(); reply.Type != "session" || reply.SessionID == "" {
+		t.Fatalf("First message = %+v, want session", reply)
+	}
+	return c
+}
+
+// writeFrame sends a single masked frame
+func (c *wsTestClient) writeFrame(fin bool, opcode byte, payload []byte) {
+	c.t.Helper()
+
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n <= 125:
+		frame = append(frame, 0x80|byte(n))
+	case n <= 0xffff:
+		frame = append(frame, 0x80|126)
+		frame = binary.BigEndian.AppendUint16(frame, uint16(n))
+	default:
+		frame = append(frame, 0x80|127)
+		frame = binary.BigEndian.AppendUint64(frame, uint64(n))
+	}
+	mask := []byte{0x12, 0x34, 0x56, 0x78}
+	frame = append(frame, mask...)
+	for i, b := range payload {
+		frame = append(frame, b^mask[i%4])
+	}
+	if _, err := c.conn.Write(frame); err != nil {
+		c.t.Fatalf("Write failed: %v", err)
+	}
+}
+
+// readFrame reads one unmasked server frame
+func (c *wsTestClient) readFrame() (byte, []byte) {
+	c.t.Helper()
+
+	var head [2]byte
+	if _, err := io.ReadFull(c.reader, head[:]); err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	if head[1]&0x80 != 0 {
+		c.t.Fatalf("Server frame is masked")
+	}
+	length := uint64(head[1] & 0x7f)
+	switch length {
+	case 126:
+		var ext [2]byte
+		io.ReadFull(c.reader, ext[:])
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		io.ReadFull(c.reader, ext[:])
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, payload); err != nil {
+		c.t.Fatalf("Read failed: %v", err)
+	}
+	return head[0] & 0x0f, payload
+}
+
+func (c *wsTestClient) send(msg string) CalcReply {
+	c.t.Helper()
+	c.writeFrame(true, wsText, []byte(msg))
+	return c.readReply()
+}
+
+func (c *wsTestClient) readReply() CalcReply {
+	c.t.Helper()
+
+	opcode, payload := c.readFrame()
+	if opcode != wsText {
+		c.t.Fatalf("Opcode = %#x, want text; payload %q", opcode, payload)
+	}
+	var reply CalcReply
+	if err := json.Unmarshal(payload, &reply); err != nil {
+		c.t.Fatalf("Invalid reply %q: %v", payload, err)
+	}
+	return reply
+}
+
+// expectClose reads a close frame and returns its code
+func (c *wsTestClient) expectClose() int {
+	c.t.Helper()
+
+	opcode, payload := c.readFrame()
+	if opcode != wsClose || len(payload) < 2 {
+		c.t.Fatalf("Frame = %#x %q, want close", opcode, payload)
+	}
+	return int(binary.BigEndian.Uint16(payload))
+}
+
+// newWSTestServer serves s over a real connection, which WebSockets need
+func newWSTestServer(t *testing.T, s *Server) *httptest.Server {
+	srv := httptest.NewServer(s.Handler())
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+// Test operations, ans and registers across messages of one session
+func TestWebSocketCalculatorSession(t *testing.T) {
+	c := dialWS(t, newWSTestServer(t, newTestServer(t)))
+	defer c.conn.Close()
+
+	tests := []struct {
+		message  string
+		wantType string
+		wantAns  interface{}
+		wantCode string
+	}{
+		{`{"id":"1","op":"multiply","args":{"a":6,"b":7}}`, "result", 42.0, ""},
+		{`{"id":"2","op":"power","args":{"base":"ans","exponent":2},"store":"x"}`, "result", 1764.0, ""},
+		{`{"id":"3","op":"set","name":"y","value":2}`, "registers", nil, ""},
+		{`{"id":"4","op":"multiply_scalar","args":{"numbers":["y",3],"scalar":"y"}}`, "result", []interface{}{4.0, 6.0}, ""},
+		{`{"id":"5","op":"multiply_array","args":{"numbers":"ans"}}`, "result", 24.0, ""},
+		{`{"id":"6","op":"divide","args":{"a":"x","b":0}}`, "error", nil, "calculation_error"},
+		{`{"id":"7","op":"multiply","args":{"a":"missing","b":1}}`, "error", nil, "unknown_register"},
+		{`{"id":"8","op":"set","name":"ans","value":1}`, "error", nil, "bad_request"},
+		{`{"id":"9","op":"sqrt","args":{}}`, "error", nil, "unknown_operation"},
+		{`{"id":"10","op":"factorial","args":{"number":21}}`, "error", nil, "validation_error"},
+		{`not json`, "error", nil, "bad_request"},
+	}
+
+	for _, tt := range tests {
+		reply := c.send(tt.message)
+		if reply.Type != tt.wantType {
+			t.Fatalf("%s: type = %q, want %q (%+v)", tt.message, reply.Type, tt.wantType, reply)
+		}
+		if tt.wantAns != nil {
+			got, _ := json.Marshal(reply.Ans)
+			want, _ := json.Marshal(tt.wantAns)
+			if string(got) != string(want) {
+				t.Errorf("%s: ans = %s, want %s", tt.message, got, want)
+			}
+		}
+		if tt.wantCode != "" && (reply.Error == nil || reply.Error.Code != tt.wantCode) {
+			t.Errorf("%s: error = %+v, want code %q", tt.message, reply.Error, tt.wantCode)
+		}
+	}
+
+	reply := c.send(`{"op":"registers"}`)
+	if reply.Registers["x"] != 1764.0 || reply.Registers["y"] != 2.0 {
+		t.Errorf("registers = %v, want x=1764 y=2", reply.Registers)
+	}
+	if reply := c.send(`{"op":"clear"}`); len(reply.Registers) != 0 {
+		t.Errorf("registers after clear = %v, want none", reply.Registers)
+	}
+}
+
+// Test pings, fragmented messages and the closing handshake
+func TestWebSocketControlFrames(t *testing.T) {
+	c := dialWS(t, newWSTestServer(t, newTestServer(t)))
+	defer c.conn.Close()
+
+	c.writeFrame(true, wsPing, []byte("hi"))
+	if opcode, payload := c.readFrame(); opcode != wsPong || string(payload) != "hi" {
+		t.Fatalf("Ping answer = %#x %q, want pong \"hi\"", opcode, payload)
+	}
+
+	c.writeFrame(false, wsText, []byte(`{"op":"multiply",`))
+	c.writeFrame(true, wsContinuation, []byte(`"args":{"a":2,"b":3}}`))
+	if reply := c.readReply(); reply.Type != "result" || reply.Ans != 6.0 {
+		t.Fatalf("Fragmented message reply = %+v, want ans 6", reply)
+	}
+
+	// A message that has reached the size limit still allows control frames
+	c.writeFrame(false, wsText, []byte(strings.Repeat(" ", wsMaxMessageSize)))
+	c.writeFrame(true, wsPing, []byte("full"))
+	if opcode, payload := c.readFrame(); opcode != wsPong || string(payload) != "full" {
+		t.Fatalf("Ping answer with a full message = %#x %q, want pong \"full\"", opcode, payload)
+	}
+	c.writeFrame(true, wsContinuation, nil)
+	c.readReply()
+
+	c.writeFrame(true, wsClose, binary.BigEndian.AppendUint16(nil, wsCloseNormal))
+	if code := c.expectClose(); code != wsCloseNormal {
+		t.Errorf("Close code = %v, want %v", code, wsCloseNormal)
+	}
+}
+
+// Test that shutdown closes open sessions with "going away" and refuses new ones
+func TestWebSocketShutdown(t *testing.T) {
+	s := newTestServer(t)
+	srv := newWSTestServer(t, s)
+	c := dialWS(t, srv)
+	defer c.conn.Close()
+
+	s.sessions.Shutdown()
+	if code := c.expectClose(); code != wsCloseGoingAway {
+		t.Errorf("Close code = %v, want %v", code, wsCloseGoingAway)
+	}
+
+	req := httptest.NewRequest("GET", "/ws", nil)
+	w := httptest.NewRecorder()
+	s.wsHandler(w, req)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Upgrade during shutdown status = %v, want %v", w.Code, http.StatusServiceUnavailable)
+	}
+}
+
+// Test that plain HTTP requests to /ws are rejected
+func TestWebSocketHandshakeErrors(t *testing.T) {
+	s := newTestServer(t)
+	tests := []struct {
+		name    string
+		method  string
+		headers map[string]string
+		want    int
+	}{
+		{"wrong method", "POST", nil, http.StatusMethodNotAllowed},
+		{"not an upgrade", "GET", nil, http.StatusBadRequest},
+		{"wrong version", "GET", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "8"}, http.StatusUpgradeRequired},
+		{"bad key", "GET", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "short"}, http.StatusBadRequest},
+		{"foreign origin", "GET", map[string]string{"Connection": "Upgrade", "Upgrade": "websocket", "Sec-WebSocket-Version": "13", "Sec-WebSocket-Key": "dGhlIHNhbXBsZSBub25jZQ==", "Origin": "https://evil.example"}, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/ws", nil)
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			s.wsHandler(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %v, want %v", w.Code, tt.want)
+			}
+		})
+	}
+}
+
+// Test which origins may open a WebSocket
+func TestWebSocketOrigin(t *testing.T) {
+	allowed := []string{"https://app.example.com", " https://admin.example.com/"}
+	tests := []struct {
+		origin string
+		want   bool
+	}{
+		{"", true},
+		{"http://calc.example.com", true},
+		{"https://calc.example.com:443", false},
+		{"https://app.example.com", true},
+		{"HTTPS://ADMIN.EXAMPLE.COM", true},
+		{"https://evil.example", false},
+		{"null", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "http://calc.example.com/ws", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if got := originAllowed(req, allowed); got != tt.want {
+			t.Errorf("originAllowed(%q) = %t, want %t", tt.origin, got, tt.want)
+		}
+	}
+	req := httptest.NewRequest("GET", "http://calc.example.com/ws", nil)
+	req.Header.Set("Origin", "https://evil.example")
+	if !originAllowed(req, []string{"*"}) {
+		t.Error(`"*" should allow any origin`)
+	}
+}